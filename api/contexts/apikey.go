@@ -0,0 +1,24 @@
+package contexts
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/thesambayo/digillets-api/internal/data/apikeys"
+)
+
+const apiKeyContextKey = contextKey("API_KEY")
+
+// ContextSetAPIKey adds the API key a request was authenticated with to the
+// request context.
+func ContextSetAPIKey(req *http.Request, apiKey *apikeys.APIKey) *http.Request {
+	ctx := context.WithValue(req.Context(), apiKeyContextKey, apiKey)
+	return req.WithContext(ctx)
+}
+
+// ContextGetAPIKey returns the API key the request was authenticated with, or nil
+// when it was not authenticated with one.
+func ContextGetAPIKey(req *http.Request) *apikeys.APIKey {
+	apiKey, _ := req.Context().Value(apiKeyContextKey).(*apikeys.APIKey)
+	return apiKey
+}
@@ -0,0 +1,24 @@
+package contexts
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/thesambayo/digillets-api/internal/data/oauth"
+)
+
+const oauthGrantContextKey = contextKey("OAUTH_GRANT")
+
+// ContextSetOAuthGrant adds the grant of the third party app a request was made by
+// to the request context.
+func ContextSetOAuthGrant(req *http.Request, grant *oauth.Grant) *http.Request {
+	ctx := context.WithValue(req.Context(), oauthGrantContextKey, grant)
+	return req.WithContext(ctx)
+}
+
+// ContextGetOAuthGrant returns the grant of the third party app the request was
+// made by, or nil when it was not made by one.
+func ContextGetOAuthGrant(req *http.Request) *oauth.Grant {
+	grant, _ := req.Context().Value(oauthGrantContextKey).(*oauth.Grant)
+	return grant
+}
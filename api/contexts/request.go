@@ -0,0 +1,20 @@
+package contexts
+
+import (
+	"context"
+	"net/http"
+)
+
+const requestIDContextKey = contextKey("REQUEST_ID")
+
+// ContextSetRequestID() helper adds the request id to the request context.
+func ContextSetRequestID(req *http.Request, requestID string) *http.Request {
+	ctx := context.WithValue(req.Context(), requestIDContextKey, requestID)
+	return req.WithContext(ctx)
+}
+
+// ContextGetRequestID returns the request id, or "" if none has been set.
+func ContextGetRequestID(req *http.Request) string {
+	requestID, _ := req.Context().Value(requestIDContextKey).(string)
+	return requestID
+}
@@ -1,13 +1,14 @@
 package httpx
 
 import (
+	"fmt"
 	"net/http"
 )
 
-// The logError() method is a generic helper for logging an error message.
+// The LogError() method is a generic helper for logging an error message.
 // Later, we'll upgrade this to use structured logging, and record additional information
 // about the request including the HTTP method and URL.
-func (utils *Utils) logError(req *http.Request, err error) {
+func (utils *Utils) LogError(req *http.Request, err error) {
 	utils.logger.PrintError(err, map[string]string{
 		"request_method": req.Method,
 		"request_url":    req.URL.String(),
@@ -25,7 +26,7 @@ func (utils *Utils) ErrorResponse(resWriter http.ResponseWriter, req *http.Reque
 	// 500 Internal Server Error status code.
 	err := utils.WriteJSON(resWriter, status, env, nil)
 	if err != nil {
-		utils.logError(req, err)
+		utils.LogError(req, err)
 		resWriter.WriteHeader(http.StatusInternalServerError)
 	}
 }
@@ -35,7 +36,7 @@ func (utils *Utils) ErrorResponse(resWriter http.ResponseWriter, req *http.Reque
 // errorResponse() helper to send a 500 Internal Server Error status and JSON
 // response (containing a generic error message) to the client.”
 func (utils *Utils) ServerErrorResponse(resWriter http.ResponseWriter, req *http.Request, err error) {
-	utils.logError(req, err)
+	utils.LogError(req, err)
 	message := "the server encountered a problem and could not process your request"
 	utils.ErrorResponse(resWriter, req, http.StatusInternalServerError, message)
 }
@@ -96,7 +97,17 @@ func (utils *Utils) AuthenticationRequiredResponse(resWriter http.ResponseWriter
 // 	ErrorResponse(resWriter, req, http.StatusForbidden, message)
 // }
 
-// func NotPermittedResponse(resWriter http.ResponseWriter, req *http.Request) {
-// 	message := "your staff account doesn't have the necessary permissions to access this resource"
-// 	ErrorResponse(resWriter, req, http.StatusForbidden, message)
-// }
+func (utils *Utils) NotPermittedResponse(resWriter http.ResponseWriter, req *http.Request) {
+	message := "your user account doesn't have the necessary permissions to access this resource"
+	utils.ErrorResponse(resWriter, req, http.StatusForbidden, message)
+}
+
+func (utils *Utils) AppAccessNotAllowedResponse(resWriter http.ResponseWriter, req *http.Request) {
+	message := "this resource cannot be accessed with an api key or the access token of an app"
+	utils.ErrorResponse(resWriter, req, http.StatusForbidden, message)
+}
+
+func (utils *Utils) MissingScopeResponse(resWriter http.ResponseWriter, req *http.Request, scope string) {
+	message := fmt.Sprintf("the %s scope is needed to access this resource", scope)
+	utils.ErrorResponse(resWriter, req, http.StatusForbidden, message)
+}
@@ -0,0 +1,26 @@
+package httpx
+
+import (
+	"net/url"
+
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// The ReadFilters() helper reads page, page_size, cursor, sort and any safelisted
+// field filters from the query string into the given filters, recording any
+// malformed values in the validator. Call listing.Validate() afterwards.
+func (utils *Utils) ReadFilters(queryString url.Values, filters *listing.Filters, validator *validators.Validator) {
+	filters.Page = utils.ReadInt(queryString, "page", 1, validator)
+	filters.PageSize = utils.ReadInt(queryString, "page_size", 20, validator)
+	filters.Cursor = utils.ReadString(queryString, "cursor", "")
+	filters.Sort = utils.ReadString(queryString, "sort", filters.Sort)
+
+	filters.Fields = make(map[string][]string)
+	for name := range filters.FieldSafelist {
+		values := utils.ReadCSV(queryString, name, nil)
+		if len(values) != 0 {
+			filters.Fields[name] = values
+		}
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+
+	"github.com/thesambayo/digillets-api/internal/validators"
 )
 
 // ReadIDParam gets id from request url
@@ -62,23 +64,23 @@ func (utils *Utils) ReadCSV(queryString url.Values, key string, defaultValue []s
 // integer before returning. If no matching key could be found it returns the provided
 // default value. If the value couldn't be converted to an integer, then we record an
 // error message in the provided Validator instance.
-// func ReadInt(queryString url.Values, key string, defaultValue int, validator *validators.Validator) int {
-// 	// Extract the value from the query string.
-// 	queryStringValue := queryString.Get(key)
+func (utils *Utils) ReadInt(queryString url.Values, key string, defaultValue int, validator *validators.Validator) int {
+	// Extract the value from the query string.
+	queryStringValue := queryString.Get(key)
 
-// 	// If no key exists (or the value is empty) then return the default value.
-// 	if queryStringValue == "" {
-// 		return defaultValue
-// 	}
+	// If no key exists (or the value is empty) then return the default value.
+	if queryStringValue == "" {
+		return defaultValue
+	}
 
-// 	// Try to convert the value to an int. If this fails, add an error message to the
-// 	// validator instance and return the default value.
-// 	queryIntValue, err := strconv.Atoi(queryStringValue)
-// 	if err != nil {
-// 		validator.AddError(key, "must be an integer value")
-// 		return defaultValue
-// 	}
+	// Try to convert the value to an int. If this fails, add an error message to the
+	// validator instance and return the default value.
+	queryIntValue, err := strconv.Atoi(queryStringValue)
+	if err != nil {
+		validator.AddError(key, "must be an integer value")
+		return defaultValue
+	}
 
-// 	// Otherwise, return the converted integer value.
-// 	return queryIntValue
-// }
+	// Otherwise, return the converted integer value.
+	return queryIntValue
+}
@@ -9,6 +9,8 @@ import (
 	"github.com/pascaldekloe/jwt"
 	"github.com/thesambayo/digillets-api/api/contexts"
 	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/apikeys"
+	"github.com/thesambayo/digillets-api/internal/data/oauth"
 	"github.com/thesambayo/digillets-api/internal/data/users"
 )
 
@@ -40,6 +42,13 @@ func (middleware *Middleware) Authenticate(next http.Handler) http.Handler {
 		// in a moment).
 		// headerParts := strings.Split(authorizationHeader, " ")
 		headerParts := strings.Fields(authorizationHeader)
+		// Basic credentials are those of OAuth clients, which the OAuth endpoints
+		// check themselves.
+		if len(headerParts) == 2 && headerParts[0] == "Basic" {
+			req = contexts.ContextSetUser(req, users.AnonymousUser)
+			next.ServeHTTP(resWriter, req)
+			return
+		}
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
 			middleware.httpx.InvalidAuthenticationTokenResponse(resWriter, req)
 			return
@@ -48,6 +57,12 @@ func (middleware *Middleware) Authenticate(next http.Handler) http.Handler {
 		// Extract the actual authentication token from the header parts.
 		token := headerParts[1]
 
+		// API keys are recognisable by their prefix, anything else should be a JWT.
+		if apikeys.IsKey(token) {
+			middleware.authenticateAPIKey(resWriter, req, next, token)
+			return
+		}
+
 		// Parse the JWT and extract the claims. This will return an error if the JWT
 		// contents doesn't match the signature (i.e. the token has been
 		// tampered with) or the algorithm isn't valid.
@@ -72,6 +87,26 @@ func (middleware *Middleware) Authenticate(next http.Handler) http.Handler {
 		// 	return
 		// }
 
+		// Access tokens issued to third party apps carry the grant they were issued
+		// for, which must not have been revoked since.
+		var grant *oauth.Grant
+		if clientID, ok := claims.Set["client_id"].(string); ok {
+			grant, err = middleware.models.OAuth.GetGrant(claims.ID)
+			if err != nil {
+				switch {
+				case errors.Is(err, constants.ErrRecordNotFound):
+					middleware.httpx.InvalidAuthenticationTokenResponse(resWriter, req)
+				default:
+					middleware.httpx.ServerErrorResponse(resWriter, req, err)
+				}
+				return
+			}
+			if grant.ClientPublicID != clientID || grant.UserPublicID != claims.Subject {
+				middleware.httpx.InvalidAuthenticationTokenResponse(resWriter, req)
+				return
+			}
+		}
+
 		// At this point, we know that the JWT is all OK and we can trust the data in
 		// it. We extract the user ID from the claims subject
 		UserPublicID := claims.Subject
@@ -89,7 +124,44 @@ func (middleware *Middleware) Authenticate(next http.Handler) http.Handler {
 		}
 
 		req = contexts.ContextSetUser(req, user)
+		if grant != nil {
+			req = contexts.ContextSetOAuthGrant(req, grant)
+		}
 		// Call the next handler in the chain.
 		next.ServeHTTP(resWriter, req)
 	})
 }
+
+// authenticateAPIKey authenticates a request made with an API key as the user who
+// owns the key, and records that the key was used.
+func (middleware *Middleware) authenticateAPIKey(resWriter http.ResponseWriter, req *http.Request, next http.Handler, token string) {
+	apiKey, err := middleware.models.APIKeys.GetByKey(token)
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			middleware.httpx.InvalidAuthenticationTokenResponse(resWriter, req)
+		default:
+			middleware.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	user, err := middleware.models.Users.GetByPublicId(apiKey.UserPublicID)
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			middleware.httpx.InvalidAuthenticationTokenResponse(resWriter, req)
+		default:
+			middleware.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	if err := middleware.models.APIKeys.Touch(apiKey); err != nil {
+		middleware.httpx.LogError(req, err)
+	}
+
+	req = contexts.ContextSetUser(req, user)
+	req = contexts.ContextSetAPIKey(req, apiKey)
+	next.ServeHTTP(resWriter, req)
+}
@@ -13,6 +13,11 @@ func (middleware *Middleware) RecoverFromPanic(next http.Handler) http.Handler {
 			// Use the builtin recover function to check if there has been a
 			// panic or not. If there has...
 			if err := recover(); err != nil {
+				// http.ErrAbortHandler is how a handler deliberately drops the connection
+				// of a response it has already started, let the server deal with it.
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
 				// Set a "Connection: close" header on the response.
 				responseWriter.Header().Set("Connection", "close")
 				// Call the ServerError helper method to return a 500 Internal Server response.
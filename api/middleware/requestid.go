@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/thesambayo/digillets-api/api/contexts"
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// RequestID gives every request an id, used to tie log lines and audit events back
+// to the request. An X-Request-ID sent by a proxy in front of us is kept when it
+// looks sane, otherwise a random one is generated. The id is echoed back in the
+// X-Request-ID response header.
+func (middleware *Middleware) RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resWriter http.ResponseWriter, req *http.Request) {
+		requestID := req.Header.Get("X-Request-ID")
+		if !validators.Matches(requestID, constants.RequestIDREGEX) {
+			random := make([]byte, 16)
+			if _, err := rand.Read(random); err != nil {
+				middleware.httpx.ServerErrorResponse(resWriter, req, err)
+				return
+			}
+			requestID = hex.EncodeToString(random)
+		}
+
+		resWriter.Header().Set("X-Request-ID", requestID)
+		req = contexts.ContextSetRequestID(req, requestID)
+
+		next.ServeHTTP(resWriter, req)
+	})
+}
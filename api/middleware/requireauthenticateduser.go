@@ -6,6 +6,9 @@ import (
 	"github.com/thesambayo/digillets-api/api/contexts"
 )
 
+// RequireAuthenticatedUser only lets through users who signed in. Requests made
+// with an API key or by a third party app are refused, they only reach the routes
+// wrapped in RequireScope.
 func (middleware *Middleware) RequireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(resWriter http.ResponseWriter, req *http.Request) {
 		user := contexts.ContextGetUser(req)
@@ -14,6 +17,11 @@ func (middleware *Middleware) RequireAuthenticatedUser(next http.HandlerFunc) ht
 			return
 		}
 
+		if contexts.ContextGetAPIKey(req) != nil || contexts.ContextGetOAuthGrant(req) != nil {
+			middleware.httpx.AppAccessNotAllowedResponse(resWriter, req)
+			return
+		}
+
 		next.ServeHTTP(resWriter, req)
 	})
 }
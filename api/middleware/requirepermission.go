@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/thesambayo/digillets-api/api/contexts"
+)
+
+// RequirePermission only lets through authenticated users who have been granted the
+// given permission code, e.g wallets:freeze. It wraps RequireAuthenticatedUser so
+// anonymous users get a 401 rather than a 403.
+func (middleware *Middleware) RequirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	handler := func(resWriter http.ResponseWriter, req *http.Request) {
+		user := contexts.ContextGetUser(req)
+
+		permissions, err := middleware.models.Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			middleware.httpx.ServerErrorResponse(resWriter, req, err)
+			return
+		}
+
+		if !permissions.Include(code) {
+			middleware.httpx.NotPermittedResponse(resWriter, req)
+			return
+		}
+
+		next.ServeHTTP(resWriter, req)
+	}
+
+	return middleware.RequireAuthenticatedUser(handler)
+}
@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/thesambayo/digillets-api/api/contexts"
+	"github.com/thesambayo/digillets-api/internal/data/apikeys"
+	"github.com/thesambayo/digillets-api/internal/data/oauth"
+)
+
+// oauthScopes are the scopes a third party app needs for what an API key needs a
+// scope for. Apps cannot be given what is missing, e.g payouts.
+var oauthScopes = map[string]string{
+	apikeys.ScopeRead:     oauth.ScopeWalletsRead,
+	apikeys.ScopePayments: oauth.ScopeTransfersWrite,
+}
+
+// RequireScope lets through users who signed in, requests made with an API key
+// that has been given scope, e.g payments, and third party apps given the matching
+// OAuth scope.
+func (middleware *Middleware) RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(resWriter http.ResponseWriter, req *http.Request) {
+		user := contexts.ContextGetUser(req)
+		if user.IsAnonymous() {
+			middleware.httpx.AuthenticationRequiredResponse(resWriter, req)
+			return
+		}
+
+		if apiKey := contexts.ContextGetAPIKey(req); apiKey != nil && !apiKey.Has(scope) {
+			middleware.httpx.MissingScopeResponse(resWriter, req, scope)
+			return
+		}
+
+		if grant := contexts.ContextGetOAuthGrant(req); grant != nil {
+			oauthScope, ok := oauthScopes[scope]
+			if !ok {
+				middleware.httpx.AppAccessNotAllowedResponse(resWriter, req)
+				return
+			}
+			if !grant.Has(oauthScope) {
+				middleware.httpx.MissingScopeResponse(resWriter, req, oauthScope)
+				return
+			}
+		}
+
+		next.ServeHTTP(resWriter, req)
+	})
+}
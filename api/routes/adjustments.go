@@ -0,0 +1,132 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/thesambayo/digillets-api/api/contexts"
+	"github.com/thesambayo/digillets-api/api/httpx"
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/adjustments"
+	"github.com/thesambayo/digillets-api/internal/data/approvals"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/currencies"
+	"github.com/thesambayo/digillets-api/internal/money"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// CreateAdjustment requests a manual credit or debit of the wallet in the url. It is
+// posted once another member of staff approves it, and the amount of a debit is
+// held on the wallet until then.
+func (routes *Routes) CreateAdjustment(resWriter http.ResponseWriter, req *http.Request) {
+	staff := contexts.ContextGetUser(req)
+
+	var input struct {
+		Amount    money.Amount `json:"amount"`
+		Direction string       `json:"direction"`
+		Reason    string       `json:"reason"`
+		Reference string       `json:"reference"`
+		Note      string       `json:"note"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	wallet, err := routes.models.Wallets.GetByPublicId(routes.httpx.ReadIDParam(req))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	adjustment := &adjustments.Adjustment{
+		Wallet:      wallet.PublicID,
+		Direction:   input.Direction,
+		Amount:      input.Amount,
+		Currency:    wallet.Currency.Code,
+		Reason:      input.Reason,
+		Reference:   input.Reference,
+		Note:        input.Note,
+		RequestedBy: staff.PublicID,
+	}
+
+	validator := validators.New()
+	adjustments.ValidateAdjustment(validator, adjustment)
+	currencies.ValidateAmount(validator, "amount", adjustment.Amount, wallet.Currency)
+	if !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+	if wallet.Status == constants.WalletStatusClosed {
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the wallet is closed")
+		return
+	}
+
+	payload, err := json.Marshal(adjustment)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	approval := &approvals.Approval{
+		Action:      approvals.ActionAdjustment,
+		InitiatorID: staff.ID,
+		InitiatedBy: staff.PublicID,
+		WalletID:    wallet.ID,
+		Wallet:      wallet.PublicID,
+		Amount:      adjustment.Amount,
+		Currency:    adjustment.Currency,
+		BaseAmount:  adjustment.Amount.Div(wallet.Currency.ExchangeRate, 4, money.DefaultRounding),
+		Payload:     payload,
+		ExpiresAt:   time.Now().Add(routes.config.Approvals.TTL),
+	}
+	hold := money.Zero
+	if adjustment.Direction == adjustments.DirectionDebit {
+		hold = adjustment.Amount
+	}
+
+	err = routes.models.Approvals.Create(approval, hold, routes.auditActor(req, audit.ActorAdmin))
+	if err != nil {
+		routes.adjustmentErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusAccepted,
+		httpx.Envelope{"message": "adjustment is waiting for approval", "data": adjustment, "approval_id": approval.PublicID},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// adjustmentErrorResponse sends the response for an error from holding or posting
+// an adjustment.
+func (routes *Routes) adjustmentErrorResponse(resWriter http.ResponseWriter, req *http.Request, err error) {
+	switch {
+	case errors.Is(err, constants.ErrInsufficientFunds):
+		routes.httpx.FailedValidationResponse(resWriter, req, map[string]string{"amount": "is more than the wallet has available"})
+	case errors.Is(err, constants.ErrLimitExceeded):
+		routes.httpx.FailedValidationResponse(resWriter, req, map[string]string{"amount": "would go over " + err.Error()})
+	case errors.Is(err, constants.ErrAmountPrecision):
+		routes.httpx.FailedValidationResponse(resWriter, req, map[string]string{"amount": "has more decimal places than the currency allows"})
+	case errors.Is(err, constants.ErrWalletFrozen):
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the wallet is frozen")
+	case errors.Is(err, constants.ErrWalletClosed):
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the wallet is closed")
+	default:
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
@@ -0,0 +1,126 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/thesambayo/digillets-api/api/contexts"
+	"github.com/thesambayo/digillets-api/api/httpx"
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/apikeys"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// CreateAPIKey creates an API key for server to server integrations. The key is
+// only in the response, it cannot be read back afterwards.
+func (routes *Routes) CreateAPIKey(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	var input struct {
+		Name   string   `json:"name"`
+		Mode   string   `json:"mode"`
+		Scopes []string `json:"scopes"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	apiKey := &apikeys.APIKey{
+		UserID:       user.ID,
+		UserPublicID: user.PublicID,
+		Name:         input.Name,
+		Mode:         input.Mode,
+		Scopes:       input.Scopes,
+	}
+
+	validator := validators.New()
+	if apikeys.ValidateAPIKey(validator, apiKey); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	err = routes.models.APIKeys.Insert(apiKey, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusCreated,
+		httpx.Envelope{"message": "api key created successfully, keep the key safe as it will not be shown again", "data": apiKey},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) GetAPIKeys(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	apiKeys, err := routes.models.APIKeys.GetAllForUser(user.ID)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "api keys fetched successfully", "data": apiKeys},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// RevokeAPIKey revokes an API key, requests made with it fail from then on.
+func (routes *Routes) RevokeAPIKey(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	apiKey, err := routes.models.APIKeys.GetForUser(user.ID, routes.httpx.ReadIDParam(req))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	err = routes.models.APIKeys.Revoke(apiKey, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "api key revoked successfully", "data": apiKey},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// refuseTestKey refuses requests made with a test API key, for routes that move
+// money. When it returns true the error response has already been sent.
+func (routes *Routes) refuseTestKey(resWriter http.ResponseWriter, req *http.Request) bool {
+	if apiKey := contexts.ContextGetAPIKey(req); apiKey != nil && apiKey.Mode == apikeys.ModeTest {
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusForbidden, "test api keys cannot move money, use a live key")
+		return true
+	}
+	return false
+}
@@ -8,15 +8,19 @@ import (
 	"github.com/thesambayo/digillets-api/api/middleware"
 	"github.com/thesambayo/digillets-api/internal/config"
 	"github.com/thesambayo/digillets-api/internal/data"
+	"github.com/thesambayo/digillets-api/internal/data/apikeys"
+	"github.com/thesambayo/digillets-api/internal/data/permissions"
+	"github.com/thesambayo/digillets-api/internal/notify"
 )
 
 type Routes struct {
 	config config.Config
 	httpx  *httpx.Utils
 	models *data.Models
+	hub    *notify.Hub
 }
 
-func Handlers(cfg config.Config, models *data.Models, httpx *httpx.Utils) http.Handler {
+func Handlers(cfg config.Config, models *data.Models, httpx *httpx.Utils, hub *notify.Hub) http.Handler {
 	router := http.NewServeMux()
 	middleware := middleware.New(cfg, httpx, models)
 
@@ -24,6 +28,7 @@ func Handlers(cfg config.Config, models *data.Models, httpx *httpx.Utils) http.H
 		config: cfg,
 		models: models,
 		httpx:  httpx,
+		hub:    hub,
 	}
 
 	// healthcheck
@@ -38,15 +43,31 @@ func Handlers(cfg config.Config, models *data.Models, httpx *httpx.Utils) http.H
 		"GET /v1/users/profile",
 		middleware.RequireAuthenticatedUser(routes.GetUserProfile),
 	)
+	router.HandleFunc(
+		"GET /v1/users/limits",
+		middleware.RequireScope(apikeys.ScopeRead, routes.GetUserLimits),
+	)
+	router.HandleFunc(
+		"POST /v1/users/kyc",
+		middleware.RequireAuthenticatedUser(routes.SubmitKYC),
+	)
+	router.HandleFunc(
+		"GET /v1/users/kyc",
+		middleware.RequireAuthenticatedUser(routes.GetKYCSubmissions),
+	)
 
 	// Currencies
 	router.HandleFunc(
 		"GET /v1/rates/convert",
-		middleware.RequireAuthenticatedUser(routes.GetTwoCurrenciesExchangeRate),
+		middleware.RequireScope(apikeys.ScopeRead, routes.GetTwoCurrenciesExchangeRate),
 	)
 	router.HandleFunc(
 		"GET /v1/rates/list",
-		middleware.RequireAuthenticatedUser(routes.GetCurrencyExchangeRates),
+		middleware.RequireScope(apikeys.ScopeRead, routes.GetCurrencyExchangeRates),
+	)
+	router.HandleFunc(
+		"GET /v1/rates/ws",
+		middleware.RequireScope(apikeys.ScopeRead, routes.StreamExchangeRates),
 	)
 
 	// WALLETS
@@ -56,20 +77,410 @@ func Handlers(cfg config.Config, models *data.Models, httpx *httpx.Utils) http.H
 	)
 	router.HandleFunc(
 		"GET /v1/wallets",
-		middleware.RequireAuthenticatedUser(routes.GetWallets),
+		middleware.RequireScope(apikeys.ScopeRead, routes.GetWallets),
 	)
 	router.HandleFunc(
 		"GET /v1/wallets/{id}",
-		middleware.RequireAuthenticatedUser(routes.GetSingleWallet),
+		middleware.RequireScope(apikeys.ScopeRead, routes.GetSingleWallet),
+	)
+	router.HandleFunc(
+		"DELETE /v1/wallets/{id}",
+		middleware.RequireAuthenticatedUser(routes.CloseWallet),
+	)
+	router.HandleFunc(
+		"GET /v1/wallets/{id}/statement",
+		middleware.RequireScope(apikeys.ScopeRead, routes.GetWalletStatement),
+	)
+
+	// STREAM
+	router.HandleFunc(
+		"GET /v1/stream",
+		middleware.RequireScope(apikeys.ScopeRead, routes.Stream),
+	)
+
+	// TRANSFERS
+	router.HandleFunc(
+		"POST /v1/transfers/preview",
+		middleware.RequireScope(apikeys.ScopePayments, routes.PreviewTransfer),
+	)
+	router.HandleFunc(
+		"POST /v1/transfers",
+		middleware.RequireScope(apikeys.ScopePayments, routes.CreateTransfer),
+	)
+
+	// WEBHOOKS
+	router.HandleFunc(
+		"POST /v1/webhooks",
+		middleware.RequireAuthenticatedUser(routes.CreateWebhookEndpoint),
+	)
+	router.HandleFunc(
+		"GET /v1/webhooks",
+		middleware.RequireAuthenticatedUser(routes.GetWebhookEndpoints),
+	)
+	router.HandleFunc(
+		"GET /v1/webhooks/{id}",
+		middleware.RequireAuthenticatedUser(routes.GetWebhookEndpoint),
+	)
+	router.HandleFunc(
+		"PATCH /v1/webhooks/{id}",
+		middleware.RequireAuthenticatedUser(routes.UpdateWebhookEndpoint),
+	)
+	router.HandleFunc(
+		"DELETE /v1/webhooks/{id}",
+		middleware.RequireAuthenticatedUser(routes.DeleteWebhookEndpoint),
+	)
+	router.HandleFunc(
+		"POST /v1/webhooks/{id}/rotate-secret",
+		middleware.RequireAuthenticatedUser(routes.RotateWebhookSecret),
+	)
+	router.HandleFunc(
+		"GET /v1/webhooks/{id}/attempts",
+		middleware.RequireAuthenticatedUser(routes.GetWebhookAttempts),
+	)
+	router.HandleFunc(
+		"POST /v1/webhooks/{id}/test",
+		middleware.RequireAuthenticatedUser(routes.SendWebhookTest),
+	)
+
+	// API KEYS
+	router.HandleFunc(
+		"POST /v1/api-keys",
+		middleware.RequireAuthenticatedUser(routes.CreateAPIKey),
+	)
+	router.HandleFunc(
+		"GET /v1/api-keys",
+		middleware.RequireAuthenticatedUser(routes.GetAPIKeys),
+	)
+	router.HandleFunc(
+		"DELETE /v1/api-keys/{id}",
+		middleware.RequireAuthenticatedUser(routes.RevokeAPIKey),
+	)
+
+	// OAUTH
+	router.HandleFunc("POST /v1/oauth/token", routes.IssueOAuthToken)
+	router.HandleFunc("POST /v1/oauth/introspect", routes.IntrospectOAuthToken)
+	router.HandleFunc(
+		"GET /v1/oauth/authorize",
+		middleware.RequireAuthenticatedUser(routes.GetOAuthConsent),
+	)
+	router.HandleFunc(
+		"POST /v1/oauth/authorize",
+		middleware.RequireAuthenticatedUser(routes.Authorize),
+	)
+	router.HandleFunc(
+		"GET /v1/oauth/grants",
+		middleware.RequireAuthenticatedUser(routes.GetOAuthGrants),
+	)
+	router.HandleFunc(
+		"DELETE /v1/oauth/grants/{id}",
+		middleware.RequireAuthenticatedUser(routes.RevokeOAuthGrant),
+	)
+	router.HandleFunc(
+		"POST /v1/oauth/clients",
+		middleware.RequireAuthenticatedUser(routes.CreateOAuthClient),
+	)
+	router.HandleFunc(
+		"GET /v1/oauth/clients",
+		middleware.RequireAuthenticatedUser(routes.GetOAuthClients),
+	)
+	router.HandleFunc(
+		"DELETE /v1/oauth/clients/{id}",
+		middleware.RequireAuthenticatedUser(routes.RevokeOAuthClient),
+	)
+
+	// MERCHANTS
+	router.HandleFunc(
+		"POST /v1/merchant",
+		middleware.RequireAuthenticatedUser(routes.CreateMerchant),
+	)
+	router.HandleFunc(
+		"GET /v1/merchant",
+		middleware.RequireScope(apikeys.ScopeRead, routes.GetMerchant),
+	)
+	router.HandleFunc(
+		"PATCH /v1/merchant",
+		middleware.RequireAuthenticatedUser(routes.UpdateMerchant),
+	)
+	router.HandleFunc(
+		"GET /v1/merchant/payments",
+		middleware.RequireScope(apikeys.ScopeRead, routes.GetMerchantPayments),
+	)
+	router.HandleFunc(
+		"GET /v1/merchant/payments/{id}",
+		middleware.RequireScope(apikeys.ScopeRead, routes.GetMerchantPayment),
+	)
+	router.HandleFunc(
+		"POST /v1/merchant/payments/{id}/capture",
+		middleware.RequireScope(apikeys.ScopePayments, routes.CapturePayment),
+	)
+	router.HandleFunc(
+		"POST /v1/merchant/payments/{id}/void",
+		middleware.RequireScope(apikeys.ScopePayments, routes.VoidPayment),
+	)
+	router.HandleFunc(
+		"POST /v1/merchant/payments/{id}/refunds",
+		middleware.RequireScope(apikeys.ScopePayments, routes.RefundPayment),
+	)
+	router.HandleFunc(
+		"GET /v1/merchant/settlements",
+		middleware.RequireScope(apikeys.ScopeRead, routes.GetSettlements),
+	)
+
+	// PAYMENTS
+	router.HandleFunc(
+		"POST /v1/payments",
+		middleware.RequireScope(apikeys.ScopePayments, routes.CreatePayment),
+	)
+	router.HandleFunc(
+		"GET /v1/payments/{id}",
+		middleware.RequireScope(apikeys.ScopeRead, routes.GetPayment),
+	)
+
+	// CHECKOUT
+	router.HandleFunc(
+		"POST /v1/checkout/sessions",
+		middleware.RequireScope(apikeys.ScopePayments, routes.CreateCheckoutSession),
+	)
+	router.HandleFunc(
+		"GET /v1/checkout/sessions",
+		middleware.RequireScope(apikeys.ScopeRead, routes.GetCheckoutSessions),
+	)
+	router.HandleFunc(
+		"GET /v1/checkout/sessions/{id}",
+		middleware.RequireScope(apikeys.ScopeRead, routes.GetCheckoutSession),
+	)
+	router.HandleFunc(
+		"POST /v1/checkout/sessions/{id}/pay",
+		middleware.RequireScope(apikeys.ScopePayments, routes.PayCheckoutSession),
+	)
+	router.HandleFunc(
+		"POST /v1/checkout/sessions/{id}/expire",
+		middleware.RequireScope(apikeys.ScopePayments, routes.ExpireCheckoutSession),
+	)
+
+	// INVOICES
+	router.HandleFunc(
+		"POST /v1/invoices",
+		middleware.RequireScope(apikeys.ScopePayments, routes.CreateInvoice),
+	)
+	router.HandleFunc(
+		"GET /v1/invoices",
+		middleware.RequireScope(apikeys.ScopeRead, routes.GetInvoices),
+	)
+	router.HandleFunc(
+		"GET /v1/invoices/{id}",
+		middleware.RequireScope(apikeys.ScopeRead, routes.GetInvoice),
+	)
+	router.HandleFunc(
+		"PATCH /v1/invoices/{id}",
+		middleware.RequireScope(apikeys.ScopePayments, routes.UpdateInvoice),
+	)
+	router.HandleFunc(
+		"POST /v1/invoices/{id}/finalize",
+		middleware.RequireScope(apikeys.ScopePayments, routes.FinalizeInvoice),
+	)
+	router.HandleFunc(
+		"POST /v1/invoices/{id}/void",
+		middleware.RequireScope(apikeys.ScopePayments, routes.VoidInvoice),
+	)
+	router.HandleFunc(
+		"GET /v1/invoices/received",
+		middleware.RequireScope(apikeys.ScopeRead, routes.GetReceivedInvoices),
+	)
+	router.HandleFunc(
+		"GET /v1/invoices/received/{id}",
+		middleware.RequireScope(apikeys.ScopeRead, routes.GetReceivedInvoice),
+	)
+	router.HandleFunc(
+		"POST /v1/invoices/received/{id}/payments",
+		middleware.RequireScope(apikeys.ScopePayments, routes.PayInvoice),
+	)
+
+	// PAYMENT REQUESTS
+	router.HandleFunc(
+		"POST /v1/payment-requests",
+		middleware.RequireScope(apikeys.ScopePayments, routes.CreatePaymentRequest),
+	)
+	router.HandleFunc(
+		"GET /v1/payment-requests/incoming",
+		middleware.RequireScope(apikeys.ScopeRead, routes.GetIncomingPaymentRequests),
+	)
+	router.HandleFunc(
+		"GET /v1/payment-requests/outgoing",
+		middleware.RequireScope(apikeys.ScopeRead, routes.GetOutgoingPaymentRequests),
+	)
+	router.HandleFunc(
+		"GET /v1/payment-requests/{id}",
+		middleware.RequireScope(apikeys.ScopeRead, routes.GetPaymentRequest),
+	)
+	router.HandleFunc(
+		"POST /v1/payment-requests/{id}/accept",
+		middleware.RequireScope(apikeys.ScopePayments, routes.AcceptPaymentRequest),
+	)
+	router.HandleFunc(
+		"POST /v1/payment-requests/{id}/decline",
+		middleware.RequireScope(apikeys.ScopePayments, routes.DeclinePaymentRequest),
+	)
+	router.HandleFunc(
+		"POST /v1/payment-requests/{id}/cancel",
+		middleware.RequireScope(apikeys.ScopePayments, routes.CancelPaymentRequest),
+	)
+
+	// ADMIN
+	router.HandleFunc(
+		"POST /v1/admin/wallets/{id}/freeze",
+		middleware.RequirePermission(permissions.WalletsFreeze, routes.FreezeWallet),
+	)
+	router.HandleFunc(
+		"POST /v1/admin/wallets/{id}/unfreeze",
+		middleware.RequirePermission(permissions.WalletsFreeze, routes.UnfreezeWallet),
+	)
+	router.HandleFunc(
+		"GET /v1/admin/wallets/{id}/freezes",
+		middleware.RequirePermission(permissions.WalletsFreeze, routes.GetWalletFreezeEvents),
+	)
+	router.HandleFunc(
+		"POST /v1/admin/users/{id}/freeze",
+		middleware.RequirePermission(permissions.WalletsFreeze, routes.FreezeUserWallets),
+	)
+	router.HandleFunc(
+		"POST /v1/admin/users/{id}/unfreeze",
+		middleware.RequirePermission(permissions.WalletsFreeze, routes.UnfreezeUserWallets),
+	)
+
+	router.HandleFunc(
+		"GET /v1/admin/kyc",
+		middleware.RequirePermission(permissions.KYCReview, routes.GetAdminKYCSubmissions),
+	)
+	router.HandleFunc(
+		"GET /v1/admin/kyc/{id}",
+		middleware.RequirePermission(permissions.KYCReview, routes.GetAdminKYCSubmission),
+	)
+	router.HandleFunc(
+		"GET /v1/admin/kyc/{id}/documents/{kind}",
+		middleware.RequirePermission(permissions.KYCReview, routes.GetAdminKYCDocument),
+	)
+	router.HandleFunc(
+		"POST /v1/admin/kyc/{id}/approve",
+		middleware.RequirePermission(permissions.KYCReview, routes.ApproveKYCSubmission),
+	)
+	router.HandleFunc(
+		"POST /v1/admin/kyc/{id}/reject",
+		middleware.RequirePermission(permissions.KYCReview, routes.RejectKYCSubmission),
+	)
+
+	router.HandleFunc(
+		"GET /v1/admin/risk/decisions",
+		middleware.RequirePermission(permissions.RiskReview, routes.GetRiskDecisions),
+	)
+	router.HandleFunc(
+		"GET /v1/admin/risk/decisions/{id}",
+		middleware.RequirePermission(permissions.RiskReview, routes.GetRiskDecision),
+	)
+	router.HandleFunc(
+		"POST /v1/admin/risk/decisions/{id}/approve",
+		middleware.RequirePermission(permissions.RiskReview, routes.ApproveRiskDecision),
+	)
+	router.HandleFunc(
+		"POST /v1/admin/risk/decisions/{id}/reject",
+		middleware.RequirePermission(permissions.RiskReview, routes.RejectRiskDecision),
+	)
+
+	router.HandleFunc(
+		"GET /v1/admin/sanctions/matches",
+		middleware.RequirePermission(permissions.SanctionsReview, routes.GetSanctionsMatches),
+	)
+	router.HandleFunc(
+		"GET /v1/admin/sanctions/matches/{id}",
+		middleware.RequirePermission(permissions.SanctionsReview, routes.GetSanctionsMatch),
+	)
+	router.HandleFunc(
+		"POST /v1/admin/sanctions/matches/{id}/clear",
+		middleware.RequirePermission(permissions.SanctionsReview, routes.ClearSanctionsMatch),
+	)
+	router.HandleFunc(
+		"POST /v1/admin/sanctions/matches/{id}/confirm",
+		middleware.RequirePermission(permissions.SanctionsReview, routes.ConfirmSanctionsMatch),
+	)
+	router.HandleFunc(
+		"GET /v1/admin/sanctions/list",
+		middleware.RequirePermission(permissions.SanctionsReview, routes.GetSanctionsList),
+	)
+	router.HandleFunc(
+		"POST /v1/admin/sanctions/list/reload",
+		middleware.RequirePermission(permissions.SanctionsReview, routes.ReloadSanctionsList),
+	)
+
+	router.HandleFunc(
+		"POST /v1/admin/wallets/{id}/adjustments",
+		middleware.RequirePermission(permissions.LedgerAdjust, routes.CreateAdjustment),
+	)
+
+	router.HandleFunc(
+		"GET /v1/admin/approvals",
+		middleware.RequirePermission(permissions.ApprovalsDecide, routes.GetApprovals),
+	)
+	router.HandleFunc(
+		"GET /v1/admin/approvals/{id}",
+		middleware.RequirePermission(permissions.ApprovalsDecide, routes.GetApproval),
+	)
+	router.HandleFunc(
+		"POST /v1/admin/approvals/{id}/approve",
+		middleware.RequirePermission(permissions.ApprovalsDecide, routes.ApproveApproval),
+	)
+	router.HandleFunc(
+		"POST /v1/admin/approvals/{id}/reject",
+		middleware.RequirePermission(permissions.ApprovalsDecide, routes.RejectApproval),
+	)
+
+	router.HandleFunc(
+		"GET /v1/admin/reconciliation/runs",
+		middleware.RequirePermission(permissions.ReconciliationManage, routes.GetReconciliationRuns),
+	)
+	router.HandleFunc(
+		"GET /v1/admin/reconciliation/breaks",
+		middleware.RequirePermission(permissions.ReconciliationManage, routes.GetReconciliationBreaks),
+	)
+	router.HandleFunc(
+		"GET /v1/admin/reconciliation/breaks/{id}",
+		middleware.RequirePermission(permissions.ReconciliationManage, routes.GetReconciliationBreak),
+	)
+	router.HandleFunc(
+		"POST /v1/admin/reconciliation/breaks/{id}/resolve",
+		middleware.RequirePermission(permissions.ReconciliationManage, routes.ResolveReconciliationBreak),
+	)
+
+	router.HandleFunc(
+		"GET /v1/admin/webhooks/deliveries",
+		middleware.RequirePermission(permissions.WebhooksManage, routes.GetWebhookDeliveries),
+	)
+	router.HandleFunc(
+		"GET /v1/admin/webhooks/deliveries/{id}",
+		middleware.RequirePermission(permissions.WebhooksManage, routes.GetWebhookDelivery),
+	)
+	router.HandleFunc(
+		"POST /v1/admin/webhooks/deliveries/{id}/redeliver",
+		middleware.RequirePermission(permissions.WebhooksManage, routes.RedeliverWebhookDelivery),
+	)
+
+	router.HandleFunc(
+		"GET /v1/admin/audit",
+		middleware.RequirePermission(permissions.AuditRead, routes.GetAuditEvents),
+	)
+	router.HandleFunc(
+		"GET /v1/admin/audit/verify",
+		middleware.RequirePermission(permissions.AuditRead, routes.VerifyAuditEvents),
 	)
 
 	// middlewares usages around servemux
 	return middleware.Metrics( // first
 		middleware.RecoverFromPanic(
-			middleware.EnableCORS(
-				middleware.RateLimit(
-					middleware.Authenticate( // last
-						router,
+			middleware.RequestID(
+				middleware.EnableCORS(
+					middleware.RateLimit(
+						middleware.Authenticate( // last
+							router,
+						),
 					),
 				),
 			),
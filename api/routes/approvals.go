@@ -0,0 +1,282 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/thesambayo/digillets-api/api/contexts"
+	"github.com/thesambayo/digillets-api/api/httpx"
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/adjustments"
+	"github.com/thesambayo/digillets-api/internal/data/approvals"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/data/transfers"
+	"github.com/thesambayo/digillets-api/internal/risk"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// transferApproval is the payload of a transfer waiting for approval: the transfer
+// as it was priced, and the device it was made from for the risk rules.
+type transferApproval struct {
+	Transfer *transfers.Transfer `json:"transfer"`
+	Device   string              `json:"device"`
+}
+
+func (routes *Routes) GetApprovals(resWriter http.ResponseWriter, req *http.Request) {
+	filters := listing.Filters{
+		Sort: "-created_at",
+		SortSafelist: map[string]string{
+			"created_at":  "pending_approvals.created_at",
+			"expires_at":  "pending_approvals.expires_at",
+			"base_amount": "pending_approvals.base_amount",
+		},
+		FieldSafelist: map[string]string{
+			"status":       "pending_approvals.status",
+			"action":       "pending_approvals.action",
+			"initiated_by": "initiators.public_id",
+			"wallet":       "wallets.public_id",
+		},
+		IDColumn: "pending_approvals.id",
+	}
+
+	validator := validators.New()
+	routes.httpx.ReadFilters(req.URL.Query(), &filters, validator)
+	if listing.Validate(validator, filters); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	pending, metadata, err := routes.models.Approvals.GetAll(filters)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "approvals fetched successfully", "data": pending, "metadata": metadata},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) GetApproval(resWriter http.ResponseWriter, req *http.Request) {
+	approval, ok := routes.readApproval(resWriter, req)
+	if !ok {
+		return
+	}
+
+	err := routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "approval fetched successfully", "data": approval},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) ApproveApproval(resWriter http.ResponseWriter, req *http.Request) {
+	routes.decideApproval(resWriter, req, true)
+}
+
+func (routes *Routes) RejectApproval(resWriter http.ResponseWriter, req *http.Request) {
+	routes.decideApproval(resWriter, req, false)
+}
+
+func (routes *Routes) decideApproval(resWriter http.ResponseWriter, req *http.Request, approve bool) {
+	staff := contexts.ContextGetUser(req)
+
+	var input struct {
+		Note string `json:"note"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	decision := approvals.Decision{
+		Approve:   approve,
+		Note:      input.Note,
+		DeciderID: staff.ID,
+	}
+
+	validator := validators.New()
+	if approvals.ValidateDecision(validator, &decision); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	approval, ok := routes.readApproval(resWriter, req)
+	if !ok {
+		return
+	}
+	if approval.Status != approvals.StatusPending {
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the approval has already been decided")
+		return
+	}
+
+	actor := routes.auditActor(req, audit.ActorAdmin)
+	message := "approval rejected successfully"
+	var execute approvals.Executor
+	if approve {
+		execute, err = routes.approvalExecutor(approval, actor, &message)
+		if err != nil {
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+			return
+		}
+	}
+
+	err = routes.models.Approvals.Decide(approval, decision, actor, execute)
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrApprovalDecided):
+			routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the approval has already been decided")
+		case errors.Is(err, constants.ErrApprovalExpired):
+			routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the approval has expired")
+		case errors.Is(err, constants.ErrSelfApproval):
+			routes.httpx.ErrorResponse(resWriter, req, http.StatusForbidden, "an approval must be decided by someone other than its initiator")
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		case approval.Action == approvals.ActionAdjustment:
+			routes.adjustmentErrorResponse(resWriter, req, err)
+		case approval.Action == approvals.ActionPayment:
+			routes.paymentErrorResponse(resWriter, req, err)
+		default:
+			routes.transferErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": message, "data": approval},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// approvalExecutor returns what executes an approval once it is approved, which sets
+// the message to respond with. A transfer or payment goes through the risk rules as
+// if it was being made now, so the message depends on their outcome.
+func (routes *Routes) approvalExecutor(approval *approvals.Approval, actor audit.Actor, message *string) (approvals.Executor, error) {
+	switch approval.Action {
+	case approvals.ActionTransfer:
+		var payload transferApproval
+		if err := json.Unmarshal(approval.Payload, &payload); err != nil {
+			return nil, err
+		}
+
+		var err error
+		payload.Transfer.From, err = routes.models.Wallets.GetByPublicId(payload.Transfer.FromWallet)
+		if err == nil {
+			payload.Transfer.To, err = routes.models.Wallets.GetByPublicId(payload.Transfer.ToWallet)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		execute := func(ctx context.Context, tx *sql.Tx) (string, error) {
+			decision, err := routes.models.RiskDecisions.CreateTransferTx(ctx, tx, payload.Transfer, payload.Device, actor)
+			if err != nil {
+				return "", err
+			}
+			switch decision.Outcome {
+			case risk.OutcomeBlock:
+				*message = "approval approved, but the transfer was declined by the risk rules"
+			case risk.OutcomeReview:
+				*message = "approval approved, the transfer is under risk review"
+			default:
+				*message = "approval approved, the transfer was made successfully"
+				return payload.Transfer.PublicID, nil
+			}
+			return decision.PublicID, nil
+		}
+		return execute, nil
+
+	case approvals.ActionPayment:
+		var payload merchantPayment
+		if err := json.Unmarshal(approval.Payload, &payload); err != nil {
+			return nil, err
+		}
+
+		debit, pay, err := routes.merchantPaymentDebit(payload, actor)
+		if err != nil {
+			return nil, err
+		}
+		debit.Payload = approval.Payload
+
+		execute := func(ctx context.Context, tx *sql.Tx) (string, error) {
+			decision, err := routes.models.RiskDecisions.CreateDebitTx(ctx, tx, debit, payload.Device, actor, pay)
+			if err != nil {
+				return "", err
+			}
+			switch decision.Outcome {
+			case risk.OutcomeBlock:
+				*message = "approval approved, but the payment was declined by the risk rules"
+			case risk.OutcomeReview:
+				*message = "approval approved, the payment is under risk review"
+			default:
+				*message = "approval approved, the payment was made successfully"
+				return decision.TransactionID, nil
+			}
+			return decision.PublicID, nil
+		}
+		return execute, nil
+
+	case approvals.ActionAdjustment:
+		var adjustment adjustments.Adjustment
+		if err := json.Unmarshal(approval.Payload, &adjustment); err != nil {
+			return nil, err
+		}
+
+		wallet, err := routes.models.Wallets.GetByPublicId(adjustment.Wallet)
+		if err != nil {
+			return nil, err
+		}
+
+		execute := func(ctx context.Context, tx *sql.Tx) (string, error) {
+			if err := adjustments.CreateTx(ctx, tx, &adjustment, wallet, actor); err != nil {
+				return "", err
+			}
+			*message = "approval approved, the adjustment was posted successfully"
+			return adjustment.TransactionID, nil
+		}
+		return execute, nil
+	}
+
+	return nil, fmt.Errorf("approvals: unknown action %q", approval.Action)
+}
+
+// readApproval fetches the approval in the url. When it returns false the error
+// response has already been sent.
+func (routes *Routes) readApproval(resWriter http.ResponseWriter, req *http.Request) (*approvals.Approval, bool) {
+	approval, err := routes.models.Approvals.GetByPublicId(routes.httpx.ReadIDParam(req))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return nil, false
+	}
+	return approval, true
+}
@@ -0,0 +1,106 @@
+package routes
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/thesambayo/digillets-api/api/contexts"
+	"github.com/thesambayo/digillets-api/api/httpx"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// auditActor describes the user making the request for the audit log, as a user
+// acting on their own behalf or as staff acting through an admin endpoint. A user
+// acting through an API key is recorded as the key, and a third party app acting
+// for a user as the grant the user gave it.
+func (routes *Routes) auditActor(req *http.Request, actorType string) audit.Actor {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+
+	actor := audit.Actor{
+		Type:      actorType,
+		RequestID: contexts.ContextGetRequestID(req),
+		IP:        ip,
+	}
+	if user := contexts.ContextGetUser(req); !user.IsAnonymous() {
+		actor.PublicID = user.PublicID
+	}
+	if apiKey := contexts.ContextGetAPIKey(req); apiKey != nil && actorType == audit.ActorUser {
+		actor.Type = audit.ActorAPIKey
+		actor.PublicID = apiKey.PublicID
+	}
+	if grant := contexts.ContextGetOAuthGrant(req); grant != nil && actorType == audit.ActorUser {
+		actor.Type = audit.ActorOAuthApp
+		actor.PublicID = grant.PublicID
+	}
+
+	return actor
+}
+
+func (routes *Routes) GetAuditEvents(resWriter http.ResponseWriter, req *http.Request) {
+	filters := listing.Filters{
+		Sort: "-id",
+		SortSafelist: map[string]string{
+			"id":         "audit_events.id",
+			"created_at": "audit_events.created_at",
+		},
+		FieldSafelist: map[string]string{
+			"actor_type":  "audit_events.actor_type",
+			"actor_id":    "audit_events.actor_id",
+			"action":      "audit_events.action",
+			"target_type": "audit_events.target_type",
+			"target_id":   "audit_events.target_id",
+			"request_id":  "audit_events.request_id",
+			"ip":          "audit_events.ip",
+		},
+		IDColumn: "audit_events.id",
+	}
+
+	validator := validators.New()
+	routes.httpx.ReadFilters(req.URL.Query(), &filters, validator)
+	if listing.Validate(validator, filters); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	events, metadata, err := routes.models.Audit.GetAll(filters)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "audit events fetched successfully", "data": events, "metadata": metadata},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// VerifyAuditEvents recomputes the hash chain of the whole audit log.
+func (routes *Routes) VerifyAuditEvents(resWriter http.ResponseWriter, req *http.Request) {
+	verification, err := routes.models.Audit.Verify(req.Context())
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "audit log verified", "data": verification},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
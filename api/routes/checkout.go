@@ -0,0 +1,440 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/thesambayo/digillets-api/api/contexts"
+	"github.com/thesambayo/digillets-api/api/httpx"
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/currencies"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/data/payments"
+	"github.com/thesambayo/digillets-api/internal/data/riskdecisions"
+	"github.com/thesambayo/digillets-api/internal/data/screenings"
+	"github.com/thesambayo/digillets-api/internal/data/transactions"
+	"github.com/thesambayo/digillets-api/internal/data/wallets"
+	"github.com/thesambayo/digillets-api/internal/money"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// CreateCheckoutSession opens a checkout session the merchant can share as a payment
+// link. The currency defaults to the one the merchant settles in, and the session
+// to expiring after a day.
+func (routes *Routes) CreateCheckoutSession(resWriter http.ResponseWriter, req *http.Request) {
+	merchant, ok := routes.readMerchant(resWriter, req)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Amount      money.Amount      `json:"amount"`
+		Currency    string            `json:"currency"`
+		Description string            `json:"description"`
+		SuccessURL  string            `json:"success_url"`
+		CancelURL   string            `json:"cancel_url"`
+		Metadata    payments.Metadata `json:"metadata"`
+		ExpiresAt   *time.Time        `json:"expires_at"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	if input.Currency == "" {
+		input.Currency = merchant.Currency
+	}
+	if input.ExpiresAt == nil {
+		expiresAt := time.Now().Add(payments.SessionDefaultTTL)
+		input.ExpiresAt = &expiresAt
+	}
+
+	session := &payments.CheckoutSession{
+		MerchantID:     merchant.ID,
+		Merchant:       merchant.PublicID,
+		MerchantName:   merchant.BusinessName,
+		MerchantUserID: merchant.UserID,
+		Amount:         input.Amount,
+		Description:    input.Description,
+		SuccessURL:     input.SuccessURL,
+		CancelURL:      input.CancelURL,
+		Metadata:       input.Metadata,
+		ExpiresAt:      *input.ExpiresAt,
+	}
+
+	validator := validators.New()
+	if payments.ValidateCheckoutSession(validator, session); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	currency, err := routes.models.Currencies.GetCurrencyByCode(input.Currency)
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			validator.AddError("currency", "must be a supported currency code e.g NGN")
+			routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	if currencies.ValidateAmount(validator, "amount", input.Amount, *currency); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+	session.CurrencyID = currency.ID
+	session.Currency = currency.Code
+
+	err = routes.models.Payments.InsertCheckoutSession(session, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusCreated,
+		httpx.Envelope{"message": "checkout session created successfully, share its id with the payer", "data": session},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// GetCheckoutSessions lists the checkout sessions the merchant opened.
+func (routes *Routes) GetCheckoutSessions(resWriter http.ResponseWriter, req *http.Request) {
+	merchant, ok := routes.readMerchant(resWriter, req)
+	if !ok {
+		return
+	}
+
+	filters := listing.Filters{
+		Sort: "-created_at",
+		SortSafelist: map[string]string{
+			"created_at": "checkout_sessions.created_at",
+			"expires_at": "checkout_sessions.expires_at",
+			"amount":     "checkout_sessions.amount",
+		},
+		FieldSafelist: map[string]string{
+			"status":   "checkout_sessions.status",
+			"currency": "currencies.code",
+		},
+		IDColumn: "checkout_sessions.id",
+	}
+
+	validator := validators.New()
+	routes.httpx.ReadFilters(req.URL.Query(), &filters, validator)
+	if listing.Validate(validator, filters); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	sessions, metadata, err := routes.models.Payments.GetCheckoutSessions(merchant.ID, filters)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "checkout sessions fetched successfully", "data": sessions, "metadata": metadata},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// GetCheckoutSession returns a checkout session to the payer about to pay it, or to
+// the merchant. Given one of the payer's wallets in ?wallet=, it also quotes how much
+// paying from it takes, converted at the current rate.
+func (routes *Routes) GetCheckoutSession(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	session, ok := routes.readCheckoutSession(resWriter, req)
+	if !ok {
+		return
+	}
+
+	envelope := httpx.Envelope{"message": "checkout session fetched successfully", "data": session}
+
+	if walletID := req.URL.Query().Get("wallet"); walletID != "" && session.Status == payments.SessionOpen {
+		wallet, err := routes.models.Wallets.GetForUser(user.ID, walletID)
+		if err != nil {
+			switch {
+			case errors.Is(err, constants.ErrRecordNotFound):
+				routes.httpx.FailedValidationResponse(resWriter, req, map[string]string{"wallet": "must be one of your wallets e.g NGN or its public id"})
+			default:
+				routes.httpx.ServerErrorResponse(resWriter, req, err)
+			}
+			return
+		}
+
+		currency, err := routes.models.Currencies.GetCurrencyByCode(session.Currency)
+		if err != nil {
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+			return
+		}
+
+		envelope["quote"] = map[string]interface{}{
+			"wallet":   wallet.PublicID,
+			"amount":   currency.Convert(session.Amount, wallet.Currency),
+			"currency": wallet.Currency.Code,
+		}
+	}
+
+	err := routes.httpx.WriteJSON(resWriter, http.StatusOK, envelope, nil)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// PayCheckoutSession pays an open checkout session from one of the user's wallets,
+// converting the amount at the current rate when the wallet is in another currency.
+// The payment goes through approval and the risk rules like a transfer does, and is
+// made once approved if the session is still open. The response carries the
+// success_url to send the payer back to.
+func (routes *Routes) PayCheckoutSession(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+	if user.ScreeningStatus == screenings.UserBlocked {
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusForbidden, "the payment was declined")
+		return
+	}
+	if routes.refuseTestKey(resWriter, req) {
+		return
+	}
+
+	session, ok := routes.readCheckoutSession(resWriter, req)
+	if !ok {
+		return
+	}
+	// checked here too so that a closed session cannot be sent for approval
+	if session.Status != payments.SessionOpen || !time.Now().Before(session.ExpiresAt) {
+		routes.checkoutErrorResponse(resWriter, req, constants.ErrSessionNotOpen)
+		return
+	}
+
+	var input struct {
+		Wallet string `json:"wallet"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	validator := validators.New()
+	validator.Check(input.Wallet != "", "wallet", "must be one of your wallets e.g NGN or its public id")
+	validator.Check(session.MerchantUserID != user.ID, "wallet", "must not pay your own checkout session")
+	if !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	payer, err := routes.models.Wallets.GetForUser(user.ID, input.Wallet)
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			validator.AddError("wallet", "must be one of your wallets e.g NGN or its public id")
+			routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	settlement, currency, ok := routes.readCheckoutSettlement(resWriter, req, session)
+	if !ok {
+		return
+	}
+
+	validator.Check(payer.Status != constants.WalletStatusClosed, "wallet", "must be an open wallet")
+	validator.Check(currency.Convert(session.Amount, payer.Currency).IsPositive(), "wallet", "the amount is too small to pay in "+payer.Currency.Code)
+	if !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	payload := merchantPayment{
+		Kind:            paymentKindCheckout,
+		Merchant:        session.Merchant,
+		Wallet:          payer.PublicID,
+		Amount:          currency.Convert(session.Amount, payer.Currency),
+		CheckoutSession: session.PublicID,
+		Device:          deviceID(req),
+	}
+	debit, execute := checkoutDebit(payload, session, *currency, payer, settlement, routes.auditActor(req, audit.ActorUser))
+	if !routes.payMerchant(resWriter, req, debit, money.Zero, payload, execute, routes.checkoutErrorResponse) {
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "checkout session paid successfully", "data": session},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// ExpireCheckoutSession closes an open checkout session of the merchant so that it
+// can no longer be paid.
+func (routes *Routes) ExpireCheckoutSession(resWriter http.ResponseWriter, req *http.Request) {
+	merchant, ok := routes.readMerchant(resWriter, req)
+	if !ok {
+		return
+	}
+
+	session, err := routes.models.Payments.GetCheckoutSessionForMerchant(merchant.ID, routes.httpx.ReadIDParam(req))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	err = routes.models.Payments.ExpireCheckoutSession(session, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrSessionNotOpen):
+			routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the checkout session was already paid or expired")
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "checkout session expired successfully", "data": session},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// readCheckoutSession reads the checkout session in the URL. When it returns false
+// the error response has already been sent.
+func (routes *Routes) readCheckoutSession(resWriter http.ResponseWriter, req *http.Request) (*payments.CheckoutSession, bool) {
+	session, err := routes.models.Payments.GetCheckoutSession(routes.httpx.ReadIDParam(req))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return nil, false
+	}
+
+	return session, true
+}
+
+// readCheckoutSettlement reads the wallet a checkout session is paid into and the
+// currency of the session, see checkoutSettlement. When it returns false the error
+// response has already been sent.
+func (routes *Routes) readCheckoutSettlement(resWriter http.ResponseWriter, req *http.Request, session *payments.CheckoutSession) (*wallets.Wallet, *currencies.Currency, bool) {
+	settlement, currency, err := routes.checkoutSettlement(session)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return nil, nil, false
+	}
+
+	return settlement, currency, true
+}
+
+// checkoutSettlement returns the wallet a checkout session is paid into, the current
+// settlement wallet of its merchant, and the currency of the session.
+func (routes *Routes) checkoutSettlement(session *payments.CheckoutSession) (*wallets.Wallet, *currencies.Currency, error) {
+	merchant, err := routes.models.Payments.GetMerchant(session.Merchant)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	settlement, err := routes.models.Wallets.GetByPublicId(merchant.SettlementWallet)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	currency, err := routes.models.Currencies.GetCurrencyByCode(session.Currency)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return settlement, currency, nil
+}
+
+// checkoutDebit returns the debit of paying a checkout session from payer for the
+// risk rules, and what pays it.
+func checkoutDebit(payload merchantPayment, session *payments.CheckoutSession, currency currencies.Currency, payer, settlement *wallets.Wallet, actor audit.Actor) (*riskdecisions.Debit, riskdecisions.Executor) {
+	debit := &riskdecisions.Debit{
+		TransactionType: transactions.TypePayment,
+		From:            payer,
+		To:              settlement,
+		BeneficiaryName: session.MerchantName,
+		Amount:          payload.Amount,
+		Hold:            payload.Amount,
+	}
+	execute := func(ctx context.Context, tx *sql.Tx) (string, error) {
+		if err := payments.PayCheckoutSessionTx(ctx, tx, session, currency, payer, settlement, actor); err != nil {
+			return "", err
+		}
+		return session.TransactionID, nil
+	}
+	return debit, execute
+}
+
+// checkoutPaymentDebit loads the checkout session and wallets of the payload of a
+// checkout payment waiting for approval or review, see merchantPaymentDebit.
+func (routes *Routes) checkoutPaymentDebit(payload merchantPayment, actor audit.Actor) (*riskdecisions.Debit, riskdecisions.Executor, error) {
+	session, err := routes.models.Payments.GetCheckoutSession(payload.CheckoutSession)
+	if err != nil {
+		return nil, nil, err
+	}
+	payer, err := routes.models.Wallets.GetByPublicId(payload.Wallet)
+	if err != nil {
+		return nil, nil, err
+	}
+	settlement, currency, err := routes.checkoutSettlement(session)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	debit, execute := checkoutDebit(payload, session, *currency, payer, settlement, actor)
+	return debit, execute, nil
+}
+
+// checkoutErrorResponse sends the response for an error from paying a checkout
+// session.
+func (routes *Routes) checkoutErrorResponse(resWriter http.ResponseWriter, req *http.Request, err error) {
+	switch {
+	case errors.Is(err, constants.ErrSessionNotOpen):
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the checkout session was already paid or expired")
+	case errors.Is(err, constants.ErrInsufficientFunds):
+		routes.httpx.FailedValidationResponse(resWriter, req, map[string]string{"wallet": "insufficient funds to cover the amount"})
+	default:
+		routes.transferErrorResponse(resWriter, req, err)
+	}
+}
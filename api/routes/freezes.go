@@ -0,0 +1,129 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/thesambayo/digillets-api/api/contexts"
+	"github.com/thesambayo/digillets-api/api/httpx"
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/users"
+	"github.com/thesambayo/digillets-api/internal/data/wallets"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+func (routes *Routes) FreezeWallet(resWriter http.ResponseWriter, req *http.Request) {
+	routes.applyFreezeEvent(resWriter, req, wallets.FreezeActionFreeze, false)
+}
+
+func (routes *Routes) UnfreezeWallet(resWriter http.ResponseWriter, req *http.Request) {
+	routes.applyFreezeEvent(resWriter, req, wallets.FreezeActionUnfreeze, false)
+}
+
+func (routes *Routes) FreezeUserWallets(resWriter http.ResponseWriter, req *http.Request) {
+	routes.applyFreezeEvent(resWriter, req, wallets.FreezeActionFreeze, true)
+}
+
+func (routes *Routes) UnfreezeUserWallets(resWriter http.ResponseWriter, req *http.Request) {
+	routes.applyFreezeEvent(resWriter, req, wallets.FreezeActionUnfreeze, true)
+}
+
+// applyFreezeEvent freezes or unfreezes the wallet in the url, or every wallet of
+// the user in the url when forUser is set, on behalf of the staff member making the
+// request.
+func (routes *Routes) applyFreezeEvent(resWriter http.ResponseWriter, req *http.Request, action string, forUser bool) {
+	staff := contexts.ContextGetUser(req)
+
+	var input struct {
+		Reason       string `json:"reason"`
+		Note         string `json:"note"`
+		BlockCredits bool   `json:"block_credits"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	event := wallets.FreezeEvent{
+		Action:       action,
+		Reason:       input.Reason,
+		Note:         input.Note,
+		BlockCredits: input.BlockCredits,
+		ActorID:      staff.ID,
+		Actor:        staff.PublicID,
+	}
+
+	validator := validators.New()
+	routes.models.Wallets.ValidateFreezeEvent(validator, &event)
+	if !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	actor := routes.auditActor(req, audit.ActorAdmin)
+	var events []*wallets.FreezeEvent
+	if forUser {
+		var owner *users.User
+		owner, err = routes.models.Users.GetByPublicId(routes.httpx.ReadIDParam(req))
+		if err != nil {
+			switch {
+			case errors.Is(err, constants.ErrRecordNotFound):
+				routes.httpx.NotFoundResponse(resWriter, req)
+			default:
+				routes.httpx.ServerErrorResponse(resWriter, req, err)
+			}
+			return
+		}
+		events, err = routes.models.Wallets.FreezeByUserId(owner.ID, event, actor)
+	} else {
+		events, err = routes.models.Wallets.FreezeByPublicId(routes.httpx.ReadIDParam(req), event, actor)
+	}
+
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	message := "wallets frozen successfully"
+	if action == wallets.FreezeActionUnfreeze {
+		message = "wallets unfrozen successfully"
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": message, "data": events},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) GetWalletFreezeEvents(resWriter http.ResponseWriter, req *http.Request) {
+	events, err := routes.models.Wallets.GetFreezeEvents(routes.httpx.ReadIDParam(req))
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "wallet freeze history fetched successfully", "data": events},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
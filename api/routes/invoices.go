@@ -0,0 +1,633 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/thesambayo/digillets-api/api/contexts"
+	"github.com/thesambayo/digillets-api/api/httpx"
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/currencies"
+	"github.com/thesambayo/digillets-api/internal/data/invoices"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/data/riskdecisions"
+	"github.com/thesambayo/digillets-api/internal/data/screenings"
+	"github.com/thesambayo/digillets-api/internal/data/transactions"
+	"github.com/thesambayo/digillets-api/internal/data/wallets"
+	"github.com/thesambayo/digillets-api/internal/money"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+type lineItemInput struct {
+	Description string       `json:"description"`
+	Quantity    int          `json:"quantity"`
+	UnitAmount  money.Amount `json:"unit_amount"`
+}
+
+func lineItems(input []lineItemInput) []*invoices.LineItem {
+	items := make([]*invoices.LineItem, len(input))
+	for i, item := range input {
+		items[i] = &invoices.LineItem{
+			Description: item.Description,
+			Quantity:    item.Quantity,
+			UnitAmount:  item.UnitAmount,
+		}
+	}
+	return items
+}
+
+// CreateInvoice creates a draft invoice for a customer identified by email. The
+// currency defaults to the one the merchant settles in.
+func (routes *Routes) CreateInvoice(resWriter http.ResponseWriter, req *http.Request) {
+	merchant, ok := routes.readMerchant(resWriter, req)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		CustomerEmail string          `json:"customer_email"`
+		Currency      string          `json:"currency"`
+		LineItems     []lineItemInput `json:"line_items"`
+		TaxRate       money.Amount    `json:"tax_rate"`
+		Memo          string          `json:"memo"`
+		DueDate       string          `json:"due_date"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	if input.Currency == "" {
+		input.Currency = merchant.Currency
+	}
+
+	invoice := &invoices.Invoice{
+		MerchantID:     merchant.ID,
+		Merchant:       merchant.PublicID,
+		MerchantName:   merchant.BusinessName,
+		MerchantUserID: merchant.UserID,
+		CustomerEmail:  input.CustomerEmail,
+		LineItems:      lineItems(input.LineItems),
+		TaxRate:        input.TaxRate,
+		Memo:           input.Memo,
+		DueDate:        input.DueDate,
+	}
+
+	currency, ok := routes.readInvoiceCurrency(resWriter, req, invoice, input.Currency)
+	if !ok {
+		return
+	}
+
+	validator := validators.New()
+	if invoices.ValidateInvoice(validator, invoice, *currency); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+	invoice.Price(*currency)
+
+	err = routes.models.Invoices.Insert(invoice, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusCreated,
+		httpx.Envelope{"message": "invoice created successfully, finalize it to send it to the customer", "data": invoice},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// GetInvoices lists the invoices the merchant created.
+func (routes *Routes) GetInvoices(resWriter http.ResponseWriter, req *http.Request) {
+	merchant, ok := routes.readMerchant(resWriter, req)
+	if !ok {
+		return
+	}
+
+	filters, ok := routes.readInvoiceFilters(resWriter, req, "customer_email", "invoices.customer_email")
+	if !ok {
+		return
+	}
+
+	merchantInvoices, metadata, err := routes.models.Invoices.GetAllForMerchant(merchant.ID, filters)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "invoices fetched successfully", "data": merchantInvoices, "metadata": metadata},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) GetInvoice(resWriter http.ResponseWriter, req *http.Request) {
+	invoice, ok := routes.readMerchantInvoice(resWriter, req)
+	if !ok {
+		return
+	}
+
+	err := routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "invoice fetched successfully", "data": invoice},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// UpdateInvoice edits a draft invoice. Line items, when given, replace the ones it
+// has.
+func (routes *Routes) UpdateInvoice(resWriter http.ResponseWriter, req *http.Request) {
+	invoice, ok := routes.readMerchantInvoice(resWriter, req)
+	if !ok {
+		return
+	}
+	if invoice.Status != invoices.StatusDraft {
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "only draft invoices can be edited")
+		return
+	}
+
+	var input struct {
+		CustomerEmail *string         `json:"customer_email"`
+		Currency      *string         `json:"currency"`
+		LineItems     []lineItemInput `json:"line_items"`
+		TaxRate       *money.Amount   `json:"tax_rate"`
+		Memo          *string         `json:"memo"`
+		DueDate       *string         `json:"due_date"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	before := *invoice
+	if input.CustomerEmail != nil {
+		invoice.CustomerEmail = *input.CustomerEmail
+	}
+	if input.LineItems != nil {
+		invoice.LineItems = lineItems(input.LineItems)
+	}
+	if input.TaxRate != nil {
+		invoice.TaxRate = *input.TaxRate
+	}
+	if input.Memo != nil {
+		invoice.Memo = *input.Memo
+	}
+	if input.DueDate != nil {
+		invoice.DueDate = *input.DueDate
+	}
+
+	currencyCode := invoice.Currency
+	if input.Currency != nil {
+		currencyCode = *input.Currency
+	}
+	currency, ok := routes.readInvoiceCurrency(resWriter, req, invoice, currencyCode)
+	if !ok {
+		return
+	}
+
+	validator := validators.New()
+	if invoices.ValidateInvoice(validator, invoice, *currency); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+	invoice.Price(*currency)
+
+	err = routes.models.Invoices.Update(&before, invoice, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrEditConflict):
+			routes.httpx.EditConflictResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "invoice updated successfully", "data": invoice},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// FinalizeInvoice opens a draft invoice for payment. The customer is emailed about
+// it by the next run of the reminders job.
+func (routes *Routes) FinalizeInvoice(resWriter http.ResponseWriter, req *http.Request) {
+	invoice, ok := routes.readMerchantInvoice(resWriter, req)
+	if !ok {
+		return
+	}
+
+	validator := validators.New()
+	if invoices.ValidateDueDate(validator, invoice.DueDate); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	err := routes.models.Invoices.Finalize(invoice, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrInvoiceNotDraft):
+			routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "only draft invoices can be finalized")
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "invoice finalized successfully", "data": invoice},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// VoidInvoice cancels an invoice nothing was paid on yet.
+func (routes *Routes) VoidInvoice(resWriter http.ResponseWriter, req *http.Request) {
+	invoice, ok := routes.readMerchantInvoice(resWriter, req)
+	if !ok {
+		return
+	}
+
+	err := routes.models.Invoices.Void(invoice, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrInvoiceNotVoidable):
+			routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "only unpaid invoices nothing was paid on can be voided")
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "invoice voided successfully", "data": invoice},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// GetReceivedInvoices lists the invoices sent to the user's email address.
+func (routes *Routes) GetReceivedInvoices(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	filters, ok := routes.readInvoiceFilters(resWriter, req, "merchant", "merchants.public_id")
+	if !ok {
+		return
+	}
+
+	received, metadata, err := routes.models.Invoices.GetAllForCustomer(user.Email, filters)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "invoices fetched successfully", "data": received, "metadata": metadata},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) GetReceivedInvoice(resWriter http.ResponseWriter, req *http.Request) {
+	invoice, ok := routes.readReceivedInvoice(resWriter, req)
+	if !ok {
+		return
+	}
+
+	err := routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "invoice fetched successfully", "data": invoice},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// PayInvoice pays towards an invoice sent to the user from one of their wallets,
+// what is left of it without an amount. The amount is in the invoice currency and
+// converted at the current rate when the wallet is in another. The payment goes
+// through approval and the risk rules like a transfer does, with what was already
+// paid of the invoice counted towards the approval threshold, and is made once
+// approved if the invoice still has that much due.
+func (routes *Routes) PayInvoice(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+	if user.ScreeningStatus == screenings.UserBlocked {
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusForbidden, "the payment was declined")
+		return
+	}
+	if routes.refuseTestKey(resWriter, req) {
+		return
+	}
+
+	invoice, ok := routes.readReceivedInvoice(resWriter, req)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Wallet string        `json:"wallet"`
+		Amount *money.Amount `json:"amount"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	amount := invoice.AmountDue
+	if input.Amount != nil {
+		amount = *input.Amount
+	}
+
+	validator := validators.New()
+	validator.Check(input.Wallet != "", "wallet", "must be one of your wallets e.g NGN or its public id")
+	validator.Check(invoice.MerchantUserID != user.ID, "wallet", "must not pay your own invoice")
+	if !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	payer, err := routes.models.Wallets.GetForUser(user.ID, input.Wallet)
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			validator.AddError("wallet", "must be one of your wallets e.g NGN or its public id")
+			routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	settlement, currency, err := routes.invoiceSettlement(invoice)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	currencies.ValidateAmount(validator, "amount", amount, *currency)
+	validator.Check(payer.Status != constants.WalletStatusClosed, "wallet", "must be an open wallet")
+	validator.Check(currency.Convert(amount, payer.Currency).IsPositive(), "amount", "is too small to pay in "+payer.Currency.Code)
+	if !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	// checked here too so that what cannot be paid is not sent for approval
+	switch {
+	case invoice.Status != invoices.StatusOpen && invoice.Status != invoices.StatusOverdue:
+		routes.invoicePaymentErrorResponse(resWriter, req, constants.ErrInvoiceNotPayable)
+		return
+	case amount.Cmp(invoice.AmountDue) > 0:
+		routes.invoicePaymentErrorResponse(resWriter, req, constants.ErrAmountExceedsInvoice)
+		return
+	}
+
+	payload := merchantPayment{
+		Kind:          paymentKindInvoice,
+		Merchant:      invoice.Merchant,
+		Wallet:        payer.PublicID,
+		Amount:        currency.Convert(amount, payer.Currency),
+		Invoice:       invoice.PublicID,
+		InvoiceAmount: amount,
+		Device:        deviceID(req),
+	}
+	paidBefore := invoice.AmountPaid.Div(currency.ExchangeRate, 4, money.DefaultRounding)
+	debit, execute := invoiceDebit(payload, invoice, *currency, payer, settlement, routes.auditActor(req, audit.ActorUser))
+	if !routes.payMerchant(resWriter, req, debit, paidBefore, payload, execute, routes.invoicePaymentErrorResponse) {
+		return
+	}
+	payment := invoice.Payments[len(invoice.Payments)-1]
+
+	message := "payment made successfully, the invoice is partly paid"
+	if invoice.Status == invoices.StatusPaid {
+		message = "payment made successfully, the invoice is paid"
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusCreated,
+		httpx.Envelope{"message": message, "data": invoice, "payment": payment},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// invoiceSettlement returns the wallet an invoice is paid into, the current
+// settlement wallet of its merchant, and the currency of the invoice.
+func (routes *Routes) invoiceSettlement(invoice *invoices.Invoice) (*wallets.Wallet, *currencies.Currency, error) {
+	merchant, err := routes.models.Payments.GetMerchant(invoice.Merchant)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	settlement, err := routes.models.Wallets.GetByPublicId(merchant.SettlementWallet)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	currency, err := routes.models.Currencies.GetCurrencyByCode(invoice.Currency)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return settlement, currency, nil
+}
+
+// invoiceDebit returns the debit of paying towards an invoice from payer for the
+// risk rules, and what pays it.
+func invoiceDebit(payload merchantPayment, invoice *invoices.Invoice, currency currencies.Currency, payer, settlement *wallets.Wallet, actor audit.Actor) (*riskdecisions.Debit, riskdecisions.Executor) {
+	debit := &riskdecisions.Debit{
+		TransactionType: transactions.TypePayment,
+		From:            payer,
+		To:              settlement,
+		BeneficiaryName: invoice.MerchantName,
+		Amount:          payload.Amount,
+		Hold:            payload.Amount,
+	}
+	execute := func(ctx context.Context, tx *sql.Tx) (string, error) {
+		payment, err := invoices.PayTx(ctx, tx, invoice, payload.InvoiceAmount, currency, payer, settlement, actor)
+		if err != nil {
+			return "", err
+		}
+		return payment.PublicID, nil
+	}
+	return debit, execute
+}
+
+// invoicePaymentDebit loads the invoice and wallets of the payload of an invoice
+// payment waiting for approval or review, see merchantPaymentDebit.
+func (routes *Routes) invoicePaymentDebit(payload merchantPayment, actor audit.Actor) (*riskdecisions.Debit, riskdecisions.Executor, error) {
+	invoice, err := routes.models.Invoices.GetByPublicId(payload.Invoice)
+	if err != nil {
+		return nil, nil, err
+	}
+	payer, err := routes.models.Wallets.GetByPublicId(payload.Wallet)
+	if err != nil {
+		return nil, nil, err
+	}
+	settlement, currency, err := routes.invoiceSettlement(invoice)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	debit, execute := invoiceDebit(payload, invoice, *currency, payer, settlement, actor)
+	return debit, execute, nil
+}
+
+// invoicePaymentErrorResponse sends the response for an error from paying towards an
+// invoice.
+func (routes *Routes) invoicePaymentErrorResponse(resWriter http.ResponseWriter, req *http.Request, err error) {
+	switch {
+	case errors.Is(err, constants.ErrInvoiceNotPayable):
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the invoice is already paid or was voided")
+	case errors.Is(err, constants.ErrAmountExceedsInvoice):
+		routes.httpx.FailedValidationResponse(resWriter, req, map[string]string{"amount": "must not be more than the amount due"})
+	case errors.Is(err, constants.ErrInsufficientFunds):
+		routes.httpx.FailedValidationResponse(resWriter, req, map[string]string{"wallet": "insufficient funds to cover the amount"})
+	default:
+		routes.transferErrorResponse(resWriter, req, err)
+	}
+}
+
+// readInvoiceCurrency sets the currency of an invoice from its code. When it returns
+// false the error response has already been sent.
+func (routes *Routes) readInvoiceCurrency(resWriter http.ResponseWriter, req *http.Request, invoice *invoices.Invoice, code string) (*currencies.Currency, bool) {
+	currency, err := routes.models.Currencies.GetCurrencyByCode(code)
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.FailedValidationResponse(resWriter, req, map[string]string{"currency": "must be a supported currency code e.g NGN"})
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return nil, false
+	}
+
+	invoice.CurrencyID = currency.ID
+	invoice.Currency = currency.Code
+	return currency, true
+}
+
+// readInvoiceFilters reads the filters of an invoice list, which can also be filtered
+// by the field naming the other party. When it returns false the error response has
+// already been sent.
+func (routes *Routes) readInvoiceFilters(resWriter http.ResponseWriter, req *http.Request, partyField, partyColumn string) (listing.Filters, bool) {
+	filters := listing.Filters{
+		Sort: "-created_at",
+		SortSafelist: map[string]string{
+			"created_at": "invoices.created_at",
+			"due_date":   "invoices.due_date",
+			"total":      "invoices.total",
+		},
+		FieldSafelist: map[string]string{
+			"status":   "invoices.status",
+			"currency": "currencies.code",
+			partyField: partyColumn,
+		},
+		IDColumn: "invoices.id",
+	}
+
+	validator := validators.New()
+	routes.httpx.ReadFilters(req.URL.Query(), &filters, validator)
+	if listing.Validate(validator, filters); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return filters, false
+	}
+
+	return filters, true
+}
+
+// readMerchantInvoice reads the invoice in the URL, which the user's merchant account
+// must have created. When it returns false the error response has already been sent.
+func (routes *Routes) readMerchantInvoice(resWriter http.ResponseWriter, req *http.Request) (*invoices.Invoice, bool) {
+	merchant, ok := routes.readMerchant(resWriter, req)
+	if !ok {
+		return nil, false
+	}
+
+	invoice, err := routes.models.Invoices.GetForMerchant(merchant.ID, routes.httpx.ReadIDParam(req))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return nil, false
+	}
+
+	return invoice, true
+}
+
+// readReceivedInvoice reads the invoice in the URL, which must have been sent to the
+// user's email address. When it returns false the error response has already been
+// sent.
+func (routes *Routes) readReceivedInvoice(resWriter http.ResponseWriter, req *http.Request) (*invoices.Invoice, bool) {
+	user := contexts.ContextGetUser(req)
+
+	invoice, err := routes.models.Invoices.GetForCustomer(user.Email, routes.httpx.ReadIDParam(req))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return nil, false
+	}
+
+	return invoice, true
+}
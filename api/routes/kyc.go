@@ -0,0 +1,309 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/thesambayo/digillets-api/api/contexts"
+	"github.com/thesambayo/digillets-api/api/httpx"
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/kyc"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/publicid"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// SubmitKYC receives a multipart/form-data submission of identity data, with the
+// tier, id_type, id_number and date_of_birth fields and a file field per document
+// kind, e.g id_front.
+func (routes *Routes) SubmitKYC(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	// room for every document at its largest, plus the other fields
+	req.Body = http.MaxBytesReader(resWriter, req.Body, int64(len(kyc.DocumentKinds)*kyc.MaxDocumentSize+1<<20))
+	err := req.ParseMultipartForm(8 << 20)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, errors.New("body must be multipart/form-data of at most 21MB"))
+		return
+	}
+	defer req.MultipartForm.RemoveAll()
+
+	validator := validators.New()
+
+	tier, err := strconv.Atoi(req.FormValue("tier"))
+	if err != nil {
+		tier = user.KYCTier + 1
+	}
+
+	publicID, err := publicid.New(constants.PrefixKYCSubmissionID)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	submission := &kyc.Submission{
+		PublicID:      publicID,
+		UserID:        user.ID,
+		User:          user.PublicID,
+		RequestedTier: tier,
+		IDType:        req.FormValue("id_type"),
+		IDNumber:      strings.TrimSpace(req.FormValue("id_number")),
+		DateOfBirth:   req.FormValue("date_of_birth"),
+	}
+
+	var uploads []kyc.Upload
+	for _, kind := range kyc.DocumentKinds {
+		file, _, err := req.FormFile(kind)
+		if err != nil {
+			if !errors.Is(err, http.ErrMissingFile) {
+				validator.AddError(kind, "must be a file")
+			}
+			continue
+		}
+
+		// read one byte more than allowed, so that a file that is too large is caught
+		data, err := io.ReadAll(io.LimitReader(file, kyc.MaxDocumentSize+1))
+		file.Close()
+		if err != nil {
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+			return
+		}
+
+		uploads = append(uploads, kyc.Upload{
+			Kind:        kind,
+			ContentType: http.DetectContentType(data),
+			Data:        data,
+		})
+	}
+
+	validator.Check(tier > user.KYCTier, "tier", "must be above your current tier")
+	if kyc.ValidateSubmission(validator, submission, uploads); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	err = routes.models.KYC.Insert(submission, uploads, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrPendingKYCSubmission):
+			routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "you already have a submission waiting for review")
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	// the response carries no personal data back
+	submission.IDNumber, submission.DateOfBirth = "", ""
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusCreated,
+		httpx.Envelope{"message": "kyc submitted successfully, it will be reviewed shortly", "data": submission},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) GetKYCSubmissions(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	submissions, err := routes.models.KYC.GetAllForUser(user.ID)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "kyc submissions fetched successfully", "data": submissions},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) GetAdminKYCSubmissions(resWriter http.ResponseWriter, req *http.Request) {
+	filters := listing.Filters{
+		Sort: "created_at",
+		SortSafelist: map[string]string{
+			"created_at": "kyc_submissions.created_at",
+		},
+		FieldSafelist: map[string]string{
+			"status":         "kyc_submissions.status",
+			"requested_tier": "kyc_submissions.requested_tier::text",
+			"user":           "users.public_id",
+		},
+		IDColumn: "kyc_submissions.id",
+	}
+
+	validator := validators.New()
+	routes.httpx.ReadFilters(req.URL.Query(), &filters, validator)
+	if listing.Validate(validator, filters); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	submissions, metadata, err := routes.models.KYC.GetAll(filters)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "kyc submissions fetched successfully", "data": submissions, "metadata": metadata},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) GetAdminKYCSubmission(resWriter http.ResponseWriter, req *http.Request) {
+	submission, ok := routes.readKYCSubmission(resWriter, req)
+	if !ok {
+		return
+	}
+
+	err := routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "kyc submission fetched successfully", "data": submission},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// GetAdminKYCDocument sends a document of a submission, decrypted.
+func (routes *Routes) GetAdminKYCDocument(resWriter http.ResponseWriter, req *http.Request) {
+	submission, ok := routes.readKYCSubmission(resWriter, req)
+	if !ok {
+		return
+	}
+
+	document, data, err := routes.models.KYC.OpenDocument(submission, req.PathValue("kind"))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	extension := ""
+	if extensions, _ := mime.ExtensionsByType(document.ContentType); len(extensions) > 0 {
+		extension = extensions[0]
+	}
+
+	resWriter.Header().Set("Content-Type", document.ContentType)
+	resWriter.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", submission.PublicID+"-"+document.Kind+extension))
+	resWriter.Header().Set("Cache-Control", "no-store")
+	resWriter.WriteHeader(http.StatusOK)
+	resWriter.Write(data)
+}
+
+func (routes *Routes) ApproveKYCSubmission(resWriter http.ResponseWriter, req *http.Request) {
+	routes.reviewKYCSubmission(resWriter, req, true)
+}
+
+func (routes *Routes) RejectKYCSubmission(resWriter http.ResponseWriter, req *http.Request) {
+	routes.reviewKYCSubmission(resWriter, req, false)
+}
+
+func (routes *Routes) reviewKYCSubmission(resWriter http.ResponseWriter, req *http.Request, approve bool) {
+	staff := contexts.ContextGetUser(req)
+
+	var input struct {
+		Reason string `json:"reason"`
+		Note   string `json:"note"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	review := kyc.Review{
+		Approve:    approve,
+		Reason:     input.Reason,
+		Note:       input.Note,
+		ReviewerID: staff.ID,
+	}
+
+	validator := validators.New()
+	if kyc.ValidateReview(validator, &review); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	submission, ok := routes.readKYCSubmission(resWriter, req)
+	if !ok {
+		return
+	}
+
+	err = routes.models.KYC.Review(submission, review, routes.auditActor(req, audit.ActorAdmin))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrKYCAlreadyReviewed):
+			routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the submission has already been reviewed")
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	message := "kyc submission rejected successfully"
+	if approve {
+		message = "kyc submission approved successfully"
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": message, "data": submission},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// readKYCSubmission fetches the submission in the url. When it returns false the
+// error response has already been sent.
+func (routes *Routes) readKYCSubmission(resWriter http.ResponseWriter, req *http.Request) (*kyc.Submission, bool) {
+	submission, err := routes.models.KYC.GetByPublicId(routes.httpx.ReadIDParam(req))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return nil, false
+	}
+	return submission, true
+}
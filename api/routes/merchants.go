@@ -0,0 +1,496 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/thesambayo/digillets-api/api/contexts"
+	"github.com/thesambayo/digillets-api/api/httpx"
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/data/payments"
+	"github.com/thesambayo/digillets-api/internal/money"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// CreateMerchant makes the user a merchant who can collect payments into one of
+// their wallets.
+func (routes *Routes) CreateMerchant(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	var input struct {
+		BusinessName     string `json:"business_name"`
+		BusinessEmail    string `json:"business_email"`
+		Website          string `json:"website"`
+		SettlementWallet string `json:"settlement_wallet"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	merchant := &payments.Merchant{
+		UserID:        user.ID,
+		BusinessName:  input.BusinessName,
+		BusinessEmail: input.BusinessEmail,
+		Website:       input.Website,
+	}
+
+	validator := validators.New()
+	payments.ValidateMerchant(validator, merchant)
+	if !routes.readSettlementWallet(resWriter, req, merchant, input.SettlementWallet, validator) {
+		return
+	}
+	if !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	err = routes.models.Payments.InsertMerchant(merchant, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrDuplicateMerchant):
+			routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "you already have a merchant account")
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusCreated,
+		httpx.Envelope{"message": "merchant account created successfully", "data": merchant},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) GetMerchant(resWriter http.ResponseWriter, req *http.Request) {
+	merchant, ok := routes.readMerchant(resWriter, req)
+	if !ok {
+		return
+	}
+
+	err := routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "merchant account fetched successfully", "data": merchant},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) UpdateMerchant(resWriter http.ResponseWriter, req *http.Request) {
+	merchant, ok := routes.readMerchant(resWriter, req)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		BusinessName     *string `json:"business_name"`
+		BusinessEmail    *string `json:"business_email"`
+		Website          *string `json:"website"`
+		SettlementWallet *string `json:"settlement_wallet"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	before := *merchant
+	if input.BusinessName != nil {
+		merchant.BusinessName = *input.BusinessName
+	}
+	if input.BusinessEmail != nil {
+		merchant.BusinessEmail = *input.BusinessEmail
+	}
+	if input.Website != nil {
+		merchant.Website = *input.Website
+	}
+
+	validator := validators.New()
+	payments.ValidateMerchant(validator, merchant)
+	if input.SettlementWallet != nil && !routes.readSettlementWallet(resWriter, req, merchant, *input.SettlementWallet, validator) {
+		return
+	}
+	if !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	err = routes.models.Payments.UpdateMerchant(&before, merchant, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrEditConflict):
+			routes.httpx.EditConflictResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "merchant account updated successfully", "data": merchant},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// readSettlementWallet sets the settlement wallet of a merchant to one of the user's
+// open wallets, adding a validation error when it is not one. When it returns false
+// the error response has already been sent.
+func (routes *Routes) readSettlementWallet(resWriter http.ResponseWriter, req *http.Request, merchant *payments.Merchant, idOrCurrencyCode string, validator *validators.Validator) bool {
+	if idOrCurrencyCode == "" {
+		validator.AddError("settlement_wallet", "must be one of your wallets e.g NGN or its public id")
+		return true
+	}
+
+	wallet, err := routes.models.Wallets.GetForUser(merchant.UserID, idOrCurrencyCode)
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			validator.AddError("settlement_wallet", "must be one of your wallets e.g NGN or its public id")
+			return true
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+			return false
+		}
+	}
+
+	validator.Check(wallet.Status != constants.WalletStatusClosed, "settlement_wallet", "must be an open wallet")
+	merchant.SettlementWalletID = wallet.ID
+	merchant.SettlementWallet = wallet.PublicID
+	merchant.Currency = wallet.Currency.Code
+	return true
+}
+
+// readMerchant reads the merchant account of the user. When it returns false the
+// error response has already been sent.
+func (routes *Routes) readMerchant(resWriter http.ResponseWriter, req *http.Request) (*payments.Merchant, bool) {
+	user := contexts.ContextGetUser(req)
+
+	merchant, err := routes.models.Payments.GetMerchantForUser(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.ErrorResponse(resWriter, req, http.StatusNotFound, "you do not have a merchant account")
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return nil, false
+	}
+
+	return merchant, true
+}
+
+// GetMerchantPayments lists the payments the merchant collected. from and to accept
+// a date (2006-01-02) or an RFC3339 time and default to the last 30 days.
+func (routes *Routes) GetMerchantPayments(resWriter http.ResponseWriter, req *http.Request) {
+	merchant, ok := routes.readMerchant(resWriter, req)
+	if !ok {
+		return
+	}
+
+	filters := listing.Filters{
+		Sort: "-created_at",
+		SortSafelist: map[string]string{
+			"created_at": "payments.created_at",
+			"amount":     "payments.amount",
+		},
+		FieldSafelist: map[string]string{
+			"status":          "payments.status",
+			"customer_wallet": "wallets.public_id",
+			"currency":        "currencies.code",
+		},
+		IDColumn: "payments.id",
+	}
+
+	now := time.Now().UTC()
+	queryString := req.URL.Query()
+	validator := validators.New()
+	from := readStatementTime(queryString.Get("from"), "from", now.AddDate(0, 0, -30), false, validator)
+	to := readStatementTime(queryString.Get("to"), "to", now, true, validator)
+	validator.Check(!from.After(to), "from", "must not be after to")
+	routes.httpx.ReadFilters(queryString, &filters, validator)
+	if listing.Validate(validator, filters); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	merchantPayments, metadata, err := routes.models.Payments.GetPayments(merchant.ID, from, to, filters)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "payments fetched successfully", "data": merchantPayments, "metadata": metadata},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) GetMerchantPayment(resWriter http.ResponseWriter, req *http.Request) {
+	payment, ok := routes.readMerchantPayment(resWriter, req)
+	if !ok {
+		return
+	}
+
+	err := routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "payment fetched successfully", "data": payment},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// CapturePayment captures an authorized payment, in full or, given an amount, in
+// part. What is not captured goes back to the customer.
+func (routes *Routes) CapturePayment(resWriter http.ResponseWriter, req *http.Request) {
+	if routes.refuseTestKey(resWriter, req) {
+		return
+	}
+
+	payment, ok := routes.readMerchantPayment(resWriter, req)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Amount *money.Amount `json:"amount"`
+	}
+
+	// the body is optional, an empty one captures the whole payment
+	if req.ContentLength != 0 {
+		err := routes.httpx.ReadJSON(resWriter, req, &input)
+		if err != nil {
+			routes.httpx.BadRequestResponse(resWriter, req, err)
+			return
+		}
+	}
+
+	amount := payment.Amount
+	if input.Amount != nil {
+		amount = *input.Amount
+	}
+
+	validator := validators.New()
+	validator.Check(amount.IsPositive(), "amount", "must be greater than zero")
+	validator.Check(amount.Cmp(payment.Amount) <= 0, "amount", "must not be more than the payment amount")
+	if !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	err := routes.models.Payments.Capture(payment, amount, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		routes.paymentErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "payment captured successfully", "data": payment},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// VoidPayment cancels an authorized payment, releasing the customer's funds.
+func (routes *Routes) VoidPayment(resWriter http.ResponseWriter, req *http.Request) {
+	payment, ok := routes.readMerchantPayment(resWriter, req)
+	if !ok {
+		return
+	}
+
+	err := routes.models.Payments.Void(payment, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		routes.paymentErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "payment voided successfully", "data": payment},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// RefundPayment refunds a captured payment. Without an amount it refunds what is
+// left of it, several partial refunds can be made up to the captured amount.
+func (routes *Routes) RefundPayment(resWriter http.ResponseWriter, req *http.Request) {
+	if routes.refuseTestKey(resWriter, req) {
+		return
+	}
+
+	payment, ok := routes.readMerchantPayment(resWriter, req)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Amount *money.Amount `json:"amount"`
+		Reason string        `json:"reason"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	refund := &payments.Refund{
+		Amount: payment.CapturedAmount.Sub(payment.RefundedAmount),
+		Reason: input.Reason,
+	}
+	if input.Amount != nil {
+		refund.Amount = *input.Amount
+	}
+
+	validator := validators.New()
+	validator.Check(refund.Amount.IsPositive(), "amount", "must be greater than zero")
+	validator.Check(len(refund.Reason) <= 255, "reason", "must not be more than 255 characters long")
+	if !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	err = routes.models.Payments.Refund(payment, refund, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		routes.paymentErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusCreated,
+		httpx.Envelope{"message": "payment refunded successfully", "data": payment},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// GetSettlements sums up what the merchant was paid and refunded each day, per
+// currency. from and to accept a date (2006-01-02) or an RFC3339 time and default to
+// the last 30 days.
+func (routes *Routes) GetSettlements(resWriter http.ResponseWriter, req *http.Request) {
+	merchant, ok := routes.readMerchant(resWriter, req)
+	if !ok {
+		return
+	}
+
+	now := time.Now().UTC()
+	queryString := req.URL.Query()
+	validator := validators.New()
+	from := readStatementTime(queryString.Get("from"), "from", now.AddDate(0, 0, -30), false, validator)
+	to := readStatementTime(queryString.Get("to"), "to", now, true, validator)
+	validator.Check(!from.After(to), "from", "must not be after to")
+	validator.Check(to.Sub(from) <= 366*24*time.Hour, "from", "must not be more than a year before to")
+	if !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	settlements, err := routes.models.Payments.GetSettlements(merchant.ID, from, to)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "settlements fetched successfully", "data": settlements},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// readMerchantPayment reads the payment in the URL, which the user's merchant account
+// must have collected. When it returns false the error response has already been sent.
+func (routes *Routes) readMerchantPayment(resWriter http.ResponseWriter, req *http.Request) (*payments.Payment, bool) {
+	merchant, ok := routes.readMerchant(resWriter, req)
+	if !ok {
+		return nil, false
+	}
+
+	payment, err := routes.models.Payments.GetPaymentForMerchant(merchant.ID, routes.httpx.ReadIDParam(req))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return nil, false
+	}
+
+	return payment, true
+}
+
+// paymentErrorResponse sends the response for an error from authorizing, capturing,
+// voiding or refunding a payment.
+func (routes *Routes) paymentErrorResponse(resWriter http.ResponseWriter, req *http.Request, err error) {
+	switch {
+	case errors.Is(err, constants.ErrPaymentNotAuthorized):
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the payment is not authorized, it was already captured, voided or expired")
+	case errors.Is(err, constants.ErrAuthorizationExpired):
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the payment authorization expired")
+	case errors.Is(err, constants.ErrPaymentNotRefundable):
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "only captured payments that are not fully refunded can be refunded")
+	case errors.Is(err, constants.ErrAmountExceedsPayment):
+		routes.httpx.FailedValidationResponse(resWriter, req, map[string]string{"amount": "must not be more than what is left of the payment"})
+	case errors.Is(err, constants.ErrInsufficientFunds):
+		routes.httpx.FailedValidationResponse(resWriter, req, map[string]string{"amount": "insufficient funds to cover the amount"})
+	case errors.Is(err, constants.ErrSessionNotOpen):
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the checkout session was already paid or expired")
+	case errors.Is(err, constants.ErrInvoiceNotPayable):
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the invoice is already paid or was voided")
+	case errors.Is(err, constants.ErrAmountExceedsInvoice):
+		routes.httpx.FailedValidationResponse(resWriter, req, map[string]string{"amount": "must not be more than the amount due"})
+	default:
+		routes.transferErrorResponse(resWriter, req, err)
+	}
+}
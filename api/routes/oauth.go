@@ -0,0 +1,586 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pascaldekloe/jwt"
+	"github.com/thesambayo/digillets-api/api/contexts"
+	"github.com/thesambayo/digillets-api/api/httpx"
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/oauth"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// rxCodeVerifier matches a PKCE code verifier, and the S256 challenge of one.
+var rxCodeVerifier = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+func (routes *Routes) CreateOAuthClient(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	var input struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Confidential bool     `json:"confidential"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	client := &oauth.Client{
+		UserID:       user.ID,
+		Name:         input.Name,
+		RedirectURIs: input.RedirectURIs,
+		Confidential: input.Confidential,
+	}
+
+	validator := validators.New()
+	if oauth.ValidateClient(validator, client, routes.config.Env == "development"); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	err = routes.models.OAuth.InsertClient(client, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	message := "oauth client registered successfully"
+	if client.Confidential {
+		message += ", keep the client secret safe as it will not be shown again"
+	}
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusCreated,
+		httpx.Envelope{"message": message, "data": client},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) GetOAuthClients(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	clients, err := routes.models.OAuth.GetClientsForUser(user.ID)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "oauth clients fetched successfully", "data": clients},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// RevokeOAuthClient revokes a client the user registered, ending the access every
+// user gave it.
+func (routes *Routes) RevokeOAuthClient(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	client, err := routes.models.OAuth.GetClientForUser(user.ID, routes.httpx.ReadIDParam(req))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	err = routes.models.OAuth.RevokeClient(client, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "oauth client revoked successfully", "data": client},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// authorizationRequest holds the parameters of an OAuth authorization request.
+type authorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// GetOAuthConsent checks the authorization request in the query string an app sent
+// the user with, and returns what to show on the consent screen: the app and what
+// it asks to be allowed to do.
+func (routes *Routes) GetOAuthConsent(resWriter http.ResponseWriter, req *http.Request) {
+	queryString := req.URL.Query()
+	input := authorizationRequest{
+		ResponseType:        queryString.Get("response_type"),
+		ClientID:            queryString.Get("client_id"),
+		RedirectURI:         queryString.Get("redirect_uri"),
+		Scope:               queryString.Get("scope"),
+		State:               queryString.Get("state"),
+		CodeChallenge:       queryString.Get("code_challenge"),
+		CodeChallengeMethod: queryString.Get("code_challenge_method"),
+	}
+
+	authorization, ok := routes.readAuthorization(resWriter, req, input)
+	if !ok {
+		return
+	}
+
+	scopes := make([]map[string]string, 0, len(authorization.Scopes))
+	for _, scope := range authorization.Scopes {
+		scopes = append(scopes, map[string]string{"scope": scope, "description": oauth.Scopes[scope]})
+	}
+	consent := map[string]interface{}{
+		"client": map[string]string{
+			"client_id": authorization.Client.PublicID,
+			"name":      authorization.Client.Name,
+		},
+		"redirect_uri": authorization.RedirectURI,
+		"scopes":       scopes,
+		"state":        input.State,
+	}
+
+	err := routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "authorization request is valid", "data": consent},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// Authorize records the answer of the user to an authorization request, and
+// returns where to send the user back to the app: with a code to exchange for
+// tokens when the user approved, or with an access_denied error otherwise.
+func (routes *Routes) Authorize(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	var input struct {
+		authorizationRequest
+		Approve bool `json:"approve"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	authorization, ok := routes.readAuthorization(resWriter, req, input.authorizationRequest)
+	if !ok {
+		return
+	}
+	authorization.UserID = user.ID
+
+	params := url.Values{}
+	if input.Approve {
+		code, err := routes.models.OAuth.CreateCode(authorization, routes.auditActor(req, audit.ActorUser))
+		if err != nil {
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+			return
+		}
+		params.Set("code", code)
+	} else {
+		params.Set("error", "access_denied")
+		params.Set("error_description", "the user denied the request")
+	}
+	if input.State != "" {
+		params.Set("state", input.State)
+	}
+
+	// the redirect uri was checked against those registered, so it parses
+	redirect, _ := url.Parse(authorization.RedirectURI)
+	query := redirect.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	redirect.RawQuery = query.Encode()
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "authorization request answered", "data": map[string]string{"redirect_uri": redirect.String()}},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// readAuthorization checks an authorization request. PKCE with S256 is required of
+// every client. When it returns false the error response has already been sent.
+func (routes *Routes) readAuthorization(resWriter http.ResponseWriter, req *http.Request, input authorizationRequest) (*oauth.Authorization, bool) {
+	validator := validators.New()
+
+	client, err := routes.models.OAuth.GetClient(input.ClientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			validator.AddError("client_id", "must be the client id of a registered app")
+			routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return nil, false
+	}
+
+	// the redirect uri can be left out by clients that registered a single one
+	redirectURI := input.RedirectURI
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+
+	var scopes []string
+	for _, scope := range strings.Fields(input.Scope) {
+		if !validators.In(scope, scopes...) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	validator.Check(client.HasRedirectURI(redirectURI), "redirect_uri", "must be one of the redirect uris registered for the app")
+	validator.Check(input.ResponseType == "code", "response_type", "must be code")
+	validator.Check(len(scopes) != 0, "scope", "must contain at least one scope")
+	for _, scope := range scopes {
+		_, ok := oauth.Scopes[scope]
+		validator.Check(ok, "scope", "must only contain wallets:read or transfers:write")
+	}
+	validator.Check(len(input.State) <= 500, "state", "must not be more than 500 characters long")
+	validator.Check(validators.Matches(input.CodeChallenge, rxCodeVerifier), "code_challenge", "must be the S256 challenge of a PKCE code verifier")
+	validator.Check(input.CodeChallengeMethod == "S256", "code_challenge_method", "must be S256")
+
+	if !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return nil, false
+	}
+
+	return &oauth.Authorization{
+		Client:        client,
+		RedirectURI:   redirectURI,
+		Scopes:        scopes,
+		CodeChallenge: input.CodeChallenge,
+	}, true
+}
+
+// IssueOAuthToken is the token endpoint of RFC 6749. It exchanges an authorization
+// code, along with its PKCE verifier, or a refresh token for an access token and
+// a new refresh token. Confidential clients authenticate with their secret.
+func (routes *Routes) IssueOAuthToken(resWriter http.ResponseWriter, req *http.Request) {
+	client, ok := routes.authenticateOAuthClient(resWriter, req, false)
+	if !ok {
+		return
+	}
+
+	var (
+		grant        *oauth.Grant
+		refreshToken string
+		err          error
+	)
+	switch req.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code := req.PostForm.Get("code")
+		verifier := req.PostForm.Get("code_verifier")
+		if code == "" || !validators.Matches(verifier, rxCodeVerifier) {
+			routes.oauthErrorResponse(resWriter, req, http.StatusBadRequest, "invalid_request", "code and a valid code_verifier must be provided")
+			return
+		}
+		redirectURI := req.PostForm.Get("redirect_uri")
+		if redirectURI == "" && len(client.RedirectURIs) == 1 {
+			redirectURI = client.RedirectURIs[0]
+		}
+		grant, refreshToken, err = routes.models.OAuth.ExchangeCode(client, code, redirectURI, verifier)
+	case "refresh_token":
+		grant, refreshToken, err = routes.models.OAuth.Refresh(client, req.PostForm.Get("refresh_token"))
+	default:
+		routes.oauthErrorResponse(resWriter, req, http.StatusBadRequest, "unsupported_grant_type", "grant_type must be authorization_code or refresh_token")
+		return
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrInvalidGrant):
+			routes.oauthErrorResponse(resWriter, req, http.StatusBadRequest, "invalid_grant", "the code or refresh token is invalid, expired or revoked")
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	accessToken, err := routes.signAccessToken(grant)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+	headers.Set("Pragma", "no-cache")
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{
+			"access_token":  accessToken,
+			"token_type":    "Bearer",
+			"expires_in":    int(oauth.AccessTokenTTL.Seconds()),
+			"refresh_token": refreshToken,
+			"scope":         strings.Join(grant.Scopes, " "),
+		},
+		headers,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// IntrospectOAuthToken is the introspection endpoint of RFC 7662, for confidential
+// clients to check an access or refresh token they were issued. Tokens of other
+// clients are reported as inactive.
+func (routes *Routes) IntrospectOAuthToken(resWriter http.ResponseWriter, req *http.Request) {
+	client, ok := routes.authenticateOAuthClient(resWriter, req, true)
+	if !ok {
+		return
+	}
+
+	token := req.PostForm.Get("token")
+	if token == "" {
+		routes.oauthErrorResponse(resWriter, req, http.StatusBadRequest, "invalid_request", "token must be provided")
+		return
+	}
+
+	introspection := httpx.Envelope{"active": false}
+
+	// the hint only decides what the token is tried as first
+	kinds := []string{"access_token", "refresh_token"}
+	if req.PostForm.Get("token_type_hint") == "refresh_token" {
+		kinds = []string{"refresh_token", "access_token"}
+	}
+	for _, kind := range kinds {
+		var (
+			grant     *oauth.Grant
+			expiresAt time.Time
+			issuedAt  time.Time
+			err       error
+		)
+		switch kind {
+		case "access_token":
+			claims, checkErr := jwt.HMACCheck([]byte(token), []byte(routes.config.Jwt.Secret))
+			if checkErr != nil || !claims.Valid(time.Now()) {
+				continue
+			}
+			if clientID, _ := claims.Set["client_id"].(string); clientID != client.PublicID {
+				continue
+			}
+			grant, err = routes.models.OAuth.GetGrant(claims.ID)
+			if err == nil && grant.UserPublicID != claims.Subject {
+				continue
+			}
+			expiresAt, issuedAt = claims.Expires.Time(), claims.Issued.Time()
+		case "refresh_token":
+			grant, err = routes.models.OAuth.GetGrantByRefreshToken(token)
+			if err == nil {
+				expiresAt, issuedAt = grant.RefreshExpiresAt, grant.UpdatedAt
+			}
+		}
+		if err != nil {
+			switch {
+			case errors.Is(err, constants.ErrRecordNotFound):
+				continue
+			default:
+				routes.httpx.ServerErrorResponse(resWriter, req, err)
+				return
+			}
+		}
+		if grant.ClientID != client.ID {
+			continue
+		}
+
+		introspection = httpx.Envelope{
+			"active":     true,
+			"scope":      strings.Join(grant.Scopes, " "),
+			"client_id":  grant.ClientPublicID,
+			"sub":        grant.UserPublicID,
+			"token_type": kind,
+			"exp":        expiresAt.Unix(),
+			"iat":        issuedAt.Unix(),
+		}
+		break
+	}
+
+	err := routes.httpx.WriteJSON(resWriter, http.StatusOK, introspection, nil)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// authenticateOAuthClient reads the form of a request to the token or introspection
+// endpoint and returns the client making it. Clients send their credentials with
+// HTTP Basic authentication or in the form; confidential clients must send their
+// secret, and so must every client when requireSecret is true. When it returns
+// false the error response has already been sent.
+func (routes *Routes) authenticateOAuthClient(resWriter http.ResponseWriter, req *http.Request, requireSecret bool) (*oauth.Client, bool) {
+	req.Body = http.MaxBytesReader(resWriter, req.Body, 1_048_576)
+	if err := req.ParseForm(); err != nil {
+		routes.oauthErrorResponse(resWriter, req, http.StatusBadRequest, "invalid_request", "the body must be form encoded")
+		return nil, false
+	}
+
+	clientID, secret, basic := req.BasicAuth()
+	if basic {
+		// credentials in the header are form encoded first
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = req.PostForm.Get("client_id")
+		secret = req.PostForm.Get("client_secret")
+	}
+
+	invalidClient := func() {
+		if basic {
+			resWriter.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+		routes.oauthErrorResponse(resWriter, req, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+	}
+
+	client, err := routes.models.OAuth.GetClient(clientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			invalidClient()
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return nil, false
+	}
+
+	if (client.Confidential || requireSecret) && !client.Authenticate(secret) {
+		invalidClient()
+		return nil, false
+	}
+
+	return client, true
+}
+
+// signAccessToken returns an access token for a grant. It is a JWT like the ones
+// users sign in with, which also carries the grant, the client and the scopes.
+func (routes *Routes) signAccessToken(grant *oauth.Grant) (string, error) {
+	now := time.Now()
+
+	var claims jwt.Claims
+	claims.Subject = grant.UserPublicID
+	claims.ID = grant.PublicID
+	claims.Issued = jwt.NewNumericTime(now)
+	claims.NotBefore = jwt.NewNumericTime(now)
+	claims.Expires = jwt.NewNumericTime(now.Add(oauth.AccessTokenTTL))
+	claims.Set = map[string]interface{}{
+		"client_id": grant.ClientPublicID,
+		"scope":     strings.Join(grant.Scopes, " "),
+	}
+
+	jwtBytes, err := claims.HMACSign(jwt.HS256, []byte(routes.config.Jwt.Secret))
+	if err != nil {
+		return "", err
+	}
+	return string(jwtBytes), nil
+}
+
+// oauthErrorResponse sends an error in the format of RFC 6749, which clients of
+// the token endpoint expect rather than the usual one.
+func (routes *Routes) oauthErrorResponse(resWriter http.ResponseWriter, req *http.Request, status int, code, description string) {
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+
+	err := routes.httpx.WriteJSON(resWriter, status, httpx.Envelope{"error": code, "error_description": description}, headers)
+	if err != nil {
+		routes.httpx.LogError(req, err)
+		resWriter.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// GetOAuthGrants returns the apps the user gave access to.
+func (routes *Routes) GetOAuthGrants(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	grants, err := routes.models.OAuth.GetGrantsForUser(user.ID)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "authorized apps fetched successfully", "data": grants},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// RevokeOAuthGrant takes back the access the user gave an app.
+func (routes *Routes) RevokeOAuthGrant(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	grant, err := routes.models.OAuth.GetGrantForUser(user.ID, routes.httpx.ReadIDParam(req))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	err = routes.models.OAuth.RevokeGrant(grant, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "app access revoked successfully", "data": grant},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
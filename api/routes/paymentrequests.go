@@ -0,0 +1,441 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/thesambayo/digillets-api/api/contexts"
+	"github.com/thesambayo/digillets-api/api/httpx"
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/approvals"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/currencies"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/data/paymentrequests"
+	"github.com/thesambayo/digillets-api/internal/data/screenings"
+	"github.com/thesambayo/digillets-api/internal/data/transactions"
+	"github.com/thesambayo/digillets-api/internal/data/transfers"
+	"github.com/thesambayo/digillets-api/internal/money"
+	"github.com/thesambayo/digillets-api/internal/pricing"
+	"github.com/thesambayo/digillets-api/internal/risk"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// CreatePaymentRequest asks someone, by email, for money paid into one of the user's
+// wallets, by default their wallet in the currency asked for. The response is the
+// same whether or not a user has the email, so it cannot be used to find out.
+func (routes *Routes) CreatePaymentRequest(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	var input struct {
+		PayerEmail string       `json:"payer_email"`
+		Amount     money.Amount `json:"amount"`
+		Currency   string       `json:"currency"`
+		Wallet     string       `json:"wallet"`
+		Note       string       `json:"note"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	validator := validators.New()
+	validator.Check(validators.Matches(input.PayerEmail, validators.EmailREGEX), "payer_email", "must be a valid email address")
+	validator.Check(input.Currency != "" || input.Wallet != "", "currency", "must be provided e.g NGN")
+	paymentrequests.ValidateNote(validator, input.Note)
+	if !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	field, key := "currency", input.Currency
+	if input.Wallet != "" {
+		field, key = "wallet", input.Wallet
+	}
+	wallet, err := routes.models.Wallets.GetForUser(user.ID, key)
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			validator.AddError(field, "must be one of your wallets e.g NGN or its public id")
+			routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	if input.Currency != "" {
+		validator.Check(wallet.Currency.Code == input.Currency, "wallet", "must be in the currency asked for")
+	}
+	currencies.ValidateAmount(validator, "amount", input.Amount, wallet.Currency)
+	validator.Check(wallet.Status != constants.WalletStatusClosed, "wallet", "must be an open wallet")
+	validator.Check(!strings.EqualFold(input.PayerEmail, user.Email), "payer_email", "must not be your own email address")
+	if !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	request := &paymentrequests.PaymentRequest{
+		RequesterID:   user.ID,
+		Requester:     user.PublicID,
+		RequesterName: user.Name,
+		PayerEmail:    input.PayerEmail,
+		WalletID:      wallet.ID,
+		Wallet:        wallet.PublicID,
+		Amount:        wallet.Currency.Round(input.Amount),
+		Currency:      wallet.Currency.Code,
+		Note:          input.Note,
+		ExpiresAt:     time.Now().Add(routes.config.PaymentRequests.TTL),
+	}
+
+	err = routes.models.PaymentRequests.Insert(request, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusCreated,
+		httpx.Envelope{"message": "payment request sent successfully", "data": request},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// GetIncomingPaymentRequests lists the requests the user was asked to pay.
+func (routes *Routes) GetIncomingPaymentRequests(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	filters, ok := routes.readPaymentRequestFilters(resWriter, req, "requester", "requesters.public_id")
+	if !ok {
+		return
+	}
+
+	requests, metadata, err := routes.models.PaymentRequests.GetAllIncoming(user.Email, filters)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "payment requests fetched successfully", "data": requests, "metadata": metadata},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// GetOutgoingPaymentRequests lists the requests the user made.
+func (routes *Routes) GetOutgoingPaymentRequests(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	filters, ok := routes.readPaymentRequestFilters(resWriter, req, "payer_email", "payment_requests.payer_email")
+	if !ok {
+		return
+	}
+
+	requests, metadata, err := routes.models.PaymentRequests.GetAllOutgoing(user.ID, filters)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "payment requests fetched successfully", "data": requests, "metadata": metadata},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// GetPaymentRequest returns a request the user made or was asked to pay.
+func (routes *Routes) GetPaymentRequest(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	request, ok := routes.readPaymentRequest(resWriter, req, func(publicID string) (*paymentrequests.PaymentRequest, error) {
+		return routes.models.PaymentRequests.Get(user.ID, user.Email, publicID)
+	})
+	if !ok {
+		return
+	}
+
+	err := routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "payment request fetched successfully", "data": request},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// AcceptPaymentRequest pays a request the user was asked to pay with a transfer from
+// one of their wallets in its currency, by default their wallet in it. The transfer
+// is priced and goes through approval and the risk rules as if the user made it; a
+// request whose transfer waits on either is processing until it is decided.
+func (routes *Routes) AcceptPaymentRequest(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+	if user.ScreeningStatus == screenings.UserBlocked {
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusForbidden, "the transfer was declined")
+		return
+	}
+	if routes.refuseTestKey(resWriter, req) {
+		return
+	}
+
+	request, ok := routes.readPaymentRequest(resWriter, req, func(publicID string) (*paymentrequests.PaymentRequest, error) {
+		return routes.models.PaymentRequests.GetIncoming(user.Email, publicID)
+	})
+	if !ok {
+		return
+	}
+
+	var input struct {
+		FromWallet string `json:"from_wallet"`
+	}
+
+	// the body is optional, an empty one pays from the wallet in the request currency
+	if req.ContentLength != 0 {
+		err := routes.httpx.ReadJSON(resWriter, req, &input)
+		if err != nil {
+			routes.httpx.BadRequestResponse(resWriter, req, err)
+			return
+		}
+	}
+	if input.FromWallet == "" {
+		input.FromWallet = request.Currency
+	}
+
+	validator := validators.New()
+	from, err := routes.models.Wallets.GetForUser(user.ID, input.FromWallet)
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			validator.AddError("from_wallet", "must be one of your wallets in "+request.Currency)
+			routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	to, err := routes.models.Wallets.GetByPublicId(request.Wallet)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	validator.Check(from.Currency.Code == request.Currency, "from_wallet", "must be one of your wallets in "+request.Currency)
+	validator.Check(from.Status != constants.WalletStatusClosed, "from_wallet", "must be an open wallet")
+	validator.Check(to.Status != constants.WalletStatusClosed, "from_wallet", "cannot pay into the requester's wallet, it is closed")
+	if !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	rules, err := routes.models.Fees.GetRules(transactions.TypeTransfer, from.Currency.Code)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+	rule := pricing.Match(rules, transactions.TypeTransfer, from.Currency.Code, user.KYCTier)
+	transfer := transfers.New(from, to, request.Amount, "Payment request "+request.PublicID, rule)
+
+	approval, err := routes.transferApproval(req, transfer)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	actor := routes.auditActor(req, audit.ActorUser)
+	message := "payment request accepted, the transfer was made successfully"
+	execute := func(ctx context.Context, tx *sql.Tx) (string, error) {
+		if approval != nil {
+			if err := approvals.CreateTx(ctx, tx, approval, transfer.Fee.TotalDebit, actor); err != nil {
+				return "", err
+			}
+			message = "payment request is processing, the transfer is waiting for approval, its funds are held until then"
+			return approval.PublicID, nil
+		}
+
+		decision, err := routes.models.RiskDecisions.CreateTransferTx(ctx, tx, transfer, deviceID(req), actor)
+		if err != nil {
+			return "", err
+		}
+		// the rules that fired are kept from the user
+		switch decision.Outcome {
+		case risk.OutcomeBlock:
+			return "", nil
+		case risk.OutcomeReview:
+			message = "payment request is processing, the transfer is under review, its funds are held until then"
+			return decision.PublicID, nil
+		}
+		return transfer.PublicID, nil
+	}
+
+	err = routes.models.PaymentRequests.Accept(request, actor, execute)
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrTransferDeclined):
+			routes.httpx.ErrorResponse(resWriter, req, http.StatusForbidden, "the transfer was declined")
+		default:
+			routes.paymentRequestErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": message, "data": request, "transfer": transfer},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// DeclinePaymentRequest declines a request the user was asked to pay.
+func (routes *Routes) DeclinePaymentRequest(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	request, ok := routes.readPaymentRequest(resWriter, req, func(publicID string) (*paymentrequests.PaymentRequest, error) {
+		return routes.models.PaymentRequests.GetIncoming(user.Email, publicID)
+	})
+	if !ok {
+		return
+	}
+
+	err := routes.models.PaymentRequests.Decline(request, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		routes.paymentRequestErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "payment request declined successfully", "data": request},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// CancelPaymentRequest withdraws a request the user made before it is answered.
+func (routes *Routes) CancelPaymentRequest(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	request, ok := routes.readPaymentRequest(resWriter, req, func(publicID string) (*paymentrequests.PaymentRequest, error) {
+		return routes.models.PaymentRequests.GetOutgoing(user.ID, publicID)
+	})
+	if !ok {
+		return
+	}
+
+	err := routes.models.PaymentRequests.Cancel(request, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		routes.paymentRequestErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "payment request cancelled successfully", "data": request},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// readPaymentRequestFilters reads the filters of a payment request list, which can
+// also be filtered by the field naming the other party. When it returns false the
+// error response has already been sent.
+func (routes *Routes) readPaymentRequestFilters(resWriter http.ResponseWriter, req *http.Request, partyField, partyColumn string) (listing.Filters, bool) {
+	filters := listing.Filters{
+		Sort: "-created_at",
+		SortSafelist: map[string]string{
+			"created_at": "payment_requests.created_at",
+			"expires_at": "payment_requests.expires_at",
+			"amount":     "payment_requests.amount",
+		},
+		FieldSafelist: map[string]string{
+			"status":   "payment_requests.status",
+			"currency": "currencies.code",
+			partyField: partyColumn,
+		},
+		IDColumn: "payment_requests.id",
+	}
+
+	validator := validators.New()
+	routes.httpx.ReadFilters(req.URL.Query(), &filters, validator)
+	if listing.Validate(validator, filters); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return filters, false
+	}
+
+	return filters, true
+}
+
+// readPaymentRequest reads the payment request in the URL with get, which limits it
+// to the requests of the user. When it returns false the error response has already
+// been sent.
+func (routes *Routes) readPaymentRequest(
+	resWriter http.ResponseWriter,
+	req *http.Request,
+	get func(publicID string) (*paymentrequests.PaymentRequest, error),
+) (*paymentrequests.PaymentRequest, bool) {
+	request, err := get(routes.httpx.ReadIDParam(req))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return nil, false
+	}
+
+	return request, true
+}
+
+// paymentRequestErrorResponse sends the response for an error from answering a
+// payment request.
+func (routes *Routes) paymentRequestErrorResponse(resWriter http.ResponseWriter, req *http.Request, err error) {
+	switch {
+	case errors.Is(err, constants.ErrRequestNotPending):
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the payment request has already been answered")
+	case errors.Is(err, constants.ErrRequestExpired):
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the payment request has expired")
+	case errors.Is(err, constants.ErrRecordNotFound):
+		routes.httpx.NotFoundResponse(resWriter, req)
+	default:
+		routes.transferErrorResponse(resWriter, req, err)
+	}
+}
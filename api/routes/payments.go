@@ -0,0 +1,324 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/thesambayo/digillets-api/api/contexts"
+	"github.com/thesambayo/digillets-api/api/httpx"
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/approvals"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/currencies"
+	"github.com/thesambayo/digillets-api/internal/data/payments"
+	"github.com/thesambayo/digillets-api/internal/data/riskdecisions"
+	"github.com/thesambayo/digillets-api/internal/data/screenings"
+	"github.com/thesambayo/digillets-api/internal/data/transactions"
+	"github.com/thesambayo/digillets-api/internal/data/wallets"
+	"github.com/thesambayo/digillets-api/internal/money"
+	"github.com/thesambayo/digillets-api/internal/risk"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// Kinds of payments to merchants.
+const (
+	paymentKindPayment  = "payment"
+	paymentKindCheckout = "checkout_session"
+	paymentKindInvoice  = "invoice"
+)
+
+// merchantPayment is the payload of a payment to a merchant waiting for approval or
+// risk review: what it pays from which wallet, and the device it was made from for
+// the risk rules. Amount is what is debited from the wallet, and InvoiceAmount what
+// it pays of an invoice in the invoice currency.
+type merchantPayment struct {
+	Kind            string            `json:"kind"`
+	Merchant        string            `json:"merchant"`
+	Wallet          string            `json:"wallet"`
+	Amount          money.Amount      `json:"amount"`
+	Capture         bool              `json:"capture,omitempty"`
+	Description     string            `json:"description,omitempty"`
+	Metadata        payments.Metadata `json:"metadata,omitempty"`
+	CheckoutSession string            `json:"checkout_session,omitempty"`
+	Invoice         string            `json:"invoice,omitempty"`
+	InvoiceAmount   money.Amount      `json:"invoice_amount"`
+	Device          string            `json:"device"`
+}
+
+// CreatePayment pays a merchant from one of the user's wallets. The amount is held
+// on the wallet until the merchant captures the payment, unless capture is true, in
+// which case it is paid straight away. The wallet must be in the currency the
+// merchant settles in. The payment goes through approval and the risk rules like a
+// transfer does.
+func (routes *Routes) CreatePayment(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+	if user.ScreeningStatus == screenings.UserBlocked {
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusForbidden, "the payment was declined")
+		return
+	}
+	if routes.refuseTestKey(resWriter, req) {
+		return
+	}
+
+	var input struct {
+		Merchant    string            `json:"merchant"`
+		Wallet      string            `json:"wallet"`
+		Amount      money.Amount      `json:"amount"`
+		Capture     bool              `json:"capture"`
+		Description string            `json:"description"`
+		Metadata    payments.Metadata `json:"metadata"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	validator := validators.New()
+	validator.Check(input.Merchant != "", "merchant", "must be the public id of the merchant to pay")
+	validator.Check(input.Wallet != "", "wallet", "must be one of your wallets e.g NGN or its public id")
+	validator.Check(len(input.Description) <= 255, "description", "must not be more than 255 characters long")
+	payments.ValidateMetadata(validator, input.Metadata)
+	if !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	merchant, err := routes.models.Payments.GetMerchant(input.Merchant)
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			validator.AddError("merchant", "merchant not found")
+			routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	wallet, err := routes.models.Wallets.GetForUser(user.ID, input.Wallet)
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			validator.AddError("wallet", "must be one of your wallets e.g NGN or its public id")
+			routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	currencies.ValidateAmount(validator, "amount", input.Amount, wallet.Currency)
+	validator.Check(merchant.UserID != user.ID, "merchant", "must not be your own merchant account")
+	validator.Check(wallet.Currency.Code == merchant.Currency, "wallet", "must be in "+merchant.Currency+", the currency the merchant is paid in")
+	validator.Check(wallet.Status != constants.WalletStatusClosed, "wallet", "must be an open wallet")
+	if !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	settlement, err := routes.models.Wallets.GetByPublicId(merchant.SettlementWallet)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	payload := merchantPayment{
+		Kind:        paymentKindPayment,
+		Merchant:    merchant.PublicID,
+		Wallet:      wallet.PublicID,
+		Amount:      input.Amount,
+		Capture:     input.Capture,
+		Description: input.Description,
+		Metadata:    input.Metadata,
+		Device:      deviceID(req),
+	}
+	payment, debit, execute := paymentDebit(payload, merchant, wallet, settlement, routes.auditActor(req, audit.ActorUser))
+	if !routes.payMerchant(resWriter, req, debit, money.Zero, payload, execute, routes.paymentErrorResponse) {
+		return
+	}
+
+	message := "payment authorized successfully, its funds are held until the merchant captures it"
+	if input.Capture {
+		message = "payment made successfully"
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusCreated,
+		httpx.Envelope{"message": message, "data": payment},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// GetPayment returns a payment the user made.
+func (routes *Routes) GetPayment(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	payment, err := routes.models.Payments.GetPaymentForCustomer(user.ID, routes.httpx.ReadIDParam(req))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "payment fetched successfully", "data": payment},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// paymentDebit returns the payment of payload from wallet to merchant, its debit for
+// the risk rules, and what authorizes it.
+func paymentDebit(payload merchantPayment, merchant *payments.Merchant, wallet, settlement *wallets.Wallet, actor audit.Actor) (*payments.Payment, *riskdecisions.Debit, riskdecisions.Executor) {
+	payment := &payments.Payment{
+		MerchantID:         merchant.ID,
+		Merchant:           merchant.PublicID,
+		MerchantName:       merchant.BusinessName,
+		MerchantUserID:     merchant.UserID,
+		CustomerWalletID:   wallet.ID,
+		CustomerWallet:     wallet.PublicID,
+		CustomerUserID:     wallet.User.ID,
+		SettlementWalletID: settlement.ID,
+		Amount:             payload.Amount,
+		Currency:           wallet.Currency.Code,
+		Description:        payload.Description,
+		Metadata:           payload.Metadata,
+	}
+	debit := &riskdecisions.Debit{
+		TransactionType: transactions.TypePayment,
+		From:            wallet,
+		To:              settlement,
+		BeneficiaryName: merchant.BusinessName,
+		Amount:          payload.Amount,
+		Hold:            payload.Amount,
+	}
+	execute := func(ctx context.Context, tx *sql.Tx) (string, error) {
+		if err := payments.AuthorizeTx(ctx, tx, payment, payload.Capture, actor); err != nil {
+			return "", err
+		}
+		return payment.PublicID, nil
+	}
+	return payment, debit, execute
+}
+
+// payMerchant makes a payment to a merchant the way CreateTransfer makes a transfer:
+// one over the approval threshold waits for approval with its funds held, otherwise
+// the risk rules decide whether execute makes it now, it is held for review, or it is
+// declined. The payload is what it is made with once approved, and paidBefore what
+// was already paid towards the same thing, see debitApproval. When it returns false
+// the payment was not made and the response has already been sent, errors from
+// making it by errorResponse.
+func (routes *Routes) payMerchant(
+	resWriter http.ResponseWriter,
+	req *http.Request,
+	debit *riskdecisions.Debit,
+	paidBefore money.Amount,
+	payload merchantPayment,
+	execute riskdecisions.Executor,
+	errorResponse func(http.ResponseWriter, *http.Request, error),
+) bool {
+	actor := routes.auditActor(req, audit.ActorUser)
+
+	approval, err := routes.debitApproval(req, approvals.ActionPayment, debit.From, debit.Amount, paidBefore, payload)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return false
+	}
+	if approval != nil {
+		err = routes.models.Approvals.Create(approval, debit.Hold, actor)
+		if err != nil {
+			errorResponse(resWriter, req, err)
+			return false
+		}
+
+		err = routes.httpx.WriteJSON(
+			resWriter,
+			http.StatusAccepted,
+			httpx.Envelope{"message": "payment is waiting for approval, its funds are held until then", "data": payload, "approval_id": approval.PublicID},
+			nil,
+		)
+		if err != nil {
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return false
+	}
+
+	debit.Payload, err = json.Marshal(payload)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return false
+	}
+
+	decision, err := routes.models.RiskDecisions.CreateDebit(debit, payload.Device, actor, execute)
+	if err != nil {
+		errorResponse(resWriter, req, err)
+		return false
+	}
+
+	// the rules that fired are kept from the user
+	switch decision.Outcome {
+	case risk.OutcomeBlock:
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusForbidden, "the payment was declined")
+		return false
+	case risk.OutcomeReview:
+		err = routes.httpx.WriteJSON(
+			resWriter,
+			http.StatusAccepted,
+			httpx.Envelope{"message": "payment is under review, its funds are held until then", "data": payload, "review_id": decision.PublicID},
+			nil,
+		)
+		if err != nil {
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return false
+	}
+
+	return true
+}
+
+// merchantPaymentDebit loads what the payload of a payment waiting for approval or
+// review pays, from and into which wallets, and returns its debit for the risk rules
+// and what makes it.
+func (routes *Routes) merchantPaymentDebit(payload merchantPayment, actor audit.Actor) (*riskdecisions.Debit, riskdecisions.Executor, error) {
+	switch payload.Kind {
+	case paymentKindCheckout:
+		return routes.checkoutPaymentDebit(payload, actor)
+	case paymentKindInvoice:
+		return routes.invoicePaymentDebit(payload, actor)
+	}
+
+	merchant, err := routes.models.Payments.GetMerchant(payload.Merchant)
+	if err != nil {
+		return nil, nil, err
+	}
+	wallet, err := routes.models.Wallets.GetByPublicId(payload.Wallet)
+	if err != nil {
+		return nil, nil, err
+	}
+	settlement, err := routes.models.Wallets.GetByPublicId(merchant.SettlementWallet)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, debit, execute := paymentDebit(payload, merchant, wallet, settlement, actor)
+	return debit, execute, nil
+}
@@ -4,6 +4,8 @@ import (
 	"net/http"
 
 	"github.com/thesambayo/digillets-api/api/httpx"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/money"
 	"github.com/thesambayo/digillets-api/internal/validators"
 )
 
@@ -27,7 +29,7 @@ func (routes *Routes) GetTwoCurrenciesExchangeRate(resWriter http.ResponseWriter
 
 	rate, err := routes.models.Currencies.GetExchangeRateBetweenTwoCurrencies(input.currencyFrom, input.currencyTo)
 	data := struct {
-		ExchangeRate float64 `json:"exchange_rate"`
+		ExchangeRate money.Amount `json:"exchange_rate"`
 	}{
 		ExchangeRate: rate,
 	}
@@ -47,28 +49,49 @@ func (routes *Routes) GetTwoCurrenciesExchangeRate(resWriter http.ResponseWriter
 func (routes *Routes) GetCurrencyExchangeRates(resWriter http.ResponseWriter, req *http.Request) {
 	var input struct {
 		currency string
+		listing.Filters
 	}
 
+	input.Filters = exchangeRateFilters()
+
 	queryString := req.URL.Query()
 	input.currency = routes.httpx.ReadString(queryString, "currency", "")
 
 	validator := validators.New()
+	routes.httpx.ReadFilters(queryString, &input.Filters, validator)
 	validator.Check(len(input.currency) != 0, "currency", "currency is required e.g NGN, USD, EUR")
-	if !validator.Valid() {
+	if listing.Validate(validator, input.Filters); !validator.Valid() {
 		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
 		return
 	}
 
-	exchangeRates, err := routes.models.Currencies.GetExchangeRatesForACurrency(input.currency)
+	exchangeRates, metadata, err := routes.models.Currencies.GetExchangeRatesForACurrency(input.currency, input.Filters)
 
 	if err != nil {
 		routes.httpx.ServerErrorResponse(resWriter, req, err)
 		return
 	}
 
-	err = routes.httpx.WriteJSON(resWriter, http.StatusOK, httpx.Envelope{"data": exchangeRates}, nil)
+	err = routes.httpx.WriteJSON(resWriter, http.StatusOK, httpx.Envelope{"data": exchangeRates, "metadata": metadata}, nil)
 	if err != nil {
 		routes.httpx.ServerErrorResponse(resWriter, req, err)
 		return
 	}
 }
+
+// exchangeRateFilters returns the filters for listing the exchange rates of a
+// currency, sorted by currency.
+func exchangeRateFilters() listing.Filters {
+	return listing.Filters{
+		Sort: "currency",
+		SortSafelist: map[string]string{
+			"currency":     "rates.currency",
+			"buying_rate":  "rates.buying_rate",
+			"selling_rate": "rates.selling_rate",
+		},
+		FieldSafelist: map[string]string{
+			"to": "rates.currency",
+		},
+		IDColumn: "rates.id",
+	}
+}
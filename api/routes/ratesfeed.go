@@ -0,0 +1,280 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/data/currencies"
+	"github.com/thesambayo/digillets-api/internal/money"
+	"github.com/thesambayo/digillets-api/internal/websocket"
+)
+
+const (
+	// ratesPingPeriod is how often clients are pinged, and ratesPongWait how long
+	// one has to answer or send anything before it is dropped.
+	ratesPingPeriod = 25 * time.Second
+	ratesPongWait   = 60 * time.Second
+	// ratesSendBuffer is how many messages may wait for a client. A client that
+	// falls that far behind is too slow to keep up and is dropped.
+	ratesSendBuffer = 32
+	// ratesMaxPairs is how many pairs a client may subscribe to.
+	ratesMaxPairs = 50
+)
+
+// rxCurrencyPair matches a currency pair, e.g USD/NGN.
+var rxCurrencyPair = regexp.MustCompile(`^[A-Z]{3}/[A-Z]{3}$`)
+
+// ratesRequest is a message from a client, e.g
+// {"action": "subscribe", "pairs": ["USD/NGN", "EUR/GBP"]}
+type ratesRequest struct {
+	Action string   `json:"action"`
+	Pairs  []string `json:"pairs"`
+}
+
+// ratesMessage is a message to a client. A rate message is sent for a pair on
+// subscribing to it and whenever its rate changes afterwards; one BASE buys
+// selling_rate QUOTE, and one QUOTE buys buying_rate BASE.
+type ratesMessage struct {
+	Type        string        `json:"type"`
+	Pair        string        `json:"pair,omitempty"`
+	BuyingRate  *money.Amount `json:"buying_rate,omitempty"`
+	SellingRate *money.Amount `json:"selling_rate,omitempty"`
+	Pairs       []string      `json:"pairs,omitempty"`
+	Message     string        `json:"message,omitempty"`
+	At          *time.Time    `json:"at,omitempty"`
+}
+
+// StreamExchangeRates upgrades to a WebSocket over which the client subscribes to
+// currency pairs and is sent their exchange rates as they change.
+func (routes *Routes) StreamExchangeRates(resWriter http.ResponseWriter, req *http.Request) {
+	conn, err := websocket.Upgrade(resWriter, req)
+	if err != nil {
+		switch {
+		case errors.Is(err, websocket.ErrBadHandshake):
+			routes.httpx.ErrorResponse(resWriter, req, http.StatusBadRequest, "this endpoint must be connected to as a websocket")
+		default:
+			// the connection may be hijacked already, so there is no response to send
+			routes.httpx.LogError(req, err)
+		}
+		return
+	}
+	defer conn.Close()
+
+	changes := routes.hub.Subscribe(currencies.RatesChannel, "")
+	defer changes.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// Read what the client sends. Its answers to our pings keep the connection
+	// open, and it is dropped once it has been quiet for too long.
+	requests := make(chan ratesRequest)
+	readErr := make(chan error, 1)
+	conn.SetReadDeadline(time.Now().Add(ratesPongWait))
+	conn.OnPong = func() {
+		conn.SetReadDeadline(time.Now().Add(ratesPongWait))
+	}
+	go func() {
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(ratesPongWait))
+
+			var request ratesRequest
+			if err := json.Unmarshal(message, &request); err != nil {
+				request = ratesRequest{Action: "invalid"}
+			}
+			select {
+			case requests <- request:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// Write to the client from a single goroutine through a bounded queue, so that
+	// a slow client never holds up the feed.
+	send := make(chan ratesMessage, ratesSendBuffer)
+	writeErr := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case message := <-send:
+				payload, err := json.Marshal(message)
+				if err == nil {
+					err = conn.WriteMessage(websocket.TextMessage, payload)
+				}
+				if err != nil {
+					writeErr <- err
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	slow := false
+	enqueue := func(message ratesMessage) {
+		select {
+		case send <- message:
+		default:
+			slow = true
+		}
+	}
+
+	ping := time.NewTicker(ratesPingPeriod)
+	defer ping.Stop()
+
+	pairs := map[string]bool{}
+	// last holds the rates last sent for each pair, to only send changes.
+	last := map[string]money.Amount{}
+
+	for !slow {
+		select {
+		case request := <-requests:
+			switch request.Action {
+			case "subscribe":
+				added, message := routes.validateRatePairs(request.Pairs, pairs)
+				if message != "" {
+					enqueue(ratesMessage{Type: "error", Message: message})
+					continue
+				}
+				for _, pair := range added {
+					pairs[pair] = true
+					delete(last, pair)
+				}
+				enqueue(ratesMessage{Type: "subscribed", Pairs: sortedPairs(pairs)})
+				routes.sendRates(added, last, enqueue)
+			case "unsubscribe":
+				for _, pair := range request.Pairs {
+					pair = strings.ToUpper(pair)
+					delete(pairs, pair)
+					delete(last, pair)
+				}
+				enqueue(ratesMessage{Type: "subscribed", Pairs: sortedPairs(pairs)})
+			default:
+				enqueue(ratesMessage{Type: "error", Message: `messages must be {"action": "subscribe" or "unsubscribe", "pairs": ["USD/NGN", ...]}`})
+			}
+
+		case _, ok := <-changes.C:
+			if !ok {
+				conn.WriteClose(websocket.CloseGoingAway, "server is shutting down")
+				return
+			}
+			routes.sendRates(sortedPairs(pairs), last, enqueue)
+
+		case <-ping.C:
+			if err := conn.Ping(); err != nil {
+				return
+			}
+
+		case err := <-readErr:
+			var closeError *websocket.CloseError
+			if !errors.As(err, &closeError) {
+				conn.WriteClose(websocket.ClosePolicyViolation, "")
+			}
+			return
+
+		case <-writeErr:
+			return
+		}
+	}
+
+	// The client is not reading fast enough. Its connection is dropped without a
+	// closing handshake, which it would not read in time anyway.
+}
+
+// validateRatePairs checks pairs to subscribe to on top of the subscribed ones, and
+// returns them deduplicated, or a message saying what is wrong with them.
+func (routes *Routes) validateRatePairs(pairs []string, subscribed map[string]bool) ([]string, string) {
+	if len(pairs) == 0 {
+		return nil, "pairs must contain at least one currency pair e.g USD/NGN"
+	}
+	seen := map[string]bool{}
+	var valid []string
+	total := len(subscribed)
+	for _, pair := range pairs {
+		pair = strings.ToUpper(pair)
+		if !rxCurrencyPair.MatchString(pair) || pair[:3] == pair[4:] {
+			return nil, "pairs must be pairs of different currency codes e.g USD/NGN"
+		}
+		if !seen[pair] {
+			seen[pair] = true
+			valid = append(valid, pair)
+			if !subscribed[pair] {
+				total++
+			}
+		}
+	}
+	if total > ratesMaxPairs {
+		return nil, fmt.Sprintf("no more than %d pairs can be subscribed to", ratesMaxPairs)
+	}
+	return valid, ""
+}
+
+// sendRates enqueues the rates of the pairs that changed since they were last
+// sent. A pair that has no rate, because a currency does not exist, gets an error.
+func (routes *Routes) sendRates(pairs []string, last map[string]money.Amount, enqueue func(ratesMessage)) {
+	// the rates of every quote currency of a base come in one query
+	quotes := map[string][]string{}
+	for _, pair := range pairs {
+		base, quote, _ := strings.Cut(pair, "/")
+		quotes[base] = append(quotes[base], quote)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for base, codes := range quotes {
+		filters := exchangeRateFilters()
+		filters.Page, filters.PageSize = 1, ratesMaxPairs
+		filters.Fields = map[string][]string{"to": codes}
+
+		rates, _, err := routes.models.Currencies.GetExchangeRatesForACurrency(base, filters)
+		if err != nil {
+			enqueue(ratesMessage{Type: "error", Message: "the rates could not be fetched, they will be sent on their next change"})
+			continue
+		}
+
+		found := map[string]bool{}
+		for _, rate := range rates {
+			pair := base + "/" + rate.Currency
+			found[pair] = true
+			if previous, ok := last[pair]; ok && previous.Cmp(rate.SellingRate) == 0 {
+				continue
+			}
+			last[pair] = rate.SellingRate
+			enqueue(ratesMessage{
+				Type:        "rate",
+				Pair:        pair,
+				BuyingRate:  &rate.BuyingRate,
+				SellingRate: &rate.SellingRate,
+				At:          &now,
+			})
+		}
+		for _, quote := range codes {
+			pair := base + "/" + quote
+			if _, ok := last[pair]; !ok && !found[pair] {
+				// remember the pair has been reported, so that it is not again
+				last[pair] = money.Zero
+				enqueue(ratesMessage{Type: "error", Pair: pair, Message: "unknown currency pair"})
+			}
+		}
+	}
+}
+
+func sortedPairs(pairs map[string]bool) []string {
+	sorted := make([]string, 0, len(pairs))
+	for pair := range pairs {
+		sorted = append(sorted, pair)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
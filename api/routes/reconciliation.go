@@ -0,0 +1,182 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/thesambayo/digillets-api/api/contexts"
+	"github.com/thesambayo/digillets-api/api/httpx"
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/data/reconciliation"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+func (routes *Routes) GetReconciliationBreaks(resWriter http.ResponseWriter, req *http.Request) {
+	filters := listing.Filters{
+		Sort: "-created_at",
+		SortSafelist: map[string]string{
+			"created_at": "reconciliation_breaks.created_at",
+			"updated_at": "reconciliation_breaks.updated_at",
+		},
+		FieldSafelist: map[string]string{
+			"status":   "reconciliation_breaks.status",
+			"kind":     "reconciliation_breaks.kind",
+			"currency": "reconciliation_breaks.currency",
+			"subject":  "reconciliation_breaks.subject",
+			"run":      "reconciliation_runs.public_id",
+		},
+		IDColumn: "reconciliation_breaks.id",
+	}
+
+	validator := validators.New()
+	routes.httpx.ReadFilters(req.URL.Query(), &filters, validator)
+	if listing.Validate(validator, filters); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	breaks, metadata, err := routes.models.Reconciliation.GetBreaks(filters)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "reconciliation breaks fetched successfully", "data": breaks, "metadata": metadata},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) GetReconciliationBreak(resWriter http.ResponseWriter, req *http.Request) {
+	brk, ok := routes.readReconciliationBreak(resWriter, req)
+	if !ok {
+		return
+	}
+
+	err := routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "reconciliation break fetched successfully", "data": brk},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) ResolveReconciliationBreak(resWriter http.ResponseWriter, req *http.Request) {
+	staff := contexts.ContextGetUser(req)
+
+	var input struct {
+		Note string `json:"note"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	resolution := reconciliation.Resolution{
+		Note:       input.Note,
+		ResolverID: staff.ID,
+	}
+
+	validator := validators.New()
+	if reconciliation.ValidateResolution(validator, &resolution); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	brk, ok := routes.readReconciliationBreak(resWriter, req)
+	if !ok {
+		return
+	}
+
+	err = routes.models.Reconciliation.Resolve(brk, resolution, routes.auditActor(req, audit.ActorAdmin))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrBreakResolved):
+			routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the break has already been resolved")
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "reconciliation break resolved successfully", "data": brk},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) GetReconciliationRuns(resWriter http.ResponseWriter, req *http.Request) {
+	filters := listing.Filters{
+		Sort: "-started_at",
+		SortSafelist: map[string]string{
+			"started_at":   "reconciliation_runs.started_at",
+			"breaks_found": "reconciliation_runs.breaks_found",
+		},
+		FieldSafelist: map[string]string{
+			"source": "reconciliation_runs.source",
+		},
+		IDColumn: "reconciliation_runs.id",
+	}
+
+	validator := validators.New()
+	routes.httpx.ReadFilters(req.URL.Query(), &filters, validator)
+	if listing.Validate(validator, filters); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	runs, metadata, err := routes.models.Reconciliation.GetRuns(filters)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "reconciliation runs fetched successfully", "data": runs, "metadata": metadata},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// readReconciliationBreak fetches the reconciliation break in the url. When it
+// returns false the error response has already been sent.
+func (routes *Routes) readReconciliationBreak(resWriter http.ResponseWriter, req *http.Request) (*reconciliation.Break, bool) {
+	brk, err := routes.models.Reconciliation.GetBreakByPublicId(routes.httpx.ReadIDParam(req))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return nil, false
+	}
+	return brk, true
+}
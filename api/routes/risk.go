@@ -0,0 +1,215 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/thesambayo/digillets-api/api/contexts"
+	"github.com/thesambayo/digillets-api/api/httpx"
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/data/riskdecisions"
+	"github.com/thesambayo/digillets-api/internal/data/transfers"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+func (routes *Routes) GetRiskDecisions(resWriter http.ResponseWriter, req *http.Request) {
+	filters := listing.Filters{
+		Sort: "-created_at",
+		SortSafelist: map[string]string{
+			"created_at": "risk_decisions.created_at",
+		},
+		FieldSafelist: map[string]string{
+			"status":   "risk_decisions.status",
+			"outcome":  "risk_decisions.outcome",
+			"currency": "risk_decisions.currency",
+			"user":     "users.public_id",
+			"wallet":   "wallets.public_id",
+		},
+		IDColumn: "risk_decisions.id",
+	}
+
+	validator := validators.New()
+	routes.httpx.ReadFilters(req.URL.Query(), &filters, validator)
+	if listing.Validate(validator, filters); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	decisions, metadata, err := routes.models.RiskDecisions.GetAll(filters)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "risk decisions fetched successfully", "data": decisions, "metadata": metadata},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) GetRiskDecision(resWriter http.ResponseWriter, req *http.Request) {
+	decision, ok := routes.readRiskDecision(resWriter, req)
+	if !ok {
+		return
+	}
+
+	err := routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "risk decision fetched successfully", "data": decision},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) ApproveRiskDecision(resWriter http.ResponseWriter, req *http.Request) {
+	routes.reviewRiskDecision(resWriter, req, true)
+}
+
+func (routes *Routes) RejectRiskDecision(resWriter http.ResponseWriter, req *http.Request) {
+	routes.reviewRiskDecision(resWriter, req, false)
+}
+
+// reviewRiskDecision approves or rejects a debit held by the risk rules. An approved
+// transfer is made as it was priced, and a payment to a merchant as it was asked
+// for, against the wallets as they are now.
+func (routes *Routes) reviewRiskDecision(resWriter http.ResponseWriter, req *http.Request, approve bool) {
+	staff := contexts.ContextGetUser(req)
+
+	var input struct {
+		Note string `json:"note"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	review := riskdecisions.Review{
+		Approve:    approve,
+		Note:       input.Note,
+		ReviewerID: staff.ID,
+	}
+
+	validator := validators.New()
+	if riskdecisions.ValidateReview(validator, &review); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	decision, ok := routes.readRiskDecision(resWriter, req)
+	if !ok {
+		return
+	}
+	debit := "transfer"
+	if decision.Transfer == nil {
+		debit = "payment"
+	}
+	if decision.Status != riskdecisions.StatusPending || (decision.Transfer == nil && decision.Payload == nil) {
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the "+debit+" is not waiting for review")
+		return
+	}
+
+	actor := routes.auditActor(req, audit.ActorAdmin)
+	var execute riskdecisions.Executor
+	if approve {
+		execute, err = routes.riskReviewExecutor(decision, actor)
+		if err != nil {
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+			return
+		}
+	}
+
+	err = routes.models.RiskDecisions.Review(decision, review, actor, execute)
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRiskAlreadyReviewed):
+			routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the "+debit+" is not waiting for review")
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		case decision.Transfer == nil:
+			routes.paymentErrorResponse(resWriter, req, err)
+		default:
+			routes.transferErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	message := debit + " rejected successfully, its funds are released"
+	if approve {
+		message = debit + " approved and made successfully"
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": message, "data": decision},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// riskReviewExecutor returns what makes a debit held for review once it is approved:
+// the transfer it keeps, or else the payment to a merchant of its payload.
+func (routes *Routes) riskReviewExecutor(decision *riskdecisions.Decision, actor audit.Actor) (riskdecisions.Executor, error) {
+	if decision.Transfer == nil {
+		var payload merchantPayment
+		if err := json.Unmarshal(decision.Payload, &payload); err != nil {
+			return nil, err
+		}
+		_, execute, err := routes.merchantPaymentDebit(payload, actor)
+		return execute, err
+	}
+
+	transfer := decision.Transfer
+	var err error
+	transfer.From, err = routes.models.Wallets.GetByPublicId(transfer.FromWallet)
+	if err == nil {
+		transfer.To, err = routes.models.Wallets.GetByPublicId(transfer.ToWallet)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	execute := func(ctx context.Context, tx *sql.Tx) (string, error) {
+		if err := transfers.CreateTx(ctx, tx, transfer, actor); err != nil {
+			return "", err
+		}
+		return transfer.PublicID, nil
+	}
+	return execute, nil
+}
+
+// readRiskDecision fetches the risk decision in the url. When it returns false the
+// error response has already been sent.
+func (routes *Routes) readRiskDecision(resWriter http.ResponseWriter, req *http.Request) (*riskdecisions.Decision, bool) {
+	decision, err := routes.models.RiskDecisions.GetByPublicId(routes.httpx.ReadIDParam(req))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return nil, false
+	}
+	return decision, true
+}
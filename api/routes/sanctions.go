@@ -0,0 +1,191 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/thesambayo/digillets-api/api/contexts"
+	"github.com/thesambayo/digillets-api/api/httpx"
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/data/screenings"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+func (routes *Routes) GetSanctionsMatches(resWriter http.ResponseWriter, req *http.Request) {
+	filters := listing.Filters{
+		Sort: "-created_at",
+		SortSafelist: map[string]string{
+			"created_at": "sanctions_matches.created_at",
+			"score":      "sanctions_matches.score",
+		},
+		FieldSafelist: map[string]string{
+			"status":       "sanctions_matches.status",
+			"subject_type": "sanctions_matches.subject_type",
+			"user":         "users.public_id",
+			"entry_uid":    "sanctions_matches.entry_uid",
+		},
+		IDColumn: "sanctions_matches.id",
+	}
+
+	validator := validators.New()
+	routes.httpx.ReadFilters(req.URL.Query(), &filters, validator)
+	if listing.Validate(validator, filters); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	matches, metadata, err := routes.models.Screenings.GetAll(filters)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "sanctions matches fetched successfully", "data": matches, "metadata": metadata},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) GetSanctionsMatch(resWriter http.ResponseWriter, req *http.Request) {
+	match, ok := routes.readSanctionsMatch(resWriter, req)
+	if !ok {
+		return
+	}
+
+	err := routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "sanctions match fetched successfully", "data": match},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) ClearSanctionsMatch(resWriter http.ResponseWriter, req *http.Request) {
+	routes.reviewSanctionsMatch(resWriter, req, false)
+}
+
+func (routes *Routes) ConfirmSanctionsMatch(resWriter http.ResponseWriter, req *http.Request) {
+	routes.reviewSanctionsMatch(resWriter, req, true)
+}
+
+func (routes *Routes) reviewSanctionsMatch(resWriter http.ResponseWriter, req *http.Request, confirm bool) {
+	staff := contexts.ContextGetUser(req)
+
+	var input struct {
+		Note string `json:"note"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	review := screenings.Review{
+		Confirm:    confirm,
+		Note:       input.Note,
+		ReviewerID: staff.ID,
+	}
+
+	validator := validators.New()
+	if screenings.ValidateReview(validator, &review); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	match, ok := routes.readSanctionsMatch(resWriter, req)
+	if !ok {
+		return
+	}
+
+	err = routes.models.Screenings.Review(match, review, routes.auditActor(req, audit.ActorAdmin))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrMatchAlreadyReviewed):
+			routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the match has already been reviewed")
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	message := "sanctions match cleared successfully"
+	if confirm {
+		message = "sanctions match confirmed successfully, the account is blocked"
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": message, "data": match},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) GetSanctionsList(resWriter http.ResponseWriter, req *http.Request) {
+	err := routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "sanctions list fetched successfully", "data": routes.models.Screenings.ListStatus()},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// ReloadSanctionsList reloads the sanctions list from its file, e.g after it has been
+// replaced with a newer export, without restarting the server.
+func (routes *Routes) ReloadSanctionsList(resWriter http.ResponseWriter, req *http.Request) {
+	status, err := routes.models.Screenings.ReloadList(routes.auditActor(req, audit.ActorAdmin))
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "sanctions list reloaded successfully", "data": status},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// readSanctionsMatch fetches the sanctions match in the url. When it returns false
+// the error response has already been sent.
+func (routes *Routes) readSanctionsMatch(resWriter http.ResponseWriter, req *http.Request) (*screenings.Match, bool) {
+	match, err := routes.models.Screenings.GetByPublicId(routes.httpx.ReadIDParam(req))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return nil, false
+	}
+	return match, true
+}
@@ -0,0 +1,135 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/thesambayo/digillets-api/api/contexts"
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/transactions"
+	"github.com/thesambayo/digillets-api/internal/statements"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// GetWalletStatement streams the statement of a wallet for a period as CSV or PDF.
+// from and to accept a date (2006-01-02) or an RFC3339 time, a date for `to`
+// includes that whole day. The period defaults to the current month so far.
+func (routes *Routes) GetWalletStatement(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	var input struct {
+		from   time.Time
+		to     time.Time
+		format string
+	}
+
+	now := time.Now().UTC()
+	queryString := req.URL.Query()
+	validator := validators.New()
+	input.from = readStatementTime(queryString.Get("from"), "from", time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC), false, validator)
+	input.to = readStatementTime(queryString.Get("to"), "to", now, true, validator)
+	input.format = routes.httpx.ReadString(queryString, "format", statements.FormatCSV)
+
+	validator.Check(validators.In(input.format, statements.FormatCSV, statements.FormatPDF), "format", "must be csv or pdf")
+	validator.Check(!input.from.After(input.to), "from", "must not be after to")
+	if !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	wallet, err := routes.models.Wallets.GetForUser(user.ID, routes.httpx.ReadIDParam(req))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	openingBalance, err := routes.models.Transactions.GetOpeningBalance(wallet.ID, input.from)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	// Long statements can take longer to send than the server wide write timeout, so
+	// extend the deadline for this response only.
+	controller := http.NewResponseController(resWriter)
+	_ = controller.SetWriteDeadline(time.Now().Add(10 * time.Minute))
+
+	filename := fmt.Sprintf(
+		"statement-%s-%s-%s.%s",
+		wallet.PublicID, input.from.Format("20060102"), input.to.Format("20060102"), input.format,
+	)
+	resWriter.Header().Set("Content-Type", statements.ContentType(input.format))
+	resWriter.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	resWriter.WriteHeader(http.StatusOK)
+
+	// From here on the status line has been sent, so errors can only be logged and
+	// the connection closed to signal an incomplete download.
+	writer := statements.New(input.format, resWriter)
+	err = writer.WriteHeader(statements.Header{
+		AccountName:    user.Name,
+		WalletID:       wallet.PublicID,
+		CurrencyCode:   wallet.Currency.Code,
+		CurrencySymbol: wallet.Currency.Symbol,
+		MinorUnits:     wallet.Currency.MinorUnits,
+		From:           input.from,
+		To:             input.to,
+		OpeningBalance: openingBalance,
+		GeneratedAt:    now,
+	})
+	if err != nil {
+		routes.abortStream(resWriter, req, err)
+		return
+	}
+
+	closingBalance := openingBalance
+	err = routes.models.Transactions.StreamStatement(req.Context(), wallet.ID, input.from, input.to, func(line *transactions.StatementLine) error {
+		closingBalance = line.Balance
+		return writer.WriteLine(line)
+	})
+	if err != nil {
+		routes.abortStream(resWriter, req, err)
+		return
+	}
+
+	if err = writer.Close(closingBalance); err != nil {
+		routes.abortStream(resWriter, req, err)
+	}
+}
+
+// abortStream logs an error that happened after a streamed response had started and
+// panics with http.ErrAbortHandler, which makes the server drop the connection
+// without logging a stack trace, so the client sees a truncated response instead of
+// a seemingly complete one.
+func (routes *Routes) abortStream(resWriter http.ResponseWriter, req *http.Request, err error) {
+	routes.httpx.LogError(req, err)
+	panic(http.ErrAbortHandler)
+}
+
+// readStatementTime parses a statement period bound given as a date or an RFC3339
+// time. A date for the end of the period is taken as the end of that day.
+func readStatementTime(value, key string, defaultValue time.Time, endOfDay bool, validator *validators.Validator) time.Time {
+	if value == "" {
+		return defaultValue
+	}
+
+	if date, err := time.Parse(time.DateOnly, value); err == nil {
+		if endOfDay {
+			return date.Add(24 * time.Hour)
+		}
+		return date
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		validator.AddError(key, "must be a date (2006-01-02) or an RFC3339 time")
+		return defaultValue
+	}
+	return parsed
+}
@@ -0,0 +1,123 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/thesambayo/digillets-api/api/contexts"
+	"github.com/thesambayo/digillets-api/internal/data/streams"
+)
+
+const (
+	// streamBatch is how many events are read from the database at a time.
+	streamBatch = 100
+	// streamHeartbeat is how often a comment is sent on an idle stream, so that
+	// proxies do not time it out and a client that went away is noticed.
+	streamHeartbeat = 20 * time.Second
+)
+
+// Stream pushes the balance changes and transaction updates of the user as
+// Server-Sent Events, until the client disconnects or the server shuts down. Each
+// event has the id of the stream event, and a client reconnecting with the
+// Last-Event-ID header (or the last_event_id query parameter) first gets the events
+// it missed, as long as they are not older than streams.Retention.
+func (routes *Routes) Stream(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+	ctx := req.Context()
+
+	lastEventID := req.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = req.URL.Query().Get("last_event_id")
+	}
+
+	var lastID int64
+	if lastEventID != "" {
+		id, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || id < 0 {
+			routes.httpx.BadRequestResponse(resWriter, req, errors.New("last event id must be a positive integer"))
+			return
+		}
+		lastID = id
+	}
+
+	// Subscribe before reading where the stream starts, so that nothing committed
+	// in between is missed.
+	subscription := routes.hub.Subscribe(streams.Channel, strconv.FormatInt(user.ID, 10))
+	defer subscription.Close()
+
+	if lastEventID == "" {
+		var err error
+		lastID, err = routes.models.Streams.GetLatestID(ctx, user.ID)
+		if err != nil {
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+			return
+		}
+	}
+
+	// The stream outlives the write timeout of the server.
+	controller := http.NewResponseController(resWriter)
+	if err := controller.SetWriteDeadline(time.Time{}); err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	headers := resWriter.Header()
+	headers.Set("Content-Type", "text/event-stream")
+	headers.Set("Cache-Control", "no-cache")
+	headers.Set("Connection", "keep-alive")
+	headers.Set("X-Accel-Buffering", "no")
+	resWriter.WriteHeader(http.StatusOK)
+
+	// Ask clients to wait a few seconds before reconnecting.
+	fmt.Fprint(resWriter, "retry: 3000\n\n")
+	if err := controller.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	// Catch up on what the client missed, then wait for more.
+	wake := true
+	for {
+		if wake {
+			for {
+				events, err := routes.models.Streams.GetSince(ctx, user.ID, lastID, streamBatch)
+				if err != nil {
+					// the client reconnects and resumes from its last event
+					routes.httpx.LogError(req, err)
+					return
+				}
+				for _, event := range events {
+					fmt.Fprintf(resWriter, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+					lastID = event.ID
+				}
+				if err := controller.Flush(); err != nil {
+					return
+				}
+				if len(events) < streamBatch {
+					break
+				}
+			}
+			wake = false
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-subscription.C:
+			if !ok {
+				return
+			}
+			wake = true
+		case <-heartbeat.C:
+			fmt.Fprint(resWriter, ": heartbeat\n\n")
+			if err := controller.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
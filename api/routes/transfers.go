@@ -0,0 +1,262 @@
+package routes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/thesambayo/digillets-api/api/contexts"
+	"github.com/thesambayo/digillets-api/api/httpx"
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/approvals"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/currencies"
+	"github.com/thesambayo/digillets-api/internal/data/screenings"
+	"github.com/thesambayo/digillets-api/internal/data/transactions"
+	"github.com/thesambayo/digillets-api/internal/data/transfers"
+	"github.com/thesambayo/digillets-api/internal/data/wallets"
+	"github.com/thesambayo/digillets-api/internal/money"
+	"github.com/thesambayo/digillets-api/internal/pricing"
+	"github.com/thesambayo/digillets-api/internal/risk"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// PreviewTransfer prices a transfer without making it, so that the user can see the
+// fee and the amount the recipient gets before confirming.
+func (routes *Routes) PreviewTransfer(resWriter http.ResponseWriter, req *http.Request) {
+	transfer, ok := routes.readTransfer(resWriter, req)
+	if !ok {
+		return
+	}
+
+	err := routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "transfer priced successfully", "data": transfer},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// CreateTransfer prices a transfer and runs the risk rules on it, then makes it,
+// holds its funds for review, or declines it, charging its fee on top of the amount.
+// A transfer over the approval threshold waits for staff to approve it first.
+func (routes *Routes) CreateTransfer(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+	if user.ScreeningStatus == screenings.UserBlocked {
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusForbidden, "the transfer was declined")
+		return
+	}
+	if routes.refuseTestKey(resWriter, req) {
+		return
+	}
+
+	transfer, ok := routes.readTransfer(resWriter, req)
+	if !ok {
+		return
+	}
+
+	approval, err := routes.transferApproval(req, transfer)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+	if approval != nil {
+		err = routes.models.Approvals.Create(approval, transfer.Fee.TotalDebit, routes.auditActor(req, audit.ActorUser))
+		if err != nil {
+			routes.transferErrorResponse(resWriter, req, err)
+			return
+		}
+
+		err = routes.httpx.WriteJSON(
+			resWriter,
+			http.StatusAccepted,
+			httpx.Envelope{"message": "transfer is waiting for approval, its funds are held until then", "data": transfer, "approval_id": approval.PublicID},
+			nil,
+		)
+		if err != nil {
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	decision, err := routes.models.RiskDecisions.CreateTransfer(transfer, deviceID(req), routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		routes.transferErrorResponse(resWriter, req, err)
+		return
+	}
+
+	// the rules that fired are kept from the user
+	switch decision.Outcome {
+	case risk.OutcomeBlock:
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusForbidden, "the transfer was declined")
+		return
+	case risk.OutcomeReview:
+		err = routes.httpx.WriteJSON(
+			resWriter,
+			http.StatusAccepted,
+			httpx.Envelope{"message": "transfer is under review, its funds are held until then", "data": transfer, "review_id": decision.PublicID},
+			nil,
+		)
+	default:
+		err = routes.httpx.WriteJSON(
+			resWriter,
+			http.StatusCreated,
+			httpx.Envelope{"message": "transfer made successfully", "data": transfer},
+			nil,
+		)
+	}
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// transferApproval returns the approval a transfer needs before it is made, or nil
+// when it is under the approval threshold.
+func (routes *Routes) transferApproval(req *http.Request, transfer *transfers.Transfer) (*approvals.Approval, error) {
+	payload := transferApproval{Transfer: transfer, Device: deviceID(req)}
+	return routes.debitApproval(req, approvals.ActionTransfer, transfer.From, transfer.Amount, money.Zero, payload)
+}
+
+// debitApproval returns the approval action needs before it debits amount from
+// wallet, executed with payload once approved, or nil when amount is under the
+// approval threshold. What was already paid towards the same thing, in the base
+// currency, counts with amount, so that splitting it does not get around the
+// threshold.
+func (routes *Routes) debitApproval(req *http.Request, action string, wallet *wallets.Wallet, amount, paidBefore money.Amount, payload interface{}) (*approvals.Approval, error) {
+	threshold := routes.config.Approvals.TransferThreshold
+	baseAmount := amount.Div(wallet.Currency.ExchangeRate, 4, money.DefaultRounding)
+	if !threshold.IsPositive() || baseAmount.Add(paidBefore).Cmp(threshold) < 0 {
+		return nil, nil
+	}
+
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	user := contexts.ContextGetUser(req)
+	return &approvals.Approval{
+		Action:      action,
+		InitiatorID: user.ID,
+		InitiatedBy: user.PublicID,
+		WalletID:    wallet.ID,
+		Wallet:      wallet.PublicID,
+		Amount:      amount,
+		Currency:    wallet.Currency.Code,
+		BaseAmount:  baseAmount,
+		Payload:     encoded,
+		ExpiresAt:   time.Now().Add(routes.config.Approvals.TTL),
+	}, nil
+}
+
+// readTransfer reads and validates a transfer request and prices it. When it
+// returns false the error response has already been sent.
+func (routes *Routes) readTransfer(resWriter http.ResponseWriter, req *http.Request) (*transfers.Transfer, bool) {
+	user := contexts.ContextGetUser(req)
+
+	var input struct {
+		FromWallet  string       `json:"from_wallet"`
+		ToWallet    string       `json:"to_wallet"`
+		Amount      money.Amount `json:"amount"`
+		Description string       `json:"description"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return nil, false
+	}
+
+	validator := validators.New()
+	validator.Check(input.FromWallet != "", "from_wallet", "must be one of your wallets e.g NGN or its public id")
+	validator.Check(input.ToWallet != "", "to_wallet", "must be the public id of the wallet to send to")
+	validator.Check(len(input.Description) <= 255, "description", "must not be more than 255 characters long")
+	if !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return nil, false
+	}
+
+	from, err := routes.models.Wallets.GetForUser(user.ID, input.FromWallet)
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			validator.AddError("from_wallet", "must be one of your wallets e.g NGN or its public id")
+			routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return nil, false
+	}
+
+	to, err := routes.models.Wallets.GetByPublicId(input.ToWallet)
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			validator.AddError("to_wallet", "wallet not found")
+			routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return nil, false
+	}
+
+	currencies.ValidateAmount(validator, "amount", input.Amount, from.Currency)
+	validator.Check(from.ID != to.ID, "to_wallet", "must be a different wallet from from_wallet")
+	validator.Check(from.Status != constants.WalletStatusClosed, "from_wallet", "must be an open wallet")
+	validator.Check(to.Status != constants.WalletStatusClosed, "to_wallet", "must be an open wallet")
+	if !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return nil, false
+	}
+
+	rules, err := routes.models.Fees.GetRules(transactions.TypeTransfer, from.Currency.Code)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return nil, false
+	}
+	rule := pricing.Match(rules, transactions.TypeTransfer, from.Currency.Code, user.KYCTier)
+
+	return transfers.New(from, to, input.Amount, input.Description, rule), true
+}
+
+// deviceID identifies the device a request comes from for the risk rules, by the
+// X-Device-ID header apps send, or else by a hash of the user agent.
+func deviceID(req *http.Request) string {
+	if device := strings.TrimSpace(req.Header.Get("X-Device-ID")); device != "" {
+		if len(device) > 64 {
+			device = device[:64]
+		}
+		return device
+	}
+
+	sum := sha256.Sum256([]byte(req.UserAgent()))
+	return "ua:" + hex.EncodeToString(sum[:16])
+}
+
+// transferErrorResponse sends the response for an error from posting a transfer to
+// the ledger.
+func (routes *Routes) transferErrorResponse(resWriter http.ResponseWriter, req *http.Request, err error) {
+	switch {
+	case errors.Is(err, constants.ErrInsufficientFunds):
+		routes.httpx.FailedValidationResponse(resWriter, req, map[string]string{"amount": "insufficient funds to cover the amount and its fee"})
+	case errors.Is(err, constants.ErrLimitExceeded):
+		routes.httpx.FailedValidationResponse(resWriter, req, map[string]string{"amount": "would go over " + err.Error()})
+	case errors.Is(err, constants.ErrAmountPrecision):
+		routes.httpx.FailedValidationResponse(resWriter, req, map[string]string{"amount": "has more decimal places than the currency allows"})
+	case errors.Is(err, constants.ErrWalletFrozen):
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "one of the wallets is frozen")
+	case errors.Is(err, constants.ErrWalletClosed):
+		routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "one of the wallets is closed")
+	default:
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"github.com/thesambayo/digillets-api/api/contexts"
 	"github.com/thesambayo/digillets-api/api/httpx"
 	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/limits"
 	"github.com/thesambayo/digillets-api/internal/data/users"
 	"github.com/thesambayo/digillets-api/internal/publicid"
 	"github.com/thesambayo/digillets-api/internal/validators"
@@ -50,7 +52,7 @@ func (routes *Routes) CreateUser(resWriter http.ResponseWriter, req *http.Reques
 		return
 	}
 
-	user, err = routes.models.Users.Insert(user)
+	user, err = routes.models.Users.Insert(user, routes.auditActor(req, audit.ActorUser))
 	if err != nil {
 		switch {
 		// If we get a ErrDuplicateEmail error, use the v.AddError() method to manually
@@ -64,6 +66,16 @@ func (routes *Routes) CreateUser(resWriter http.ResponseWriter, req *http.Reques
 		return
 	}
 
+	// A potential sanctions match does not stop the registration, the account is put
+	// under review instead, without telling the user.
+	if matches := routes.models.Screenings.Screen(user.Name); len(matches) > 0 {
+		err = routes.models.Screenings.FlagUser(user, matches, routes.auditActor(req, audit.ActorUser))
+		if err != nil {
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+			return
+		}
+	}
+
 	err = routes.httpx.WriteJSON(
 		resWriter,
 		http.StatusOK,
@@ -90,3 +102,34 @@ func (routes *Routes) GetUserProfile(resWriter http.ResponseWriter, req *http.Re
 		routes.httpx.ServerErrorResponse(resWriter, req, err)
 	}
 }
+
+// GetUserLimits shows the limits of the user's KYC tier in the currency of each of
+// their wallets, with how much of each they have used and have left.
+func (routes *Routes) GetUserLimits(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	usages, err := routes.models.Limits.GetUsage(user.ID)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	data := struct {
+		KYCTier int             `json:"kyc_tier"`
+		Limits  []*limits.Usage `json:"limits"`
+	}{
+		KYCTier: user.KYCTier,
+		Limits:  usages,
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "user limits fetched successfully", "data": data},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"github.com/thesambayo/digillets-api/api/contexts"
 	"github.com/thesambayo/digillets-api/api/httpx"
 	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
 	"github.com/thesambayo/digillets-api/internal/data/wallets"
 	"github.com/thesambayo/digillets-api/internal/publicid"
 	"github.com/thesambayo/digillets-api/internal/validators"
@@ -46,7 +48,7 @@ func (routes *Routes) CreateWallet(resWriter http.ResponseWriter, req *http.Requ
 		User:     *user,
 	}
 
-	wallet, err = routes.models.Wallets.Insert(wallet)
+	wallet, err = routes.models.Wallets.Insert(wallet, routes.auditActor(req, audit.ActorUser))
 
 	if err != nil {
 		switch {
@@ -74,16 +76,38 @@ func (routes *Routes) CreateWallet(resWriter http.ResponseWriter, req *http.Requ
 func (routes *Routes) GetWallets(resWriter http.ResponseWriter, req *http.Request) {
 	user := contexts.ContextGetUser(req)
 
-	wallets, err := routes.models.Wallets.GetByUserId(user.ID)
+	filters := listing.Filters{
+		Sort: "created_at",
+		SortSafelist: map[string]string{
+			"created_at": "wallets.created_at",
+			"balance":    "wallets.balance",
+			"currency":   "currencies.code",
+		},
+		FieldSafelist: map[string]string{
+			"currency":  "currencies.code",
+			"is_frozen": "wallets.is_frozen",
+			"status":    "wallets.status",
+		},
+		IDColumn: "wallets.id",
+	}
+
+	validator := validators.New()
+	routes.httpx.ReadFilters(req.URL.Query(), &filters, validator)
+	if listing.Validate(validator, filters); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
 
+	wallets, metadata, err := routes.models.Wallets.GetByUserId(user.ID, filters)
 	if err != nil {
 		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
 	}
 
 	err = routes.httpx.WriteJSON(
 		resWriter,
 		http.StatusOK,
-		httpx.Envelope{"message": "wallets fetched successfully", "data": wallets},
+		httpx.Envelope{"message": "wallets fetched successfully", "data": wallets, "metadata": metadata},
 		nil,
 	)
 
@@ -94,19 +118,99 @@ func (routes *Routes) GetWallets(resWriter http.ResponseWriter, req *http.Reques
 
 func (routes *Routes) GetSingleWallet(resWriter http.ResponseWriter, req *http.Request) {
 	user := contexts.ContextGetUser(req)
-	currencyCode := routes.httpx.ReadIDParam(req)
 
-	wallets, err := routes.models.Wallets.GetByCurrencyAndUserId(user.ID, currencyCode)
+	wallet, err := routes.models.Wallets.GetForUser(user.ID, routes.httpx.ReadIDParam(req))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "wallet fetched successfully", "data": wallet},
+		nil,
+	)
 
 	if err != nil {
 		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// CloseWallet closes a wallet of the user. Any remaining balance is swept into the
+// wallet given by the sweep_to query parameter (a wallet public id or currency
+// code), otherwise the balance must already be zero.
+func (routes *Routes) CloseWallet(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+	sweepToID := routes.httpx.ReadString(req.URL.Query(), "sweep_to", "")
+
+	wallet, err := routes.models.Wallets.GetForUser(user.ID, routes.httpx.ReadIDParam(req))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	validator := validators.New()
+
+	var sweepTo *wallets.Wallet
+	if sweepToID != "" {
+		sweepTo, err = routes.models.Wallets.GetForUser(user.ID, sweepToID)
+		if err != nil {
+			switch {
+			case errors.Is(err, constants.ErrRecordNotFound):
+				validator.AddError("sweep_to", "must be another of your wallets")
+				routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+			default:
+				routes.httpx.ServerErrorResponse(resWriter, req, err)
+			}
+			return
+		}
+
+		validator.Check(sweepTo.ID != wallet.ID, "sweep_to", "must be another of your wallets")
+		validator.Check(sweepTo.Status != constants.WalletStatusClosed, "sweep_to", "must be an open wallet")
+		if !validator.Valid() {
+			routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+			return
+		}
+	}
+
+	sweep, err := routes.models.Wallets.Close(wallet, sweepTo, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrNonZeroBalance):
+			validator.AddError("sweep_to", "must be provided while the wallet has a balance")
+			routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		case errors.Is(err, constants.ErrLimitExceeded):
+			validator.AddError("sweep_to", "the sweep would go over "+err.Error())
+			routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		case errors.Is(err, constants.ErrWalletClosed):
+			routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the wallet is already closed")
+		case errors.Is(err, constants.ErrPendingHolds):
+			routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the wallet has pending holds, try again once they are settled")
+		case errors.Is(err, constants.ErrWalletFrozen):
+			routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "a frozen wallet cannot be closed or swept from or into")
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
 		return
 	}
 
 	err = routes.httpx.WriteJSON(
 		resWriter,
 		http.StatusOK,
-		httpx.Envelope{"message": "wallet fetched successfully", "data": wallets},
+		httpx.Envelope{"message": "wallet closed successfully", "data": wallet, "sweep": sweep},
 		nil,
 	)
 
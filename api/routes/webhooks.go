@@ -0,0 +1,445 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/thesambayo/digillets-api/api/contexts"
+	"github.com/thesambayo/digillets-api/api/httpx"
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/data/webhooks"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+func (routes *Routes) GetWebhookDeliveries(resWriter http.ResponseWriter, req *http.Request) {
+	filters := listing.Filters{
+		Sort: "-created_at",
+		SortSafelist: map[string]string{
+			"created_at":      "webhook_deliveries.created_at",
+			"next_attempt_at": "webhook_deliveries.next_attempt_at",
+			"attempts":        "webhook_deliveries.attempts",
+		},
+		FieldSafelist: map[string]string{
+			"status":     "webhook_deliveries.status",
+			"event_type": "outbox_events.event_type",
+			"event":      "outbox_events.public_id",
+			"endpoint":   "webhook_endpoints.public_id",
+		},
+		IDColumn: "webhook_deliveries.id",
+	}
+
+	validator := validators.New()
+	routes.httpx.ReadFilters(req.URL.Query(), &filters, validator)
+	if listing.Validate(validator, filters); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	deliveries, metadata, err := routes.models.Webhooks.GetDeliveries(nil, filters)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "webhook deliveries fetched successfully", "data": deliveries, "metadata": metadata},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) GetWebhookDelivery(resWriter http.ResponseWriter, req *http.Request) {
+	delivery, ok := routes.readWebhookDelivery(resWriter, req)
+	if !ok {
+		return
+	}
+
+	err := routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "webhook delivery fetched successfully", "data": delivery},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) RedeliverWebhookDelivery(resWriter http.ResponseWriter, req *http.Request) {
+	delivery, ok := routes.readWebhookDelivery(resWriter, req)
+	if !ok {
+		return
+	}
+
+	err := routes.models.Webhooks.Redeliver(delivery, routes.auditActor(req, audit.ActorAdmin))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrDeliveryPending):
+			routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the delivery is still pending")
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusAccepted,
+		httpx.Envelope{"message": "webhook delivery queued for redelivery", "data": delivery},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// readWebhookDelivery fetches the webhook delivery in the url. When it returns
+// false the error response has already been sent.
+func (routes *Routes) readWebhookDelivery(resWriter http.ResponseWriter, req *http.Request) (*webhooks.Delivery, bool) {
+	delivery, err := routes.models.Webhooks.GetDeliveryByPublicId(routes.httpx.ReadIDParam(req))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return nil, false
+	}
+	return delivery, true
+}
+
+func (routes *Routes) CreateWebhookEndpoint(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	var input struct {
+		URL         string   `json:"url"`
+		Description string   `json:"description"`
+		EventTypes  []string `json:"event_types"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	endpoint := &webhooks.Endpoint{
+		UserID:      user.ID,
+		URL:         input.URL,
+		Description: input.Description,
+		EventTypes:  input.EventTypes,
+	}
+
+	validator := validators.New()
+	if webhooks.ValidateEndpoint(validator, endpoint, routes.config.Env == "development"); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	err = routes.models.Webhooks.InsertEndpoint(endpoint, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusCreated,
+		httpx.Envelope{"message": "webhook endpoint created successfully, keep the secret safe as it will not be shown again", "data": endpoint},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) GetWebhookEndpoints(resWriter http.ResponseWriter, req *http.Request) {
+	user := contexts.ContextGetUser(req)
+
+	endpoints, err := routes.models.Webhooks.GetEndpoints(user.ID)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "webhook endpoints fetched successfully", "data": endpoints},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) GetWebhookEndpoint(resWriter http.ResponseWriter, req *http.Request) {
+	endpoint, ok := routes.readWebhookEndpoint(resWriter, req)
+	if !ok {
+		return
+	}
+
+	err := routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "webhook endpoint fetched successfully", "data": endpoint},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// UpdateWebhookEndpoint changes the fields of an endpoint present in the request.
+func (routes *Routes) UpdateWebhookEndpoint(resWriter http.ResponseWriter, req *http.Request) {
+	endpoint, ok := routes.readWebhookEndpoint(resWriter, req)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		URL         *string  `json:"url"`
+		Description *string  `json:"description"`
+		EventTypes  []string `json:"event_types"`
+		Active      *bool    `json:"active"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	before := *endpoint
+	if input.URL != nil {
+		endpoint.URL = *input.URL
+	}
+	if input.Description != nil {
+		endpoint.Description = *input.Description
+	}
+	if input.EventTypes != nil {
+		endpoint.EventTypes = input.EventTypes
+	}
+	if input.Active != nil {
+		endpoint.Active = *input.Active
+	}
+
+	validator := validators.New()
+	if webhooks.ValidateEndpoint(validator, endpoint, routes.config.Env == "development"); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	err = routes.models.Webhooks.UpdateEndpoint(&before, endpoint, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrEditConflict):
+			routes.httpx.EditConflictResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "webhook endpoint updated successfully", "data": endpoint},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) DeleteWebhookEndpoint(resWriter http.ResponseWriter, req *http.Request) {
+	endpoint, ok := routes.readWebhookEndpoint(resWriter, req)
+	if !ok {
+		return
+	}
+
+	err := routes.models.Webhooks.DeleteEndpoint(endpoint, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "webhook endpoint deleted successfully"},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// RotateWebhookSecret gives an endpoint a new signing secret. The old one keeps
+// signing deliveries alongside it for overlap_hours, 24 by default.
+func (routes *Routes) RotateWebhookSecret(resWriter http.ResponseWriter, req *http.Request) {
+	endpoint, ok := routes.readWebhookEndpoint(resWriter, req)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		OverlapHours *int `json:"overlap_hours"`
+	}
+
+	err := routes.httpx.ReadJSON(resWriter, req, &input)
+	if err != nil {
+		routes.httpx.BadRequestResponse(resWriter, req, err)
+		return
+	}
+
+	overlap := 24 * time.Hour
+	if input.OverlapHours != nil {
+		overlap = time.Duration(*input.OverlapHours) * time.Hour
+	}
+
+	validator := validators.New()
+	validator.Check(overlap >= 0, "overlap_hours", "must not be negative")
+	validator.Check(overlap <= webhooks.MaxOverlap, "overlap_hours", "must not be more than 168")
+	if !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	err = routes.models.Webhooks.RotateSecret(endpoint, overlap, routes.auditActor(req, audit.ActorUser))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrEditConflict):
+			routes.httpx.EditConflictResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "webhook secret rotated successfully, keep the secret safe as it will not be shown again", "data": endpoint},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) GetWebhookAttempts(resWriter http.ResponseWriter, req *http.Request) {
+	endpoint, ok := routes.readWebhookEndpoint(resWriter, req)
+	if !ok {
+		return
+	}
+
+	filters := listing.Filters{
+		Sort: "-created_at",
+		SortSafelist: map[string]string{
+			"created_at": "webhook_attempts.created_at",
+			"latency_ms": "webhook_attempts.latency_ms",
+		},
+		FieldSafelist: map[string]string{
+			"delivery":    "webhook_deliveries.public_id",
+			"event_type":  "outbox_events.event_type",
+			"status_code": "webhook_attempts.status_code",
+		},
+		IDColumn: "webhook_attempts.id",
+	}
+
+	validator := validators.New()
+	routes.httpx.ReadFilters(req.URL.Query(), &filters, validator)
+	if listing.Validate(validator, filters); !validator.Valid() {
+		routes.httpx.FailedValidationResponse(resWriter, req, validator.Errors)
+		return
+	}
+
+	attempts, metadata, err := routes.models.Webhooks.GetAttempts(endpoint.ID, filters)
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusOK,
+		httpx.Envelope{"message": "webhook attempts fetched successfully", "data": attempts, "metadata": metadata},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+func (routes *Routes) SendWebhookTest(resWriter http.ResponseWriter, req *http.Request) {
+	endpoint, ok := routes.readWebhookEndpoint(resWriter, req)
+	if !ok {
+		return
+	}
+
+	deliveryID, err := routes.models.Webhooks.SendTest(endpoint)
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrEndpointInactive):
+			routes.httpx.ErrorResponse(resWriter, req, http.StatusConflict, "the endpoint is inactive")
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return
+	}
+
+	err = routes.httpx.WriteJSON(
+		resWriter,
+		http.StatusAccepted,
+		httpx.Envelope{"message": "test event queued for delivery", "data": map[string]string{"delivery": deliveryID}},
+		nil,
+	)
+
+	if err != nil {
+		routes.httpx.ServerErrorResponse(resWriter, req, err)
+	}
+}
+
+// readWebhookEndpoint fetches the webhook endpoint of the user in the url. When it
+// returns false the error response has already been sent.
+func (routes *Routes) readWebhookEndpoint(resWriter http.ResponseWriter, req *http.Request) (*webhooks.Endpoint, bool) {
+	user := contexts.ContextGetUser(req)
+
+	endpoint, err := routes.models.Webhooks.GetEndpointForUser(user.ID, routes.httpx.ReadIDParam(req))
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			routes.httpx.NotFoundResponse(resWriter, req)
+		default:
+			routes.httpx.ServerErrorResponse(resWriter, req, err)
+		}
+		return nil, false
+	}
+	return endpoint, true
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strconv"
+)
+
+// reminderBatch is how many invoice emails a run of the reminders job sends.
+const reminderBatch = 50
+
+// remindInvoices marks the open invoices past their due date as overdue, then emails
+// the customers of the invoices due a reminder. An email that fails is logged and
+// tried again on the next run.
+func (app *application) remindInvoices() error {
+	overdue, err := app.models.Invoices.MarkOverdue()
+	if err != nil {
+		return err
+	}
+	if overdue > 0 {
+		app.logger.PrintInfo("invoices overdue", map[string]string{"count": strconv.Itoa(overdue)})
+	}
+
+	if !app.mailer.Enabled() {
+		return nil
+	}
+
+	due, err := app.models.Invoices.GetDueReminders(reminderBatch)
+	if err != nil {
+		return err
+	}
+
+	sent := 0
+	for _, invoice := range due {
+		err = app.mailer.Send(invoice.CustomerEmail, "invoice_reminder.tmpl", invoice)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"invoice": invoice.PublicID})
+			continue
+		}
+		if err = app.models.Invoices.MarkReminded(invoice); err != nil {
+			return err
+		}
+		sent++
+	}
+	if sent > 0 {
+		app.logger.PrintInfo("invoice reminders sent", map[string]string{"count": strconv.Itoa(sent)})
+	}
+
+	return nil
+}
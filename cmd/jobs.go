@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/reconciliation"
+)
+
+// systemActor is the audit actor of the changes scheduled jobs make.
+var systemActor = audit.Actor{Type: audit.ActorSystem}
+
+// startJobs starts the scheduled jobs in the background. They stop once ctx is
+// cancelled, and app.wg waits for a run in progress to finish.
+func (app *application) startJobs(ctx context.Context) {
+	app.startJob(ctx, "expire approvals", time.Minute, func() error {
+		expired, err := app.models.Approvals.ExpireDue(systemActor)
+		if err != nil {
+			return err
+		}
+		if expired > 0 {
+			app.logger.PrintInfo("approvals expired", map[string]string{"count": strconv.Itoa(expired)})
+		}
+		return nil
+	})
+
+	app.startJob(ctx, "expire payment authorizations", time.Minute, func() error {
+		expired, err := app.models.Payments.ExpireDue(systemActor)
+		if err != nil {
+			return err
+		}
+		if expired > 0 {
+			app.logger.PrintInfo("payment authorizations expired", map[string]string{"count": strconv.Itoa(expired)})
+		}
+		return nil
+	})
+
+	app.startJob(ctx, "expire checkout sessions", time.Minute, func() error {
+		expired, err := app.models.Payments.ExpireDueCheckoutSessions()
+		if err != nil {
+			return err
+		}
+		if expired > 0 {
+			app.logger.PrintInfo("checkout sessions expired", map[string]string{"count": strconv.Itoa(expired)})
+		}
+		return nil
+	})
+
+	app.startJob(ctx, "expire payment requests", time.Minute, func() error {
+		expired, err := app.models.PaymentRequests.ExpireDue()
+		if err != nil {
+			return err
+		}
+		if expired > 0 {
+			app.logger.PrintInfo("payment requests expired", map[string]string{"count": strconv.Itoa(expired)})
+		}
+		return nil
+	})
+
+	app.startJob(ctx, "resolve payment requests", time.Minute, func() error {
+		resolved, err := app.models.PaymentRequests.ResolveDue(systemActor)
+		if err != nil {
+			return err
+		}
+		if resolved > 0 {
+			app.logger.PrintInfo("payment requests resolved", map[string]string{"count": strconv.Itoa(resolved)})
+		}
+		return nil
+	})
+
+	app.startJob(ctx, "invoice reminders", 10*time.Minute, app.remindInvoices)
+
+	app.startJob(ctx, "dispatch webhooks", 5*time.Second, app.dispatchWebhooks)
+
+	app.startJob(ctx, "prune stream events", time.Hour, func() error {
+		_, err := app.models.Streams.Prune()
+		return err
+	})
+
+	app.startJob(ctx, "reconcile", app.config.Reconciliation.Interval, func() error {
+		return app.reconcile(reconciliation.SourceJob)
+	})
+}
+
+// startJob runs fn every interval until ctx is cancelled. Errors and panics are
+// logged, and the job carries on at the next interval.
+func (app *application) startJob(ctx context.Context, name string, interval time.Duration, fn func() error) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				app.runJob(name, fn)
+			}
+		}
+	}()
+}
+
+// runJob runs a single run of a job, recovering from a panic in it.
+func (app *application) runJob(name string, fn func() error) {
+	defer func() {
+		if err := recover(); err != nil {
+			app.logger.PrintError(fmt.Errorf("%s", err), map[string]string{"job": name})
+		}
+	}()
+
+	if err := fn(); err != nil {
+		app.logger.PrintError(err, map[string]string{"job": name})
+	}
+}
@@ -1,29 +1,82 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 
 	_ "github.com/lib/pq"
 
 	"github.com/thesambayo/digillets-api/api/httpx"
+	"github.com/thesambayo/digillets-api/internal/blobstore"
 	"github.com/thesambayo/digillets-api/internal/config"
 	"github.com/thesambayo/digillets-api/internal/data"
+	"github.com/thesambayo/digillets-api/internal/data/reconciliation"
+	"github.com/thesambayo/digillets-api/internal/dispatch"
+	"github.com/thesambayo/digillets-api/internal/encryption"
 	"github.com/thesambayo/digillets-api/internal/jsonlog"
+	"github.com/thesambayo/digillets-api/internal/mailer"
+	"github.com/thesambayo/digillets-api/internal/money"
+	"github.com/thesambayo/digillets-api/internal/sanctions"
 )
 
 type application struct {
-	config config.Config
-	logger *jsonlog.Logger
-	models *data.Models
-	httpx  *httpx.Utils
-	wg     *sync.WaitGroup
+	config   config.Config
+	logger   *jsonlog.Logger
+	mailer   mailer.Mailer
+	webhooks *dispatch.Client
+	models   *data.Models
+	httpx    *httpx.Utils
+	wg       *sync.WaitGroup
 }
 
 func main() {
+	// The first argument may name a command to run instead of the server, e.g
+	// go run ./cmd/ reconcile -reconciliation-settlement-file=./settlement.csv
+	command := "serve"
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	cfg := config.GetConfig()
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 
+	rounding, err := money.ParseRoundingMode(cfg.Money.Rounding)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	money.DefaultRounding = rounding
+
+	cipher, err := encryption.NewFromHex(cfg.KYC.EncryptionKey)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	blobs, err := blobstore.NewLocal(cfg.KYC.StorageDir)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	screener, err := sanctions.NewScreener(cfg.Sanctions.ListPath, cfg.Sanctions.Threshold)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	if cfg.Sanctions.ListPath == "" {
+		logger.PrintInfo("sanctions screening is off, no list was given", nil)
+	} else {
+		logger.PrintInfo("sanctions list loaded", map[string]string{
+			"path":    cfg.Sanctions.ListPath,
+			"entries": strconv.Itoa(screener.Status().Entries),
+		})
+	}
+
+	if cfg.SMTP.Host == "" {
+		logger.PrintInfo("emails are off, no smtp host was given", nil)
+	}
+
 	db, err := openDB(cfg)
 	if err != nil {
 		logger.PrintFatal(err, nil)
@@ -36,12 +89,22 @@ func main() {
 	app := &application{
 		config: cfg,
 		logger: logger,
-		httpx:  httpx.New(logger),
-		models: data.New(db),
-		wg:     &sync.WaitGroup{},
+		mailer: mailer.New(cfg.SMTP.Host, cfg.SMTP.Port, cfg.SMTP.Username, cfg.SMTP.Password, cfg.SMTP.Sender),
+		// endpoints on this machine or network can be used in development only
+		webhooks: dispatch.NewClient(webhookTimeout, cfg.Env == "development"),
+		httpx:    httpx.New(logger),
+		models:   data.New(db, cipher, blobs, screener),
+		wg:       &sync.WaitGroup{},
 	}
 
-	err = app.serve()
+	switch command {
+	case "serve":
+		err = app.serve()
+	case "reconcile":
+		err = app.reconcile(reconciliation.SourceCommand)
+	default:
+		err = fmt.Errorf("unknown command %q, want serve or reconcile", command)
+	}
 	if err != nil {
 		app.logger.PrintFatal(err, nil)
 	}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/thesambayo/digillets-api/internal/settlement"
+)
+
+// reconcile reconciles the ledger, and the configured settlement file if any, and
+// logs what it found. It runs as the reconcile command and as a scheduled job.
+func (app *application) reconcile(source string) error {
+	path := app.config.Reconciliation.SettlementFile
+
+	var lines []settlement.Line
+	if path != "" {
+		var err error
+		lines, err = settlement.LoadFile(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	run, err := app.models.Reconciliation.Run(source, path, lines, systemActor)
+	if err != nil {
+		return err
+	}
+
+	app.logger.PrintInfo("reconciliation completed", map[string]string{
+		"run":                run.PublicID,
+		"source":             run.Source,
+		"wallets_checked":    strconv.Itoa(run.WalletsChecked),
+		"currencies_checked": strconv.Itoa(run.CurrenciesChecked),
+		"settlement_lines":   strconv.Itoa(run.SettlementLines),
+		"breaks_found":       strconv.Itoa(run.BreaksFound),
+	})
+	return nil
+}
@@ -11,19 +11,45 @@ import (
 	"time"
 
 	"github.com/thesambayo/digillets-api/api/routes"
+	"github.com/thesambayo/digillets-api/internal/data/currencies"
+	"github.com/thesambayo/digillets-api/internal/data/streams"
+	"github.com/thesambayo/digillets-api/internal/notify"
 )
 
 func (app *application) serve() error {
+	// Listen for the changes to push to the clients of the real-time stream and
+	// the rates feed, whichever instance they are committed through.
+	hub, err := notify.New(app.config.DB.Dsn, func(err error) {
+		app.logger.PrintError(err, map[string]string{"component": "notify"})
+	}, streams.Channel, currencies.RatesChannel)
+	if err != nil {
+		return err
+	}
+
 	// Declare an HTTP httpServer with some sensible timeout settings, which listens on the
 	// port provided in the config struct and uses the serveMux we created above as the
 	// handler.
 	httpServer := &http.Server{
 		Addr:         fmt.Sprintf(":%d", app.config.Port),
-		Handler:      routes.Handlers(app.config, app.models, app.httpx),
+		Handler:      routes.Handlers(app.config, app.models, app.httpx, hub),
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
 	}
+	// Streams never go idle, so they are ended for Shutdown() not to wait on them,
+	// and the rates feeds, which Shutdown() does not track, are told to go away.
+	httpServer.RegisterOnShutdown(hub.Close)
+
+	// Start the scheduled jobs, they are stopped when the server shuts down.
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	app.startJobs(jobsCtx)
+
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		hub.Run(jobsCtx)
+	}()
 
 	// Create a shutdownError channel.
 	// We will use this to receive any errors returned by the graceful Shutdown() function.
@@ -72,6 +98,9 @@ func (app *application) serve() error {
 			"addr": httpServer.Addr,
 		})
 
+		// Stop the scheduled jobs from starting any new runs.
+		stopJobs()
+
 		// Call Wait() to block until our WaitGroup counter is zero --- essentially
 		// blocking until the background goroutines have finished. Then we return nil on
 		// the shutdownError channel, to indicate that the shutdown completed without
@@ -90,7 +119,7 @@ func (app *application) serve() error {
 	// return a http.ErrServerClosed error. So if we see this error, it is actually a
 	// good thing and an indication that the graceful shutdown has started. So we check
 	// specifically for this, only returning the error if it is NOT http.ErrServerClosed.
-	err := httpServer.ListenAndServe()
+	err = httpServer.ListenAndServe()
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/dispatch"
+)
+
+const (
+	// webhookBatch is how many deliveries a run of the dispatcher claims, and
+	// webhookWorkers how many of them it sends at once.
+	webhookBatch   = 20
+	webhookWorkers = 5
+	// webhookTimeout is how long an endpoint has to respond. The lease on a claimed
+	// delivery comfortably outlasts sending the whole batch.
+	webhookTimeout = 10 * time.Second
+	webhookLease   = 2 * time.Minute
+)
+
+// dispatchWebhooks queues deliveries of the events written to the outbox, then sends
+// the deliveries that are due. A run finishes sending what it claimed even when the
+// server is shutting down, so that no attempt is left unrecorded.
+func (app *application) dispatchWebhooks() error {
+	events, err := app.models.Webhooks.FanOut()
+	if err != nil {
+		return err
+	}
+
+	due, err := app.models.Webhooks.ClaimDue(webhookBatch, webhookLease)
+	if err != nil {
+		return err
+	}
+	if events == 0 && len(due) == 0 {
+		return nil
+	}
+
+	queue := make(chan int)
+	delivered := make([]bool, len(due))
+	var wg sync.WaitGroup
+	for range min(webhookWorkers, len(due)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				delivery := due[i]
+				result := app.webhooks.Send(context.Background(), dispatch.Request{
+					URL:        delivery.URL,
+					EventType:  delivery.EventType,
+					DeliveryID: delivery.PublicID,
+					Body:       delivery.Body,
+					Secrets:    delivery.Secrets,
+				})
+				delivered[i] = result.Delivered()
+
+				if err := app.models.Webhooks.RecordAttempt(delivery, result); err != nil {
+					app.logger.PrintError(err, map[string]string{"delivery": delivery.PublicID})
+				}
+			}
+		}()
+	}
+	for i := range due {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	count := 0
+	for _, ok := range delivered {
+		if ok {
+			count++
+		}
+	}
+	app.logger.PrintInfo("webhooks dispatched", map[string]string{
+		"events":    strconv.Itoa(events),
+		"attempted": strconv.Itoa(len(due)),
+		"delivered": strconv.Itoa(count),
+	})
+	return nil
+}
@@ -3,12 +3,9 @@ module github.com/thesambayo/digillets-api
 go 1.23.4
 
 require (
+	github.com/lib/pq v1.10.9
+	github.com/matoous/go-nanoid/v2 v2.1.0
 	github.com/pascaldekloe/jwt v1.12.0
 	golang.org/x/crypto v0.31.0
 	golang.org/x/time v0.8.0
 )
-
-require (
-	github.com/lib/pq v1.10.9 // indirect
-	github.com/matoous/go-nanoid/v2 v2.1.0 // indirect
-)
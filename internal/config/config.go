@@ -3,6 +3,9 @@ package config
 import (
 	"flag"
 	"strings"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/money"
 )
 
 type Cors struct {
@@ -22,6 +25,60 @@ type Limiter struct {
 	Enabled bool
 }
 
+// Money holds the settings for amount arithmetic. Rounding is the name of the
+// rounding mode used when amounts are rounded, e.g half_even or half_up.
+type Money struct {
+	Rounding string
+}
+
+// KYC holds the settings for identity verification. EncryptionKey is the hex
+// encoded 32 byte key personal data and documents are encrypted with, and
+// StorageDir the directory documents are stored in.
+type KYC struct {
+	EncryptionKey string
+	StorageDir    string
+}
+
+// Sanctions holds the settings for sanctions screening. ListPath is the OFAC SDN
+// file, .csv or .xml, names are screened against, screening is off without one,
+// and Threshold the score from 0 to 1 a potential match must reach.
+type Sanctions struct {
+	ListPath  string
+	Threshold float64
+}
+
+// Approvals holds the settings for actions that need a second user to approve them.
+// Transfers and payments to merchants of TransferThreshold or more in the base
+// currency need approval, none do when it is zero, and approvals expire after TTL.
+type Approvals struct {
+	TransferThreshold money.Amount
+	TTL               time.Duration
+}
+
+// Reconciliation holds the settings for reconciling the ledger. The job runs every
+// Interval, and SettlementFile is the latest settlement file of the payment
+// provider to reconcile with our deposits and withdrawals, none without one.
+type Reconciliation struct {
+	Interval       time.Duration
+	SettlementFile string
+}
+
+// PaymentRequests holds the settings for users requesting money from each other.
+// Requests not answered within TTL expire.
+type PaymentRequests struct {
+	TTL time.Duration
+}
+
+// SMTP holds the settings of the server emails are sent through. Emails are off
+// without a Host. Sender is the From address, e.g "Digillets <no-reply@digillets.com>".
+type SMTP struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Sender   string
+}
+
 type DB struct {
 	Dsn          string
 	MaxOpenConns int
@@ -31,12 +88,19 @@ type DB struct {
 
 // Config holds shared configuration settings.
 type Config struct {
-	Port    int
-	Env     string
-	Jwt     Jwt
-	Cors    Cors
-	Limiter Limiter
-	DB      DB
+	Port            int
+	Env             string
+	Jwt             Jwt
+	Cors            Cors
+	Limiter         Limiter
+	DB              DB
+	Money           Money
+	KYC             KYC
+	Sanctions       Sanctions
+	Approvals       Approvals
+	Reconciliation  Reconciliation
+	SMTP            SMTP
+	PaymentRequests PaymentRequests
 }
 
 // GetConfig creates and returns a new Config.
@@ -63,6 +127,36 @@ func GetConfig() Config {
 		return nil
 	})
 
+	flag.StringVar(&cfg.Money.Rounding, "money-rounding", DefaultConfig().Money.Rounding, "Rounding mode for amounts (half_even|half_up|half_down|down|up|floor|ceiling)")
+
+	flag.StringVar(&cfg.KYC.EncryptionKey, "kyc-encryption-key", DefaultConfig().KYC.EncryptionKey, "KYC data encryption key (64 hex characters)")
+	flag.StringVar(&cfg.KYC.StorageDir, "kyc-storage-dir", DefaultConfig().KYC.StorageDir, "KYC documents storage directory")
+
+	flag.StringVar(&cfg.Sanctions.ListPath, "sanctions-list", DefaultConfig().Sanctions.ListPath, "Sanctions list file in the OFAC SDN format (.csv|.xml)")
+	flag.Float64Var(&cfg.Sanctions.Threshold, "sanctions-threshold", DefaultConfig().Sanctions.Threshold, "Sanctions match score threshold (0-1)")
+
+	cfg.Approvals.TransferThreshold = DefaultConfig().Approvals.TransferThreshold
+	flag.Func("approvals-transfer-threshold", "Transfer or merchant payment amount in the base currency from which approval is needed (0 to turn off)", func(val string) error {
+		threshold, err := money.Parse(val)
+		if err != nil {
+			return err
+		}
+		cfg.Approvals.TransferThreshold = threshold
+		return nil
+	})
+	flag.DurationVar(&cfg.Approvals.TTL, "approvals-ttl", DefaultConfig().Approvals.TTL, "How long approvals wait for a decision before they expire")
+
+	flag.DurationVar(&cfg.Reconciliation.Interval, "reconciliation-interval", DefaultConfig().Reconciliation.Interval, "How often the reconciliation job runs")
+	flag.StringVar(&cfg.Reconciliation.SettlementFile, "reconciliation-settlement-file", DefaultConfig().Reconciliation.SettlementFile, "Provider settlement file (.csv) to reconcile with deposits and withdrawals")
+
+	flag.DurationVar(&cfg.PaymentRequests.TTL, "payment-requests-ttl", DefaultConfig().PaymentRequests.TTL, "How long payment requests wait for an answer before they expire")
+
+	flag.StringVar(&cfg.SMTP.Host, "smtp-host", DefaultConfig().SMTP.Host, "SMTP host, emails are off without one")
+	flag.IntVar(&cfg.SMTP.Port, "smtp-port", DefaultConfig().SMTP.Port, "SMTP port")
+	flag.StringVar(&cfg.SMTP.Username, "smtp-username", DefaultConfig().SMTP.Username, "SMTP username")
+	flag.StringVar(&cfg.SMTP.Password, "smtp-password", DefaultConfig().SMTP.Password, "SMTP password")
+	flag.StringVar(&cfg.SMTP.Sender, "smtp-sender", DefaultConfig().SMTP.Sender, "SMTP sender")
+
 	flag.StringVar(&cfg.Jwt.Secret, "jwt-secret", DefaultConfig().Jwt.Secret, "JWT secret")
 	flag.Parse()
 	return cfg
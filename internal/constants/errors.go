@@ -9,4 +9,37 @@ var (
 	ErrEditConflict        = errors.New("edit conflict")
 	ErrRecordNotFound      = errors.New("record not found")
 	ErrDuplicateUserWallet = errors.New("duplicate wallet")
+
+	ErrInsufficientFunds     = errors.New("insufficient funds")
+	ErrUnbalancedTransaction = errors.New("unbalanced transaction")
+	ErrWalletFrozen          = errors.New("wallet frozen")
+	ErrWalletClosed          = errors.New("wallet closed")
+	ErrPendingHolds          = errors.New("wallet has pending holds")
+	ErrNonZeroBalance        = errors.New("wallet balance is not zero")
+	ErrAmountPrecision       = errors.New("amount has more decimals than its currency allows")
+	ErrLimitExceeded         = errors.New("limit exceeded")
+	ErrPendingKYCSubmission  = errors.New("a kyc submission is already pending")
+	ErrKYCAlreadyReviewed    = errors.New("kyc submission already reviewed")
+	ErrRiskAlreadyReviewed   = errors.New("risk decision already reviewed")
+	ErrMatchAlreadyReviewed  = errors.New("sanctions match already reviewed")
+	ErrApprovalDecided       = errors.New("approval already decided")
+	ErrApprovalExpired       = errors.New("approval expired")
+	ErrSelfApproval          = errors.New("approver is the initiator")
+	ErrBreakResolved         = errors.New("reconciliation break already resolved")
+	ErrDeliveryPending       = errors.New("webhook delivery is still pending")
+	ErrEndpointInactive      = errors.New("webhook endpoint is inactive")
+	ErrInvalidGrant          = errors.New("invalid, expired or revoked authorization grant")
+	ErrDuplicateMerchant     = errors.New("user already has a merchant account")
+	ErrPaymentNotAuthorized  = errors.New("payment is not authorized")
+	ErrAuthorizationExpired  = errors.New("payment authorization expired")
+	ErrPaymentNotRefundable  = errors.New("payment is not captured")
+	ErrAmountExceedsPayment  = errors.New("amount is more than what is left of the payment")
+	ErrSessionNotOpen        = errors.New("checkout session is not open")
+	ErrInvoiceNotDraft       = errors.New("invoice is not a draft")
+	ErrInvoiceNotPayable     = errors.New("invoice is not open or overdue")
+	ErrInvoiceNotVoidable    = errors.New("invoice is paid in part or in full")
+	ErrAmountExceedsInvoice  = errors.New("amount is more than what is due on the invoice")
+	ErrRequestNotPending     = errors.New("payment request is not pending")
+	ErrRequestExpired        = errors.New("payment request expired")
+	ErrTransferDeclined      = errors.New("transfer was declined")
 )
@@ -14,4 +14,64 @@ const (
 
 	// PrefixTransactionID is used for transaction IDs.
 	PrefixTransactionID = "txn_"
+
+	// PrefixKYCSubmissionID is used for KYC submission IDs.
+	PrefixKYCSubmissionID = "kyc_"
+
+	// PrefixHoldID is used for hold IDs.
+	PrefixHoldID = "hld_"
+
+	// PrefixRiskDecisionID is used for risk decision IDs.
+	PrefixRiskDecisionID = "rsk_"
+
+	// PrefixSanctionsMatchID is used for sanctions match IDs.
+	PrefixSanctionsMatchID = "snm_"
+
+	// PrefixApprovalID is used for pending approval IDs.
+	PrefixApprovalID = "apr_"
+
+	// PrefixReconciliationRunID is used for reconciliation run IDs.
+	PrefixReconciliationRunID = "rec_"
+
+	// PrefixReconciliationBreakID is used for reconciliation break IDs.
+	PrefixReconciliationBreakID = "brk_"
+
+	// PrefixEventID is used for outbox event IDs.
+	PrefixEventID = "evt_"
+
+	// PrefixWebhookEndpointID is used for webhook endpoint IDs.
+	PrefixWebhookEndpointID = "whk_"
+
+	// PrefixWebhookDeliveryID is used for webhook delivery IDs.
+	PrefixWebhookDeliveryID = "whd_"
+
+	// PrefixAPIKeyID is used for API key IDs.
+	PrefixAPIKeyID = "key_"
+
+	// PrefixOAuthClientID is used for OAuth client IDs.
+	PrefixOAuthClientID = "app_"
+
+	// PrefixOAuthGrantID is used for OAuth grant IDs.
+	PrefixOAuthGrantID = "grt_"
+
+	// PrefixMerchantID is used for merchant IDs.
+	PrefixMerchantID = "mer_"
+
+	// PrefixPaymentID is used for payment IDs.
+	PrefixPaymentID = "pay_"
+
+	// PrefixRefundID is used for payment refund IDs.
+	PrefixRefundID = "rfd_"
+
+	// PrefixCheckoutSessionID is used for checkout session IDs.
+	PrefixCheckoutSessionID = "cs_"
+
+	// PrefixInvoiceID is used for invoice IDs.
+	PrefixInvoiceID = "inv_"
+
+	// PrefixInvoicePaymentID is used for invoice payment IDs.
+	PrefixInvoicePaymentID = "ipy_"
+
+	// PrefixPaymentRequestID is used for payment request IDs.
+	PrefixPaymentRequestID = "preq_"
 )
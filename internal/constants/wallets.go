@@ -0,0 +1,24 @@
+package constants
+
+// Wallet kinds. Customers hold user wallets, the system user holds one house wallet
+// of every other kind per currency, which the ledger posts against to keep each
+// currency balanced.
+const (
+	WalletKindUser = "user"
+	// WalletKindFX takes the other side of currency conversions.
+	WalletKindFX = "fx"
+	// WalletKindFee collects the fees charged to customers.
+	WalletKindFee = "fee"
+	// WalletKindAdjustments is the suspense account manual adjustments by staff are
+	// posted against.
+	WalletKindAdjustments = "adjustments"
+)
+
+// Wallet statuses.
+const (
+	WalletStatusActive = "active"
+	WalletStatusClosed = "closed"
+)
+
+// SystemUserPublicID is the public id of the user that owns the house wallets.
+const SystemUserPublicID = "usr_system"
@@ -0,0 +1,95 @@
+package adjustments
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/transactions"
+	"github.com/thesambayo/digillets-api/internal/data/wallets"
+	"github.com/thesambayo/digillets-api/internal/money"
+	"github.com/thesambayo/digillets-api/internal/publicid"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// Directions of an adjustment, from the point of view of the wallet adjusted.
+const (
+	DirectionCredit = "credit"
+	DirectionDebit  = "debit"
+)
+
+// Reason codes for adjusting a wallet.
+var Reasons = []string{
+	"goodwill",
+	"chargeback",
+	"correction",
+	"reversal",
+	"other",
+}
+
+// Adjustment is a manual credit or debit of a wallet by staff, posted against the
+// adjustments house wallet of its currency so that the ledger stays balanced.
+// Reference ties it to whatever it is for, e.g a support ticket or a chargeback.
+type Adjustment struct {
+	TransactionID string       `json:"transaction_id,omitempty"`
+	Wallet        string       `json:"wallet"`
+	Direction     string       `json:"direction"`
+	Amount        money.Amount `json:"amount"`
+	Currency      string       `json:"currency"`
+	Reason        string       `json:"reason"`
+	Reference     string       `json:"reference"`
+	Note          string       `json:"note"`
+	RequestedBy   string       `json:"requested_by"`
+	CreatedAt     *time.Time   `json:"created_at,omitempty"`
+}
+
+func ValidateAdjustment(validator *validators.Validator, adjustment *Adjustment) {
+	validator.Check(validators.In(adjustment.Direction, DirectionCredit, DirectionDebit), "direction", "must be credit or debit")
+	validator.Check(adjustment.Amount.IsPositive(), "amount", "must be greater than zero")
+	validator.Check(adjustment.Reason != "", "reason", "must be provided")
+	validator.Check(validators.In(adjustment.Reason, Reasons...), "reason", "must be one of the listed reason codes")
+	validator.Check(adjustment.Reference != "", "reference", "must be provided")
+	validator.Check(len(adjustment.Reference) <= 100, "reference", "must not be more than 100 characters long")
+	validator.Check(len(adjustment.Note) <= 1000, "note", "must not be more than 1000 characters long")
+}
+
+// CreateTx posts an adjustment of a wallet to the ledger within an existing
+// database transaction, against the adjustments house wallet of its currency. A
+// debit is subject to the same checks as any other, it cannot take the wallet
+// below what it has available.
+func CreateTx(ctx context.Context, tx *sql.Tx, adjustment *Adjustment, wallet *wallets.Wallet, actor audit.Actor) error {
+	suspense, err := wallets.GetHouseWalletTx(ctx, tx, constants.WalletKindAdjustments, wallet.Currency.ID)
+	if err != nil {
+		return err
+	}
+
+	publicID, err := publicid.New(constants.PrefixTransactionID)
+	if err != nil {
+		return err
+	}
+	transaction := &transactions.Transaction{
+		PublicID:    publicID,
+		Type:        transactions.TypeAdjustment,
+		Reference:   adjustment.Reference,
+		Description: fmt.Sprintf("Adjustment (%s)", adjustment.Reason),
+	}
+
+	amount := adjustment.Amount
+	if adjustment.Direction == DirectionDebit {
+		amount = amount.Neg()
+	}
+	entries := []transactions.Entry{
+		{WalletID: wallet.ID, Amount: amount},
+		{WalletID: suspense, Amount: amount.Neg()},
+	}
+	if err = transactions.PostTx(ctx, tx, transaction, entries); err != nil {
+		return err
+	}
+	adjustment.TransactionID = transaction.PublicID
+	adjustment.CreatedAt = &transaction.CreatedAt
+
+	return audit.RecordTx(ctx, tx, actor, "ledger.adjust", "transaction", adjustment.TransactionID, nil, adjustment)
+}
@@ -0,0 +1,310 @@
+package apikeys
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/publicid"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// Modes. Live keys act on real money, test keys are for building an integration
+// and cannot move any.
+const (
+	ModeLive = "live"
+	ModeTest = "test"
+)
+
+// Scopes limit what a key can do.
+const (
+	// ScopeRead allows reading wallets, statements, limits and rates.
+	ScopeRead = "read"
+	// ScopePayments allows moving money between wallets.
+	ScopePayments = "payments"
+	// ScopePayouts allows paying money out of the platform.
+	ScopePayouts = "payouts"
+)
+
+// Scopes are the scopes a key can be given.
+var Scopes = []string{ScopeRead, ScopePayments, ScopePayouts}
+
+// keyPrefixes start the keys of each mode, so that a key is recognisable as one,
+// and as live or test, at a glance.
+var keyPrefixes = map[string]string{
+	ModeLive: "sk_live_",
+	ModeTest: "sk_test_",
+}
+
+// IsKey reports whether a bearer token looks like an API key rather than a JWT.
+func IsKey(token string) bool {
+	return strings.HasPrefix(token, keyPrefixes[ModeLive]) || strings.HasPrefix(token, keyPrefixes[ModeTest])
+}
+
+// APIKey represents the api_keys table in the database. Key is only set when the
+// key has just been created, it cannot be read back afterwards.
+type APIKey struct {
+	ID           int64      `json:"-"`
+	PublicID     string     `json:"public_id"`
+	UserID       int64      `json:"-"`
+	UserPublicID string     `json:"-"`
+	Name         string     `json:"name"`
+	Mode         string     `json:"mode"`
+	Scopes       []string   `json:"scopes"`
+	Prefix       string     `json:"prefix"`
+	Key          string     `json:"key,omitempty"`
+	LastUsedAt   *time.Time `json:"last_used_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// Has reports whether the key was given a scope.
+func (apiKey *APIKey) Has(scope string) bool {
+	return validators.In(scope, apiKey.Scopes...)
+}
+
+func ValidateAPIKey(validator *validators.Validator, apiKey *APIKey) {
+	validator.Check(apiKey.Name != "", "name", "must be provided")
+	validator.Check(len(apiKey.Name) <= 100, "name", "must not be more than 100 characters long")
+	validator.Check(validators.In(apiKey.Mode, ModeLive, ModeTest), "mode", "must be live or test")
+	validator.Check(len(apiKey.Scopes) != 0, "scopes", "must contain at least one scope")
+	validator.Check(validators.Unique(apiKey.Scopes), "scopes", "must not contain duplicate values")
+	for _, scope := range apiKey.Scopes {
+		validator.Check(validators.In(scope, Scopes...), "scopes", "must only contain read, payments or payouts")
+	}
+}
+
+// hash returns what is stored of a key. Keys are long and random, so a fast hash
+// is as good as a slow one at keeping them from being recovered.
+func hash(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
+
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// Insert creates a key, which is set on apiKey to be shown to the user once.
+func (apiKeyModel APIKeyModel) Insert(apiKey *APIKey, actor audit.Actor) error {
+	publicID, err := publicid.New(constants.PrefixAPIKeyID)
+	if err != nil {
+		return err
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	key := keyPrefixes[apiKey.Mode] + base64.RawURLEncoding.EncodeToString(random)
+
+	apiKey.PublicID = publicID
+	apiKey.Prefix = key[:len(keyPrefixes[apiKey.Mode])+8]
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := apiKeyModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO api_keys (public_id, user_id, name, mode, scopes, prefix, key_hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at`,
+		apiKey.PublicID, apiKey.UserID, apiKey.Name, apiKey.Mode, pq.Array(apiKey.Scopes), apiKey.Prefix, hash(key),
+	).Scan(&apiKey.ID, &apiKey.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	err = audit.RecordTx(ctx, tx, actor, "api_key.create", "api_key", apiKey.PublicID, nil, apiKey)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	apiKey.Key = key
+	return nil
+}
+
+const columns = `
+	api_keys.id,
+	api_keys.public_id,
+	api_keys.user_id,
+	users.public_id,
+	api_keys.name,
+	api_keys.mode,
+	api_keys.scopes,
+	api_keys.prefix,
+	api_keys.last_used_at,
+	api_keys.revoked_at,
+	api_keys.created_at`
+
+func (apiKey *APIKey) scanDestinations() []interface{} {
+	return []interface{}{
+		&apiKey.ID,
+		&apiKey.PublicID,
+		&apiKey.UserID,
+		&apiKey.UserPublicID,
+		&apiKey.Name,
+		&apiKey.Mode,
+		pq.Array(&apiKey.Scopes),
+		&apiKey.Prefix,
+		&apiKey.LastUsedAt,
+		&apiKey.RevokedAt,
+		&apiKey.CreatedAt,
+	}
+}
+
+// GetByKey returns the key a bearer token is, unless it has been revoked.
+func (apiKeyModel APIKeyModel) GetByKey(key string) (*APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var apiKey APIKey
+	err := apiKeyModel.DB.QueryRowContext(ctx, `
+		SELECT`+columns+`
+		FROM api_keys
+		JOIN users ON users.id = api_keys.user_id
+		WHERE api_keys.key_hash = $1 AND api_keys.revoked_at IS NULL`,
+		hash(key),
+	).Scan(apiKey.scanDestinations()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, constants.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &apiKey, nil
+}
+
+// Touch records that a key was just used. It is only written once a minute at
+// most, so that busy keys do not cost a write per request.
+func (apiKeyModel APIKeyModel) Touch(apiKey *APIKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := apiKeyModel.DB.ExecContext(ctx, `
+		UPDATE api_keys
+		SET last_used_at = NOW()
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`,
+		apiKey.ID,
+	)
+	return err
+}
+
+// GetAllForUser returns the keys of a user, revoked ones included, the latest
+// first.
+func (apiKeyModel APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := apiKeyModel.DB.QueryContext(ctx, `
+		SELECT`+columns+`
+		FROM api_keys
+		JOIN users ON users.id = api_keys.user_id
+		WHERE api_keys.user_id = $1
+		ORDER BY api_keys.id DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	apiKeys := []*APIKey{}
+	for rows.Next() {
+		var apiKey APIKey
+		if err := rows.Scan(apiKey.scanDestinations()...); err != nil {
+			return nil, err
+		}
+		apiKeys = append(apiKeys, &apiKey)
+	}
+
+	return apiKeys, rows.Err()
+}
+
+// GetForUser returns a key of a user by its public id.
+func (apiKeyModel APIKeyModel) GetForUser(userID int64, publicID string) (*APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var apiKey APIKey
+	err := apiKeyModel.DB.QueryRowContext(ctx, `
+		SELECT`+columns+`
+		FROM api_keys
+		JOIN users ON users.id = api_keys.user_id
+		WHERE api_keys.user_id = $1 AND api_keys.public_id = $2`,
+		userID, publicID,
+	).Scan(apiKey.scanDestinations()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, constants.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &apiKey, nil
+}
+
+// Revoke revokes a key, which stops working straight away. Revoking a revoked key
+// does nothing.
+func (apiKeyModel APIKeyModel) Revoke(apiKey *APIKey, actor audit.Actor) error {
+	if apiKey.RevokedAt != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := apiKeyModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE api_keys
+		SET revoked_at = NOW()
+		WHERE id = $1 AND revoked_at IS NULL
+		RETURNING revoked_at`,
+		apiKey.ID,
+	).Scan(&apiKey.RevokedAt)
+	if err != nil {
+		switch {
+		// revoked in the meantime
+		case errors.Is(err, sql.ErrNoRows):
+			return nil
+		default:
+			return err
+		}
+	}
+
+	before := map[string]interface{}{"revoked_at": nil}
+	after := map[string]interface{}{"revoked_at": apiKey.RevokedAt}
+	err = audit.RecordTx(ctx, tx, actor, "api_key.revoke", "api_key", apiKey.PublicID, before, after)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,545 @@
+package approvals
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/data/wallets"
+	"github.com/thesambayo/digillets-api/internal/money"
+	"github.com/thesambayo/digillets-api/internal/publicid"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// Actions that need approval.
+const (
+	ActionTransfer   = "transfer"
+	ActionAdjustment = "adjustment"
+	ActionPayment    = "payment"
+)
+
+// Approval statuses. An approval is pending until a second user approves or rejects
+// it, or it expires.
+const (
+	StatusPending  = "pending"
+	StatusApproved = "approved"
+	StatusRejected = "rejected"
+	StatusExpired  = "expired"
+)
+
+// Trail events.
+const (
+	EventCreated  = "created"
+	EventApproved = "approved"
+	EventRejected = "rejected"
+	EventExpired  = "expired"
+)
+
+// HoldReason is the reason of the holds placed on debits waiting for approval.
+const HoldReason = "approval"
+
+// Approval represents the pending_approvals table in the database: an action a user
+// started that another user must approve before it is executed. Payload is what the
+// action is executed with, and ResultID the public id of what executing it made.
+type Approval struct {
+	ID           int64           `json:"-"`
+	PublicID     string          `json:"public_id"`
+	Action       string          `json:"action"`
+	InitiatorID  int64           `json:"-"`
+	InitiatedBy  string          `json:"initiated_by"`
+	WalletID     int64           `json:"-"`
+	Wallet       string          `json:"wallet"`
+	Amount       money.Amount    `json:"amount"`
+	Currency     string          `json:"currency"`
+	BaseAmount   money.Amount    `json:"base_amount"`
+	Payload      json.RawMessage `json:"payload"`
+	HoldID       string          `json:"hold_id,omitempty"`
+	Status       string          `json:"status"`
+	ExpiresAt    time.Time       `json:"expires_at"`
+	DecidedBy    string          `json:"decided_by,omitempty"`
+	DecidedAt    *time.Time      `json:"decided_at,omitempty"`
+	DecisionNote string          `json:"decision_note,omitempty"`
+	ResultID     string          `json:"result_id,omitempty"`
+	Trail        []Event         `json:"trail,omitempty"`
+	CreatedAt    time.Time       `json:"created_at"`
+	UpdatedAt    time.Time       `json:"updated_at"`
+}
+
+// Event is a step in the trail of an approval. Expiries have no actor.
+type Event struct {
+	Event     string    `json:"event"`
+	Actor     string    `json:"actor,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Decision is an approver's decision on an approval.
+type Decision struct {
+	Approve   bool
+	Note      string
+	DeciderID int64
+}
+
+func ValidateDecision(validator *validators.Validator, decision *Decision) {
+	if !decision.Approve {
+		validator.Check(decision.Note != "", "note", "must be provided when rejecting")
+	}
+	validator.Check(len(decision.Note) <= 1000, "note", "must not be more than 1000 characters long")
+}
+
+// Executor executes an approved action within the database transaction deciding
+// it, and returns the public id of what it made.
+type Executor func(ctx context.Context, tx *sql.Tx) (string, error)
+
+type ApprovalModel struct {
+	DB *sql.DB
+}
+
+// Create records an action waiting for approval. See CreateTx.
+func (approvalModel ApprovalModel) Create(approval *Approval, hold money.Amount, actor audit.Actor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := approvalModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = CreateTx(ctx, tx, approval, hold, actor); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CreateTx records an action waiting for approval until its expiry within an
+// existing database transaction, and holds hold on its wallet meanwhile, unless
+// hold is zero.
+func CreateTx(ctx context.Context, tx *sql.Tx, approval *Approval, hold money.Amount, actor audit.Actor) error {
+	var err error
+	approval.PublicID, err = publicid.New(constants.PrefixApprovalID)
+	if err != nil {
+		return err
+	}
+	approval.Status = StatusPending
+
+	if hold.IsPositive() {
+		approval.HoldID, err = wallets.PlaceHoldTx(ctx, tx, approval.WalletID, hold, HoldReason, approval.PublicID, approval.ExpiresAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO pending_approvals
+			(public_id, action, initiated_by, wallet_id, amount, currency, base_amount, payload, hold_id, status, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id, created_at, updated_at`,
+		approval.PublicID,
+		approval.Action,
+		approval.InitiatorID,
+		approval.WalletID,
+		approval.Amount,
+		approval.Currency,
+		approval.BaseAmount,
+		string(approval.Payload),
+		approval.HoldID,
+		approval.Status,
+		approval.ExpiresAt,
+	).Scan(&approval.ID, &approval.CreatedAt, &approval.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	event, err := insertEventTx(ctx, tx, approval.ID, EventCreated, &approval.InitiatorID, actor.PublicID, "")
+	if err != nil {
+		return err
+	}
+	approval.Trail = []Event{event}
+
+	after := map[string]interface{}{
+		"action":       approval.Action,
+		"amount":       approval.Amount,
+		"currency":     approval.Currency,
+		"hold_id":      approval.HoldID,
+		"expires_at":   approval.ExpiresAt,
+		"initiated_by": approval.InitiatedBy,
+	}
+	return audit.RecordTx(ctx, tx, actor, "approval.create", "approval", approval.PublicID, nil, after)
+}
+
+// Decide approves or rejects a pending approval. The approver must not be the user
+// who started the action. The hold is released either way, before an approved
+// action is executed so that its funds are free for it; if executing fails nothing
+// is decided. An approval past its expiry is expired instead, and
+// ErrApprovalExpired returned.
+func (approvalModel ApprovalModel) Decide(approval *Approval, decision Decision, actor audit.Actor, execute Executor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := approvalModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var expired bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT status, expires_at <= NOW()
+		FROM pending_approvals
+		WHERE id = $1
+		FOR UPDATE`,
+		approval.ID,
+	).Scan(&status, &expired)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return constants.ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	switch {
+	case status != StatusPending:
+		return constants.ErrApprovalDecided
+	case expired:
+		if err = expireTx(ctx, tx, approval, actor); err != nil {
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		return constants.ErrApprovalExpired
+	case decision.DeciderID == approval.InitiatorID:
+		return constants.ErrSelfApproval
+	}
+
+	if approval.HoldID != "" {
+		if err = wallets.SettleHoldTx(ctx, tx, approval.HoldID, wallets.HoldStatusReleased); err != nil {
+			return err
+		}
+	}
+
+	action, event := "approval.reject", EventRejected
+	approval.Status = StatusRejected
+	if decision.Approve {
+		action, event = "approval.approve", EventApproved
+		approval.Status = StatusApproved
+
+		approval.ResultID, err = execute(ctx, tx)
+		if err != nil {
+			return err
+		}
+	}
+	approval.DecisionNote = decision.Note
+	approval.DecidedBy = actor.PublicID
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE pending_approvals
+		SET status = $1, decided_by = $2, decided_at = NOW(), decision_note = $3, result_id = $4, updated_at = NOW()
+		WHERE id = $5
+		RETURNING decided_at, updated_at`,
+		approval.Status, decision.DeciderID, approval.DecisionNote, approval.ResultID, approval.ID,
+	).Scan(&approval.DecidedAt, &approval.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	trailEvent, err := insertEventTx(ctx, tx, approval.ID, event, &decision.DeciderID, actor.PublicID, decision.Note)
+	if err != nil {
+		return err
+	}
+	approval.Trail = append(approval.Trail, trailEvent)
+
+	before := map[string]interface{}{"status": status}
+	after := map[string]interface{}{
+		"status":        approval.Status,
+		"result_id":     approval.ResultID,
+		"decision_note": approval.DecisionNote,
+	}
+	err = audit.RecordTx(ctx, tx, actor, action, "approval", approval.PublicID, before, after)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ExpireDue expires the pending approvals past their expiry and releases their
+// holds, returning how many were expired. Approvals being decided meanwhile are
+// skipped, they are expired by the decision.
+func (approvalModel ApprovalModel) ExpireDue(actor audit.Actor) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := approvalModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, public_id, hold_id
+		FROM pending_approvals
+		WHERE status = 'pending' AND expires_at <= NOW()
+		ORDER BY id
+		LIMIT 500
+		FOR UPDATE SKIP LOCKED`,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	due := []*Approval{}
+	for rows.Next() {
+		var approval Approval
+		if err := rows.Scan(&approval.ID, &approval.PublicID, &approval.HoldID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, &approval)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, approval := range due {
+		if err = expireTx(ctx, tx, approval, actor); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(due), nil
+}
+
+// expireTx expires a pending approval locked by the caller and releases its hold.
+func expireTx(ctx context.Context, tx *sql.Tx, approval *Approval, actor audit.Actor) error {
+	if approval.HoldID != "" {
+		err := wallets.SettleHoldTx(ctx, tx, approval.HoldID, wallets.HoldStatusReleased)
+		// a hold already settled some other way has nothing left to release
+		if err != nil && !errors.Is(err, constants.ErrRecordNotFound) {
+			return err
+		}
+	}
+
+	approval.Status = StatusExpired
+	err := tx.QueryRowContext(ctx, `
+		UPDATE pending_approvals
+		SET status = $1, updated_at = NOW()
+		WHERE id = $2
+		RETURNING updated_at`,
+		approval.Status, approval.ID,
+	).Scan(&approval.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	event, err := insertEventTx(ctx, tx, approval.ID, EventExpired, nil, "", "")
+	if err != nil {
+		return err
+	}
+	approval.Trail = append(approval.Trail, event)
+
+	before := map[string]interface{}{"status": StatusPending}
+	after := map[string]interface{}{"status": approval.Status}
+	return audit.RecordTx(ctx, tx, actor, "approval.expire", "approval", approval.PublicID, before, after)
+}
+
+// insertEventTx adds an event to the trail of an approval.
+func insertEventTx(ctx context.Context, tx *sql.Tx, approvalID int64, event string, actorID *int64, actorPublicID, note string) (Event, error) {
+	trailEvent := Event{Event: event, Actor: actorPublicID, Note: note}
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO pending_approval_events (approval_id, event, actor_id, note)
+		VALUES ($1, $2, $3, $4)
+		RETURNING created_at`,
+		approvalID, event, actorID, note,
+	).Scan(&trailEvent.CreatedAt)
+	return trailEvent, err
+}
+
+const approvalColumns = `
+	pending_approvals.id,
+	pending_approvals.public_id,
+	pending_approvals.action,
+	pending_approvals.initiated_by,
+	initiators.public_id,
+	pending_approvals.wallet_id,
+	wallets.public_id,
+	pending_approvals.amount,
+	pending_approvals.currency,
+	pending_approvals.base_amount,
+	pending_approvals.payload::text,
+	pending_approvals.hold_id,
+	pending_approvals.status,
+	pending_approvals.expires_at,
+	COALESCE(deciders.public_id, ''),
+	pending_approvals.decided_at,
+	pending_approvals.decision_note,
+	pending_approvals.result_id,
+	pending_approvals.created_at,
+	pending_approvals.updated_at`
+
+const approvalJoins = `
+	JOIN
+		users initiators ON initiators.id = pending_approvals.initiated_by
+	JOIN
+		wallets ON wallets.id = pending_approvals.wallet_id
+	LEFT JOIN
+		users deciders ON deciders.id = pending_approvals.decided_by`
+
+// scanDestinations returns the destinations of approvalColumns. The payload is
+// scanned as text into the given slice.
+func (approval *Approval) scanDestinations(payload *[]byte) []interface{} {
+	return []interface{}{
+		&approval.ID,
+		&approval.PublicID,
+		&approval.Action,
+		&approval.InitiatorID,
+		&approval.InitiatedBy,
+		&approval.WalletID,
+		&approval.Wallet,
+		&approval.Amount,
+		&approval.Currency,
+		&approval.BaseAmount,
+		payload,
+		&approval.HoldID,
+		&approval.Status,
+		&approval.ExpiresAt,
+		&approval.DecidedBy,
+		&approval.DecidedAt,
+		&approval.DecisionNote,
+		&approval.ResultID,
+		&approval.CreatedAt,
+		&approval.UpdatedAt,
+	}
+}
+
+func (approvalModel ApprovalModel) GetAll(filters listing.Filters) ([]*Approval, listing.Metadata, error) {
+	where, args := filters.Where(nil)
+	pagination, args := filters.Paginate(args)
+
+	query := fmt.Sprintf(`
+		SELECT
+			count(*) OVER(),
+			%s,
+			%s
+		FROM
+			pending_approvals
+		%s
+		WHERE
+			true
+		%s
+		%s
+		%s;
+	`, filters.CursorColumns(), approvalColumns, approvalJoins, where, filters.OrderBy(), pagination)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := approvalModel.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, listing.Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	lastSortValue := ""
+	var lastID int64
+	approvals := []*Approval{}
+	for rows.Next() {
+		var approval Approval
+		var payload []byte
+		destinations := append([]interface{}{&totalRecords, &lastSortValue, &lastID}, approval.scanDestinations(&payload)...)
+		if err := rows.Scan(destinations...); err != nil {
+			return nil, listing.Metadata{}, err
+		}
+		approval.Payload = payload
+		approvals = append(approvals, &approval)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, listing.Metadata{}, err
+	}
+
+	metadata := filters.Metadata(totalRecords, len(approvals), lastSortValue, lastID)
+	return approvals, metadata, nil
+}
+
+// GetByPublicId returns an approval with its trail.
+func (approvalModel ApprovalModel) GetByPublicId(publicID string) (*Approval, error) {
+	query := fmt.Sprintf(`
+		SELECT
+			%s
+		FROM
+			pending_approvals
+		%s
+		WHERE
+			pending_approvals.public_id = $1;
+	`, approvalColumns, approvalJoins)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var approval Approval
+	var payload []byte
+	err := approvalModel.DB.QueryRowContext(ctx, query, publicID).Scan(approval.scanDestinations(&payload)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, constants.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	approval.Payload = payload
+
+	rows, err := approvalModel.DB.QueryContext(ctx, `
+		SELECT
+			pending_approval_events.event,
+			COALESCE(users.public_id, ''),
+			pending_approval_events.note,
+			pending_approval_events.created_at
+		FROM
+			pending_approval_events
+		LEFT JOIN
+			users ON users.id = pending_approval_events.actor_id
+		WHERE
+			pending_approval_events.approval_id = $1
+		ORDER BY
+			pending_approval_events.id`,
+		approval.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	approval.Trail = []Event{}
+	for rows.Next() {
+		var event Event
+		if err := rows.Scan(&event.Event, &event.Actor, &event.Note, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		approval.Trail = append(approval.Trail, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &approval, nil
+}
@@ -0,0 +1,323 @@
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+)
+
+// Actor types.
+const (
+	ActorUser   = "user"
+	ActorAdmin  = "admin"
+	ActorSystem = "system"
+	// ActorAPIKey is a user acting through one of their API keys, identified by
+	// the public id of the key.
+	ActorAPIKey = "api_key"
+	// ActorOAuthApp is a third party app acting on behalf of a user, identified by
+	// the public id of the grant the user gave it.
+	ActorOAuthApp = "oauth_app"
+)
+
+// genesisHash is the prev_hash of the very first event.
+var genesisHash = strings.Repeat("0", 64)
+
+// Actor identifies who made a change and the request it came from.
+type Actor struct {
+	Type      string
+	PublicID  string
+	RequestID string
+	IP        string
+}
+
+// Event represents the audit_events table in the database.
+type Event struct {
+	ID         int64           `json:"id"`
+	ActorType  string          `json:"actor_type"`
+	ActorID    string          `json:"actor_id"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type"`
+	TargetID   string          `json:"target_id"`
+	RequestID  string          `json:"request_id"`
+	IP         string          `json:"ip"`
+	Before     json.RawMessage `json:"before"`
+	After      json.RawMessage `json:"after"`
+	PrevHash   string          `json:"prev_hash"`
+	Hash       string          `json:"hash"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+// computeHash hashes the event fields together with the hash of the previous event.
+func (event *Event) computeHash() string {
+	hash := sha256.New()
+	fields := []string{
+		event.PrevHash,
+		event.ActorType,
+		event.ActorID,
+		event.Action,
+		event.TargetType,
+		event.TargetID,
+		event.RequestID,
+		event.IP,
+		string(event.Before),
+		string(event.After),
+		event.CreatedAt.UTC().Format(time.RFC3339Nano),
+	}
+	for _, field := range fields {
+		// length prefix every field so that no two different events hash the same
+		fmt.Fprintf(hash, "%d:%s|", len(field), field)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// RecordTx appends an event for a change to the audit log within the database
+// transaction making the change, so the event is only kept if the change is.
+// before and after are marshalled to JSON, either may be nil.
+//
+// The log is a single hash chain, so RecordTx takes a lock that every audited
+// transaction waits on from its first RecordTx call until it commits or rolls back.
+// This is a deliberate throughput ceiling: all state-changing writes, ledger
+// postings included, commit one at a time, at a rate bounded by how long their
+// transactions run after auditing. Callers should audit once the rest of their
+// work is done, and keep the work after it short. Chaining per entity type instead
+// would have transactions that audit several types take several locks in varying
+// orders, and deadlock.
+func RecordTx(ctx context.Context, tx *sql.Tx, actor Actor, action, targetType, targetID string, before, after interface{}) error {
+	event := &Event{
+		ActorType:  actor.Type,
+		ActorID:    actor.PublicID,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		RequestID:  actor.RequestID,
+		IP:         actor.IP,
+		// microseconds is the precision Postgres stores, so the hash can be recomputed
+		CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+	}
+
+	var err error
+	if event.Before, err = marshal(before); err != nil {
+		return err
+	}
+	if event.After, err = marshal(after); err != nil {
+		return err
+	}
+
+	// Serialize writers to the chain until this transaction ends, so that each event
+	// links to the one committed right before it. See the throughput note above.
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('audit_events'))`)
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRowContext(ctx, `SELECT hash FROM audit_events ORDER BY id DESC LIMIT 1`).Scan(&event.PrevHash)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			event.PrevHash = genesisHash
+		default:
+			return err
+		}
+	}
+	event.Hash = event.computeHash()
+
+	query := `
+		INSERT INTO audit_events
+			(actor_type, actor_id, action, target_type, target_id, request_id, ip, before, after, prev_hash, hash, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+
+	args := []interface{}{
+		event.ActorType,
+		event.ActorID,
+		event.Action,
+		event.TargetType,
+		event.TargetID,
+		event.RequestID,
+		event.IP,
+		nullableJSON(event.Before),
+		nullableJSON(event.After),
+		event.PrevHash,
+		event.Hash,
+		event.CreatedAt,
+	}
+
+	_, err = tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+func marshal(value interface{}) (json.RawMessage, error) {
+	if value == nil {
+		return nil, nil
+	}
+	return json.Marshal(value)
+}
+
+func nullableJSON(raw json.RawMessage) interface{} {
+	if raw == nil {
+		return nil
+	}
+	return string(raw)
+}
+
+type AuditModel struct {
+	DB *sql.DB
+}
+
+// GetAll returns the audit events matching the filters.
+func (auditModel AuditModel) GetAll(filters listing.Filters) ([]*Event, listing.Metadata, error) {
+	where, args := filters.Where(nil)
+	pagination, args := filters.Paginate(args)
+
+	query := fmt.Sprintf(`
+		SELECT
+			count(*) OVER(),
+			%s,
+			%s
+		FROM
+			audit_events
+		WHERE
+			true
+		%s
+		%s
+		%s;
+	`, filters.CursorColumns(), eventColumns, where, filters.OrderBy(), pagination)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := auditModel.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, listing.Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	lastSortValue := ""
+	var lastID int64
+	events := []*Event{}
+	for rows.Next() {
+		var event Event
+		destinations := append([]interface{}{&totalRecords, &lastSortValue, &lastID}, event.scanDestinations()...)
+		if err := rows.Scan(destinations...); err != nil {
+			return nil, listing.Metadata{}, err
+		}
+		events = append(events, &event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, listing.Metadata{}, err
+	}
+
+	metadata := filters.Metadata(totalRecords, len(events), lastSortValue, lastID)
+	return events, metadata, nil
+}
+
+// Verification is the outcome of checking the hash chain.
+type Verification struct {
+	Valid         bool   `json:"valid"`
+	EventsChecked int    `json:"events_checked"`
+	BrokenAtID    int64  `json:"broken_at_id,omitempty"`
+	Reason        string `json:"reason,omitempty"`
+}
+
+// Verify walks the whole audit log in order and recomputes every hash, reporting
+// the first event whose hash or link to the previous event doesn't match.
+func (auditModel AuditModel) Verify(ctx context.Context) (*Verification, error) {
+	query := fmt.Sprintf(`SELECT %s FROM audit_events ORDER BY id`, eventColumns)
+
+	rows, err := auditModel.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	verification := &Verification{Valid: true}
+	prevHash := genesisHash
+	for rows.Next() {
+		var event Event
+		if err := rows.Scan(event.scanDestinations()...); err != nil {
+			return nil, err
+		}
+		verification.EventsChecked++
+
+		switch {
+		case event.PrevHash != prevHash:
+			verification.Valid = false
+			verification.BrokenAtID = event.ID
+			verification.Reason = "prev_hash does not match the hash of the previous event"
+		case event.computeHash() != event.Hash:
+			verification.Valid = false
+			verification.BrokenAtID = event.ID
+			verification.Reason = "hash does not match the event contents"
+		}
+		if !verification.Valid {
+			return verification, nil
+		}
+		prevHash = event.Hash
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return verification, nil
+}
+
+const eventColumns = `
+	audit_events.id,
+	audit_events.actor_type,
+	audit_events.actor_id,
+	audit_events.action,
+	audit_events.target_type,
+	audit_events.target_id,
+	audit_events.request_id,
+	audit_events.ip,
+	audit_events.before::text,
+	audit_events.after::text,
+	audit_events.prev_hash,
+	audit_events.hash,
+	audit_events.created_at`
+
+func (event *Event) scanDestinations() []interface{} {
+	return []interface{}{
+		&event.ID,
+		&event.ActorType,
+		&event.ActorID,
+		&event.Action,
+		&event.TargetType,
+		&event.TargetID,
+		&event.RequestID,
+		&event.IP,
+		(*nullRawMessage)(&event.Before),
+		(*nullRawMessage)(&event.After),
+		&event.PrevHash,
+		&event.Hash,
+		&event.CreatedAt,
+	}
+}
+
+// nullRawMessage scans a nullable json column into a json.RawMessage, leaving it nil
+// for NULL.
+type nullRawMessage json.RawMessage
+
+func (raw *nullRawMessage) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*raw = nil
+	case []byte:
+		*raw = append((*raw)[:0], v...)
+	case string:
+		*raw = nullRawMessage(v)
+	default:
+		return fmt.Errorf("audit: cannot scan %T into json", value)
+	}
+	return nil
+}
@@ -1,3 +1,11 @@
+// currencies holds the currencies wallets can be kept in and their exchange rates.
+//
+// Rounding policy: exchange rates are stored against the base currency with eight
+// decimals. An amount is converted exactly, as amount × target rate / source rate,
+// and rounded once at the end to the minor units of the target currency with
+// money.DefaultRounding, half-even unless configured otherwise. Rates shown to
+// clients are rounded to six decimals and are for display only, amounts are never
+// derived from them.
 package currencies
 
 import (
@@ -8,25 +16,33 @@ import (
 	"time"
 
 	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/money"
+	"github.com/thesambayo/digillets-api/internal/validators"
 )
 
+// RatesChannel is the Postgres notification channel changes of exchange rates are
+// announced on, with the code of the currency as the payload.
+const RatesChannel = "exchange_rates"
+
 type Currency struct {
 	ID           int64          `json:"-"`
 	Code         string         `json:"code"`
 	Name         string         `json:"name"`
 	Symbol       string         `json:"symbol"`
-	ExchangeRate float64        `json:"-"`
+	MinorUnits   int32          `json:"minor_units"`
+	ExchangeRate money.Amount   `json:"-"`
 	BaseCurrency sql.NullString `json:"-"`
 	CreatedAt    time.Time      `json:"created_at"`
 	UpdatedAt    time.Time      `json:"updated_at"`
 }
 
 type CurrencyExchangeRate struct {
-	Currency       string  `json:"currency"`
-	CurrencyName   string  `json:"currency_name"`
-	CurrencySymbol string  `json:"currency_symbol"`
-	BuyingRate     float64 `json:"buying_rate"`
-	SellingRate    float64 `json:"selling_rate"`
+	Currency       string       `json:"currency"`
+	CurrencyName   string       `json:"currency_name"`
+	CurrencySymbol string       `json:"currency_symbol"`
+	BuyingRate     money.Amount `json:"buying_rate"`
+	SellingRate    money.Amount `json:"selling_rate"`
 }
 
 type CurrencyModel struct {
@@ -34,27 +50,31 @@ type CurrencyModel struct {
 }
 
 func (currencyModel *CurrencyModel) GetCurrencyByCode(code string) (*Currency, error) {
-	query := fmt.Sprintf(`
+	query := `
 		SELECT
 			currencies.id,
 			currencies.code,
 			currencies.name,
-			currencies.symbol
+			currencies.symbol,
+			currencies.minor_units,
+			currencies.exchange_rate
 		FROM
 			currencies
 		WHERE
-			currencies.code = '%v';
-	`, code)
+			currencies.code = $1;
+	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	var currency Currency
-	err := currencyModel.DB.QueryRowContext(ctx, query).Scan(
+	err := currencyModel.DB.QueryRowContext(ctx, query, code).Scan(
 		&currency.ID,
 		&currency.Code,
 		&currency.Name,
 		&currency.Symbol,
+		&currency.MinorUnits,
+		&currency.ExchangeRate,
 	)
 
 	if err != nil {
@@ -69,62 +89,118 @@ func (currencyModel *CurrencyModel) GetCurrencyByCode(code string) (*Currency, e
 	return &currency, err
 }
 
-func (currencyModel *CurrencyModel) GetExchangeRateBetweenTwoCurrencies(currFrom, currTo string) (float64, error) {
-	query := fmt.Sprintf(`
-    SELECT
-      ROUND((currencyTo.exchange_rate / currencyFrom.exchange_rate), 4) AS conversion_rate
-    FROM
-      currencies currencyFrom
-    JOIN
-      currencies currencyTo ON currencyTo.code = '%v'
-    WHERE
-      currencyFrom.code = '%v';
-  `, currTo, currFrom)
+// Round rounds an amount to the minor units of the currency, and holds it at exactly
+// that many decimals so that it is shown with them, e.g 5 as 5.00 for NGN.
+func (currency Currency) Round(amount money.Amount) money.Amount {
+	return amount.Round(currency.MinorUnits, money.DefaultRounding)
+}
+
+// Fits reports whether an amount can be held in the currency without rounding, e.g
+// 10.5 fits NGN but not JPY.
+func (currency Currency) Fits(amount money.Amount) bool {
+	return amount.HasPrecision(currency.MinorUnits)
+}
+
+// Convert converts an amount in this currency to the target currency following the
+// rounding policy above.
+func (currency Currency) Convert(amount money.Amount, target Currency) money.Amount {
+	if currency.Code == target.Code {
+		return target.Round(amount)
+	}
+	return amount.Mul(target.ExchangeRate).Div(currency.ExchangeRate, target.MinorUnits, money.DefaultRounding)
+}
+
+// ValidateAmount checks an amount to be moved in a currency: it must be positive and
+// have no more decimals than the currency's minor units.
+func ValidateAmount(validator *validators.Validator, key string, amount money.Amount, currency Currency) {
+	validator.Check(amount.IsPositive(), key, "must be greater than zero")
+	validator.Check(currency.Fits(amount), key, fmt.Sprintf("must not have more than %d decimal places for %s", currency.MinorUnits, currency.Code))
+}
+
+func (currencyModel *CurrencyModel) GetExchangeRateBetweenTwoCurrencies(currFrom, currTo string) (money.Amount, error) {
+	query := `
+		SELECT
+			ROUND((currencyTo.exchange_rate / currencyFrom.exchange_rate), 4) AS conversion_rate
+		FROM
+			currencies currencyFrom
+		JOIN
+			currencies currencyTo ON currencyTo.code = $1
+		WHERE
+			currencyFrom.code = $2;
+	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	var conversionRate float64
-	err := currencyModel.DB.QueryRowContext(ctx, query).Scan(&conversionRate)
+	var conversionRate money.Amount
+	err := currencyModel.DB.QueryRowContext(ctx, query, currTo, currFrom).Scan(&conversionRate)
 	return conversionRate, err
 }
 
-func (currencyModel *CurrencyModel) GetExchangeRatesForACurrency(currency string) ([]*CurrencyExchangeRate, error) {
-	query := `
+func (currencyModel *CurrencyModel) GetExchangeRatesForACurrency(currency string, filters listing.Filters) ([]*CurrencyExchangeRate, listing.Metadata, error) {
+	args := []interface{}{
+		currency,
+	}
+	where, args := filters.Where(args)
+	pagination, args := filters.Paginate(args)
+
+	// the rates are computed in a subquery so that the filters, sort and cursor can
+	// refer to the computed buying_rate and selling_rate columns by name.
+	query := fmt.Sprintf(`
 		WITH base_currency AS (
 	    SELECT exchange_rate AS rate
 	    FROM currencies
 	    WHERE code = $1
+		), rates AS (
+			SELECT
+				currency.id,
+				currency.code AS currency,
+				currency.name AS currency_name,
+				currency.symbol AS currency_symbol,
+				ROUND(base_currency.rate / currency.exchange_rate, 6) AS buying_rate,
+				ROUND(currency.exchange_rate / base_currency.rate, 6) AS selling_rate
+			FROM
+				currencies currency, base_currency
+			WHERE
+				currency.code != $1
 		)
 		SELECT
-	    currency.code AS currency,
-	    currency.name AS currency_name,
-			currency.symbol AS currency_symbol,
-	    ROUND(base_currency.rate / currency.exchange_rate, 6) AS buying_rate,
-	    ROUND(currency.exchange_rate / base_currency.rate, 6) AS selling_rate
+			count(*) OVER(),
+			%s,
+			rates.currency,
+			rates.currency_name,
+			rates.currency_symbol,
+			rates.buying_rate,
+			rates.selling_rate
 		FROM
-	    currencies currency, base_currency
+			rates
 		WHERE
-	    currency.code != $1;
-	`
+			true
+		%s
+		%s
+		%s;
+	`, filters.CursorColumns(), where, filters.OrderBy(), pagination)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []interface{}{
-		currency,
-	}
 	rows, err := currencyModel.DB.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return nil, listing.Metadata{}, err
 	}
 
 	defer rows.Close()
-	var exchangeRates []*CurrencyExchangeRate
+	totalRecords := 0
+	lastSortValue := ""
+	var lastID int64
+	exchangeRates := []*CurrencyExchangeRate{}
 	for rows.Next() {
 		var exchangeRate CurrencyExchangeRate
 
 		err := rows.Scan(
+			&totalRecords,
+			&lastSortValue,
+			&lastID,
 			&exchangeRate.Currency,
 			&exchangeRate.CurrencyName,
 			&exchangeRate.CurrencySymbol,
@@ -133,9 +209,15 @@ func (currencyModel *CurrencyModel) GetExchangeRatesForACurrency(currency string
 		)
 
 		if err != nil {
-			return nil, err
+			return nil, listing.Metadata{}, err
 		}
 		exchangeRates = append(exchangeRates, &exchangeRate)
 	}
-	return exchangeRates, nil
+
+	if err = rows.Err(); err != nil {
+		return nil, listing.Metadata{}, err
+	}
+
+	metadata := filters.Metadata(totalRecords, len(exchangeRates), lastSortValue, lastID)
+	return exchangeRates, metadata, nil
 }
@@ -0,0 +1,81 @@
+package fees
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/pricing"
+)
+
+type FeeModel struct {
+	DB *sql.DB
+}
+
+// GetRules returns the active fee rules for a transaction type in a currency, for
+// every user tier.
+func (feeModel FeeModel) GetRules(transactionType, currency string) ([]pricing.Rule, error) {
+	query := `
+		SELECT
+			fee_rules.id,
+			fee_rules.transaction_type,
+			fee_rules.currency,
+			fee_rules.user_tier,
+			fee_rules.kind,
+			fee_rules.flat,
+			fee_rules.percentage,
+			fee_rules.tiers::text,
+			fee_rules.min_fee,
+			fee_rules.max_fee
+		FROM
+			fee_rules
+		WHERE
+			fee_rules.transaction_type = $1
+		AND
+			fee_rules.currency = $2
+		AND
+			fee_rules.active;
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := feeModel.DB.QueryContext(ctx, query, transactionType, currency)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []pricing.Rule{}
+	for rows.Next() {
+		var rule pricing.Rule
+		var tiers []byte
+		err := rows.Scan(
+			&rule.ID,
+			&rule.TransactionType,
+			&rule.Currency,
+			&rule.UserTier,
+			&rule.Kind,
+			&rule.Flat,
+			&rule.Percentage,
+			&tiers,
+			&rule.MinFee,
+			&rule.MaxFee,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = json.Unmarshal(tiers, &rule.Tiers); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,751 @@
+// invoices holds the invoices merchants send to customers by email, which customers
+// pay from their wallets in one or more payments.
+package invoices
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/currencies"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/data/outbox"
+	"github.com/thesambayo/digillets-api/internal/data/transactions"
+	"github.com/thesambayo/digillets-api/internal/data/wallets"
+	"github.com/thesambayo/digillets-api/internal/money"
+	"github.com/thesambayo/digillets-api/internal/publicid"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// Invoice statuses. A draft can be edited until it is finalized, which opens it for
+// payment. An open invoice turns overdue once its due date passes, and either is
+// paid once payments cover its total. Invoices nothing was paid on can be voided.
+const (
+	StatusDraft   = "draft"
+	StatusOpen    = "open"
+	StatusPaid    = "paid"
+	StatusOverdue = "overdue"
+	StatusVoid    = "void"
+)
+
+// Customers are reminded of an unpaid invoice once it is finalized, then every
+// ReminderInterval, up to MaxReminders times in all.
+const (
+	ReminderInterval = 3 * 24 * time.Hour
+	MaxReminders     = 5
+)
+
+// LineItem represents the invoice_line_items table in the database.
+type LineItem struct {
+	ID          int64        `json:"-"`
+	Description string       `json:"description"`
+	Quantity    int          `json:"quantity"`
+	UnitAmount  money.Amount `json:"unit_amount"`
+	Amount      money.Amount `json:"amount"`
+}
+
+// Payment represents the invoice_payments table in the database. Amount is in the
+// invoice currency, PaidAmount what the payer wallet was debited in its own.
+type Payment struct {
+	ID            int64        `json:"-"`
+	PublicID      string       `json:"public_id"`
+	InvoiceID     int64        `json:"-"`
+	PayerWallet   string       `json:"payer_wallet"`
+	Amount        money.Amount `json:"amount"`
+	PaidAmount    money.Amount `json:"paid_amount"`
+	PaidCurrency  string       `json:"paid_currency"`
+	SettledAmount money.Amount `json:"-"`
+	TransactionID string       `json:"transaction_id"`
+	CreatedAt     time.Time    `json:"created_at"`
+}
+
+// Invoice represents the invoices table in the database. DueDate is a date, e.g
+// 2006-01-02, and TaxRate a percentage of the subtotal.
+type Invoice struct {
+	ID             int64        `json:"-"`
+	PublicID       string       `json:"public_id"`
+	MerchantID     int64        `json:"-"`
+	Merchant       string       `json:"merchant"`
+	MerchantName   string       `json:"merchant_name"`
+	MerchantUserID int64        `json:"-"`
+	CustomerEmail  string       `json:"customer_email"`
+	CurrencyID     int64        `json:"-"`
+	Currency       string       `json:"currency"`
+	LineItems      []*LineItem  `json:"line_items,omitempty"`
+	Subtotal       money.Amount `json:"subtotal"`
+	TaxRate        money.Amount `json:"tax_rate"`
+	TaxAmount      money.Amount `json:"tax_amount"`
+	Total          money.Amount `json:"total"`
+	AmountPaid     money.Amount `json:"amount_paid"`
+	AmountDue      money.Amount `json:"amount_due"`
+	Memo           string       `json:"memo"`
+	DueDate        string       `json:"due_date"`
+	Status         string       `json:"status"`
+	Payments       []*Payment   `json:"payments,omitempty"`
+	RemindersSent  int          `json:"reminders_sent"`
+	LastRemindedAt *time.Time   `json:"last_reminded_at,omitempty"`
+	FinalizedAt    *time.Time   `json:"finalized_at,omitempty"`
+	PaidAt         *time.Time   `json:"paid_at,omitempty"`
+	VoidedAt       *time.Time   `json:"voided_at,omitempty"`
+	Version        int          `json:"version"`
+	CreatedAt      time.Time    `json:"created_at"`
+	UpdatedAt      time.Time    `json:"updated_at"`
+}
+
+// Price works out the amount of each line item and the totals of the invoice,
+// rounding the tax to the minor units of its currency.
+func (invoice *Invoice) Price(currency currencies.Currency) {
+	invoice.Subtotal = money.Zero
+	for _, item := range invoice.LineItems {
+		item.Amount = currency.Round(item.UnitAmount.Mul(money.New(int64(item.Quantity), 0)))
+		invoice.Subtotal = invoice.Subtotal.Add(item.Amount)
+	}
+	invoice.TaxAmount = invoice.Subtotal.Mul(invoice.TaxRate).Div(money.New(100, 0), currency.MinorUnits, money.DefaultRounding)
+	invoice.Total = invoice.Subtotal.Add(invoice.TaxAmount)
+	invoice.AmountDue = invoice.Total.Sub(invoice.AmountPaid)
+}
+
+func ValidateInvoice(validator *validators.Validator, invoice *Invoice, currency currencies.Currency) {
+	validator.Check(validators.Matches(invoice.CustomerEmail, validators.EmailREGEX), "customer_email", "must be a valid email address")
+	ValidateDueDate(validator, invoice.DueDate)
+	validator.Check(!invoice.TaxRate.IsNegative() && invoice.TaxRate.Cmp(money.New(100, 0)) <= 0 && invoice.TaxRate.HasPrecision(2), "tax_rate", "must be a percentage from 0 to 100 with up to 2 decimal places")
+	validator.Check(len(invoice.Memo) <= 1000, "memo", "must not be more than 1000 characters long")
+
+	validator.Check(len(invoice.LineItems) != 0, "line_items", "must contain at least one item")
+	validator.Check(len(invoice.LineItems) <= 100, "line_items", "must not contain more than 100 items")
+	for _, item := range invoice.LineItems {
+		validator.Check(item.Description != "" && len(item.Description) <= 255, "line_items", "must only have descriptions of 1 to 255 characters")
+		validator.Check(item.Quantity > 0 && item.Quantity <= 1_000_000, "line_items", "must only have quantities from 1 to 1000000")
+		validator.Check(item.UnitAmount.IsPositive() && currency.Fits(item.UnitAmount), "line_items", fmt.Sprintf("must only have unit amounts greater than zero with up to %d decimal places", currency.MinorUnits))
+	}
+}
+
+// ValidateDueDate checks a due date is a date from today on, in UTC.
+func ValidateDueDate(validator *validators.Validator, dueDate string) {
+	date, err := time.Parse(time.DateOnly, dueDate)
+	if err != nil {
+		validator.AddError("due_date", "must be a date e.g 2006-01-02")
+		return
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	validator.Check(!date.Before(today), "due_date", "must not be in the past")
+}
+
+type InvoiceModel struct {
+	DB *sql.DB
+}
+
+// Insert creates a draft invoice with its line items, priced by the caller.
+func (invoiceModel InvoiceModel) Insert(invoice *Invoice, actor audit.Actor) error {
+	publicID, err := publicid.New(constants.PrefixInvoiceID)
+	if err != nil {
+		return err
+	}
+	invoice.PublicID = publicID
+	invoice.Status = StatusDraft
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := invoiceModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO invoices
+			(public_id, merchant_id, customer_email, currency_id, subtotal, tax_rate, tax_amount, total, memo, due_date, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id, version, created_at, updated_at`,
+		invoice.PublicID,
+		invoice.MerchantID,
+		invoice.CustomerEmail,
+		invoice.CurrencyID,
+		invoice.Subtotal,
+		invoice.TaxRate,
+		invoice.TaxAmount,
+		invoice.Total,
+		invoice.Memo,
+		invoice.DueDate,
+		invoice.Status,
+	).Scan(&invoice.ID, &invoice.Version, &invoice.CreatedAt, &invoice.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	if err = insertLineItemsTx(ctx, tx, invoice); err != nil {
+		return err
+	}
+
+	err = audit.RecordTx(ctx, tx, actor, "invoice.create", "invoice", invoice.PublicID, nil, invoice)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func insertLineItemsTx(ctx context.Context, tx *sql.Tx, invoice *Invoice) error {
+	for _, item := range invoice.LineItems {
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO invoice_line_items (invoice_id, description, quantity, unit_amount, amount)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING id`,
+			invoice.ID, item.Description, item.Quantity, item.UnitAmount, item.Amount,
+		).Scan(&item.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update saves the changes made to a draft invoice, which was before them, replacing
+// its line items. It returns ErrEditConflict if the invoice was changed in the
+// meantime, including being finalized.
+func (invoiceModel InvoiceModel) Update(before, invoice *Invoice, actor audit.Actor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := invoiceModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE invoices
+		SET
+			customer_email = $1,
+			currency_id = $2,
+			subtotal = $3,
+			tax_rate = $4,
+			tax_amount = $5,
+			total = $6,
+			memo = $7,
+			due_date = $8,
+			version = version + 1,
+			updated_at = NOW()
+		WHERE id = $9 AND version = $10 AND status = $11
+		RETURNING version, updated_at`,
+		invoice.CustomerEmail,
+		invoice.CurrencyID,
+		invoice.Subtotal,
+		invoice.TaxRate,
+		invoice.TaxAmount,
+		invoice.Total,
+		invoice.Memo,
+		invoice.DueDate,
+		invoice.ID,
+		invoice.Version,
+		StatusDraft,
+	).Scan(&invoice.Version, &invoice.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return constants.ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM invoice_line_items WHERE invoice_id = $1`, invoice.ID)
+	if err != nil {
+		return err
+	}
+	if err = insertLineItemsTx(ctx, tx, invoice); err != nil {
+		return err
+	}
+
+	err = audit.RecordTx(ctx, tx, actor, "invoice.update", "invoice", invoice.PublicID, before, invoice)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Finalize opens a draft invoice for payment. It can no longer be edited after.
+func (invoiceModel InvoiceModel) Finalize(invoice *Invoice, actor audit.Actor) error {
+	return invoiceModel.setStatus(invoice, StatusOpen, "finalized_at", "invoice.finalize", constants.ErrInvoiceNotDraft, actor,
+		"status = 'draft'")
+}
+
+// Void cancels an invoice nothing was paid on yet.
+func (invoiceModel InvoiceModel) Void(invoice *Invoice, actor audit.Actor) error {
+	return invoiceModel.setStatus(invoice, StatusVoid, "voided_at", "invoice.void", constants.ErrInvoiceNotVoidable, actor,
+		"status IN ('draft', 'open', 'overdue') AND amount_paid = 0")
+}
+
+// setStatus moves an invoice to status and stamps timestampColumn, if condition
+// still holds for it, returning notAllowed when it does not.
+func (invoiceModel InvoiceModel) setStatus(invoice *Invoice, status, timestampColumn, action string, notAllowed error, actor audit.Actor, condition string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := invoiceModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var stamped time.Time
+	err = tx.QueryRowContext(ctx, `
+		UPDATE invoices
+		SET status = $1, `+timestampColumn+` = NOW(), version = version + 1, updated_at = NOW()
+		WHERE id = $2 AND `+condition+`
+		RETURNING `+timestampColumn+`, version, updated_at`,
+		status, invoice.ID,
+	).Scan(&stamped, &invoice.Version, &invoice.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return notAllowed
+		default:
+			return err
+		}
+	}
+
+	before := map[string]interface{}{"status": invoice.Status}
+	invoice.Status = status
+	switch status {
+	case StatusOpen:
+		invoice.FinalizedAt = &stamped
+	case StatusVoid:
+		invoice.VoidedAt = &stamped
+	}
+	after := map[string]interface{}{"status": invoice.Status}
+
+	err = audit.RecordTx(ctx, tx, actor, action, "invoice", invoice.PublicID, before, after)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// PayTx pays amount, in the invoice currency, towards an open or overdue invoice
+// from the payer wallet into the settlement wallet of the merchant within an
+// existing database transaction. Where the currencies of the wallets differ from
+// the invoice's, the amounts debited and credited are converted from it. The
+// invoice is paid once its total is covered.
+func PayTx(ctx context.Context, tx *sql.Tx, invoice *Invoice, amount money.Amount, currency currencies.Currency, payer, settlement *wallets.Wallet, actor audit.Actor) (*Payment, error) {
+	paid := currency.Convert(amount, payer.Currency)
+	settled := currency.Convert(amount, settlement.Currency)
+	if payer.Currency.Code == settlement.Currency.Code {
+		settled = paid
+	}
+
+	// lock the invoice so that concurrent payments cannot pay more than its total
+	err := tx.QueryRowContext(ctx, `
+		SELECT status, amount_paid, total
+		FROM invoices
+		WHERE id = $1
+		FOR UPDATE`,
+		invoice.ID,
+	).Scan(&invoice.Status, &invoice.AmountPaid, &invoice.Total)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, constants.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	if invoice.Status != StatusOpen && invoice.Status != StatusOverdue {
+		return nil, constants.ErrInvoiceNotPayable
+	}
+	if amount.Cmp(invoice.Total.Sub(invoice.AmountPaid)) > 0 {
+		return nil, constants.ErrAmountExceedsInvoice
+	}
+
+	entries, err := wallets.ExchangeEntriesTx(ctx, tx, payer, settlement, paid, settled)
+	if err != nil {
+		return nil, err
+	}
+
+	paymentID, err := publicid.New(constants.PrefixInvoicePaymentID)
+	if err != nil {
+		return nil, err
+	}
+	transactionID, err := publicid.New(constants.PrefixTransactionID)
+	if err != nil {
+		return nil, err
+	}
+	transaction := &transactions.Transaction{
+		PublicID:    transactionID,
+		Type:        transactions.TypePayment,
+		Reference:   paymentID,
+		Description: fmt.Sprintf("Payment to %s for invoice %s", invoice.MerchantName, invoice.PublicID),
+	}
+	if err = transactions.PostTx(ctx, tx, transaction, entries); err != nil {
+		return nil, err
+	}
+
+	payment := &Payment{
+		PublicID:      paymentID,
+		InvoiceID:     invoice.ID,
+		PayerWallet:   payer.PublicID,
+		Amount:        amount,
+		PaidAmount:    paid,
+		PaidCurrency:  payer.Currency.Code,
+		SettledAmount: settled,
+		TransactionID: transaction.PublicID,
+	}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO invoice_payments
+			(public_id, invoice_id, payer_wallet_id, settlement_wallet_id, amount, paid_amount, settled_amount, transaction_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at`,
+		payment.PublicID, payment.InvoiceID, payer.ID, settlement.ID, payment.Amount, payment.PaidAmount, payment.SettledAmount, payment.TransactionID,
+	).Scan(&payment.ID, &payment.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	before := map[string]interface{}{"status": invoice.Status, "amount_paid": invoice.AmountPaid}
+	invoice.AmountPaid = invoice.AmountPaid.Add(amount)
+	invoice.AmountDue = invoice.Total.Sub(invoice.AmountPaid)
+	if invoice.AmountDue.IsZero() {
+		invoice.Status = StatusPaid
+	}
+	err = tx.QueryRowContext(ctx, `
+		UPDATE invoices
+		SET
+			status = $1,
+			amount_paid = $2,
+			paid_at = CASE WHEN $3 THEN NOW() END,
+			version = version + 1,
+			updated_at = NOW()
+		WHERE id = $4
+		RETURNING paid_at, version, updated_at`,
+		invoice.Status, invoice.AmountPaid, invoice.Status == StatusPaid, invoice.ID,
+	).Scan(&invoice.PaidAt, &invoice.Version, &invoice.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	invoice.Payments = append(invoice.Payments, payment)
+
+	after := map[string]interface{}{"status": invoice.Status, "amount_paid": invoice.AmountPaid, "payment": payment}
+	err = audit.RecordTx(ctx, tx, actor, "invoice.pay", "invoice", invoice.PublicID, before, after)
+	if err != nil {
+		return nil, err
+	}
+
+	err = outbox.WriteTx(ctx, tx, invoice.MerchantUserID, outbox.EventInvoicePaymentReceived, invoice)
+	if err != nil {
+		return nil, err
+	}
+	if invoice.Status == StatusPaid {
+		err = outbox.WriteTx(ctx, tx, invoice.MerchantUserID, outbox.EventInvoicePaid, invoice)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return payment, nil
+}
+
+// MarkOverdue marks the open invoices whose due date has passed, in UTC, as overdue
+// and returns how many it marked.
+func (invoiceModel InvoiceModel) MarkOverdue() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := invoiceModel.DB.ExecContext(ctx, `
+		UPDATE invoices
+		SET status = $1, version = version + 1, updated_at = NOW()
+		WHERE status = $2 AND due_date < (NOW() AT TIME ZONE 'UTC')::date`,
+		StatusOverdue, StatusOpen,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	overdue, err := result.RowsAffected()
+	return int(overdue), err
+}
+
+// GetDueReminders returns up to limit unpaid invoices whose customer is due a
+// reminder, the ones waiting longest first.
+func (invoiceModel InvoiceModel) GetDueReminders(limit int) ([]*Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := invoiceModel.DB.QueryContext(ctx, `
+		SELECT`+invoiceColumns+`
+		FROM invoices`+invoiceJoins+`
+		WHERE invoices.status IN ($1, $2)
+		AND invoices.reminders_sent < $3
+		AND (invoices.last_reminded_at IS NULL OR invoices.last_reminded_at <= $4)
+		ORDER BY invoices.last_reminded_at NULLS FIRST, invoices.id
+		LIMIT $5`,
+		StatusOpen, StatusOverdue, MaxReminders, time.Now().Add(-ReminderInterval), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invoices := []*Invoice{}
+	for rows.Next() {
+		var invoice Invoice
+		if err := rows.Scan(invoice.scanDestinations()...); err != nil {
+			return nil, err
+		}
+		invoice.AmountDue = invoice.Total.Sub(invoice.AmountPaid)
+		invoices = append(invoices, &invoice)
+	}
+
+	return invoices, rows.Err()
+}
+
+// MarkReminded records that the customer of an invoice was sent a reminder.
+func (invoiceModel InvoiceModel) MarkReminded(invoice *Invoice) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return invoiceModel.DB.QueryRowContext(ctx, `
+		UPDATE invoices
+		SET reminders_sent = reminders_sent + 1, last_reminded_at = NOW()
+		WHERE id = $1
+		RETURNING reminders_sent, last_reminded_at`,
+		invoice.ID,
+	).Scan(&invoice.RemindersSent, &invoice.LastRemindedAt)
+}
+
+const invoiceColumns = `
+	invoices.id,
+	invoices.public_id,
+	invoices.merchant_id,
+	merchants.public_id,
+	merchants.business_name,
+	merchants.user_id,
+	invoices.customer_email,
+	invoices.currency_id,
+	currencies.code,
+	invoices.subtotal,
+	invoices.tax_rate,
+	invoices.tax_amount,
+	invoices.total,
+	invoices.amount_paid,
+	invoices.memo,
+	to_char(invoices.due_date, 'YYYY-MM-DD'),
+	invoices.status,
+	invoices.reminders_sent,
+	invoices.last_reminded_at,
+	invoices.finalized_at,
+	invoices.paid_at,
+	invoices.voided_at,
+	invoices.version,
+	invoices.created_at,
+	invoices.updated_at`
+
+const invoiceJoins = `
+	JOIN merchants ON merchants.id = invoices.merchant_id
+	JOIN currencies ON currencies.id = invoices.currency_id`
+
+func (invoice *Invoice) scanDestinations() []interface{} {
+	return []interface{}{
+		&invoice.ID,
+		&invoice.PublicID,
+		&invoice.MerchantID,
+		&invoice.Merchant,
+		&invoice.MerchantName,
+		&invoice.MerchantUserID,
+		&invoice.CustomerEmail,
+		&invoice.CurrencyID,
+		&invoice.Currency,
+		&invoice.Subtotal,
+		&invoice.TaxRate,
+		&invoice.TaxAmount,
+		&invoice.Total,
+		&invoice.AmountPaid,
+		&invoice.Memo,
+		&invoice.DueDate,
+		&invoice.Status,
+		&invoice.RemindersSent,
+		&invoice.LastRemindedAt,
+		&invoice.FinalizedAt,
+		&invoice.PaidAt,
+		&invoice.VoidedAt,
+		&invoice.Version,
+		&invoice.CreatedAt,
+		&invoice.UpdatedAt,
+	}
+}
+
+// getInvoice returns the invoice matching where with its line items and payments.
+func (invoiceModel InvoiceModel) getInvoice(where string, args ...interface{}) (*Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var invoice Invoice
+	err := invoiceModel.DB.QueryRowContext(ctx, `
+		SELECT`+invoiceColumns+`
+		FROM invoices`+invoiceJoins+`
+		WHERE `+where,
+		args...,
+	).Scan(invoice.scanDestinations()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, constants.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	invoice.AmountDue = invoice.Total.Sub(invoice.AmountPaid)
+
+	rows, err := invoiceModel.DB.QueryContext(ctx, `
+		SELECT id, description, quantity, unit_amount, amount
+		FROM invoice_line_items
+		WHERE invoice_id = $1
+		ORDER BY id`,
+		invoice.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item LineItem
+		if err := rows.Scan(&item.ID, &item.Description, &item.Quantity, &item.UnitAmount, &item.Amount); err != nil {
+			return nil, err
+		}
+		invoice.LineItems = append(invoice.LineItems, &item)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = invoiceModel.DB.QueryContext(ctx, `
+		SELECT
+			invoice_payments.id,
+			invoice_payments.public_id,
+			invoice_payments.invoice_id,
+			wallets.public_id,
+			invoice_payments.amount,
+			invoice_payments.paid_amount,
+			currencies.code,
+			invoice_payments.settled_amount,
+			invoice_payments.transaction_id,
+			invoice_payments.created_at
+		FROM invoice_payments
+		JOIN wallets ON wallets.id = invoice_payments.payer_wallet_id
+		JOIN currencies ON currencies.id = wallets.currency_id
+		WHERE invoice_payments.invoice_id = $1
+		ORDER BY invoice_payments.id`,
+		invoice.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var payment Payment
+		err := rows.Scan(
+			&payment.ID,
+			&payment.PublicID,
+			&payment.InvoiceID,
+			&payment.PayerWallet,
+			&payment.Amount,
+			&payment.PaidAmount,
+			&payment.PaidCurrency,
+			&payment.SettledAmount,
+			&payment.TransactionID,
+			&payment.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		invoice.Payments = append(invoice.Payments, &payment)
+	}
+
+	return &invoice, rows.Err()
+}
+
+// GetByPublicId returns an invoice by its public id, whoever it belongs to.
+func (invoiceModel InvoiceModel) GetByPublicId(publicID string) (*Invoice, error) {
+	return invoiceModel.getInvoice("invoices.public_id = $1", publicID)
+}
+
+// GetForMerchant returns an invoice a merchant created by its public id.
+func (invoiceModel InvoiceModel) GetForMerchant(merchantID int64, publicID string) (*Invoice, error) {
+	return invoiceModel.getInvoice("invoices.merchant_id = $1 AND invoices.public_id = $2", merchantID, publicID)
+}
+
+// GetForCustomer returns an invoice sent to email by its public id. Drafts are only
+// seen by their merchant.
+func (invoiceModel InvoiceModel) GetForCustomer(email, publicID string) (*Invoice, error) {
+	return invoiceModel.getInvoice("invoices.customer_email = $1 AND invoices.public_id = $2 AND invoices.status <> 'draft'", email, publicID)
+}
+
+// GetAllForMerchant returns the invoices a merchant created.
+func (invoiceModel InvoiceModel) GetAllForMerchant(merchantID int64, filters listing.Filters) ([]*Invoice, listing.Metadata, error) {
+	return invoiceModel.getInvoices("invoices.merchant_id = $1", merchantID, filters)
+}
+
+// GetAllForCustomer returns the invoices sent to email, drafts aside.
+func (invoiceModel InvoiceModel) GetAllForCustomer(email string, filters listing.Filters) ([]*Invoice, listing.Metadata, error) {
+	return invoiceModel.getInvoices("invoices.customer_email = $1 AND invoices.status <> 'draft'", email, filters)
+}
+
+// getInvoices returns the invoices matching condition, whose only placeholder is
+// $1 for arg, without their line items and payments.
+func (invoiceModel InvoiceModel) getInvoices(condition string, arg interface{}, filters listing.Filters) ([]*Invoice, listing.Metadata, error) {
+	where, args := filters.Where([]interface{}{arg})
+	pagination, args := filters.Paginate(args)
+
+	query := fmt.Sprintf(`
+		SELECT
+			count(*) OVER(),
+			%s,
+			%s
+		FROM
+			invoices
+		%s
+		WHERE
+			%s
+		%s
+		%s
+		%s;
+	`, filters.CursorColumns(), invoiceColumns, invoiceJoins, condition, where, filters.OrderBy(), pagination)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := invoiceModel.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, listing.Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	lastSortValue := ""
+	var lastID int64
+	invoices := []*Invoice{}
+	for rows.Next() {
+		var invoice Invoice
+		destinations := append([]interface{}{&totalRecords, &lastSortValue, &lastID}, invoice.scanDestinations()...)
+		if err := rows.Scan(destinations...); err != nil {
+			return nil, listing.Metadata{}, err
+		}
+		invoice.AmountDue = invoice.Total.Sub(invoice.AmountPaid)
+		invoices = append(invoices, &invoice)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, listing.Metadata{}, err
+	}
+
+	metadata := filters.Metadata(totalRecords, len(invoices), lastSortValue, lastID)
+	return invoices, metadata, nil
+}
@@ -0,0 +1,623 @@
+package kyc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/thesambayo/digillets-api/internal/blobstore"
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/encryption"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// Submission statuses.
+const (
+	StatusPending  = "pending"
+	StatusApproved = "approved"
+	StatusRejected = "rejected"
+)
+
+// Document kinds.
+const (
+	DocumentIDFront        = "id_front"
+	DocumentIDBack         = "id_back"
+	DocumentSelfie         = "selfie"
+	DocumentProofOfAddress = "proof_of_address"
+)
+
+var (
+	DocumentKinds = []string{DocumentIDFront, DocumentIDBack, DocumentSelfie, DocumentProofOfAddress}
+	// DocumentContentTypes are the types documents may be uploaded as.
+	DocumentContentTypes = []string{"image/jpeg", "image/png", "application/pdf"}
+	IDTypes              = []string{"nin", "bvn", "passport", "drivers_license", "voters_card"}
+	RejectionReasons     = []string{"document_unreadable", "document_expired", "details_mismatch", "underage", "suspected_fraud", "other"}
+)
+
+// MaxDocumentSize is the largest document that can be uploaded, in bytes.
+const MaxDocumentSize = 5 << 20
+
+// Document is an uploaded document of a submission. The file itself is in the blob
+// store, encrypted.
+type Document struct {
+	ID          int64     `json:"-"`
+	Kind        string    `json:"kind"`
+	BlobKey     string    `json:"-"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Upload is a document file as received, before it is stored.
+type Upload struct {
+	Kind        string
+	ContentType string
+	Data        []byte
+}
+
+// Submission represents the kyc_submissions table in the database. The id number
+// and date of birth are only decrypted for reviewers.
+type Submission struct {
+	ID              int64       `json:"-"`
+	PublicID        string      `json:"public_id"`
+	UserID          int64       `json:"-"`
+	User            string      `json:"user"`
+	RequestedTier   int         `json:"requested_tier"`
+	IDType          string      `json:"id_type"`
+	IDNumber        string      `json:"id_number,omitempty"`
+	DateOfBirth     string      `json:"date_of_birth,omitempty"` // YYYY-MM-DD
+	Status          string      `json:"status"`
+	RejectionReason string      `json:"rejection_reason,omitempty"`
+	ReviewNote      string      `json:"review_note,omitempty"`
+	ReviewedBy      string      `json:"reviewed_by,omitempty"`
+	ReviewedAt      *time.Time  `json:"reviewed_at,omitempty"`
+	Documents       []*Document `json:"documents"`
+	CreatedAt       time.Time   `json:"created_at"`
+	UpdatedAt       time.Time   `json:"updated_at"`
+}
+
+// Review is a reviewer's decision on a submission.
+type Review struct {
+	Approve    bool
+	Reason     string
+	Note       string
+	ReviewerID int64
+}
+
+func ValidateSubmission(validator *validators.Validator, submission *Submission, uploads []Upload) {
+	validator.Check(submission.RequestedTier == 1 || submission.RequestedTier == 2, "tier", "must be 1 or 2")
+	validator.Check(validators.In(submission.IDType, IDTypes...), "id_type", "must be one of "+strings.Join(IDTypes, ", "))
+	validator.Check(len(submission.IDNumber) >= 5, "id_number", "must be at least 5 characters long")
+	validator.Check(len(submission.IDNumber) <= 30, "id_number", "must not be more than 30 characters long")
+
+	dateOfBirth, err := time.Parse(time.DateOnly, submission.DateOfBirth)
+	validator.Check(err == nil, "date_of_birth", "must be a date in the format YYYY-MM-DD")
+	if err == nil {
+		validator.Check(!dateOfBirth.AddDate(18, 0, 0).After(time.Now()), "date_of_birth", "you must be at least 18 years old")
+	}
+
+	kinds := map[string]bool{}
+	for _, upload := range uploads {
+		kinds[upload.Kind] = true
+		validator.Check(len(upload.Data) <= MaxDocumentSize, upload.Kind, "must not be larger than 5MB")
+		validator.Check(validators.In(upload.ContentType, DocumentContentTypes...), upload.Kind, "must be a JPEG, PNG or PDF file")
+	}
+	validator.Check(kinds[DocumentIDFront], DocumentIDFront, "must be provided")
+	if submission.RequestedTier == 2 {
+		validator.Check(kinds[DocumentProofOfAddress], DocumentProofOfAddress, "must be provided for tier 2")
+	}
+}
+
+func ValidateReview(validator *validators.Validator, review *Review) {
+	if !review.Approve {
+		validator.Check(validators.In(review.Reason, RejectionReasons...), "reason", "must be one of "+strings.Join(RejectionReasons, ", "))
+	}
+	validator.Check(len(review.Note) <= 1000, "note", "must not be more than 1000 characters long")
+}
+
+type KYCModel struct {
+	DB     *sql.DB
+	Cipher *encryption.Cipher
+	Blobs  blobstore.Store
+}
+
+// Insert stores the documents of a submission, encrypted, and then records the
+// submission for review. If recording fails the stored documents are removed again.
+func (kycModel KYCModel) Insert(submission *Submission, uploads []Upload, actor audit.Actor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	submission.Documents = []*Document{}
+	for _, upload := range uploads {
+		document, err := kycModel.putDocument(ctx, submission, upload)
+		if err != nil {
+			kycModel.deleteDocuments(submission.Documents)
+			return err
+		}
+		submission.Documents = append(submission.Documents, document)
+	}
+
+	err := kycModel.insert(ctx, submission, actor)
+	if err != nil {
+		kycModel.deleteDocuments(submission.Documents)
+		return err
+	}
+
+	return nil
+}
+
+func (kycModel KYCModel) putDocument(ctx context.Context, submission *Submission, upload Upload) (*Document, error) {
+	sum := sha256.Sum256(upload.Data)
+	encrypted, err := kycModel.Cipher.Encrypt(upload.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	document := &Document{
+		Kind:        upload.Kind,
+		BlobKey:     fmt.Sprintf("kyc/%s/%s/%s", submission.User, submission.PublicID, upload.Kind),
+		ContentType: upload.ContentType,
+		Size:        int64(len(upload.Data)),
+		SHA256:      hex.EncodeToString(sum[:]),
+	}
+
+	err = kycModel.Blobs.Put(ctx, document.BlobKey, bytes.NewReader(encrypted))
+	if err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+// deleteDocuments removes stored documents on a best effort basis, a leftover blob
+// belongs to no submission and is harmless.
+func (kycModel KYCModel) deleteDocuments(documents []*Document) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, document := range documents {
+		_ = kycModel.Blobs.Delete(ctx, document.BlobKey)
+	}
+}
+
+func (kycModel KYCModel) insert(ctx context.Context, submission *Submission, actor audit.Actor) error {
+	idNumber, err := kycModel.Cipher.EncryptString(submission.IDNumber)
+	if err != nil {
+		return err
+	}
+	dateOfBirth, err := kycModel.Cipher.EncryptString(submission.DateOfBirth)
+	if err != nil {
+		return err
+	}
+
+	tx, err := kycModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO kyc_submissions
+			(public_id, user_id, requested_tier, id_type, id_number_encrypted, date_of_birth_encrypted)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, status, created_at, updated_at`
+
+	args := []interface{}{
+		submission.PublicID,
+		submission.UserID,
+		submission.RequestedTier,
+		submission.IDType,
+		idNumber,
+		dateOfBirth,
+	}
+
+	// The partial unique index on pending submissions makes sure a user has only one
+	// waiting for review at a time.
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&submission.ID, &submission.Status, &submission.CreatedAt, &submission.UpdatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "kyc_submissions_pending_idx"`:
+			return constants.ErrPendingKYCSubmission
+		default:
+			return err
+		}
+	}
+
+	for _, document := range submission.Documents {
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO kyc_documents
+				(submission_id, kind, blob_key, content_type, size, sha256)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING id, created_at`,
+			submission.ID, document.Kind, document.BlobKey, document.ContentType, document.Size, document.SHA256,
+		).Scan(&document.ID, &document.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The audit log keeps no personal data, only what was submitted.
+	after := map[string]interface{}{
+		"status":         submission.Status,
+		"requested_tier": submission.RequestedTier,
+		"id_type":        submission.IDType,
+		"documents":      submission.documentKinds(),
+	}
+	err = audit.RecordTx(ctx, tx, actor, "kyc.submit", "kyc_submission", submission.PublicID, nil, after)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (submission *Submission) documentKinds() []string {
+	kinds := []string{}
+	for _, document := range submission.Documents {
+		kinds = append(kinds, document.Kind)
+	}
+	return kinds
+}
+
+// GetAllForUser returns the submissions of a user, newest first, without their
+// personal data.
+func (kycModel KYCModel) GetAllForUser(userID int64) ([]*Submission, error) {
+	query := fmt.Sprintf(`
+		SELECT
+			%s
+		FROM
+			kyc_submissions
+		JOIN
+			users ON users.id = kyc_submissions.user_id
+		LEFT JOIN
+			users reviewers ON reviewers.id = kyc_submissions.reviewed_by
+		WHERE
+			kyc_submissions.user_id = $1
+		ORDER BY
+			kyc_submissions.created_at DESC, kyc_submissions.id DESC;
+	`, submissionColumns)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := kycModel.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	submissions := []*Submission{}
+	for rows.Next() {
+		var submission Submission
+		var idNumber, dateOfBirth []byte
+		destinations := append(submission.scanDestinations(), &idNumber, &dateOfBirth)
+		if err := rows.Scan(destinations...); err != nil {
+			return nil, err
+		}
+		submissions = append(submissions, &submission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return submissions, kycModel.loadDocuments(ctx, submissions)
+}
+
+// GetAll returns the submissions matching the filters, for reviewers, without their
+// personal data.
+func (kycModel KYCModel) GetAll(filters listing.Filters) ([]*Submission, listing.Metadata, error) {
+	where, args := filters.Where(nil)
+	pagination, args := filters.Paginate(args)
+
+	query := fmt.Sprintf(`
+		SELECT
+			count(*) OVER(),
+			%s,
+			%s
+		FROM
+			kyc_submissions
+		JOIN
+			users ON users.id = kyc_submissions.user_id
+		LEFT JOIN
+			users reviewers ON reviewers.id = kyc_submissions.reviewed_by
+		WHERE
+			true
+		%s
+		%s
+		%s;
+	`, filters.CursorColumns(), submissionColumns, where, filters.OrderBy(), pagination)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := kycModel.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, listing.Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	lastSortValue := ""
+	var lastID int64
+	submissions := []*Submission{}
+	for rows.Next() {
+		var submission Submission
+		var idNumber, dateOfBirth []byte
+		destinations := append([]interface{}{&totalRecords, &lastSortValue, &lastID}, submission.scanDestinations()...)
+		destinations = append(destinations, &idNumber, &dateOfBirth)
+		if err := rows.Scan(destinations...); err != nil {
+			return nil, listing.Metadata{}, err
+		}
+		submissions = append(submissions, &submission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, listing.Metadata{}, err
+	}
+
+	if err = kycModel.loadDocuments(ctx, submissions); err != nil {
+		return nil, listing.Metadata{}, err
+	}
+
+	metadata := filters.Metadata(totalRecords, len(submissions), lastSortValue, lastID)
+	return submissions, metadata, nil
+}
+
+// GetByPublicId returns a submission with its personal data decrypted, for reviewers.
+func (kycModel KYCModel) GetByPublicId(publicID string) (*Submission, error) {
+	query := fmt.Sprintf(`
+		SELECT
+			%s
+		FROM
+			kyc_submissions
+		JOIN
+			users ON users.id = kyc_submissions.user_id
+		LEFT JOIN
+			users reviewers ON reviewers.id = kyc_submissions.reviewed_by
+		WHERE
+			kyc_submissions.public_id = $1;
+	`, submissionColumns)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var submission Submission
+	var idNumber, dateOfBirth []byte
+	destinations := append(submission.scanDestinations(), &idNumber, &dateOfBirth)
+	err := kycModel.DB.QueryRowContext(ctx, query, publicID).Scan(destinations...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, constants.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if submission.IDNumber, err = kycModel.Cipher.DecryptString(idNumber); err != nil {
+		return nil, err
+	}
+	if submission.DateOfBirth, err = kycModel.Cipher.DecryptString(dateOfBirth); err != nil {
+		return nil, err
+	}
+
+	return &submission, kycModel.loadDocuments(ctx, []*Submission{&submission})
+}
+
+func (kycModel KYCModel) loadDocuments(ctx context.Context, submissions []*Submission) error {
+	if len(submissions) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(submissions))
+	byID := make(map[int64]*Submission, len(submissions))
+	for i, submission := range submissions {
+		ids[i] = submission.ID
+		byID[submission.ID] = submission
+		submission.Documents = []*Document{}
+	}
+
+	rows, err := kycModel.DB.QueryContext(ctx, `
+		SELECT submission_id, id, kind, blob_key, content_type, size, sha256, created_at
+		FROM kyc_documents
+		WHERE submission_id = ANY($1)
+		ORDER BY id`,
+		pq.Array(ids),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var submissionID int64
+		var document Document
+		err := rows.Scan(
+			&submissionID,
+			&document.ID,
+			&document.Kind,
+			&document.BlobKey,
+			&document.ContentType,
+			&document.Size,
+			&document.SHA256,
+			&document.CreatedAt,
+		)
+		if err != nil {
+			return err
+		}
+		byID[submissionID].Documents = append(byID[submissionID].Documents, &document)
+	}
+
+	return rows.Err()
+}
+
+// OpenDocument returns the decrypted contents of a document of a submission.
+func (kycModel KYCModel) OpenDocument(submission *Submission, kind string) (*Document, []byte, error) {
+	var document *Document
+	for _, d := range submission.Documents {
+		if d.Kind == kind {
+			document = d
+		}
+	}
+	if document == nil {
+		return nil, nil, constants.ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	blob, err := kycModel.Blobs.Get(ctx, document.BlobKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer blob.Close()
+
+	encrypted, err := io.ReadAll(blob)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := kycModel.Cipher.Decrypt(encrypted)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return document, data, nil
+}
+
+// Review approves or rejects a pending submission. Approving moves the user up to
+// the requested tier, never down. Both the decision and any change of tier are
+// recorded in the audit log.
+func (kycModel KYCModel) Review(submission *Submission, review Review, actor audit.Actor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := kycModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var tierBefore int
+	err = tx.QueryRowContext(ctx, `
+		SELECT kyc_submissions.status, users.kyc_tier
+		FROM kyc_submissions
+		JOIN users ON users.id = kyc_submissions.user_id
+		WHERE kyc_submissions.id = $1
+		FOR UPDATE`,
+		submission.ID,
+	).Scan(&status, &tierBefore)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return constants.ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	if status != StatusPending {
+		return constants.ErrKYCAlreadyReviewed
+	}
+
+	submission.Status = StatusRejected
+	submission.RejectionReason = review.Reason
+	action := "kyc.reject"
+	if review.Approve {
+		submission.Status = StatusApproved
+		submission.RejectionReason = ""
+		action = "kyc.approve"
+	}
+	submission.ReviewNote = review.Note
+	submission.ReviewedBy = actor.PublicID
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE kyc_submissions
+		SET status = $1, rejection_reason = $2, review_note = $3, reviewed_by = $4, reviewed_at = NOW(), updated_at = NOW()
+		WHERE id = $5
+		RETURNING reviewed_at, updated_at`,
+		submission.Status, submission.RejectionReason, submission.ReviewNote, review.ReviewerID, submission.ID,
+	).Scan(&submission.ReviewedAt, &submission.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	before := map[string]interface{}{"status": status}
+	after := map[string]interface{}{
+		"status":           submission.Status,
+		"rejection_reason": submission.RejectionReason,
+		"review_note":      submission.ReviewNote,
+	}
+	err = audit.RecordTx(ctx, tx, actor, action, "kyc_submission", submission.PublicID, before, after)
+	if err != nil {
+		return err
+	}
+
+	if review.Approve && submission.RequestedTier > tierBefore {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE users
+			SET kyc_tier = $1, updated_at = NOW(), version = version + 1
+			WHERE id = $2`,
+			submission.RequestedTier, submission.UserID,
+		)
+		if err != nil {
+			return err
+		}
+
+		before := map[string]interface{}{"kyc_tier": tierBefore}
+		after := map[string]interface{}{"kyc_tier": submission.RequestedTier, "kyc_submission": submission.PublicID}
+		err = audit.RecordTx(ctx, tx, actor, "user.kyc_tier", "user", submission.User, before, after)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+const submissionColumns = `
+	kyc_submissions.id,
+	kyc_submissions.public_id,
+	kyc_submissions.user_id,
+	users.public_id,
+	kyc_submissions.requested_tier,
+	kyc_submissions.id_type,
+	kyc_submissions.status,
+	kyc_submissions.rejection_reason,
+	kyc_submissions.review_note,
+	COALESCE(reviewers.public_id, ''),
+	kyc_submissions.reviewed_at,
+	kyc_submissions.created_at,
+	kyc_submissions.updated_at,
+	kyc_submissions.id_number_encrypted,
+	kyc_submissions.date_of_birth_encrypted`
+
+// scanDestinations returns the destinations of every column but the two encrypted
+// ones, which callers scan themselves and only decrypt when needed.
+func (submission *Submission) scanDestinations() []interface{} {
+	return []interface{}{
+		&submission.ID,
+		&submission.PublicID,
+		&submission.UserID,
+		&submission.User,
+		&submission.RequestedTier,
+		&submission.IDType,
+		&submission.Status,
+		&submission.RejectionReason,
+		&submission.ReviewNote,
+		&submission.ReviewedBy,
+		&submission.ReviewedAt,
+		&submission.CreatedAt,
+		&submission.UpdatedAt,
+	}
+}
@@ -0,0 +1,292 @@
+package limits
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/money"
+)
+
+// Limit names.
+const (
+	LimitSingleTransaction = "single_transaction"
+	LimitDaily             = "daily"
+	LimitMonthly           = "monthly"
+	LimitMaxBalance        = "max_balance"
+)
+
+// Directions of a movement of money, limits apply to each separately.
+const (
+	DirectionDebit  = "debit"
+	DirectionCredit = "credit"
+)
+
+// ExceededError is returned when a movement of money would take a user past one of
+// the limits of their KYC tier. It matches constants.ErrLimitExceeded.
+type ExceededError struct {
+	Limit     string
+	Direction string
+	Currency  string
+	Value     money.Amount
+}
+
+func (exceeded *ExceededError) Error() string {
+	switch exceeded.Limit {
+	case LimitMaxBalance:
+		return fmt.Sprintf("the maximum balance of %s %s", exceeded.Value, exceeded.Currency)
+	case LimitSingleTransaction:
+		return fmt.Sprintf("the single transaction limit of %s %s", exceeded.Value, exceeded.Currency)
+	default:
+		return fmt.Sprintf("the %s %s limit of %s %s", exceeded.Limit, exceeded.Direction, exceeded.Value, exceeded.Currency)
+	}
+}
+
+func (exceeded *ExceededError) Unwrap() error {
+	return constants.ErrLimitExceeded
+}
+
+// Window is how much of a rolling limit a user has used and has left, in each
+// direction. A nil limit is no limit, and leaves nothing to count down.
+type Window struct {
+	Limit            *money.Amount `json:"limit"`
+	DebitsUsed       money.Amount  `json:"debits_used"`
+	DebitsRemaining  *money.Amount `json:"debits_remaining"`
+	CreditsUsed      money.Amount  `json:"credits_used"`
+	CreditsRemaining *money.Amount `json:"credits_remaining"`
+}
+
+// Usage is the use of the limits of a user's tier in one currency.
+type Usage struct {
+	Currency               string        `json:"currency"`
+	SingleTransactionLimit *money.Amount `json:"single_transaction_limit"`
+	Daily                  Window        `json:"daily"`
+	Monthly                Window        `json:"monthly"`
+	MaxBalance             *money.Amount `json:"max_balance"`
+	Balance                money.Amount  `json:"balance"`
+	BalanceRemaining       *money.Amount `json:"balance_remaining"`
+}
+
+// usage is a row of the usage query, for one wallet.
+type usage struct {
+	currency               string
+	minorUnits             int32
+	balance                money.Amount
+	singleTransactionLimit *money.Amount
+	dailyLimit             *money.Amount
+	monthlyLimit           *money.Amount
+	maxBalance             *money.Amount
+	dailyDebits            money.Amount
+	dailyCredits           money.Amount
+	monthlyDebits          money.Amount
+	monthlyCredits         money.Amount
+}
+
+// usageQuery selects the limits and their use for wallets. The windows are summed
+// over every customer wallet of the user in the currency, closed ones included, so
+// that closing and reopening a wallet doesn't reset them.
+const usageQuery = `
+	SELECT
+		currencies.code,
+		currencies.minor_units,
+		wallets.balance,
+		limits.single_transaction_limit,
+		limits.daily_limit,
+		limits.monthly_limit,
+		limits.max_balance,
+		COALESCE(windows.daily_debits, 0),
+		COALESCE(windows.daily_credits, 0),
+		COALESCE(windows.monthly_debits, 0),
+		COALESCE(windows.monthly_credits, 0)
+	FROM
+		wallets
+	JOIN
+		users ON users.id = wallets.user_id
+	JOIN
+		currencies ON currencies.id = wallets.currency_id
+	LEFT JOIN
+		kyc_tier_limits limits ON limits.tier = users.kyc_tier AND limits.currency_id = wallets.currency_id
+	LEFT JOIN LATERAL (
+		SELECT
+			SUM(-ledger_entries.amount) FILTER (WHERE ledger_entries.amount < 0 AND ledger_entries.created_at > NOW() - INTERVAL '24 hours') AS daily_debits,
+			SUM(ledger_entries.amount) FILTER (WHERE ledger_entries.amount > 0 AND ledger_entries.created_at > NOW() - INTERVAL '24 hours') AS daily_credits,
+			SUM(-ledger_entries.amount) FILTER (WHERE ledger_entries.amount < 0) AS monthly_debits,
+			SUM(ledger_entries.amount) FILTER (WHERE ledger_entries.amount > 0) AS monthly_credits
+		FROM
+			ledger_entries
+		JOIN
+			wallets user_wallets ON user_wallets.id = ledger_entries.wallet_id
+		WHERE
+			user_wallets.user_id = wallets.user_id
+		AND
+			user_wallets.currency_id = wallets.currency_id
+		AND
+			user_wallets.kind = 'user'
+		AND
+			ledger_entries.created_at > NOW() - INTERVAL '30 days'
+	) windows ON true`
+
+func (row *usage) scanDestinations() []interface{} {
+	return []interface{}{
+		&row.currency,
+		&row.minorUnits,
+		&row.balance,
+		&row.singleTransactionLimit,
+		&row.dailyLimit,
+		&row.monthlyLimit,
+		&row.maxBalance,
+		&row.dailyDebits,
+		&row.dailyCredits,
+		&row.monthlyDebits,
+		&row.monthlyCredits,
+	}
+}
+
+// CheckTx checks an entry of amount that has just been posted to a customer wallet
+// against the limits of its user's tier, within the database transaction posting it,
+// so the windows already include it. It returns an *ExceededError for the first
+// limit that is gone over.
+func CheckTx(ctx context.Context, tx *sql.Tx, walletID int64, amount money.Amount) error {
+	var row usage
+	err := tx.QueryRowContext(ctx, usageQuery+`
+		WHERE wallets.id = $1`,
+		walletID,
+	).Scan(row.scanDestinations()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return constants.ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	exceeded := func(limit *money.Amount, value money.Amount) bool {
+		return limit != nil && value.Cmp(*limit) > 0
+	}
+	exceededError := func(name, direction string, limit *money.Amount) error {
+		return &ExceededError{
+			Limit:     name,
+			Direction: direction,
+			Currency:  row.currency,
+			Value:     limit.Round(row.minorUnits, money.DefaultRounding),
+		}
+	}
+
+	if exceeded(row.singleTransactionLimit, amount.Abs()) {
+		direction := DirectionCredit
+		if amount.IsNegative() {
+			direction = DirectionDebit
+		}
+		return exceededError(LimitSingleTransaction, direction, row.singleTransactionLimit)
+	}
+
+	if amount.IsNegative() {
+		switch {
+		case exceeded(row.dailyLimit, row.dailyDebits):
+			return exceededError(LimitDaily, DirectionDebit, row.dailyLimit)
+		case exceeded(row.monthlyLimit, row.monthlyDebits):
+			return exceededError(LimitMonthly, DirectionDebit, row.monthlyLimit)
+		}
+		return nil
+	}
+
+	switch {
+	case exceeded(row.dailyLimit, row.dailyCredits):
+		return exceededError(LimitDaily, DirectionCredit, row.dailyLimit)
+	case exceeded(row.monthlyLimit, row.monthlyCredits):
+		return exceededError(LimitMonthly, DirectionCredit, row.monthlyLimit)
+	case exceeded(row.maxBalance, row.balance):
+		return exceededError(LimitMaxBalance, DirectionCredit, row.maxBalance)
+	}
+	return nil
+}
+
+type LimitModel struct {
+	DB *sql.DB
+}
+
+// GetUsage returns the use of the limits of a user's tier in the currency of every
+// open wallet of the user.
+func (limitModel LimitModel) GetUsage(userID int64) ([]*Usage, error) {
+	query := usageQuery + `
+		WHERE
+			wallets.user_id = $1
+		AND
+			wallets.kind = 'user'
+		AND
+			wallets.closed_at IS NULL
+		ORDER BY
+			currencies.code;
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := limitModel.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usages := []*Usage{}
+	for rows.Next() {
+		var row usage
+		if err := rows.Scan(row.scanDestinations()...); err != nil {
+			return nil, err
+		}
+		usages = append(usages, row.toUsage())
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return usages, nil
+}
+
+func (row *usage) toUsage() *Usage {
+	round := func(amount money.Amount) money.Amount {
+		return amount.Round(row.minorUnits, money.DefaultRounding)
+	}
+	roundLimit := func(limit *money.Amount) *money.Amount {
+		if limit == nil {
+			return nil
+		}
+		rounded := round(*limit)
+		return &rounded
+	}
+	remaining := func(limit *money.Amount, used money.Amount) *money.Amount {
+		if limit == nil {
+			return nil
+		}
+		left := limit.Sub(used)
+		if left.IsNegative() {
+			left = money.Zero
+		}
+		left = round(left)
+		return &left
+	}
+	window := func(limit *money.Amount, debits, credits money.Amount) Window {
+		return Window{
+			Limit:            roundLimit(limit),
+			DebitsUsed:       round(debits),
+			DebitsRemaining:  remaining(limit, debits),
+			CreditsUsed:      round(credits),
+			CreditsRemaining: remaining(limit, credits),
+		}
+	}
+
+	return &Usage{
+		Currency:               row.currency,
+		SingleTransactionLimit: roundLimit(row.singleTransactionLimit),
+		Daily:                  window(row.dailyLimit, row.dailyDebits, row.dailyCredits),
+		Monthly:                window(row.monthlyLimit, row.monthlyDebits, row.monthlyCredits),
+		MaxBalance:             roundLimit(row.maxBalance),
+		Balance:                round(row.balance),
+		BalanceRemaining:       remaining(row.maxBalance, row.balance),
+	}
+}
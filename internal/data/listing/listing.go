@@ -0,0 +1,215 @@
+// listing holds the filters, sorting and pagination shared by list queries, and the
+// SQL fragments built from them.
+package listing
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// Filters holds the list-query parameters shared by every list endpoint:
+// page based or cursor based pagination, a sort key and field filters.
+//
+// SortSafelist and FieldSafelist map the names a client may send in the query string
+// to the SQL columns they refer to. Only columns from these maps ever end up in a
+// query, and every client supplied value is passed as a placeholder argument, so the
+// generated fragments are safe to interpolate into a query.
+type Filters struct {
+	Page     int
+	PageSize int
+	Cursor   string
+	// Sort is the requested sort key, e.g "created_at" or "-created_at" for descending.
+	Sort string
+	// Fields holds the field filter values read from the query string keyed by name,
+	// e.g ?currency=NGN,USD gives Fields["currency"] = []string{"NGN", "USD"}
+	Fields map[string][]string
+
+	// SortSafelist maps each allowed sort key to its SQL column.
+	SortSafelist map[string]string
+	// FieldSafelist maps each allowed field filter to its SQL column.
+	FieldSafelist map[string]string
+	// IDColumn is the unique column used to break ties when sorting and as the
+	// second half of a cursor, e.g "wallets.id".
+	IDColumn string
+}
+
+// Metadata holds the pagination details returned alongside a list response.
+type Metadata struct {
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+}
+
+// cursor is the decoded form of Filters.Cursor, it points at the last row of the
+// previous page by its sort value and id.
+type cursor struct {
+	Value string `json:"v"`
+	ID    int64  `json:"id"`
+}
+
+// Validate checks that the pagination values are within range and that the sort key
+// and cursor are acceptable.
+func Validate(validator *validators.Validator, filters Filters) {
+	validator.Check(filters.Page > 0, "page", "must be greater than zero")
+	validator.Check(filters.Page <= 10_000_000, "page", "must be a maximum of 10 million")
+	validator.Check(filters.PageSize > 0, "page_size", "must be greater than zero")
+	validator.Check(filters.PageSize <= 100, "page_size", "must be a maximum of 100")
+
+	_, ok := filters.SortSafelist[strings.TrimPrefix(filters.Sort, "-")]
+	validator.Check(ok, "sort", "invalid sort value")
+
+	if filters.Cursor != "" {
+		validator.Check(filters.Page == 1, "cursor", "cannot be combined with page")
+		_, err := filters.decodeCursor()
+		validator.Check(err == nil, "cursor", "invalid cursor value")
+	}
+}
+
+// sortColumn returns the SQL column for the sort key. The sort key has already been
+// checked by Validate(), so we panic here as a sensible failsafe against SQL
+// injection if that step was skipped.
+func (filters Filters) sortColumn() string {
+	column, ok := filters.SortSafelist[strings.TrimPrefix(filters.Sort, "-")]
+	if !ok {
+		panic("unsafe sort parameter: " + filters.Sort)
+	}
+	return column
+}
+
+// sortDirection returns "ASC" or "DESC" depending on the prefix of the sort key.
+func (filters Filters) sortDirection() string {
+	if strings.HasPrefix(filters.Sort, "-") {
+		return "DESC"
+	}
+	return "ASC"
+}
+
+func (filters Filters) limit() int {
+	return filters.PageSize
+}
+
+func (filters Filters) offset() int {
+	if filters.Cursor != "" {
+		return 0
+	}
+	return (filters.Page - 1) * filters.PageSize
+}
+
+func (filters Filters) decodeCursor() (cursor, error) {
+	var decoded cursor
+	raw, err := base64.RawURLEncoding.DecodeString(filters.Cursor)
+	if err != nil {
+		return decoded, err
+	}
+	err = json.Unmarshal(raw, &decoded)
+	return decoded, err
+}
+
+// Where returns an SQL fragment of the form "AND column IN ($n, ...) AND ..." for
+// the field filters and cursor, numbering its placeholders after the args that are
+// already in use by the rest of the query. It returns the args extended with the
+// values for the new placeholders.
+func (filters Filters) Where(args []interface{}) (string, []interface{}) {
+	var clauses []string
+
+	for name, values := range filters.Fields {
+		column, ok := filters.FieldSafelist[name]
+		if !ok {
+			panic("unsafe filter parameter: " + name)
+		}
+		placeholders := make([]string, len(values))
+		for i, value := range values {
+			args = append(args, value)
+			placeholders[i] = fmt.Sprintf("$%d", len(args))
+		}
+		clauses = append(clauses, fmt.Sprintf("%s IN (%s)", column, strings.Join(placeholders, ", ")))
+	}
+
+	if filters.Cursor != "" {
+		decoded, err := filters.decodeCursor()
+		if err != nil {
+			panic("unchecked cursor parameter: " + filters.Cursor)
+		}
+		operator := ">"
+		if filters.sortDirection() == "DESC" {
+			operator = "<"
+		}
+		args = append(args, decoded.Value, decoded.ID)
+		clauses = append(clauses, fmt.Sprintf(
+			"(%s, %s) %s ($%d, $%d)",
+			filters.sortColumn(), filters.IDColumn, operator, len(args)-1, len(args),
+		))
+	}
+
+	if len(clauses) == 0 {
+		return "", args
+	}
+	return "AND " + strings.Join(clauses, " AND "), args
+}
+
+// OrderBy returns the "ORDER BY ..." fragment for the sort key, using the id column
+// as a tie breaker so that the order is stable between pages.
+func (filters Filters) OrderBy() string {
+	return fmt.Sprintf(
+		"ORDER BY %s %s, %s %s",
+		filters.sortColumn(), filters.sortDirection(), filters.IDColumn, filters.sortDirection(),
+	)
+}
+
+// Paginate returns the "LIMIT $n OFFSET $m" fragment and the args extended with
+// their values.
+func (filters Filters) Paginate(args []interface{}) (string, []interface{}) {
+	args = append(args, filters.limit(), filters.offset())
+	return fmt.Sprintf("LIMIT $%d OFFSET $%d", len(args)-1, len(args)), args
+}
+
+// CursorColumns returns the select list fragment "column::text, id" that list
+// queries include so that Metadata() can build the cursor for the next page.
+func (filters Filters) CursorColumns() string {
+	return fmt.Sprintf("%s::text, %s", filters.sortColumn(), filters.IDColumn)
+}
+
+// Metadata builds the metadata for a page of rowCount rows out of totalRecords,
+// where lastSortValue and lastID are the cursor columns of the final row. When a
+// cursor was supplied totalRecords only counts the rows from the cursor onwards, so
+// the page numbers are left out.
+func (filters Filters) Metadata(totalRecords, rowCount int, lastSortValue string, lastID int64) Metadata {
+	metadata := CalculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	if filters.Cursor != "" {
+		metadata = Metadata{PageSize: filters.PageSize, TotalRecords: totalRecords}
+	}
+
+	if rowCount > 0 && filters.offset()+rowCount < totalRecords {
+		raw, _ := json.Marshal(cursor{Value: lastSortValue, ID: lastID})
+		metadata.NextCursor = base64.RawURLEncoding.EncodeToString(raw)
+	}
+	return metadata
+}
+
+// CalculateMetadata calculates the pagination metadata values given the total
+// number of records, current page, and page size values. Note that the last page
+// value is calculated using the math.Ceil() function, which rounds up a float to the
+// nearest integer. So, for example, if there were 12 records in total and a page
+// size of 5, the last page value would be math.Ceil(12/5) = 3.
+func CalculateMetadata(totalRecords, page, pageSize int) Metadata {
+	if totalRecords == 0 {
+		// Note that we return an empty Metadata struct if there are no records.
+		return Metadata{}
+	}
+
+	return Metadata{
+		CurrentPage:  page,
+		PageSize:     pageSize,
+		FirstPage:    1,
+		LastPage:     int(math.Ceil(float64(totalRecords) / float64(pageSize))),
+		TotalRecords: totalRecords,
+	}
+}
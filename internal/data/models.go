@@ -3,22 +3,81 @@ package data
 import (
 	"database/sql"
 
+	"github.com/thesambayo/digillets-api/internal/blobstore"
+	"github.com/thesambayo/digillets-api/internal/data/apikeys"
+	"github.com/thesambayo/digillets-api/internal/data/approvals"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
 	"github.com/thesambayo/digillets-api/internal/data/currencies"
+	"github.com/thesambayo/digillets-api/internal/data/fees"
+	"github.com/thesambayo/digillets-api/internal/data/invoices"
+	"github.com/thesambayo/digillets-api/internal/data/kyc"
+	"github.com/thesambayo/digillets-api/internal/data/limits"
+	"github.com/thesambayo/digillets-api/internal/data/oauth"
+	"github.com/thesambayo/digillets-api/internal/data/paymentrequests"
+	"github.com/thesambayo/digillets-api/internal/data/payments"
+	"github.com/thesambayo/digillets-api/internal/data/permissions"
+	"github.com/thesambayo/digillets-api/internal/data/reconciliation"
+	"github.com/thesambayo/digillets-api/internal/data/riskdecisions"
+	"github.com/thesambayo/digillets-api/internal/data/screenings"
+	"github.com/thesambayo/digillets-api/internal/data/streams"
+	"github.com/thesambayo/digillets-api/internal/data/transactions"
+	"github.com/thesambayo/digillets-api/internal/data/transfers"
 	"github.com/thesambayo/digillets-api/internal/data/users"
 	"github.com/thesambayo/digillets-api/internal/data/wallets"
+	"github.com/thesambayo/digillets-api/internal/data/webhooks"
+	"github.com/thesambayo/digillets-api/internal/encryption"
+	"github.com/thesambayo/digillets-api/internal/sanctions"
 )
 
 type Models struct {
-	Users      users.UserModel
-	Currencies currencies.CurrencyModel
-	Wallets    wallets.WalletModel
+	Users           users.UserModel
+	Currencies      currencies.CurrencyModel
+	Wallets         wallets.WalletModel
+	Transactions    transactions.TransactionModel
+	Permissions     permissions.PermissionModel
+	Audit           audit.AuditModel
+	Fees            fees.FeeModel
+	Transfers       transfers.TransferModel
+	Limits          limits.LimitModel
+	KYC             kyc.KYCModel
+	RiskDecisions   riskdecisions.RiskDecisionModel
+	Screenings      screenings.ScreeningModel
+	Approvals       approvals.ApprovalModel
+	Reconciliation  reconciliation.ReconciliationModel
+	Webhooks        webhooks.WebhookModel
+	Streams         streams.StreamModel
+	APIKeys         apikeys.APIKeyModel
+	OAuth           oauth.OAuthModel
+	Payments        payments.PaymentModel
+	Invoices        invoices.InvoiceModel
+	PaymentRequests paymentrequests.PaymentRequestModel
 }
 
-func New(db *sql.DB) *Models {
+// New returns the models. Personal data and webhook secrets are encrypted with
+// cipher, uploaded files are kept in blobs, and names are screened with screener.
+func New(db *sql.DB, cipher *encryption.Cipher, blobs blobstore.Store, screener *sanctions.Screener) *Models {
 	return &Models{
-		Users:      users.UserModel{DB: db},
-		Currencies: currencies.CurrencyModel{DB: db},
-		Wallets:    wallets.WalletModel{DB: db},
+		Users:           users.UserModel{DB: db},
+		Currencies:      currencies.CurrencyModel{DB: db},
+		Wallets:         wallets.WalletModel{DB: db},
+		Transactions:    transactions.TransactionModel{DB: db},
+		Permissions:     permissions.PermissionModel{DB: db},
+		Audit:           audit.AuditModel{DB: db},
+		Fees:            fees.FeeModel{DB: db},
+		Transfers:       transfers.TransferModel{DB: db},
+		Limits:          limits.LimitModel{DB: db},
+		KYC:             kyc.KYCModel{DB: db, Cipher: cipher, Blobs: blobs},
+		RiskDecisions:   riskdecisions.RiskDecisionModel{DB: db, Screener: screener},
+		Screenings:      screenings.ScreeningModel{DB: db, Screener: screener},
+		Approvals:       approvals.ApprovalModel{DB: db},
+		Reconciliation:  reconciliation.ReconciliationModel{DB: db},
+		Webhooks:        webhooks.WebhookModel{DB: db, Cipher: cipher},
+		Streams:         streams.StreamModel{DB: db},
+		APIKeys:         apikeys.APIKeyModel{DB: db},
+		OAuth:           oauth.OAuthModel{DB: db},
+		Payments:        payments.PaymentModel{DB: db},
+		Invoices:        invoices.InvoiceModel{DB: db},
+		PaymentRequests: paymentrequests.PaymentRequestModel{DB: db},
 	}
 }
 
@@ -0,0 +1,319 @@
+// oauth holds what the OAuth2 authorization server keeps: the third party apps
+// registered as clients, the codes users consent with and the grants that come out
+// of them.
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/publicid"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// Scopes limit what an app can do on behalf of a user.
+const (
+	// ScopeWalletsRead allows reading wallets, statements, limits and rates.
+	ScopeWalletsRead = "wallets:read"
+	// ScopeTransfersWrite allows moving money between wallets.
+	ScopeTransfersWrite = "transfers:write"
+)
+
+// Scopes are the scopes an app can ask for, with what they are described as to
+// the user consenting.
+var Scopes = map[string]string{
+	ScopeWalletsRead:    "See your wallets, their balances and statements",
+	ScopeTransfersWrite: "Transfer money out of your wallets",
+}
+
+const (
+	// CodeTTL is how long an authorization code can be exchanged for tokens.
+	CodeTTL = 10 * time.Minute
+	// AccessTokenTTL is how long an access token is valid.
+	AccessTokenTTL = time.Hour
+	// RefreshTokenTTL is how long a refresh token is valid. Each use gives a new
+	// one, so an app in use keeps its access until it is revoked.
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// Client represents the oauth_clients table in the database. Secret is only set
+// when a confidential client has just been registered.
+type Client struct {
+	ID           int64      `json:"-"`
+	PublicID     string     `json:"client_id"`
+	UserID       int64      `json:"-"`
+	Name         string     `json:"name"`
+	RedirectURIs []string   `json:"redirect_uris"`
+	Confidential bool       `json:"confidential"`
+	Secret       string     `json:"client_secret,omitempty"`
+	SecretHash   []byte     `json:"-"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// Authenticate reports whether secret is the secret of a confidential client.
+func (client *Client) Authenticate(secret string) bool {
+	if !client.Confidential || secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare(hash(secret), client.SecretHash) == 1
+}
+
+// HasRedirectURI reports whether uri is registered for the client, compared
+// exactly as RFC 6749 asks for.
+func (client *Client) HasRedirectURI(uri string) bool {
+	return validators.In(uri, client.RedirectURIs...)
+}
+
+func ValidateClient(validator *validators.Validator, client *Client, allowHTTP bool) {
+	validator.Check(client.Name != "", "name", "must be provided")
+	validator.Check(len(client.Name) <= 100, "name", "must not be more than 100 characters long")
+	validator.Check(len(client.RedirectURIs) != 0, "redirect_uris", "must contain at least one url")
+	validator.Check(len(client.RedirectURIs) <= 10, "redirect_uris", "must not contain more than 10 urls")
+	validator.Check(validators.Unique(client.RedirectURIs), "redirect_uris", "must not contain duplicate values")
+	for _, uri := range client.RedirectURIs {
+		parsed, err := url.Parse(uri)
+		validator.Check(len(uri) <= 2000, "redirect_uris", "must not contain urls more than 2000 characters long")
+		validator.Check(err == nil && parsed.Host != "" && parsed.User == nil && parsed.Fragment == "", "redirect_uris", "must only contain absolute urls without a fragment")
+		if err == nil {
+			validator.Check(parsed.Scheme == "https" || (allowHTTP && parsed.Scheme == "http"), "redirect_uris", "must only contain https urls")
+		}
+	}
+}
+
+// hash returns what is stored of a secret, code or refresh token. They are long
+// and random, so a fast hash is as good as a slow one.
+func hash(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+// newToken returns a random secret, code or refresh token.
+func newToken() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+type OAuthModel struct {
+	DB *sql.DB
+}
+
+// InsertClient registers a client, giving a confidential one a secret which is set
+// on client to be shown to the user once.
+func (oauthModel OAuthModel) InsertClient(client *Client, actor audit.Actor) error {
+	publicID, err := publicid.New(constants.PrefixOAuthClientID)
+	if err != nil {
+		return err
+	}
+	client.PublicID = publicID
+
+	var secret string
+	if client.Confidential {
+		secret, err = newToken()
+		if err != nil {
+			return err
+		}
+		client.SecretHash = hash(secret)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := oauthModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO oauth_clients (public_id, user_id, name, redirect_uris, confidential, secret_hash)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`,
+		client.PublicID, client.UserID, client.Name, pq.Array(client.RedirectURIs), client.Confidential, client.SecretHash,
+	).Scan(&client.ID, &client.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	err = audit.RecordTx(ctx, tx, actor, "oauth_client.create", "oauth_client", client.PublicID, nil, client)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	client.Secret = secret
+	return nil
+}
+
+const clientColumns = `
+	oauth_clients.id,
+	oauth_clients.public_id,
+	oauth_clients.user_id,
+	oauth_clients.name,
+	oauth_clients.redirect_uris,
+	oauth_clients.confidential,
+	oauth_clients.secret_hash,
+	oauth_clients.revoked_at,
+	oauth_clients.created_at`
+
+func (client *Client) scanDestinations() []interface{} {
+	return []interface{}{
+		&client.ID,
+		&client.PublicID,
+		&client.UserID,
+		&client.Name,
+		pq.Array(&client.RedirectURIs),
+		&client.Confidential,
+		&client.SecretHash,
+		&client.RevokedAt,
+		&client.CreatedAt,
+	}
+}
+
+// GetClient returns a client by its client id, unless it has been revoked.
+func (oauthModel OAuthModel) GetClient(publicID string) (*Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var client Client
+	err := oauthModel.DB.QueryRowContext(ctx, `
+		SELECT`+clientColumns+`
+		FROM oauth_clients
+		WHERE public_id = $1 AND revoked_at IS NULL`,
+		publicID,
+	).Scan(client.scanDestinations()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, constants.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &client, nil
+}
+
+// GetClientsForUser returns the clients a user registered, revoked ones included,
+// the latest first.
+func (oauthModel OAuthModel) GetClientsForUser(userID int64) ([]*Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := oauthModel.DB.QueryContext(ctx, `
+		SELECT`+clientColumns+`
+		FROM oauth_clients
+		WHERE user_id = $1
+		ORDER BY id DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []*Client{}
+	for rows.Next() {
+		var client Client
+		if err := rows.Scan(client.scanDestinations()...); err != nil {
+			return nil, err
+		}
+		clients = append(clients, &client)
+	}
+
+	return clients, rows.Err()
+}
+
+// GetClientForUser returns a client a user registered by its client id.
+func (oauthModel OAuthModel) GetClientForUser(userID int64, publicID string) (*Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var client Client
+	err := oauthModel.DB.QueryRowContext(ctx, `
+		SELECT`+clientColumns+`
+		FROM oauth_clients
+		WHERE user_id = $1 AND public_id = $2`,
+		userID, publicID,
+	).Scan(client.scanDestinations()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, constants.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &client, nil
+}
+
+// RevokeClient revokes a client. The access users granted it ends straight away,
+// and it cannot be granted any more. Revoking a revoked client does nothing.
+func (oauthModel OAuthModel) RevokeClient(client *Client, actor audit.Actor) error {
+	if client.RevokedAt != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := oauthModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE oauth_clients
+		SET revoked_at = NOW()
+		WHERE id = $1 AND revoked_at IS NULL
+		RETURNING revoked_at`,
+		client.ID,
+	).Scan(&client.RevokedAt)
+	if err != nil {
+		switch {
+		// revoked in the meantime
+		case errors.Is(err, sql.ErrNoRows):
+			return nil
+		default:
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE oauth_grants
+		SET revoked_at = NOW(), updated_at = NOW()
+		WHERE client_id = $1 AND revoked_at IS NULL`,
+		client.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	before := map[string]interface{}{"revoked_at": nil}
+	after := map[string]interface{}{"revoked_at": client.RevokedAt}
+	err = audit.RecordTx(ctx, tx, actor, "oauth_client.revoke", "oauth_client", client.PublicID, before, after)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,386 @@
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/publicid"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// Authorization is what a user consented to give a client.
+type Authorization struct {
+	Client        *Client
+	UserID        int64
+	RedirectURI   string
+	Scopes        []string
+	CodeChallenge string
+}
+
+// Grant represents the oauth_grants table in the database: the access a user gave
+// a client.
+type Grant struct {
+	ID               int64      `json:"-"`
+	PublicID         string     `json:"id"`
+	ClientID         int64      `json:"-"`
+	ClientPublicID   string     `json:"client_id"`
+	ClientName       string     `json:"client_name"`
+	UserID           int64      `json:"-"`
+	UserPublicID     string     `json:"-"`
+	Scopes           []string   `json:"scopes"`
+	RefreshExpiresAt time.Time  `json:"-"`
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+// Has reports whether the user gave the client a scope.
+func (grant *Grant) Has(scope string) bool {
+	return validators.In(scope, grant.Scopes...)
+}
+
+// challenge returns the S256 PKCE challenge of a verifier.
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// CreateCode records that a user consented to an authorization and returns the
+// code the client exchanges for tokens.
+func (oauthModel OAuthModel) CreateCode(authorization *Authorization, actor audit.Actor) (string, error) {
+	code, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := oauthModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO oauth_authorization_codes (code_hash, client_id, user_id, redirect_uri, scopes, code_challenge, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW() + make_interval(secs => $7::float8))`,
+		hash(code),
+		authorization.Client.ID,
+		authorization.UserID,
+		authorization.RedirectURI,
+		pq.Array(authorization.Scopes),
+		authorization.CodeChallenge,
+		CodeTTL.Seconds(),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	after := map[string]interface{}{"scopes": authorization.Scopes, "redirect_uri": authorization.RedirectURI}
+	err = audit.RecordTx(ctx, tx, actor, "oauth_client.authorize", "oauth_client", authorization.Client.PublicID, nil, after)
+	if err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+// ExchangeCode turns a code into a grant for the client it was given to, as long as
+// the redirect uri is the one it was given at and verifier is the PKCE verifier of
+// its challenge, and returns the grant with its refresh token. A code only works
+// once: using it again revokes the grant it gave, as the code must have leaked.
+func (oauthModel OAuthModel) ExchangeCode(client *Client, code, redirectURI, verifier string) (*Grant, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// The code is used up even if the exchange fails below, so that it cannot be
+	// tried again and again.
+	var (
+		codeID        int64
+		clientID      int64
+		userID        int64
+		codeRedirect  string
+		scopes        []string
+		codeChallenge string
+		expired       bool
+	)
+	err := oauthModel.DB.QueryRowContext(ctx, `
+		UPDATE oauth_authorization_codes
+		SET used_at = NOW()
+		WHERE code_hash = $1 AND used_at IS NULL
+		RETURNING id, client_id, user_id, redirect_uri, scopes, code_challenge, expires_at <= NOW()`,
+		hash(code),
+	).Scan(&codeID, &clientID, &userID, &codeRedirect, pq.Array(&scopes), &codeChallenge, &expired)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			_, err = oauthModel.DB.ExecContext(ctx, `
+				UPDATE oauth_grants
+				SET revoked_at = NOW(), updated_at = NOW()
+				WHERE revoked_at IS NULL AND code_id IN (
+					SELECT id FROM oauth_authorization_codes WHERE code_hash = $1
+				)`,
+				hash(code),
+			)
+			if err != nil {
+				return nil, "", err
+			}
+			return nil, "", constants.ErrInvalidGrant
+		default:
+			return nil, "", err
+		}
+	}
+
+	if expired || clientID != client.ID || codeRedirect != redirectURI ||
+		subtle.ConstantTimeCompare([]byte(challenge(verifier)), []byte(codeChallenge)) != 1 {
+		return nil, "", constants.ErrInvalidGrant
+	}
+
+	publicID, err := publicid.New(constants.PrefixOAuthGrantID)
+	if err != nil {
+		return nil, "", err
+	}
+	refreshToken, err := newToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	grant := &Grant{
+		PublicID:       publicID,
+		ClientID:       client.ID,
+		ClientPublicID: client.PublicID,
+		ClientName:     client.Name,
+		UserID:         userID,
+		Scopes:         scopes,
+	}
+	err = oauthModel.DB.QueryRowContext(ctx, `
+		INSERT INTO oauth_grants (public_id, client_id, user_id, code_id, scopes, refresh_hash, refresh_expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW() + make_interval(secs => $7::float8))
+		RETURNING id, (SELECT public_id FROM users WHERE id = $3), refresh_expires_at, created_at, updated_at`,
+		grant.PublicID, grant.ClientID, grant.UserID, codeID, pq.Array(grant.Scopes), hash(refreshToken), RefreshTokenTTL.Seconds(),
+	).Scan(&grant.ID, &grant.UserPublicID, &grant.RefreshExpiresAt, &grant.CreatedAt, &grant.UpdatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return grant, refreshToken, nil
+}
+
+// Refresh renews the grant a refresh token of client belongs to, and returns it
+// with the refresh token replacing the one used, which stops working.
+func (oauthModel OAuthModel) Refresh(client *Client, refreshToken string) (*Grant, string, error) {
+	newRefreshToken, err := newToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	grant := &Grant{ClientID: client.ID, ClientPublicID: client.PublicID, ClientName: client.Name}
+	err = oauthModel.DB.QueryRowContext(ctx, `
+		UPDATE oauth_grants
+		SET
+			refresh_hash = $1,
+			refresh_expires_at = NOW() + make_interval(secs => $2::float8),
+			updated_at = NOW()
+		FROM users
+		WHERE
+			users.id = oauth_grants.user_id
+			AND oauth_grants.refresh_hash = $3
+			AND oauth_grants.client_id = $4
+			AND oauth_grants.revoked_at IS NULL
+			AND oauth_grants.refresh_expires_at > NOW()
+		RETURNING
+			oauth_grants.id,
+			oauth_grants.public_id,
+			oauth_grants.user_id,
+			users.public_id,
+			oauth_grants.scopes,
+			oauth_grants.refresh_expires_at,
+			oauth_grants.created_at,
+			oauth_grants.updated_at`,
+		hash(newRefreshToken), RefreshTokenTTL.Seconds(), hash(refreshToken), client.ID,
+	).Scan(
+		&grant.ID,
+		&grant.PublicID,
+		&grant.UserID,
+		&grant.UserPublicID,
+		pq.Array(&grant.Scopes),
+		&grant.RefreshExpiresAt,
+		&grant.CreatedAt,
+		&grant.UpdatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, "", constants.ErrInvalidGrant
+		default:
+			return nil, "", err
+		}
+	}
+
+	return grant, newRefreshToken, nil
+}
+
+const grantColumns = `
+	oauth_grants.id,
+	oauth_grants.public_id,
+	oauth_grants.client_id,
+	oauth_clients.public_id,
+	oauth_clients.name,
+	oauth_grants.user_id,
+	users.public_id,
+	oauth_grants.scopes,
+	oauth_grants.refresh_expires_at,
+	oauth_grants.revoked_at,
+	oauth_grants.created_at,
+	oauth_grants.updated_at`
+
+const grantJoins = `
+	FROM oauth_grants
+	JOIN oauth_clients ON oauth_clients.id = oauth_grants.client_id
+	JOIN users ON users.id = oauth_grants.user_id`
+
+func (grant *Grant) scanDestinations() []interface{} {
+	return []interface{}{
+		&grant.ID,
+		&grant.PublicID,
+		&grant.ClientID,
+		&grant.ClientPublicID,
+		&grant.ClientName,
+		&grant.UserID,
+		&grant.UserPublicID,
+		pq.Array(&grant.Scopes),
+		&grant.RefreshExpiresAt,
+		&grant.RevokedAt,
+		&grant.CreatedAt,
+		&grant.UpdatedAt,
+	}
+}
+
+// getGrant returns the grant matching where, unless it or its client has been
+// revoked.
+func (oauthModel OAuthModel) getGrant(where string, args ...interface{}) (*Grant, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var grant Grant
+	err := oauthModel.DB.QueryRowContext(ctx, `
+		SELECT`+grantColumns+grantJoins+`
+		WHERE oauth_grants.revoked_at IS NULL AND oauth_clients.revoked_at IS NULL AND `+where,
+		args...,
+	).Scan(grant.scanDestinations()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, constants.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &grant, nil
+}
+
+// GetGrant returns the grant an access token was issued for.
+func (oauthModel OAuthModel) GetGrant(publicID string) (*Grant, error) {
+	return oauthModel.getGrant(`oauth_grants.public_id = $1`, publicID)
+}
+
+// GetGrantByRefreshToken returns the grant a refresh token renews, unless the
+// refresh token expired.
+func (oauthModel OAuthModel) GetGrantByRefreshToken(refreshToken string) (*Grant, error) {
+	return oauthModel.getGrant(`oauth_grants.refresh_hash = $1 AND oauth_grants.refresh_expires_at > NOW()`, hash(refreshToken))
+}
+
+// GetGrantForUser returns a grant a user gave by its public id.
+func (oauthModel OAuthModel) GetGrantForUser(userID int64, publicID string) (*Grant, error) {
+	return oauthModel.getGrant(`oauth_grants.user_id = $1 AND oauth_grants.public_id = $2`, userID, publicID)
+}
+
+// GetGrantsForUser returns the apps a user gave access to and still has access,
+// the latest first.
+func (oauthModel OAuthModel) GetGrantsForUser(userID int64) ([]*Grant, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := oauthModel.DB.QueryContext(ctx, `
+		SELECT`+grantColumns+grantJoins+`
+		WHERE
+			oauth_grants.user_id = $1
+			AND oauth_grants.revoked_at IS NULL
+			AND oauth_grants.refresh_expires_at > NOW()
+			AND oauth_clients.revoked_at IS NULL
+		ORDER BY oauth_grants.id DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grants := []*Grant{}
+	for rows.Next() {
+		var grant Grant
+		if err := rows.Scan(grant.scanDestinations()...); err != nil {
+			return nil, err
+		}
+		grants = append(grants, &grant)
+	}
+
+	return grants, rows.Err()
+}
+
+// RevokeGrant takes back the access a user gave an app, its tokens stop working
+// straight away.
+func (oauthModel OAuthModel) RevokeGrant(grant *Grant, actor audit.Actor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := oauthModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE oauth_grants
+		SET revoked_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND revoked_at IS NULL
+		RETURNING revoked_at, updated_at`,
+		grant.ID,
+	).Scan(&grant.RevokedAt, &grant.UpdatedAt)
+	if err != nil {
+		switch {
+		// revoked in the meantime
+		case errors.Is(err, sql.ErrNoRows):
+			return nil
+		default:
+			return err
+		}
+	}
+
+	before := map[string]interface{}{"revoked_at": nil}
+	after := map[string]interface{}{"revoked_at": grant.RevokedAt}
+	err = audit.RecordTx(ctx, tx, actor, "oauth_grant.revoke", "oauth_grant", grant.PublicID, before, after)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,105 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/publicid"
+)
+
+// Event types.
+const (
+	EventWalletCreated     = "wallet.created"
+	EventTransferCompleted = "transfer.completed"
+	// EventDepositSucceeded is for deposits through a payment provider, once they
+	// are posted to the ledger.
+	EventDepositSucceeded = "deposit.succeeded"
+	// EventPaymentAuthorized, EventPaymentCaptured and EventPaymentRefunded are
+	// sent to merchants as the payments they collect progress.
+	EventPaymentAuthorized = "payment.authorized"
+	EventPaymentCaptured   = "payment.captured"
+	EventPaymentRefunded   = "payment.refunded"
+	// EventCheckoutCompleted is sent to merchants when a checkout session is paid.
+	EventCheckoutCompleted = "checkout.session.completed"
+	// EventInvoicePaymentReceived is sent to merchants for every payment towards an
+	// invoice, and EventInvoicePaid once it is paid in full.
+	EventInvoicePaymentReceived = "invoice.payment_received"
+	EventInvoicePaid            = "invoice.paid"
+	// EventPaymentRequestReceived is sent to the user money is requested from, and
+	// EventPaymentRequestAccepted and EventPaymentRequestDeclined to the requester
+	// once they answer.
+	EventPaymentRequestReceived = "payment_request.received"
+	EventPaymentRequestAccepted = "payment_request.accepted"
+	EventPaymentRequestDeclined = "payment_request.declined"
+	// EventWebhookTest is sent to a single endpoint on request, to try it out.
+	EventWebhookTest = "webhook.test"
+)
+
+// EventTypes are the event types webhook endpoints can subscribe to.
+var EventTypes = []string{
+	EventWalletCreated,
+	EventTransferCompleted,
+	EventDepositSucceeded,
+	EventPaymentAuthorized,
+	EventPaymentCaptured,
+	EventPaymentRefunded,
+	EventCheckoutCompleted,
+	EventInvoicePaymentReceived,
+	EventInvoicePaid,
+	EventPaymentRequestReceived,
+	EventPaymentRequestAccepted,
+	EventPaymentRequestDeclined,
+}
+
+// Event is the body delivered to webhook endpoints.
+type Event struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// WriteTx writes an event for a user to the outbox within an existing database
+// transaction, so that it is delivered if and only if the change it describes is
+// committed.
+func WriteTx(ctx context.Context, tx *sql.Tx, userID int64, eventType string, data interface{}) error {
+	_, err := insertTx(ctx, tx, userID, eventType, data, false)
+	return err
+}
+
+// WriteDispatchedTx writes an event that is not fanned out to the endpoints
+// subscribed to it, and returns its id so that the caller can queue its own
+// deliveries of it.
+func WriteDispatchedTx(ctx context.Context, tx *sql.Tx, userID int64, eventType string, data interface{}) (int64, error) {
+	return insertTx(ctx, tx, userID, eventType, data, true)
+}
+
+func insertTx(ctx context.Context, tx *sql.Tx, userID int64, eventType string, data interface{}, dispatched bool) (int64, error) {
+	publicID, err := publicid.New(constants.PrefixEventID)
+	if err != nil {
+		return 0, err
+	}
+
+	event := Event{
+		ID:        publicID,
+		Type:      eventType,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		Data:      data,
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO outbox_events (public_id, event_type, user_id, payload, created_at, dispatched_at)
+		VALUES ($1, $2, $3, $4, $5, CASE WHEN $6 THEN NOW() END)
+		RETURNING id`,
+		event.ID, event.Type, userID, string(payload), event.CreatedAt, dispatched,
+	).Scan(&id)
+	return id, err
+}
@@ -0,0 +1,555 @@
+// paymentrequests holds the requests users make for money from each other, which
+// the user asked pays with a transfer into the requester's wallet.
+package paymentrequests
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/approvals"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/data/outbox"
+	"github.com/thesambayo/digillets-api/internal/data/riskdecisions"
+	"github.com/thesambayo/digillets-api/internal/money"
+	"github.com/thesambayo/digillets-api/internal/publicid"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// Payment request statuses. A request is pending until the payer accepts or
+// declines it, the requester cancels it, or it expires. Payers can also leave a
+// request unanswered until it expires. An accepted request whose transfer waits on
+// an approval or risk review is processing until that is decided: it is accepted
+// once the transfer is made, and pending again when it is not.
+const (
+	StatusPending    = "pending"
+	StatusProcessing = "processing"
+	StatusAccepted   = "accepted"
+	StatusDeclined   = "declined"
+	StatusCancelled  = "cancelled"
+	StatusExpired    = "expired"
+)
+
+// PaymentRequest represents the payment_requests table in the database. It is
+// addressed to PayerEmail, and seen by whichever user has that email. Wallet is the
+// requester's wallet the money is paid into, and Currency its currency.
+// ResultID is the public id of the transfer paying an accepted request, or of the
+// approval or risk review the transfer of a processing request waits on.
+type PaymentRequest struct {
+	ID            int64        `json:"-"`
+	PublicID      string       `json:"public_id"`
+	RequesterID   int64        `json:"-"`
+	Requester     string       `json:"requester"`
+	RequesterName string       `json:"requester_name"`
+	PayerEmail    string       `json:"payer_email"`
+	WalletID      int64        `json:"-"`
+	Wallet        string       `json:"wallet"`
+	Amount        money.Amount `json:"amount"`
+	Currency      string       `json:"currency"`
+	Note          string       `json:"note"`
+	Status        string       `json:"status"`
+	ResultID      string       `json:"result_id,omitempty"`
+	ExpiresAt     time.Time    `json:"expires_at"`
+	AnsweredAt    *time.Time   `json:"answered_at,omitempty"`
+	CreatedAt     time.Time    `json:"created_at"`
+	UpdatedAt     time.Time    `json:"updated_at"`
+}
+
+func ValidateNote(validator *validators.Validator, note string) {
+	validator.Check(len(note) <= 255, "note", "must not be more than 255 characters long")
+}
+
+// Executor pays an accepted request within the database transaction accepting it,
+// and returns the public id of the transfer it made or of the approval or risk
+// review the transfer waits on, or "" when the transfer was declined.
+type Executor func(ctx context.Context, tx *sql.Tx) (string, error)
+
+type PaymentRequestModel struct {
+	DB *sql.DB
+}
+
+// Insert records a pending payment request, and tells the payer about it when a user
+// has their email.
+func (requestModel PaymentRequestModel) Insert(request *PaymentRequest, actor audit.Actor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := requestModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	request.PublicID, err = publicid.New(constants.PrefixPaymentRequestID)
+	if err != nil {
+		return err
+	}
+	request.Status = StatusPending
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO payment_requests (public_id, requester_id, payer_email, wallet_id, amount, note, status, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at, updated_at`,
+		request.PublicID,
+		request.RequesterID,
+		request.PayerEmail,
+		request.WalletID,
+		request.Amount,
+		request.Note,
+		request.Status,
+		request.ExpiresAt,
+	).Scan(&request.ID, &request.CreatedAt, &request.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	err = audit.RecordTx(ctx, tx, actor, "payment_request.create", "payment_request", request.PublicID, nil, request)
+	if err != nil {
+		return err
+	}
+
+	var payerID int64
+	err = tx.QueryRowContext(ctx, `SELECT id FROM users WHERE email = $1`, request.PayerEmail).Scan(&payerID)
+	switch {
+	case err == nil:
+		if err = outbox.WriteTx(ctx, tx, payerID, outbox.EventPaymentRequestReceived, request); err != nil {
+			return err
+		}
+	case !errors.Is(err, sql.ErrNoRows):
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Accept pays a pending request with execute and marks it accepted, or processing
+// when the transfer waits on an approval or risk review. When the transfer is
+// declined the request is left pending, the decision recorded, and
+// ErrTransferDeclined returned.
+func (requestModel PaymentRequestModel) Accept(request *PaymentRequest, actor audit.Actor, execute Executor) error {
+	return requestModel.answer(request, StatusAccepted, actor, execute)
+}
+
+// Decline marks a pending request declined by the payer.
+func (requestModel PaymentRequestModel) Decline(request *PaymentRequest, actor audit.Actor) error {
+	return requestModel.answer(request, StatusDeclined, actor, nil)
+}
+
+// Cancel marks a pending request cancelled by the requester.
+func (requestModel PaymentRequestModel) Cancel(request *PaymentRequest, actor audit.Actor) error {
+	return requestModel.answer(request, StatusCancelled, actor, nil)
+}
+
+// answer moves a pending request to status, paying it with execute first unless it
+// is nil, and tells the requester when the payer accepted or declined it. A request
+// that is no longer pending returns ErrRequestNotPending, and one past its expiry is
+// expired instead and returns ErrRequestExpired.
+func (requestModel PaymentRequestModel) answer(request *PaymentRequest, status string, actor audit.Actor, execute Executor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := requestModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current string
+	var expired bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT status, expires_at <= NOW()
+		FROM payment_requests
+		WHERE id = $1
+		FOR UPDATE`,
+		request.ID,
+	).Scan(&current, &expired)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return constants.ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	switch {
+	case current != StatusPending:
+		return constants.ErrRequestNotPending
+	case expired:
+		_, err = tx.ExecContext(ctx, `
+			UPDATE payment_requests
+			SET status = $1, updated_at = NOW()
+			WHERE id = $2`,
+			StatusExpired, request.ID,
+		)
+		if err != nil {
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		request.Status = StatusExpired
+		return constants.ErrRequestExpired
+	}
+
+	if execute != nil {
+		resultID, err := execute(ctx, tx)
+		if err != nil {
+			return err
+		}
+		status, resultID, err = outcomeTx(ctx, tx, resultID)
+		if err != nil {
+			return err
+		}
+		if status == StatusPending {
+			if err = tx.Commit(); err != nil {
+				return err
+			}
+			return constants.ErrTransferDeclined
+		}
+		request.ResultID = resultID
+	}
+
+	request.Status = status
+	err = tx.QueryRowContext(ctx, `
+		UPDATE payment_requests
+		SET status = $1, result_id = $2, answered_at = NOW(), updated_at = NOW()
+		WHERE id = $3
+		RETURNING answered_at, updated_at`,
+		request.Status, request.ResultID, request.ID,
+	).Scan(&request.AnsweredAt, &request.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	if err = recordTx(ctx, tx, request, current, "", actor); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// recordTx records a request moving from status before, and tells the requester
+// when it was accepted or declined.
+func recordTx(ctx context.Context, tx *sql.Tx, request *PaymentRequest, before, resultBefore string, actor audit.Actor) error {
+	action := map[string]string{
+		StatusPending:    "payment_request.reopen",
+		StatusProcessing: "payment_request.process",
+		StatusAccepted:   "payment_request.accept",
+		StatusDeclined:   "payment_request.decline",
+		StatusCancelled:  "payment_request.cancel",
+	}[request.Status]
+	err := audit.RecordTx(
+		ctx, tx, actor, action, "payment_request", request.PublicID,
+		map[string]interface{}{"status": before, "result_id": resultBefore},
+		map[string]interface{}{"status": request.Status, "result_id": request.ResultID},
+	)
+	if err != nil {
+		return err
+	}
+
+	switch request.Status {
+	case StatusAccepted:
+		return outbox.WriteTx(ctx, tx, request.RequesterID, outbox.EventPaymentRequestAccepted, request)
+	case StatusDeclined:
+		return outbox.WriteTx(ctx, tx, request.RequesterID, outbox.EventPaymentRequestDeclined, request)
+	}
+	return nil
+}
+
+// outcomeTx follows what paying a request made, from the approval its transfer
+// waits on to the risk review the transfer went through, and returns the status
+// the request is in with the public id of the transfer or of what it waits on. A
+// transfer that was rejected, blocked, or expired leaves the request pending.
+func outcomeTx(ctx context.Context, tx *sql.Tx, resultID string) (string, string, error) {
+	for resultID != "" {
+		var status, next string
+		err := tx.QueryRowContext(ctx, `
+			SELECT status, result_id FROM pending_approvals WHERE public_id = $1`,
+			resultID,
+		).Scan(&status, &next)
+		switch {
+		case err == nil:
+			switch status {
+			case approvals.StatusPending:
+				return StatusProcessing, resultID, nil
+			case approvals.StatusApproved:
+				resultID = next
+				continue
+			}
+			return StatusPending, "", nil
+		case !errors.Is(err, sql.ErrNoRows):
+			return "", "", err
+		}
+
+		err = tx.QueryRowContext(ctx, `
+			SELECT status, transaction_id FROM risk_decisions WHERE public_id = $1`,
+			resultID,
+		).Scan(&status, &next)
+		switch {
+		case err == nil:
+			switch status {
+			case riskdecisions.StatusPending:
+				return StatusProcessing, resultID, nil
+			case riskdecisions.StatusCompleted, riskdecisions.StatusApproved:
+				resultID = next
+				continue
+			}
+			return StatusPending, "", nil
+		case !errors.Is(err, sql.ErrNoRows):
+			return "", "", err
+		}
+
+		// neither an approval nor a risk review, it is the transfer
+		return StatusAccepted, resultID, nil
+	}
+	return StatusPending, "", nil
+}
+
+// ExpireDue expires the pending requests past their expiry and returns how many it
+// expired.
+func (requestModel PaymentRequestModel) ExpireDue() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := requestModel.DB.ExecContext(ctx, `
+		UPDATE payment_requests
+		SET status = $1, updated_at = NOW()
+		WHERE status = $2 AND expires_at <= NOW()`,
+		StatusExpired, StatusPending,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	expired, err := result.RowsAffected()
+	return int(expired), err
+}
+
+// ResolveDue resolves the processing requests whose approval or risk review was
+// decided, accepting those whose transfer was made and reopening the others, and
+// returns how many it resolved. Reopened requests past their expiry are left for
+// ExpireDue.
+func (requestModel PaymentRequestModel) ResolveDue(actor audit.Actor) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := requestModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`
+		SELECT %s
+		FROM payment_requests
+		%s
+		WHERE payment_requests.status = $1
+		ORDER BY payment_requests.id
+		FOR UPDATE OF payment_requests SKIP LOCKED`, requestColumns, requestJoins),
+		StatusProcessing,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	var requests []*PaymentRequest
+	for rows.Next() {
+		var request PaymentRequest
+		if err := rows.Scan(request.scanDestinations()...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		requests = append(requests, &request)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	resolved := 0
+	for _, request := range requests {
+		status, resultID, err := outcomeTx(ctx, tx, request.ResultID)
+		if err != nil {
+			return 0, err
+		}
+		if status == request.Status && resultID == request.ResultID {
+			continue
+		}
+
+		before, resultBefore := request.Status, request.ResultID
+		request.Status, request.ResultID = status, resultID
+		if status == StatusPending {
+			request.AnsweredAt = nil
+		}
+		err = tx.QueryRowContext(ctx, `
+			UPDATE payment_requests
+			SET status = $1, result_id = $2, answered_at = $3, updated_at = NOW()
+			WHERE id = $4
+			RETURNING updated_at`,
+			request.Status, request.ResultID, request.AnsweredAt, request.ID,
+		).Scan(&request.UpdatedAt)
+		if err != nil {
+			return 0, err
+		}
+
+		if err = recordTx(ctx, tx, request, before, resultBefore, actor); err != nil {
+			return 0, err
+		}
+		if status != StatusProcessing {
+			resolved++
+		}
+	}
+
+	return resolved, tx.Commit()
+}
+
+const requestColumns = `
+	payment_requests.id,
+	payment_requests.public_id,
+	payment_requests.requester_id,
+	requesters.public_id,
+	requesters.name,
+	payment_requests.payer_email,
+	payment_requests.wallet_id,
+	wallets.public_id,
+	payment_requests.amount,
+	currencies.code,
+	payment_requests.note,
+	payment_requests.status,
+	payment_requests.result_id,
+	payment_requests.expires_at,
+	payment_requests.answered_at,
+	payment_requests.created_at,
+	payment_requests.updated_at`
+
+const requestJoins = `
+	JOIN users requesters ON requesters.id = payment_requests.requester_id
+	JOIN wallets ON wallets.id = payment_requests.wallet_id
+	JOIN currencies ON currencies.id = wallets.currency_id`
+
+func (request *PaymentRequest) scanDestinations() []interface{} {
+	return []interface{}{
+		&request.ID,
+		&request.PublicID,
+		&request.RequesterID,
+		&request.Requester,
+		&request.RequesterName,
+		&request.PayerEmail,
+		&request.WalletID,
+		&request.Wallet,
+		&request.Amount,
+		&request.Currency,
+		&request.Note,
+		&request.Status,
+		&request.ResultID,
+		&request.ExpiresAt,
+		&request.AnsweredAt,
+		&request.CreatedAt,
+		&request.UpdatedAt,
+	}
+}
+
+// Get returns a request the user, with their id and email, made or was asked to pay
+// by its public id.
+func (requestModel PaymentRequestModel) Get(userID int64, email, publicID string) (*PaymentRequest, error) {
+	return requestModel.getRequest("(payment_requests.requester_id = $1 OR payment_requests.payer_email = $2) AND payment_requests.public_id = $3", userID, email, publicID)
+}
+
+// GetIncoming returns a request sent to email by its public id.
+func (requestModel PaymentRequestModel) GetIncoming(email, publicID string) (*PaymentRequest, error) {
+	return requestModel.getRequest("payment_requests.payer_email = $1 AND payment_requests.public_id = $2", email, publicID)
+}
+
+// GetOutgoing returns a request the user made by its public id.
+func (requestModel PaymentRequestModel) GetOutgoing(requesterID int64, publicID string) (*PaymentRequest, error) {
+	return requestModel.getRequest("payment_requests.requester_id = $1 AND payment_requests.public_id = $2", requesterID, publicID)
+}
+
+func (requestModel PaymentRequestModel) getRequest(where string, args ...interface{}) (*PaymentRequest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var request PaymentRequest
+	err := requestModel.DB.QueryRowContext(ctx, `
+		SELECT`+requestColumns+`
+		FROM payment_requests`+requestJoins+`
+		WHERE `+where,
+		args...,
+	).Scan(request.scanDestinations()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, constants.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &request, nil
+}
+
+// GetAllIncoming returns the requests sent to email.
+func (requestModel PaymentRequestModel) GetAllIncoming(email string, filters listing.Filters) ([]*PaymentRequest, listing.Metadata, error) {
+	return requestModel.getRequests("payment_requests.payer_email = $1", email, filters)
+}
+
+// GetAllOutgoing returns the requests the user made.
+func (requestModel PaymentRequestModel) GetAllOutgoing(requesterID int64, filters listing.Filters) ([]*PaymentRequest, listing.Metadata, error) {
+	return requestModel.getRequests("payment_requests.requester_id = $1", requesterID, filters)
+}
+
+// getRequests returns the requests matching condition, whose only placeholder is
+// $1 for arg.
+func (requestModel PaymentRequestModel) getRequests(condition string, arg interface{}, filters listing.Filters) ([]*PaymentRequest, listing.Metadata, error) {
+	where, args := filters.Where([]interface{}{arg})
+	pagination, args := filters.Paginate(args)
+
+	query := fmt.Sprintf(`
+		SELECT
+			count(*) OVER(),
+			%s,
+			%s
+		FROM
+			payment_requests
+		%s
+		WHERE
+			%s
+		%s
+		%s
+		%s;
+	`, filters.CursorColumns(), requestColumns, requestJoins, condition, where, filters.OrderBy(), pagination)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := requestModel.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, listing.Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	lastSortValue := ""
+	var lastID int64
+	requests := []*PaymentRequest{}
+	for rows.Next() {
+		var request PaymentRequest
+		destinations := append([]interface{}{&totalRecords, &lastSortValue, &lastID}, request.scanDestinations()...)
+		if err := rows.Scan(destinations...); err != nil {
+			return nil, listing.Metadata{}, err
+		}
+		requests = append(requests, &request)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, listing.Metadata{}, err
+	}
+
+	metadata := filters.Metadata(totalRecords, len(requests), lastSortValue, lastID)
+	return requests, metadata, nil
+}
@@ -0,0 +1,427 @@
+package payments
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/currencies"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/data/outbox"
+	"github.com/thesambayo/digillets-api/internal/data/transactions"
+	"github.com/thesambayo/digillets-api/internal/data/wallets"
+	"github.com/thesambayo/digillets-api/internal/money"
+	"github.com/thesambayo/digillets-api/internal/publicid"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// Checkout session statuses.
+const (
+	SessionOpen     = "open"
+	SessionComplete = "complete"
+	SessionExpired  = "expired"
+)
+
+// Bounds of how long a checkout session stays open, and how long it does when the
+// merchant does not say.
+const (
+	SessionMinTTL     = 30 * time.Minute
+	SessionMaxTTL     = 30 * 24 * time.Hour
+	SessionDefaultTTL = 24 * time.Hour
+)
+
+// CheckoutSession represents the checkout_sessions table in the database: a payment
+// link a merchant shares, which any user can pay once before it expires.
+type CheckoutSession struct {
+	ID                 int64         `json:"-"`
+	PublicID           string        `json:"public_id"`
+	MerchantID         int64         `json:"-"`
+	Merchant           string        `json:"merchant"`
+	MerchantName       string        `json:"merchant_name"`
+	MerchantUserID     int64         `json:"-"`
+	Amount             money.Amount  `json:"amount"`
+	CurrencyID         int64         `json:"-"`
+	Currency           string        `json:"currency"`
+	Description        string        `json:"description"`
+	SuccessURL         string        `json:"success_url"`
+	CancelURL          string        `json:"cancel_url"`
+	Metadata           Metadata      `json:"metadata"`
+	Status             string        `json:"status"`
+	PayerWallet        string        `json:"payer_wallet,omitempty"`
+	SettlementWalletID int64         `json:"-"`
+	PaidAmount         *money.Amount `json:"paid_amount,omitempty"`
+	PaidCurrency       string        `json:"paid_currency,omitempty"`
+	SettledAmount      *money.Amount `json:"settled_amount,omitempty"`
+	TransactionID      string        `json:"transaction_id,omitempty"`
+	ExpiresAt          time.Time     `json:"expires_at"`
+	CompletedAt        *time.Time    `json:"completed_at,omitempty"`
+	CreatedAt          time.Time     `json:"created_at"`
+	UpdatedAt          time.Time     `json:"updated_at"`
+}
+
+func ValidateCheckoutSession(validator *validators.Validator, session *CheckoutSession) {
+	ttl := time.Until(session.ExpiresAt)
+	validator.Check(ttl >= SessionMinTTL, "expires_at", "must be at least 30 minutes from now")
+	validator.Check(ttl <= SessionMaxTTL, "expires_at", "must not be more than 30 days from now")
+	validator.Check(len(session.Description) <= 255, "description", "must not be more than 255 characters long")
+	validateRedirectURL(validator, "success_url", session.SuccessURL)
+	validateRedirectURL(validator, "cancel_url", session.CancelURL)
+	ValidateMetadata(validator, session.Metadata)
+}
+
+// validateRedirectURL checks a URL the payer is sent back to after checkout.
+func validateRedirectURL(validator *validators.Validator, key, value string) {
+	parsed, err := url.Parse(value)
+	validator.Check(value != "", key, "must be provided")
+	validator.Check(len(value) <= 2000, key, "must not be more than 2000 characters long")
+	validator.Check(err == nil && parsed.Host != "" && (parsed.Scheme == "https" || parsed.Scheme == "http"), key, "must be a valid absolute url")
+}
+
+// InsertCheckoutSession opens a checkout session for a merchant.
+func (paymentModel PaymentModel) InsertCheckoutSession(session *CheckoutSession, actor audit.Actor) error {
+	publicID, err := publicid.New(constants.PrefixCheckoutSessionID)
+	if err != nil {
+		return err
+	}
+	session.PublicID = publicID
+	session.Status = SessionOpen
+	session.ExpiresAt = session.ExpiresAt.UTC().Truncate(time.Second)
+	if session.Metadata == nil {
+		session.Metadata = Metadata{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := paymentModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO checkout_sessions
+			(public_id, merchant_id, amount, currency_id, description, success_url, cancel_url, metadata, status, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id, created_at, updated_at`,
+		session.PublicID,
+		session.MerchantID,
+		session.Amount,
+		session.CurrencyID,
+		session.Description,
+		session.SuccessURL,
+		session.CancelURL,
+		session.Metadata,
+		session.Status,
+		session.ExpiresAt,
+	).Scan(&session.ID, &session.CreatedAt, &session.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	err = audit.RecordTx(ctx, tx, actor, "checkout_session.create", "checkout_session", session.PublicID, nil, session)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// PayCheckoutSessionTx pays an open checkout session from the payer wallet into the
+// settlement wallet of the merchant within an existing database transaction. Where
+// their currencies differ from the session currency, the amount debited and
+// credited are converted from it.
+func PayCheckoutSessionTx(ctx context.Context, tx *sql.Tx, session *CheckoutSession, currency currencies.Currency, payer, settlement *wallets.Wallet, actor audit.Actor) error {
+	paid := currency.Convert(session.Amount, payer.Currency)
+	settled := currency.Convert(session.Amount, settlement.Currency)
+
+	// lock the session so that it can only be paid once
+	var expired bool
+	err := tx.QueryRowContext(ctx, `
+		SELECT status, expires_at <= NOW()
+		FROM checkout_sessions
+		WHERE id = $1
+		FOR UPDATE`,
+		session.ID,
+	).Scan(&session.Status, &expired)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return constants.ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	if session.Status != SessionOpen || expired {
+		return constants.ErrSessionNotOpen
+	}
+
+	if payer.Currency.Code == settlement.Currency.Code {
+		settled = paid
+	}
+	entries, err := wallets.ExchangeEntriesTx(ctx, tx, payer, settlement, paid, settled)
+	if err != nil {
+		return err
+	}
+
+	transactionID, err := publicid.New(constants.PrefixTransactionID)
+	if err != nil {
+		return err
+	}
+	transaction := &transactions.Transaction{
+		PublicID:    transactionID,
+		Type:        transactions.TypePayment,
+		Reference:   session.PublicID,
+		Description: fmt.Sprintf("Payment to %s", session.MerchantName),
+	}
+	if err = transactions.PostTx(ctx, tx, transaction, entries); err != nil {
+		return err
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE checkout_sessions
+		SET
+			status = $1,
+			payer_wallet_id = $2,
+			settlement_wallet_id = $3,
+			paid_amount = $4,
+			settled_amount = $5,
+			transaction_id = $6,
+			completed_at = NOW(),
+			updated_at = NOW()
+		WHERE id = $7
+		RETURNING completed_at, updated_at`,
+		SessionComplete, payer.ID, settlement.ID, paid, settled, transaction.PublicID, session.ID,
+	).Scan(&session.CompletedAt, &session.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	before := map[string]interface{}{"status": session.Status}
+	session.Status = SessionComplete
+	session.PayerWallet = payer.PublicID
+	session.SettlementWalletID = settlement.ID
+	session.PaidAmount = &paid
+	session.PaidCurrency = payer.Currency.Code
+	session.SettledAmount = &settled
+	session.TransactionID = transaction.PublicID
+
+	after := map[string]interface{}{"status": session.Status, "payer_wallet": session.PayerWallet, "paid_amount": paid, "settled_amount": settled}
+	err = audit.RecordTx(ctx, tx, actor, "checkout_session.complete", "checkout_session", session.PublicID, before, after)
+	if err != nil {
+		return err
+	}
+
+	return outbox.WriteTx(ctx, tx, session.MerchantUserID, outbox.EventCheckoutCompleted, session)
+}
+
+// ExpireCheckoutSession closes an open checkout session before its time, so that it
+// can no longer be paid.
+func (paymentModel PaymentModel) ExpireCheckoutSession(session *CheckoutSession, actor audit.Actor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := paymentModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE checkout_sessions
+		SET status = $1, expires_at = LEAST(expires_at, NOW()), updated_at = NOW()
+		WHERE id = $2 AND status = $3
+		RETURNING expires_at, updated_at`,
+		SessionExpired, session.ID, SessionOpen,
+	).Scan(&session.ExpiresAt, &session.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return constants.ErrSessionNotOpen
+		default:
+			return err
+		}
+	}
+
+	before := map[string]interface{}{"status": session.Status}
+	session.Status = SessionExpired
+	after := map[string]interface{}{"status": session.Status}
+	err = audit.RecordTx(ctx, tx, actor, "checkout_session.expire", "checkout_session", session.PublicID, before, after)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ExpireDueCheckoutSessions marks the open checkout sessions past their expiry as
+// expired, and returns how many it marked. Nothing is held for an open session, so
+// there is nothing else to undo.
+func (paymentModel PaymentModel) ExpireDueCheckoutSessions() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := paymentModel.DB.ExecContext(ctx, `
+		UPDATE checkout_sessions
+		SET status = $1, updated_at = NOW()
+		WHERE status = $2 AND expires_at <= NOW()`,
+		SessionExpired, SessionOpen,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	expired, err := result.RowsAffected()
+	return int(expired), err
+}
+
+const checkoutSessionColumns = `
+	checkout_sessions.id,
+	checkout_sessions.public_id,
+	checkout_sessions.merchant_id,
+	merchants.public_id,
+	merchants.business_name,
+	merchants.user_id,
+	checkout_sessions.amount,
+	checkout_sessions.currency_id,
+	currencies.code,
+	checkout_sessions.description,
+	checkout_sessions.success_url,
+	checkout_sessions.cancel_url,
+	checkout_sessions.metadata,
+	checkout_sessions.status,
+	COALESCE(payer_wallets.public_id, ''),
+	COALESCE(checkout_sessions.settlement_wallet_id, 0),
+	checkout_sessions.paid_amount,
+	COALESCE(payer_currencies.code, ''),
+	checkout_sessions.settled_amount,
+	checkout_sessions.transaction_id,
+	checkout_sessions.expires_at,
+	checkout_sessions.completed_at,
+	checkout_sessions.created_at,
+	checkout_sessions.updated_at`
+
+const checkoutSessionJoins = `
+	JOIN merchants ON merchants.id = checkout_sessions.merchant_id
+	JOIN currencies ON currencies.id = checkout_sessions.currency_id
+	LEFT JOIN wallets payer_wallets ON payer_wallets.id = checkout_sessions.payer_wallet_id
+	LEFT JOIN currencies payer_currencies ON payer_currencies.id = payer_wallets.currency_id`
+
+func (session *CheckoutSession) scanDestinations() []interface{} {
+	return []interface{}{
+		&session.ID,
+		&session.PublicID,
+		&session.MerchantID,
+		&session.Merchant,
+		&session.MerchantName,
+		&session.MerchantUserID,
+		&session.Amount,
+		&session.CurrencyID,
+		&session.Currency,
+		&session.Description,
+		&session.SuccessURL,
+		&session.CancelURL,
+		&session.Metadata,
+		&session.Status,
+		&session.PayerWallet,
+		&session.SettlementWalletID,
+		&session.PaidAmount,
+		&session.PaidCurrency,
+		&session.SettledAmount,
+		&session.TransactionID,
+		&session.ExpiresAt,
+		&session.CompletedAt,
+		&session.CreatedAt,
+		&session.UpdatedAt,
+	}
+}
+
+func (paymentModel PaymentModel) getCheckoutSession(where string, args ...interface{}) (*CheckoutSession, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var session CheckoutSession
+	err := paymentModel.DB.QueryRowContext(ctx, `
+		SELECT`+checkoutSessionColumns+`
+		FROM checkout_sessions`+checkoutSessionJoins+`
+		WHERE `+where,
+		args...,
+	).Scan(session.scanDestinations()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, constants.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &session, nil
+}
+
+// GetCheckoutSession returns a checkout session by its public id, e.g the one a
+// payer was sent.
+func (paymentModel PaymentModel) GetCheckoutSession(publicID string) (*CheckoutSession, error) {
+	return paymentModel.getCheckoutSession("checkout_sessions.public_id = $1", publicID)
+}
+
+// GetCheckoutSessionForMerchant returns a checkout session a merchant opened by its
+// public id.
+func (paymentModel PaymentModel) GetCheckoutSessionForMerchant(merchantID int64, publicID string) (*CheckoutSession, error) {
+	return paymentModel.getCheckoutSession("checkout_sessions.merchant_id = $1 AND checkout_sessions.public_id = $2", merchantID, publicID)
+}
+
+// GetCheckoutSessions returns the checkout sessions a merchant opened.
+func (paymentModel PaymentModel) GetCheckoutSessions(merchantID int64, filters listing.Filters) ([]*CheckoutSession, listing.Metadata, error) {
+	where, args := filters.Where([]interface{}{merchantID})
+	pagination, args := filters.Paginate(args)
+
+	query := fmt.Sprintf(`
+		SELECT
+			count(*) OVER(),
+			%s,
+			%s
+		FROM
+			checkout_sessions
+		%s
+		WHERE
+			checkout_sessions.merchant_id = $1
+		%s
+		%s
+		%s;
+	`, filters.CursorColumns(), checkoutSessionColumns, checkoutSessionJoins, where, filters.OrderBy(), pagination)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := paymentModel.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, listing.Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	lastSortValue := ""
+	var lastID int64
+	sessions := []*CheckoutSession{}
+	for rows.Next() {
+		var session CheckoutSession
+		destinations := append([]interface{}{&totalRecords, &lastSortValue, &lastID}, session.scanDestinations()...)
+		if err := rows.Scan(destinations...); err != nil {
+			return nil, listing.Metadata{}, err
+		}
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, listing.Metadata{}, err
+	}
+
+	metadata := filters.Metadata(totalRecords, len(sessions), lastSortValue, lastID)
+	return sessions, metadata, nil
+}
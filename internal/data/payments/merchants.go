@@ -0,0 +1,219 @@
+// payments holds the merchant accounts of users and the payments they collect from
+// customer wallets.
+package payments
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/publicid"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// Merchant represents the merchants table in the database: the business profile of
+// a user who collects payments, and the wallet they are paid into.
+type Merchant struct {
+	ID                 int64     `json:"-"`
+	PublicID           string    `json:"public_id"`
+	UserID             int64     `json:"-"`
+	BusinessName       string    `json:"business_name"`
+	BusinessEmail      string    `json:"business_email"`
+	Website            string    `json:"website"`
+	SettlementWalletID int64     `json:"-"`
+	SettlementWallet   string    `json:"settlement_wallet"`
+	Currency           string    `json:"currency"`
+	Version            int       `json:"version"`
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+func ValidateMerchant(validator *validators.Validator, merchant *Merchant) {
+	validator.Check(merchant.BusinessName != "", "business_name", "must be provided")
+	validator.Check(len(merchant.BusinessName) <= 100, "business_name", "must not be more than 100 characters long")
+	validator.Check(validators.Matches(merchant.BusinessEmail, validators.EmailREGEX), "business_email", "must be a valid email address")
+	if merchant.Website != "" {
+		parsed, err := url.Parse(merchant.Website)
+		validator.Check(len(merchant.Website) <= 2000, "website", "must not be more than 2000 characters long")
+		validator.Check(err == nil && parsed.Host != "" && (parsed.Scheme == "https" || parsed.Scheme == "http"), "website", "must be a valid absolute url")
+	}
+}
+
+// auditMerchant is what the audit trail records of a merchant.
+func auditMerchant(merchant *Merchant) map[string]interface{} {
+	return map[string]interface{}{
+		"business_name":     merchant.BusinessName,
+		"business_email":    merchant.BusinessEmail,
+		"website":           merchant.Website,
+		"settlement_wallet": merchant.SettlementWallet,
+	}
+}
+
+type PaymentModel struct {
+	DB *sql.DB
+}
+
+// InsertMerchant makes a user a merchant. A user can only have one merchant account.
+func (paymentModel PaymentModel) InsertMerchant(merchant *Merchant, actor audit.Actor) error {
+	publicID, err := publicid.New(constants.PrefixMerchantID)
+	if err != nil {
+		return err
+	}
+	merchant.PublicID = publicID
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := paymentModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO merchants (public_id, user_id, business_name, business_email, website, settlement_wallet_id)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, version, created_at, updated_at`,
+		merchant.PublicID,
+		merchant.UserID,
+		merchant.BusinessName,
+		merchant.BusinessEmail,
+		merchant.Website,
+		merchant.SettlementWalletID,
+	).Scan(&merchant.ID, &merchant.Version, &merchant.CreatedAt, &merchant.UpdatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "merchants_user_id_key"`:
+			return constants.ErrDuplicateMerchant
+		default:
+			return err
+		}
+	}
+
+	err = audit.RecordTx(ctx, tx, actor, "merchant.create", "merchant", merchant.PublicID, nil, auditMerchant(merchant))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const merchantColumns = `
+	merchants.id,
+	merchants.public_id,
+	merchants.user_id,
+	merchants.business_name,
+	merchants.business_email,
+	merchants.website,
+	merchants.settlement_wallet_id,
+	wallets.public_id,
+	currencies.code,
+	merchants.version,
+	merchants.created_at,
+	merchants.updated_at`
+
+const merchantJoins = `
+	JOIN wallets ON wallets.id = merchants.settlement_wallet_id
+	JOIN currencies ON currencies.id = wallets.currency_id`
+
+func (merchant *Merchant) scanDestinations() []interface{} {
+	return []interface{}{
+		&merchant.ID,
+		&merchant.PublicID,
+		&merchant.UserID,
+		&merchant.BusinessName,
+		&merchant.BusinessEmail,
+		&merchant.Website,
+		&merchant.SettlementWalletID,
+		&merchant.SettlementWallet,
+		&merchant.Currency,
+		&merchant.Version,
+		&merchant.CreatedAt,
+		&merchant.UpdatedAt,
+	}
+}
+
+func (paymentModel PaymentModel) getMerchant(where string, arg interface{}) (*Merchant, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var merchant Merchant
+	err := paymentModel.DB.QueryRowContext(ctx, `
+		SELECT`+merchantColumns+`
+		FROM merchants`+merchantJoins+`
+		WHERE `+where,
+		arg,
+	).Scan(merchant.scanDestinations()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, constants.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &merchant, nil
+}
+
+// GetMerchant returns a merchant by its public id, e.g the one a customer pays.
+func (paymentModel PaymentModel) GetMerchant(publicID string) (*Merchant, error) {
+	return paymentModel.getMerchant("merchants.public_id = $1", publicID)
+}
+
+// GetMerchantForUser returns the merchant account of a user.
+func (paymentModel PaymentModel) GetMerchantForUser(userID int64) (*Merchant, error) {
+	return paymentModel.getMerchant("merchants.user_id = $1", userID)
+}
+
+// UpdateMerchant saves the changes made to a merchant, which was before them. It
+// returns ErrEditConflict if the merchant was changed in the meantime. Payments
+// already made keep the settlement wallet they were made with.
+func (paymentModel PaymentModel) UpdateMerchant(before, merchant *Merchant, actor audit.Actor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := paymentModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE merchants
+		SET
+			business_name = $1,
+			business_email = $2,
+			website = $3,
+			settlement_wallet_id = $4,
+			version = version + 1,
+			updated_at = NOW()
+		WHERE id = $5 AND version = $6
+		RETURNING version, updated_at`,
+		merchant.BusinessName,
+		merchant.BusinessEmail,
+		merchant.Website,
+		merchant.SettlementWalletID,
+		merchant.ID,
+		merchant.Version,
+	).Scan(&merchant.Version, &merchant.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return constants.ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	err = audit.RecordTx(ctx, tx, actor, "merchant.update", "merchant", merchant.PublicID, auditMerchant(before), auditMerchant(merchant))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,759 @@
+package payments
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/data/outbox"
+	"github.com/thesambayo/digillets-api/internal/data/transactions"
+	"github.com/thesambayo/digillets-api/internal/data/wallets"
+	"github.com/thesambayo/digillets-api/internal/money"
+	"github.com/thesambayo/digillets-api/internal/publicid"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// Payment statuses. An authorized payment holds its amount on the customer wallet
+// until it is captured, voided by the merchant, or expires. A captured payment can
+// be refunded, in part or in full.
+const (
+	StatusAuthorized        = "authorized"
+	StatusCaptured          = "captured"
+	StatusPartiallyRefunded = "partially_refunded"
+	StatusRefunded          = "refunded"
+	StatusVoided            = "voided"
+	StatusExpired           = "expired"
+)
+
+// AuthorizationTTL is how long an authorized payment can be captured for.
+const AuthorizationTTL = 7 * 24 * time.Hour
+
+// HoldReason is the reason of the holds placed on authorized payments.
+const HoldReason = "payment"
+
+// Metadata holds the key-value pairs a merchant attaches to a payment, e.g its own
+// order id.
+type Metadata map[string]string
+
+// Value implements the driver.Valuer interface for jsonb columns.
+func (metadata Metadata) Value() (driver.Value, error) {
+	if metadata == nil {
+		return "{}", nil
+	}
+	encoded, err := json.Marshal(metadata)
+	return string(encoded), err
+}
+
+// Scan implements the sql.Scanner interface for jsonb columns.
+func (metadata *Metadata) Scan(value interface{}) error {
+	switch value := value.(type) {
+	case []byte:
+		return json.Unmarshal(value, metadata)
+	case string:
+		return json.Unmarshal([]byte(value), metadata)
+	default:
+		return fmt.Errorf("cannot scan %T into metadata", value)
+	}
+}
+
+func ValidateMetadata(validator *validators.Validator, metadata Metadata) {
+	validator.Check(len(metadata) <= 20, "metadata", "must not have more than 20 keys")
+	for key, value := range metadata {
+		validator.Check(key != "" && len(key) <= 40, "metadata", "must only have keys of 1 to 40 characters")
+		validator.Check(len(value) <= 500, "metadata", "must only have values of up to 500 characters")
+	}
+}
+
+// Payment represents the payments table in the database.
+type Payment struct {
+	ID                   int64        `json:"-"`
+	PublicID             string       `json:"public_id"`
+	MerchantID           int64        `json:"-"`
+	Merchant             string       `json:"merchant"`
+	MerchantName         string       `json:"merchant_name"`
+	MerchantUserID       int64        `json:"-"`
+	CustomerWalletID     int64        `json:"-"`
+	CustomerWallet       string       `json:"customer_wallet"`
+	CustomerUserID       int64        `json:"-"`
+	SettlementWalletID   int64        `json:"-"`
+	Amount               money.Amount `json:"amount"`
+	Currency             string       `json:"currency"`
+	CapturedAmount       money.Amount `json:"captured_amount"`
+	RefundedAmount       money.Amount `json:"refunded_amount"`
+	Status               string       `json:"status"`
+	Description          string       `json:"description"`
+	Metadata             Metadata     `json:"metadata"`
+	HoldID               string       `json:"-"`
+	CaptureTransactionID string       `json:"capture_transaction_id,omitempty"`
+	Refunds              []*Refund    `json:"refunds,omitempty"`
+	ExpiresAt            time.Time    `json:"expires_at"`
+	CapturedAt           *time.Time   `json:"captured_at,omitempty"`
+	CreatedAt            time.Time    `json:"created_at"`
+	UpdatedAt            time.Time    `json:"updated_at"`
+}
+
+// Refund represents the payment_refunds table in the database.
+type Refund struct {
+	ID            int64        `json:"-"`
+	PublicID      string       `json:"public_id"`
+	PaymentID     int64        `json:"-"`
+	Amount        money.Amount `json:"amount"`
+	Reason        string       `json:"reason"`
+	TransactionID string       `json:"transaction_id"`
+	CreatedAt     time.Time    `json:"created_at"`
+}
+
+// Settlement sums up what a merchant was paid and refunded in a currency on a day,
+// in UTC.
+type Settlement struct {
+	Date           string       `json:"date"`
+	Currency       string       `json:"currency"`
+	Captures       int          `json:"captures"`
+	CapturedAmount money.Amount `json:"captured_amount"`
+	Refunds        int          `json:"refunds"`
+	RefundedAmount money.Amount `json:"refunded_amount"`
+	NetAmount      money.Amount `json:"net_amount"`
+}
+
+// AuthorizeTx holds the amount of a new payment on the customer wallet within an
+// existing database transaction, and captures it straight away when capture is
+// true.
+func AuthorizeTx(ctx context.Context, tx *sql.Tx, payment *Payment, capture bool, actor audit.Actor) error {
+	publicID, err := publicid.New(constants.PrefixPaymentID)
+	if err != nil {
+		return err
+	}
+	payment.PublicID = publicID
+	payment.Status = StatusAuthorized
+	payment.CapturedAmount = money.Zero
+	payment.RefundedAmount = money.Zero
+	payment.ExpiresAt = time.Now().Add(AuthorizationTTL).UTC().Truncate(time.Second)
+	if payment.Metadata == nil {
+		payment.Metadata = Metadata{}
+	}
+
+	payment.HoldID, err = wallets.PlaceHoldTx(ctx, tx, payment.CustomerWalletID, payment.Amount, HoldReason, payment.PublicID, payment.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO payments
+			(public_id, merchant_id, customer_wallet_id, settlement_wallet_id, amount, status, description, metadata, hold_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id, created_at, updated_at`,
+		payment.PublicID,
+		payment.MerchantID,
+		payment.CustomerWalletID,
+		payment.SettlementWalletID,
+		payment.Amount,
+		payment.Status,
+		payment.Description,
+		payment.Metadata,
+		payment.HoldID,
+		payment.ExpiresAt,
+	).Scan(&payment.ID, &payment.CreatedAt, &payment.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	if !capture {
+		err = audit.RecordTx(ctx, tx, actor, "payment.authorize", "payment", payment.PublicID, nil, payment)
+		if err != nil {
+			return err
+		}
+		return outbox.WriteTx(ctx, tx, payment.MerchantUserID, outbox.EventPaymentAuthorized, payment)
+	}
+
+	// The wallets are locked by capturing before the audit log is, like everywhere
+	// else, so the authorization is recorded as it was once the capture is done.
+	authorized := *payment
+	before, err := captureTx(ctx, tx, payment, payment.Amount)
+	if err != nil {
+		return err
+	}
+	err = audit.RecordTx(ctx, tx, actor, "payment.authorize", "payment", payment.PublicID, nil, &authorized)
+	if err != nil {
+		return err
+	}
+	return recordCaptureTx(ctx, tx, payment, before, actor)
+}
+
+// lockTx locks a payment for the rest of the database transaction, and refreshes
+// what may have changed about it since it was read. It reports whether its
+// authorization expired.
+func lockTx(ctx context.Context, tx *sql.Tx, payment *Payment) (bool, error) {
+	var expired bool
+	err := tx.QueryRowContext(ctx, `
+		SELECT status, captured_amount, refunded_amount, expires_at <= NOW()
+		FROM payments
+		WHERE id = $1
+		FOR UPDATE`,
+		payment.ID,
+	).Scan(&payment.Status, &payment.CapturedAmount, &payment.RefundedAmount, &expired)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, constants.ErrRecordNotFound
+		default:
+			return false, err
+		}
+	}
+	return expired, nil
+}
+
+// Capture posts amount of an authorized payment, up to all of it, from the customer
+// wallet to the settlement wallet. What is not captured is released.
+func (paymentModel PaymentModel) Capture(payment *Payment, amount money.Amount, actor audit.Actor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := paymentModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	expired, err := lockTx(ctx, tx, payment)
+	if err != nil {
+		return err
+	}
+	switch {
+	case payment.Status != StatusAuthorized:
+		return constants.ErrPaymentNotAuthorized
+	case expired:
+		return constants.ErrAuthorizationExpired
+	case amount.Cmp(payment.Amount) > 0:
+		return constants.ErrAmountExceedsPayment
+	}
+
+	before, err := captureTx(ctx, tx, payment, amount)
+	if err != nil {
+		return err
+	}
+	if err = recordCaptureTx(ctx, tx, payment, before, actor); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// captureTx captures an authorized payment locked by the caller, and returns what
+// it was before for recordCaptureTx.
+func captureTx(ctx context.Context, tx *sql.Tx, payment *Payment, amount money.Amount) (map[string]interface{}, error) {
+	// The hold comes off first, so that it does not count against the amount posted.
+	err := wallets.SettleHoldTx(ctx, tx, payment.HoldID, wallets.HoldStatusCaptured)
+	if err != nil {
+		switch {
+		case errors.Is(err, constants.ErrRecordNotFound):
+			return nil, constants.ErrPaymentNotAuthorized
+		default:
+			return nil, err
+		}
+	}
+
+	transactionID, err := publicid.New(constants.PrefixTransactionID)
+	if err != nil {
+		return nil, err
+	}
+	transaction := &transactions.Transaction{
+		PublicID:    transactionID,
+		Type:        transactions.TypePayment,
+		Reference:   payment.PublicID,
+		Description: fmt.Sprintf("Payment to %s", payment.MerchantName),
+	}
+	entries := []transactions.Entry{
+		{WalletID: payment.CustomerWalletID, Amount: amount.Neg()},
+		{WalletID: payment.SettlementWalletID, Amount: amount},
+	}
+	if err = transactions.PostTx(ctx, tx, transaction, entries); err != nil {
+		return nil, err
+	}
+
+	before := map[string]interface{}{"status": payment.Status, "captured_amount": payment.CapturedAmount}
+	err = tx.QueryRowContext(ctx, `
+		UPDATE payments
+		SET status = $1, captured_amount = $2, capture_transaction_id = $3, captured_at = NOW(), updated_at = NOW()
+		WHERE id = $4
+		RETURNING captured_at, updated_at`,
+		StatusCaptured, amount, transaction.PublicID, payment.ID,
+	).Scan(&payment.CapturedAt, &payment.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	payment.Status = StatusCaptured
+	payment.CapturedAmount = amount
+	payment.CaptureTransactionID = transaction.PublicID
+
+	return before, nil
+}
+
+// recordCaptureTx records a payment captured by captureTx in the audit log and tells
+// the merchant about it.
+func recordCaptureTx(ctx context.Context, tx *sql.Tx, payment *Payment, before map[string]interface{}, actor audit.Actor) error {
+	after := map[string]interface{}{"status": payment.Status, "captured_amount": payment.CapturedAmount}
+	err := audit.RecordTx(ctx, tx, actor, "payment.capture", "payment", payment.PublicID, before, after)
+	if err != nil {
+		return err
+	}
+
+	return outbox.WriteTx(ctx, tx, payment.MerchantUserID, outbox.EventPaymentCaptured, payment)
+}
+
+// Void cancels an authorized payment, releasing its hold.
+func (paymentModel PaymentModel) Void(payment *Payment, actor audit.Actor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := paymentModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = lockTx(ctx, tx, payment); err != nil {
+		return err
+	}
+	if payment.Status != StatusAuthorized {
+		return constants.ErrPaymentNotAuthorized
+	}
+
+	if err = releaseTx(ctx, tx, payment, StatusVoided, "payment.void", actor); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// releaseTx releases the hold of an authorized payment locked by the caller and
+// moves it to status.
+func releaseTx(ctx context.Context, tx *sql.Tx, payment *Payment, status, action string, actor audit.Actor) error {
+	err := wallets.SettleHoldTx(ctx, tx, payment.HoldID, wallets.HoldStatusReleased)
+	// a hold already settled some other way has nothing left to release
+	if err != nil && !errors.Is(err, constants.ErrRecordNotFound) {
+		return err
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE payments
+		SET status = $1, updated_at = NOW()
+		WHERE id = $2
+		RETURNING updated_at`,
+		status, payment.ID,
+	).Scan(&payment.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	before := map[string]interface{}{"status": payment.Status}
+	after := map[string]interface{}{"status": status}
+	payment.Status = status
+	return audit.RecordTx(ctx, tx, actor, action, "payment", payment.PublicID, before, after)
+}
+
+// ExpireDue expires the authorized payments that were not captured in time,
+// releasing their holds, and returns how many it expired.
+func (paymentModel PaymentModel) ExpireDue(actor audit.Actor) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := paymentModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, public_id, status, hold_id
+		FROM payments
+		WHERE status = 'authorized' AND expires_at <= NOW()
+		ORDER BY id
+		LIMIT 500
+		FOR UPDATE SKIP LOCKED`,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	due := []*Payment{}
+	for rows.Next() {
+		var payment Payment
+		if err := rows.Scan(&payment.ID, &payment.PublicID, &payment.Status, &payment.HoldID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, &payment)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, payment := range due {
+		if err = releaseTx(ctx, tx, payment, StatusExpired, "payment.expire", actor); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(due), nil
+}
+
+// Refund gives back amount of a captured payment, up to what is left of it after
+// earlier refunds, from the settlement wallet to the customer wallet.
+func (paymentModel PaymentModel) Refund(payment *Payment, refund *Refund, actor audit.Actor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := paymentModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = lockTx(ctx, tx, payment); err != nil {
+		return err
+	}
+	if payment.Status != StatusCaptured && payment.Status != StatusPartiallyRefunded {
+		return constants.ErrPaymentNotRefundable
+	}
+	if refund.Amount.Cmp(payment.CapturedAmount.Sub(payment.RefundedAmount)) > 0 {
+		return constants.ErrAmountExceedsPayment
+	}
+
+	refundID, err := publicid.New(constants.PrefixRefundID)
+	if err != nil {
+		return err
+	}
+	transactionID, err := publicid.New(constants.PrefixTransactionID)
+	if err != nil {
+		return err
+	}
+	transaction := &transactions.Transaction{
+		PublicID:    transactionID,
+		Type:        transactions.TypeRefund,
+		Reference:   payment.PublicID,
+		Description: fmt.Sprintf("Refund from %s", payment.MerchantName),
+	}
+	entries := []transactions.Entry{
+		{WalletID: payment.SettlementWalletID, Amount: refund.Amount.Neg()},
+		{WalletID: payment.CustomerWalletID, Amount: refund.Amount},
+	}
+	if err = transactions.PostTx(ctx, tx, transaction, entries); err != nil {
+		return err
+	}
+
+	refund.PublicID = refundID
+	refund.PaymentID = payment.ID
+	refund.TransactionID = transaction.PublicID
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO payment_refunds (public_id, payment_id, amount, reason, transaction_id)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`,
+		refund.PublicID, refund.PaymentID, refund.Amount, refund.Reason, refund.TransactionID,
+	).Scan(&refund.ID, &refund.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	before := map[string]interface{}{"status": payment.Status, "refunded_amount": payment.RefundedAmount}
+	refunded := payment.RefundedAmount.Add(refund.Amount)
+	status := StatusPartiallyRefunded
+	if refunded.Cmp(payment.CapturedAmount) == 0 {
+		status = StatusRefunded
+	}
+	err = tx.QueryRowContext(ctx, `
+		UPDATE payments
+		SET status = $1, refunded_amount = $2, updated_at = NOW()
+		WHERE id = $3
+		RETURNING updated_at`,
+		status, refunded, payment.ID,
+	).Scan(&payment.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	payment.Status = status
+	payment.RefundedAmount = refunded
+	payment.Refunds = append(payment.Refunds, refund)
+
+	after := map[string]interface{}{"status": payment.Status, "refunded_amount": payment.RefundedAmount, "refund": refund}
+	err = audit.RecordTx(ctx, tx, actor, "payment.refund", "payment", payment.PublicID, before, after)
+	if err != nil {
+		return err
+	}
+
+	err = outbox.WriteTx(ctx, tx, payment.MerchantUserID, outbox.EventPaymentRefunded, payment)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const paymentColumns = `
+	payments.id,
+	payments.public_id,
+	payments.merchant_id,
+	merchants.public_id,
+	merchants.business_name,
+	merchants.user_id,
+	payments.customer_wallet_id,
+	wallets.public_id,
+	wallets.user_id,
+	payments.settlement_wallet_id,
+	payments.amount,
+	currencies.code,
+	payments.captured_amount,
+	payments.refunded_amount,
+	payments.status,
+	payments.description,
+	payments.metadata,
+	payments.hold_id,
+	payments.capture_transaction_id,
+	payments.expires_at,
+	payments.captured_at,
+	payments.created_at,
+	payments.updated_at`
+
+const paymentJoins = `
+	JOIN merchants ON merchants.id = payments.merchant_id
+	JOIN wallets ON wallets.id = payments.customer_wallet_id
+	JOIN currencies ON currencies.id = wallets.currency_id`
+
+func (payment *Payment) scanDestinations() []interface{} {
+	return []interface{}{
+		&payment.ID,
+		&payment.PublicID,
+		&payment.MerchantID,
+		&payment.Merchant,
+		&payment.MerchantName,
+		&payment.MerchantUserID,
+		&payment.CustomerWalletID,
+		&payment.CustomerWallet,
+		&payment.CustomerUserID,
+		&payment.SettlementWalletID,
+		&payment.Amount,
+		&payment.Currency,
+		&payment.CapturedAmount,
+		&payment.RefundedAmount,
+		&payment.Status,
+		&payment.Description,
+		&payment.Metadata,
+		&payment.HoldID,
+		&payment.CaptureTransactionID,
+		&payment.ExpiresAt,
+		&payment.CapturedAt,
+		&payment.CreatedAt,
+		&payment.UpdatedAt,
+	}
+}
+
+// getPayment returns the payment matching where with its refunds.
+func (paymentModel PaymentModel) getPayment(where string, args ...interface{}) (*Payment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var payment Payment
+	err := paymentModel.DB.QueryRowContext(ctx, `
+		SELECT`+paymentColumns+`
+		FROM payments`+paymentJoins+`
+		WHERE `+where,
+		args...,
+	).Scan(payment.scanDestinations()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, constants.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	rows, err := paymentModel.DB.QueryContext(ctx, `
+		SELECT id, public_id, payment_id, amount, reason, transaction_id, created_at
+		FROM payment_refunds
+		WHERE payment_id = $1
+		ORDER BY id`,
+		payment.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var refund Refund
+		err := rows.Scan(&refund.ID, &refund.PublicID, &refund.PaymentID, &refund.Amount, &refund.Reason, &refund.TransactionID, &refund.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		payment.Refunds = append(payment.Refunds, &refund)
+	}
+
+	return &payment, rows.Err()
+}
+
+// GetPaymentForMerchant returns a payment a merchant collected by its public id.
+func (paymentModel PaymentModel) GetPaymentForMerchant(merchantID int64, publicID string) (*Payment, error) {
+	return paymentModel.getPayment("payments.merchant_id = $1 AND payments.public_id = $2", merchantID, publicID)
+}
+
+// GetPaymentForCustomer returns a payment a user made by its public id.
+func (paymentModel PaymentModel) GetPaymentForCustomer(userID int64, publicID string) (*Payment, error) {
+	return paymentModel.getPayment("wallets.user_id = $1 AND payments.public_id = $2", userID, publicID)
+}
+
+// GetPayments returns the payments a merchant collected between from and to.
+func (paymentModel PaymentModel) GetPayments(merchantID int64, from, to time.Time, filters listing.Filters) ([]*Payment, listing.Metadata, error) {
+	args := []interface{}{merchantID, from, to}
+	where, args := filters.Where(args)
+	pagination, args := filters.Paginate(args)
+
+	query := fmt.Sprintf(`
+		SELECT
+			count(*) OVER(),
+			%s,
+			%s
+		FROM
+			payments
+		%s
+		WHERE
+			payments.merchant_id = $1
+		AND
+			payments.created_at >= $2
+		AND
+			payments.created_at < $3
+		%s
+		%s
+		%s;
+	`, filters.CursorColumns(), paymentColumns, paymentJoins, where, filters.OrderBy(), pagination)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := paymentModel.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, listing.Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	lastSortValue := ""
+	var lastID int64
+	payments := []*Payment{}
+	for rows.Next() {
+		var payment Payment
+		destinations := append([]interface{}{&totalRecords, &lastSortValue, &lastID}, payment.scanDestinations()...)
+		if err := rows.Scan(destinations...); err != nil {
+			return nil, listing.Metadata{}, err
+		}
+		payments = append(payments, &payment)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, listing.Metadata{}, err
+	}
+
+	metadata := filters.Metadata(totalRecords, len(payments), lastSortValue, lastID)
+	return payments, metadata, nil
+}
+
+// GetSettlements returns what a merchant was paid and refunded each day between from
+// and to, per currency, the latest day first. Paid checkout sessions and invoice
+// payments count as captures. Days without either are left out.
+func (paymentModel PaymentModel) GetSettlements(merchantID int64, from, to time.Time) ([]*Settlement, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := paymentModel.DB.QueryContext(ctx, `
+		SELECT
+			day,
+			currency,
+			COUNT(*) FILTER (WHERE kind = 'capture'),
+			COALESCE(SUM(amount) FILTER (WHERE kind = 'capture'), 0),
+			COUNT(*) FILTER (WHERE kind = 'refund'),
+			COALESCE(SUM(amount) FILTER (WHERE kind = 'refund'), 0)
+		FROM (
+			SELECT
+				(payments.captured_at AT TIME ZONE 'UTC')::date AS day,
+				currencies.code AS currency,
+				'capture' AS kind,
+				payments.captured_amount AS amount
+			FROM payments
+			JOIN wallets ON wallets.id = payments.settlement_wallet_id
+			JOIN currencies ON currencies.id = wallets.currency_id
+			WHERE payments.merchant_id = $1 AND payments.captured_at >= $2 AND payments.captured_at < $3
+			UNION ALL
+			SELECT
+				(checkout_sessions.completed_at AT TIME ZONE 'UTC')::date,
+				currencies.code,
+				'capture',
+				checkout_sessions.settled_amount
+			FROM checkout_sessions
+			JOIN wallets ON wallets.id = checkout_sessions.settlement_wallet_id
+			JOIN currencies ON currencies.id = wallets.currency_id
+			WHERE checkout_sessions.merchant_id = $1 AND checkout_sessions.completed_at >= $2 AND checkout_sessions.completed_at < $3
+			UNION ALL
+			SELECT
+				(invoice_payments.created_at AT TIME ZONE 'UTC')::date,
+				currencies.code,
+				'capture',
+				invoice_payments.settled_amount
+			FROM invoice_payments
+			JOIN invoices ON invoices.id = invoice_payments.invoice_id
+			JOIN wallets ON wallets.id = invoice_payments.settlement_wallet_id
+			JOIN currencies ON currencies.id = wallets.currency_id
+			WHERE invoices.merchant_id = $1 AND invoice_payments.created_at >= $2 AND invoice_payments.created_at < $3
+			UNION ALL
+			SELECT
+				(payment_refunds.created_at AT TIME ZONE 'UTC')::date,
+				currencies.code,
+				'refund',
+				payment_refunds.amount
+			FROM payment_refunds
+			JOIN payments ON payments.id = payment_refunds.payment_id
+			JOIN wallets ON wallets.id = payments.settlement_wallet_id
+			JOIN currencies ON currencies.id = wallets.currency_id
+			WHERE payments.merchant_id = $1 AND payment_refunds.created_at >= $2 AND payment_refunds.created_at < $3
+		) movements
+		GROUP BY day, currency
+		ORDER BY day DESC, currency`,
+		merchantID, from, to,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	settlements := []*Settlement{}
+	for rows.Next() {
+		var settlement Settlement
+		var day time.Time
+		err := rows.Scan(
+			&day,
+			&settlement.Currency,
+			&settlement.Captures,
+			&settlement.CapturedAmount,
+			&settlement.Refunds,
+			&settlement.RefundedAmount,
+		)
+		if err != nil {
+			return nil, err
+		}
+		settlement.Date = day.Format(time.DateOnly)
+		settlement.NetAmount = settlement.CapturedAmount.Sub(settlement.RefundedAmount)
+		settlements = append(settlements, &settlement)
+	}
+
+	return settlements, rows.Err()
+}
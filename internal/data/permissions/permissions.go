@@ -0,0 +1,102 @@
+package permissions
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// WalletsFreeze allows freezing and unfreezing any wallet.
+	WalletsFreeze = "wallets:freeze"
+	// AuditRead allows reading and verifying the audit log.
+	AuditRead = "audit:read"
+	// KYCReview allows reviewing KYC submissions and their documents.
+	KYCReview = "kyc:review"
+	// RiskReview allows reviewing the debits held by the risk rules.
+	RiskReview = "risk:review"
+	// SanctionsReview allows reviewing sanctions matches and reloading the list.
+	SanctionsReview = "sanctions:review"
+	// ApprovalsDecide allows approving or rejecting the actions of other users that
+	// need a second pair of eyes.
+	ApprovalsDecide = "approvals:decide"
+	// LedgerAdjust allows requesting manual adjustments of wallet balances.
+	LedgerAdjust = "ledger:adjust"
+	// ReconciliationManage allows reading reconciliation breaks and resolving them.
+	ReconciliationManage = "reconciliation:manage"
+	// WebhooksManage allows inspecting webhook deliveries and redelivering them.
+	WebhooksManage = "webhooks:manage"
+)
+
+// Permissions holds the permission codes for a single user.
+type Permissions []string
+
+// Include checks whether the Permissions slice contains a specific permission code.
+func (permissions Permissions) Include(code string) bool {
+	for i := range permissions {
+		if code == permissions[i] {
+			return true
+		}
+	}
+	return false
+}
+
+type PermissionModel struct {
+	DB *sql.DB
+}
+
+// GetAllForUser returns all permission codes for a specific user.
+func (permissionModel PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	query := `
+		SELECT
+			permissions.code
+		FROM
+			permissions
+		INNER JOIN
+			users_permissions ON users_permissions.permission_id = permissions.id
+		WHERE
+			users_permissions.user_id = $1;
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := permissionModel.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions Permissions
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// AddForUser grants the given permission codes to a user.
+func (permissionModel PermissionModel) AddForUser(userID int64, codes ...string) error {
+	query := `
+		INSERT INTO users_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING;
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := permissionModel.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	return err
+}
@@ -0,0 +1,608 @@
+package reconciliation
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/data/transactions"
+	"github.com/thesambayo/digillets-api/internal/money"
+	"github.com/thesambayo/digillets-api/internal/publicid"
+	"github.com/thesambayo/digillets-api/internal/settlement"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// Sources of a run.
+const (
+	SourceJob     = "job"
+	SourceCommand = "command"
+)
+
+// Break kinds, besides the settlement ones of the settlement package.
+const (
+	// KindBalanceMismatch is a wallet whose balance is not the sum of its postings.
+	KindBalanceMismatch = "balance_mismatch"
+	// KindCurrencyImbalance is a currency whose debits do not equal its credits.
+	KindCurrencyImbalance = "currency_imbalance"
+)
+
+// Break statuses.
+const (
+	StatusOpen     = "open"
+	StatusResolved = "resolved"
+)
+
+// Run represents the reconciliation_runs table in the database, one reconciliation
+// of the ledger and optionally of a settlement file.
+type Run struct {
+	ID                int64     `json:"-"`
+	PublicID          string    `json:"public_id"`
+	Source            string    `json:"source"`
+	SettlementFile    string    `json:"settlement_file,omitempty"`
+	WalletsChecked    int       `json:"wallets_checked"`
+	CurrenciesChecked int       `json:"currencies_checked"`
+	SettlementLines   int       `json:"settlement_lines"`
+	BreaksFound       int       `json:"breaks_found"`
+	StartedAt         time.Time `json:"started_at"`
+	FinishedAt        time.Time `json:"finished_at"`
+}
+
+// Break represents the reconciliation_breaks table in the database, a discrepancy
+// found by reconciliation. Expected is what the balance, the credits or the
+// provider says, and Actual what the postings, the debits or our records say.
+type Break struct {
+	ID             int64         `json:"-"`
+	PublicID       string        `json:"public_id"`
+	Run            string        `json:"run"`
+	Kind           string        `json:"kind"`
+	Subject        string        `json:"subject"`
+	Currency       string        `json:"currency"`
+	Expected       *money.Amount `json:"expected"`
+	Actual         *money.Amount `json:"actual"`
+	Detail         string        `json:"detail"`
+	Status         string        `json:"status"`
+	ResolutionNote string        `json:"resolution_note,omitempty"`
+	ResolvedBy     string        `json:"resolved_by,omitempty"`
+	ResolvedAt     *time.Time    `json:"resolved_at,omitempty"`
+	CreatedAt      time.Time     `json:"created_at"`
+	UpdatedAt      time.Time     `json:"updated_at"`
+}
+
+// Resolution is what staff found a break to be and did about it.
+type Resolution struct {
+	Note       string
+	ResolverID int64
+}
+
+func ValidateResolution(validator *validators.Validator, resolution *Resolution) {
+	validator.Check(resolution.Note != "", "note", "must be provided")
+	validator.Check(len(resolution.Note) <= 1000, "note", "must not be more than 1000 characters long")
+}
+
+type ReconciliationModel struct {
+	DB *sql.DB
+}
+
+// Run reconciles every wallet balance with the sum of its postings, the debits of
+// every currency with its credits, and the lines of a settlement file, if any, with
+// our deposits and withdrawals, recording the discrepancies as breaks. The checks
+// read a single snapshot of the ledger so that postings made meanwhile do not show
+// up as discrepancies.
+func (reconciliationModel ReconciliationModel) Run(source, settlementFile string, lines []settlement.Line, actor audit.Actor) (*Run, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	tx, err := reconciliationModel.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	publicID, err := publicid.New(constants.PrefixReconciliationRunID)
+	if err != nil {
+		return nil, err
+	}
+	run := &Run{
+		PublicID:        publicID,
+		Source:          source,
+		SettlementFile:  settlementFile,
+		SettlementLines: len(lines),
+		StartedAt:       time.Now(),
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO reconciliation_runs (public_id, source, settlement_file, started_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id`,
+		run.PublicID, run.Source, run.SettlementFile, run.StartedAt,
+	).Scan(&run.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	balanceBreaks, err := checkBalancesTx(ctx, tx, run)
+	if err != nil {
+		return nil, err
+	}
+	currencyBreaks, err := checkCurrenciesTx(ctx, tx, run)
+	if err != nil {
+		return nil, err
+	}
+	breaks := append(balanceBreaks, currencyBreaks...)
+
+	if len(lines) > 0 {
+		records, err := getSettlementRecordsTx(ctx, tx, lines)
+		if err != nil {
+			return nil, err
+		}
+		for _, difference := range settlement.Reconcile(lines, records) {
+			breaks = append(breaks, &Break{
+				Kind:     difference.Kind,
+				Subject:  difference.Reference,
+				Currency: difference.Currency,
+				Expected: difference.Expected,
+				Actual:   difference.Actual,
+				Detail:   difference.Detail,
+			})
+		}
+	}
+
+	for _, brk := range breaks {
+		if err = upsertBreakTx(ctx, tx, run, brk); err != nil {
+			return nil, err
+		}
+	}
+	run.BreaksFound = len(breaks)
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE reconciliation_runs
+		SET wallets_checked = $1, currencies_checked = $2, settlement_lines = $3, breaks_found = $4, finished_at = NOW()
+		WHERE id = $5
+		RETURNING finished_at`,
+		run.WalletsChecked, run.CurrenciesChecked, run.SettlementLines, run.BreaksFound, run.ID,
+	).Scan(&run.FinishedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	err = audit.RecordTx(ctx, tx, actor, "reconciliation.run", "reconciliation_run", run.PublicID, nil, run)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return run, nil
+}
+
+// checkBalancesTx returns a break for every wallet whose balance is not the sum of
+// its postings.
+func checkBalancesTx(ctx context.Context, tx *sql.Tx, run *Run) ([]*Break, error) {
+	err := tx.QueryRowContext(ctx, `SELECT count(*) FROM wallets`).Scan(&run.WalletsChecked)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT
+			wallets.public_id,
+			currencies.code,
+			COALESCE(wallets.balance, 0),
+			COALESCE(SUM(ledger_entries.amount), 0)
+		FROM
+			wallets
+		JOIN
+			currencies ON currencies.id = wallets.currency_id
+		LEFT JOIN
+			ledger_entries ON ledger_entries.wallet_id = wallets.id
+		GROUP BY
+			wallets.id, currencies.code
+		HAVING
+			COALESCE(wallets.balance, 0) <> COALESCE(SUM(ledger_entries.amount), 0)
+		ORDER BY
+			wallets.id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	breaks := []*Break{}
+	for rows.Next() {
+		var balance, posted money.Amount
+		brk := &Break{Kind: KindBalanceMismatch}
+		if err := rows.Scan(&brk.Subject, &brk.Currency, &balance, &posted); err != nil {
+			return nil, err
+		}
+		brk.Expected, brk.Actual = &balance, &posted
+		brk.Detail = fmt.Sprintf("balance is %s %s, its postings sum to %s %s", balance, brk.Currency, posted, brk.Currency)
+		breaks = append(breaks, brk)
+	}
+
+	return breaks, rows.Err()
+}
+
+// checkCurrenciesTx returns a break for every currency whose debits across all
+// wallets do not equal its credits.
+func checkCurrenciesTx(ctx context.Context, tx *sql.Tx, run *Run) ([]*Break, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT
+			currencies.code,
+			COALESCE(SUM(ledger_entries.amount) FILTER (WHERE ledger_entries.amount > 0), 0),
+			COALESCE(-SUM(ledger_entries.amount) FILTER (WHERE ledger_entries.amount < 0), 0)
+		FROM
+			ledger_entries
+		JOIN
+			wallets ON wallets.id = ledger_entries.wallet_id
+		JOIN
+			currencies ON currencies.id = wallets.currency_id
+		GROUP BY
+			currencies.code
+		ORDER BY
+			currencies.code`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	breaks := []*Break{}
+	for rows.Next() {
+		var currency string
+		var credits, debits money.Amount
+		if err := rows.Scan(&currency, &credits, &debits); err != nil {
+			return nil, err
+		}
+		run.CurrenciesChecked++
+		if credits.Cmp(debits) == 0 {
+			continue
+		}
+		breaks = append(breaks, &Break{
+			Kind:     KindCurrencyImbalance,
+			Subject:  currency,
+			Currency: currency,
+			Expected: &credits,
+			Actual:   &debits,
+			Detail:   fmt.Sprintf("credits are %s %s, debits are %s %s", credits, currency, debits, currency),
+		})
+	}
+
+	return breaks, rows.Err()
+}
+
+// getSettlementRecordsTx returns our deposits and withdrawals the lines of a
+// settlement file should match: those with their references, and those made on the
+// days the file covers. The amount of a record is what it moved in or out of the
+// customer wallet.
+func getSettlementRecordsTx(ctx context.Context, tx *sql.Tx, lines []settlement.Line) ([]settlement.Record, error) {
+	references := make([]string, len(lines))
+	for i, line := range lines {
+		references[i] = line.Reference
+	}
+	var from, to *time.Time
+	if start, end, ok := settlement.Period(lines); ok {
+		from, to = &start, &end
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT
+			transactions.public_id,
+			transactions.reference,
+			transactions.type,
+			currencies.code,
+			ABS(SUM(ledger_entries.amount))
+		FROM
+			transactions
+		JOIN
+			ledger_entries ON ledger_entries.transaction_id = transactions.id
+		JOIN
+			wallets ON wallets.id = ledger_entries.wallet_id AND wallets.kind = $1
+		JOIN
+			currencies ON currencies.id = wallets.currency_id
+		WHERE
+			transactions.type IN ($2, $3)
+			AND (
+				transactions.reference = ANY($4)
+				OR ($5::timestamptz IS NOT NULL AND transactions.created_at >= $5 AND transactions.created_at < $6)
+			)
+		GROUP BY
+			transactions.id, currencies.code
+		ORDER BY
+			transactions.id`,
+		constants.WalletKindUser, transactions.TypeDeposit, transactions.TypeWithdrawal, pq.Array(references), from, to,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []settlement.Record{}
+	for rows.Next() {
+		var record settlement.Record
+		if err := rows.Scan(&record.TransactionID, &record.Reference, &record.Type, &record.Currency, &record.Amount); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+// upsertBreakTx records a break found by a run. A discrepancy that already has an
+// open break is brought up to date on it instead.
+func upsertBreakTx(ctx context.Context, tx *sql.Tx, run *Run, brk *Break) error {
+	publicID, err := publicid.New(constants.PrefixReconciliationBreakID)
+	if err != nil {
+		return err
+	}
+	if len(brk.Subject) > 100 {
+		brk.Subject = brk.Subject[:100]
+	}
+
+	return tx.QueryRowContext(ctx, `
+		INSERT INTO reconciliation_breaks
+			(public_id, run_id, kind, subject, currency, expected, actual, detail)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (kind, subject) WHERE status = 'open' DO UPDATE
+		SET run_id = EXCLUDED.run_id, currency = EXCLUDED.currency, expected = EXCLUDED.expected,
+			actual = EXCLUDED.actual, detail = EXCLUDED.detail, updated_at = NOW()
+		RETURNING id, public_id, status, created_at, updated_at`,
+		publicID, run.ID, brk.Kind, brk.Subject, brk.Currency, brk.Expected, brk.Actual, brk.Detail,
+	).Scan(&brk.ID, &brk.PublicID, &brk.Status, &brk.CreatedAt, &brk.UpdatedAt)
+}
+
+// Resolve closes an open break with what staff found it to be.
+func (reconciliationModel ReconciliationModel) Resolve(brk *Break, resolution Resolution, actor audit.Actor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := reconciliationModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRowContext(ctx, `
+		SELECT status
+		FROM reconciliation_breaks
+		WHERE id = $1
+		FOR UPDATE`,
+		brk.ID,
+	).Scan(&status)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return constants.ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	if status != StatusOpen {
+		return constants.ErrBreakResolved
+	}
+
+	brk.Status = StatusResolved
+	brk.ResolutionNote = resolution.Note
+	brk.ResolvedBy = actor.PublicID
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE reconciliation_breaks
+		SET status = $1, resolution_note = $2, resolved_by = $3, resolved_at = NOW(), updated_at = NOW()
+		WHERE id = $4
+		RETURNING resolved_at, updated_at`,
+		brk.Status, brk.ResolutionNote, resolution.ResolverID, brk.ID,
+	).Scan(&brk.ResolvedAt, &brk.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	before := map[string]interface{}{"status": status}
+	after := map[string]interface{}{"status": brk.Status, "resolution_note": brk.ResolutionNote}
+	err = audit.RecordTx(ctx, tx, actor, "reconciliation.resolve", "reconciliation_break", brk.PublicID, before, after)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const breakColumns = `
+	reconciliation_breaks.id,
+	reconciliation_breaks.public_id,
+	reconciliation_runs.public_id,
+	reconciliation_breaks.kind,
+	reconciliation_breaks.subject,
+	reconciliation_breaks.currency,
+	reconciliation_breaks.expected,
+	reconciliation_breaks.actual,
+	reconciliation_breaks.detail,
+	reconciliation_breaks.status,
+	reconciliation_breaks.resolution_note,
+	COALESCE(resolvers.public_id, ''),
+	reconciliation_breaks.resolved_at,
+	reconciliation_breaks.created_at,
+	reconciliation_breaks.updated_at`
+
+const breakJoins = `
+	JOIN
+		reconciliation_runs ON reconciliation_runs.id = reconciliation_breaks.run_id
+	LEFT JOIN
+		users resolvers ON resolvers.id = reconciliation_breaks.resolved_by`
+
+func (brk *Break) scanDestinations() []interface{} {
+	return []interface{}{
+		&brk.ID,
+		&brk.PublicID,
+		&brk.Run,
+		&brk.Kind,
+		&brk.Subject,
+		&brk.Currency,
+		&brk.Expected,
+		&brk.Actual,
+		&brk.Detail,
+		&brk.Status,
+		&brk.ResolutionNote,
+		&brk.ResolvedBy,
+		&brk.ResolvedAt,
+		&brk.CreatedAt,
+		&brk.UpdatedAt,
+	}
+}
+
+func (reconciliationModel ReconciliationModel) GetBreaks(filters listing.Filters) ([]*Break, listing.Metadata, error) {
+	where, args := filters.Where(nil)
+	pagination, args := filters.Paginate(args)
+
+	query := fmt.Sprintf(`
+		SELECT
+			count(*) OVER(),
+			%s,
+			%s
+		FROM
+			reconciliation_breaks
+		%s
+		WHERE
+			true
+		%s
+		%s
+		%s;
+	`, filters.CursorColumns(), breakColumns, breakJoins, where, filters.OrderBy(), pagination)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := reconciliationModel.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, listing.Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	lastSortValue := ""
+	var lastID int64
+	breaks := []*Break{}
+	for rows.Next() {
+		var brk Break
+		destinations := append([]interface{}{&totalRecords, &lastSortValue, &lastID}, brk.scanDestinations()...)
+		if err := rows.Scan(destinations...); err != nil {
+			return nil, listing.Metadata{}, err
+		}
+		breaks = append(breaks, &brk)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, listing.Metadata{}, err
+	}
+
+	metadata := filters.Metadata(totalRecords, len(breaks), lastSortValue, lastID)
+	return breaks, metadata, nil
+}
+
+func (reconciliationModel ReconciliationModel) GetBreakByPublicId(publicID string) (*Break, error) {
+	query := fmt.Sprintf(`
+		SELECT
+			%s
+		FROM
+			reconciliation_breaks
+		%s
+		WHERE
+			reconciliation_breaks.public_id = $1;
+	`, breakColumns, breakJoins)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var brk Break
+	err := reconciliationModel.DB.QueryRowContext(ctx, query, publicID).Scan(brk.scanDestinations()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, constants.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &brk, nil
+}
+
+func (reconciliationModel ReconciliationModel) GetRuns(filters listing.Filters) ([]*Run, listing.Metadata, error) {
+	where, args := filters.Where(nil)
+	pagination, args := filters.Paginate(args)
+
+	query := fmt.Sprintf(`
+		SELECT
+			count(*) OVER(),
+			%s,
+			reconciliation_runs.id,
+			reconciliation_runs.public_id,
+			reconciliation_runs.source,
+			reconciliation_runs.settlement_file,
+			reconciliation_runs.wallets_checked,
+			reconciliation_runs.currencies_checked,
+			reconciliation_runs.settlement_lines,
+			reconciliation_runs.breaks_found,
+			reconciliation_runs.started_at,
+			reconciliation_runs.finished_at
+		FROM
+			reconciliation_runs
+		WHERE
+			true
+		%s
+		%s
+		%s;
+	`, filters.CursorColumns(), where, filters.OrderBy(), pagination)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := reconciliationModel.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, listing.Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	lastSortValue := ""
+	var lastID int64
+	runs := []*Run{}
+	for rows.Next() {
+		var run Run
+		err := rows.Scan(
+			&totalRecords,
+			&lastSortValue,
+			&lastID,
+			&run.ID,
+			&run.PublicID,
+			&run.Source,
+			&run.SettlementFile,
+			&run.WalletsChecked,
+			&run.CurrenciesChecked,
+			&run.SettlementLines,
+			&run.BreaksFound,
+			&run.StartedAt,
+			&run.FinishedAt,
+		)
+		if err != nil {
+			return nil, listing.Metadata{}, err
+		}
+		runs = append(runs, &run)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, listing.Metadata{}, err
+	}
+
+	metadata := filters.Metadata(totalRecords, len(runs), lastSortValue, lastID)
+	return runs, metadata, nil
+}
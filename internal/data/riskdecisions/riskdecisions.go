@@ -0,0 +1,763 @@
+package riskdecisions
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/data/screenings"
+	"github.com/thesambayo/digillets-api/internal/data/transactions"
+	"github.com/thesambayo/digillets-api/internal/data/transfers"
+	"github.com/thesambayo/digillets-api/internal/data/wallets"
+	"github.com/thesambayo/digillets-api/internal/money"
+	"github.com/thesambayo/digillets-api/internal/publicid"
+	"github.com/thesambayo/digillets-api/internal/risk"
+	"github.com/thesambayo/digillets-api/internal/sanctions"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// Decision statuses. An allowed debit is completed and a blocked one blocked
+// straight away, one sent for review is pending until a reviewer approves or
+// rejects it.
+const (
+	StatusCompleted = "completed"
+	StatusBlocked   = "blocked"
+	StatusPending   = "pending"
+	StatusApproved  = "approved"
+	StatusRejected  = "rejected"
+)
+
+// HoldReason is the reason of the holds placed on debits sent for review.
+const HoldReason = "risk_review"
+
+// HoldDuration is how long the funds of a debit sent for review are held.
+const HoldDuration = 7 * 24 * time.Hour
+
+// Decision represents the risk_decisions table in the database: the outcome of the
+// risk rules on a debit, the rules that fired, and what was done about it. The
+// transfer, or the payload of another debit, is kept so that a reviewed one can be
+// made as it was asked for.
+type Decision struct {
+	ID              int64               `json:"-"`
+	PublicID        string              `json:"public_id"`
+	UserID          int64               `json:"-"`
+	User            string              `json:"user"`
+	Wallet          string              `json:"wallet"`
+	Beneficiary     string              `json:"beneficiary_wallet,omitempty"`
+	TransactionType string              `json:"transaction_type"`
+	Amount          money.Amount        `json:"amount"`
+	Currency        string              `json:"currency"`
+	BaseAmount      money.Amount        `json:"base_amount"`
+	Device          string              `json:"device"`
+	Outcome         string              `json:"outcome"`
+	Fired           []risk.Fired        `json:"fired"`
+	Status          string              `json:"status"`
+	HoldID          string              `json:"hold_id,omitempty"`
+	TransactionID   string              `json:"transaction_id,omitempty"`
+	Transfer        *transfers.Transfer `json:"transfer,omitempty"`
+	Payload         json.RawMessage     `json:"payload,omitempty"`
+	ReviewNote      string              `json:"review_note,omitempty"`
+	ReviewedBy      string              `json:"reviewed_by,omitempty"`
+	ReviewedAt      *time.Time          `json:"reviewed_at,omitempty"`
+	CreatedAt       time.Time           `json:"created_at"`
+	UpdatedAt       time.Time           `json:"updated_at"`
+}
+
+// Review is a reviewer's decision on a held debit.
+type Review struct {
+	Approve    bool
+	Note       string
+	ReviewerID int64
+}
+
+func ValidateReview(validator *validators.Validator, review *Review) {
+	if !review.Approve {
+		validator.Check(review.Note != "", "note", "must be provided when rejecting")
+	}
+	validator.Check(len(review.Note) <= 1000, "note", "must not be more than 1000 characters long")
+}
+
+// Debit is a debit other than a transfer for the risk rules, e.g a payment to a
+// merchant. To is the wallet paid into, and BeneficiaryName the name screened for
+// it when its owner's is not the one that matters. Hold is what is held on From
+// while it is under review.
+type Debit struct {
+	TransactionType string
+	From            *wallets.Wallet
+	To              *wallets.Wallet
+	BeneficiaryName string
+	Amount          money.Amount
+	Hold            money.Amount
+	Payload         json.RawMessage
+}
+
+// Executor makes a debit allowed by the risk rules or approved by a reviewer within
+// the database transaction deciding it, and returns the public id of what it made.
+type Executor func(ctx context.Context, tx *sql.Tx) (string, error)
+
+type RiskDecisionModel struct {
+	DB       *sql.DB
+	Screener *sanctions.Screener
+}
+
+// CreateTransfer runs the risk rules on a priced transfer made from a device and
+// acts on the outcome. See CreateTransferTx.
+func (decisionModel RiskDecisionModel) CreateTransfer(transfer *transfers.Transfer, device string, actor audit.Actor) (*Decision, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := decisionModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	decision, err := decisionModel.CreateTransferTx(ctx, tx, transfer, device, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return decision, nil
+}
+
+// CreateTransferTx runs the risk rules on a priced transfer made from a device, and
+// acts on the outcome within an existing database transaction: an allowed transfer
+// is made, one sent for review has its total debit held on the wallet, and a
+// blocked one is left. The decision is recorded whatever the outcome, unless acting
+// on it fails, and potential sanctions matches of the beneficiary are queued for
+// review.
+func (decisionModel RiskDecisionModel) CreateTransferTx(ctx context.Context, tx *sql.Tx, transfer *transfers.Transfer, device string, actor audit.Actor) (*Decision, error) {
+	debit := &Debit{
+		TransactionType: transactions.TypeTransfer,
+		From:            transfer.From,
+		To:              transfer.To,
+		Amount:          transfer.Amount,
+		Hold:            transfer.Fee.TotalDebit,
+	}
+	execute := func(ctx context.Context, tx *sql.Tx) (string, error) {
+		if err := transfers.CreateTx(ctx, tx, transfer, actor); err != nil {
+			return "", err
+		}
+		return transfer.PublicID, nil
+	}
+
+	return decisionModel.createTx(ctx, tx, debit, transfer, device, actor, execute)
+}
+
+// CreateDebit runs the risk rules on a debit made from a device and acts on the
+// outcome. See CreateDebitTx.
+func (decisionModel RiskDecisionModel) CreateDebit(debit *Debit, device string, actor audit.Actor, execute Executor) (*Decision, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := decisionModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	decision, err := decisionModel.CreateDebitTx(ctx, tx, debit, device, actor, execute)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return decision, nil
+}
+
+// CreateDebitTx runs the risk rules on a debit other than a transfer like
+// CreateTransferTx does, making an allowed one with execute and keeping its payload
+// for one sent for review.
+func (decisionModel RiskDecisionModel) CreateDebitTx(ctx context.Context, tx *sql.Tx, debit *Debit, device string, actor audit.Actor, execute Executor) (*Decision, error) {
+	return decisionModel.createTx(ctx, tx, debit, nil, device, actor, execute)
+}
+
+// createTx decides a debit, which is the transfer when it is not nil.
+func (decisionModel RiskDecisionModel) createTx(ctx context.Context, tx *sql.Tx, debit *Debit, transfer *transfers.Transfer, device string, actor audit.Actor, execute Executor) (*Decision, error) {
+	from, to := debit.From, debit.To
+
+	// Take the debits of a user one at a time, so that the velocity rules count
+	// every debit before the next is decided.
+	_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, from.User.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := getRulesTx(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	publicID, err := publicid.New(constants.PrefixRiskDecisionID)
+	if err != nil {
+		return nil, err
+	}
+
+	decision := &Decision{
+		PublicID:        publicID,
+		UserID:          from.User.ID,
+		Wallet:          from.PublicID,
+		TransactionType: debit.TransactionType,
+		Amount:          debit.Amount,
+		Currency:        from.Currency.Code,
+		BaseAmount:      debit.Amount.Div(from.Currency.ExchangeRate, 4, money.DefaultRounding),
+		Device:          device,
+		Transfer:        transfer,
+		Payload:         debit.Payload,
+	}
+	var beneficiaryID *int64
+	if to.User.ID != from.User.ID {
+		decision.Beneficiary = to.PublicID
+		beneficiaryID = &to.ID
+	}
+
+	watchlist, beneficiaryName, matches, err := decisionModel.screenTx(ctx, tx, from.User.ID, to.User.ID, debit.BeneficiaryName)
+	if err != nil {
+		return nil, err
+	}
+
+	history := &txHistory{ctx: ctx, tx: tx, userID: from.User.ID, wallet: from, transactionType: debit.TransactionType, device: device, beneficiaryID: beneficiaryID}
+	riskDebit := risk.Debit{
+		Amount:      decision.Amount,
+		Currency:    decision.Currency,
+		BaseAmount:  decision.BaseAmount,
+		Device:      device,
+		Beneficiary: decision.Beneficiary,
+		Watchlist:   watchlist,
+	}
+	result, err := risk.Evaluate(rules, riskDebit, history, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	decision.Outcome = result.Outcome
+	decision.Fired = result.Fired
+
+	switch decision.Outcome {
+	case risk.OutcomeAllow:
+		decision.TransactionID, err = execute(ctx, tx)
+		if err != nil {
+			return nil, err
+		}
+		decision.Status = StatusCompleted
+
+	case risk.OutcomeReview:
+		decision.HoldID, err = wallets.PlaceHoldTx(ctx, tx, from.ID, debit.Hold, HoldReason, decision.PublicID, time.Now().Add(HoldDuration))
+		if err != nil {
+			return nil, err
+		}
+		decision.Status = StatusPending
+
+	case risk.OutcomeBlock:
+		decision.Status = StatusBlocked
+	}
+
+	fired, err := json.Marshal(decision.Fired)
+	if err != nil {
+		return nil, err
+	}
+	transferJSON, err := json.Marshal(transfer)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO risk_decisions
+			(public_id, user_id, wallet_id, beneficiary_wallet_id, transaction_type, amount, currency, base_amount, device, outcome, fired, status, hold_id, transaction_id, transfer, payload)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+		RETURNING id, created_at, updated_at`,
+		decision.PublicID,
+		decision.UserID,
+		from.ID,
+		beneficiaryID,
+		decision.TransactionType,
+		decision.Amount,
+		decision.Currency,
+		decision.BaseAmount,
+		decision.Device,
+		decision.Outcome,
+		string(fired),
+		decision.Status,
+		decision.HoldID,
+		decision.TransactionID,
+		string(transferJSON),
+		nullJSON(decision.Payload),
+	).Scan(&decision.ID, &decision.CreatedAt, &decision.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	subject := screenings.SubjectTransfer
+	if transfer == nil {
+		subject = screenings.SubjectPayment
+	}
+	_, err = screenings.InsertMatchesTx(ctx, tx, subject, to.User.ID, &decision.ID, beneficiaryName, matches, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	// an allowed debit is already in the audit log by what made it
+	if decision.Outcome != risk.OutcomeAllow {
+		after := map[string]interface{}{
+			"outcome": decision.Outcome,
+			"status":  decision.Status,
+			"hold_id": decision.HoldID,
+			"fired":   decision.Fired,
+		}
+		err = audit.RecordTx(ctx, tx, actor, "risk."+decision.Outcome, "risk_decision", decision.PublicID, nil, after)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return decision, nil
+}
+
+// screenTx describes the watchlist hits on the parties of a debit for the risk
+// rules: a sender or beneficiary account under sanctions review or blocked, and new
+// potential matches of the beneficiary's name, or of name when it is given, which
+// are returned to be queued. A debit between wallets of the same user has no
+// beneficiary to screen.
+func (decisionModel RiskDecisionModel) screenTx(ctx context.Context, tx *sql.Tx, senderID, beneficiaryID int64, name string) ([]string, string, []sanctions.Match, error) {
+	watchlist := []string{}
+
+	var senderStatus string
+	err := tx.QueryRowContext(ctx, `SELECT screening_status FROM users WHERE id = $1`, senderID).Scan(&senderStatus)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if senderStatus != screenings.UserClear {
+		watchlist = append(watchlist, "sender account sanctions screening is "+senderStatus)
+	}
+
+	if beneficiaryID == senderID {
+		return watchlist, "", nil, nil
+	}
+
+	var userName, status string
+	err = tx.QueryRowContext(ctx, `SELECT name, screening_status FROM users WHERE id = $1`, beneficiaryID).Scan(&userName, &status)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if name == "" {
+		name = userName
+	}
+	if status != screenings.UserClear {
+		watchlist = append(watchlist, "beneficiary account sanctions screening is "+status)
+	}
+
+	matches, err := screenings.FilterClearedTx(ctx, tx, beneficiaryID, decisionModel.Screener.Screen(name))
+	if err != nil {
+		return nil, "", nil, err
+	}
+	for _, match := range matches {
+		watchlist = append(watchlist, fmt.Sprintf("beneficiary name %q potentially matches %s (%s, score %.2f)", name, match.Entry.Name, match.Entry.UID, match.Score))
+	}
+
+	return watchlist, name, matches, nil
+}
+
+// Review approves or rejects a debit held for review. Approving captures the hold
+// and makes the debit with execute; rejecting releases the hold.
+func (decisionModel RiskDecisionModel) Review(decision *Decision, review Review, actor audit.Actor, execute Executor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := decisionModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRowContext(ctx, `
+		SELECT status
+		FROM risk_decisions
+		WHERE id = $1
+		FOR UPDATE`,
+		decision.ID,
+	).Scan(&status)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return constants.ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	if status != StatusPending {
+		return constants.ErrRiskAlreadyReviewed
+	}
+
+	action := "risk.reject"
+	decision.Status = StatusRejected
+	if review.Approve {
+		action = "risk.approve"
+		decision.Status = StatusApproved
+
+		// capture the hold first, so that its funds are free for the transfer
+		if err = wallets.SettleHoldTx(ctx, tx, decision.HoldID, wallets.HoldStatusCaptured); err != nil {
+			return err
+		}
+		decision.TransactionID, err = execute(ctx, tx)
+		if err != nil {
+			return err
+		}
+	} else {
+		if err = wallets.SettleHoldTx(ctx, tx, decision.HoldID, wallets.HoldStatusReleased); err != nil {
+			return err
+		}
+	}
+	decision.ReviewNote = review.Note
+	decision.ReviewedBy = actor.PublicID
+
+	transferJSON, err := json.Marshal(decision.Transfer)
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE risk_decisions
+		SET status = $1, transaction_id = $2, transfer = $3, review_note = $4, reviewed_by = $5, reviewed_at = NOW(), updated_at = NOW()
+		WHERE id = $6
+		RETURNING reviewed_at, updated_at`,
+		decision.Status, decision.TransactionID, string(transferJSON), decision.ReviewNote, review.ReviewerID, decision.ID,
+	).Scan(&decision.ReviewedAt, &decision.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	before := map[string]interface{}{"status": status}
+	after := map[string]interface{}{
+		"status":         decision.Status,
+		"transaction_id": decision.TransactionID,
+		"review_note":    decision.ReviewNote,
+	}
+	err = audit.RecordTx(ctx, tx, actor, action, "risk_decision", decision.PublicID, before, after)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const decisionColumns = `
+	risk_decisions.id,
+	risk_decisions.public_id,
+	risk_decisions.user_id,
+	users.public_id,
+	wallets.public_id,
+	COALESCE(beneficiaries.public_id, ''),
+	risk_decisions.transaction_type,
+	risk_decisions.amount,
+	risk_decisions.currency,
+	risk_decisions.base_amount,
+	risk_decisions.device,
+	risk_decisions.outcome,
+	risk_decisions.fired::text,
+	risk_decisions.status,
+	risk_decisions.hold_id,
+	risk_decisions.transaction_id,
+	COALESCE(risk_decisions.transfer::text, 'null'),
+	COALESCE(risk_decisions.payload::text, ''),
+	risk_decisions.review_note,
+	COALESCE(reviewers.public_id, ''),
+	risk_decisions.reviewed_at,
+	risk_decisions.created_at,
+	risk_decisions.updated_at`
+
+const decisionJoins = `
+	JOIN
+		users ON users.id = risk_decisions.user_id
+	JOIN
+		wallets ON wallets.id = risk_decisions.wallet_id
+	LEFT JOIN
+		wallets beneficiaries ON beneficiaries.id = risk_decisions.beneficiary_wallet_id
+	LEFT JOIN
+		users reviewers ON reviewers.id = risk_decisions.reviewed_by`
+
+// scanDestinations returns the destinations of decisionColumns. The fired rules
+// and the transfer are scanned as json into the given slices, see decode.
+func (decision *Decision) scanDestinations(fired, transfer *[]byte, payload *string) []interface{} {
+	return []interface{}{
+		&decision.ID,
+		&decision.PublicID,
+		&decision.UserID,
+		&decision.User,
+		&decision.Wallet,
+		&decision.Beneficiary,
+		&decision.TransactionType,
+		&decision.Amount,
+		&decision.Currency,
+		&decision.BaseAmount,
+		&decision.Device,
+		&decision.Outcome,
+		fired,
+		&decision.Status,
+		&decision.HoldID,
+		&decision.TransactionID,
+		transfer,
+		payload,
+		&decision.ReviewNote,
+		&decision.ReviewedBy,
+		&decision.ReviewedAt,
+		&decision.CreatedAt,
+		&decision.UpdatedAt,
+	}
+}
+
+func (decision *Decision) decode(fired, transfer []byte, payload string) error {
+	if err := json.Unmarshal(fired, &decision.Fired); err != nil {
+		return err
+	}
+	if payload != "" {
+		decision.Payload = json.RawMessage(payload)
+	}
+	return json.Unmarshal(transfer, &decision.Transfer)
+}
+
+// nullJSON stores an empty payload as NULL.
+func nullJSON(payload json.RawMessage) interface{} {
+	if len(payload) == 0 {
+		return nil
+	}
+	return string(payload)
+}
+
+func (decisionModel RiskDecisionModel) GetAll(filters listing.Filters) ([]*Decision, listing.Metadata, error) {
+	where, args := filters.Where(nil)
+	pagination, args := filters.Paginate(args)
+
+	query := fmt.Sprintf(`
+		SELECT
+			count(*) OVER(),
+			%s,
+			%s
+		FROM
+			risk_decisions
+		%s
+		WHERE
+			true
+		%s
+		%s
+		%s;
+	`, filters.CursorColumns(), decisionColumns, decisionJoins, where, filters.OrderBy(), pagination)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := decisionModel.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, listing.Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	lastSortValue := ""
+	var lastID int64
+	decisions := []*Decision{}
+	for rows.Next() {
+		var decision Decision
+		var fired, transfer []byte
+		var payload string
+		destinations := append([]interface{}{&totalRecords, &lastSortValue, &lastID}, decision.scanDestinations(&fired, &transfer, &payload)...)
+		if err := rows.Scan(destinations...); err != nil {
+			return nil, listing.Metadata{}, err
+		}
+		if err := decision.decode(fired, transfer, payload); err != nil {
+			return nil, listing.Metadata{}, err
+		}
+		decisions = append(decisions, &decision)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, listing.Metadata{}, err
+	}
+
+	metadata := filters.Metadata(totalRecords, len(decisions), lastSortValue, lastID)
+	return decisions, metadata, nil
+}
+
+func (decisionModel RiskDecisionModel) GetByPublicId(publicID string) (*Decision, error) {
+	query := fmt.Sprintf(`
+		SELECT
+			%s
+		FROM
+			risk_decisions
+		%s
+		WHERE
+			risk_decisions.public_id = $1;
+	`, decisionColumns, decisionJoins)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var decision Decision
+	var fired, transfer []byte
+	var payload string
+	err := decisionModel.DB.QueryRowContext(ctx, query, publicID).Scan(decision.scanDestinations(&fired, &transfer, &payload)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, constants.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if err = decision.decode(fired, transfer, payload); err != nil {
+		return nil, err
+	}
+
+	return &decision, nil
+}
+
+// getRulesTx returns the active risk rules.
+func getRulesTx(ctx context.Context, tx *sql.Tx) ([]risk.Rule, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT
+			risk_rules.id,
+			risk_rules.name,
+			risk_rules.kind,
+			risk_rules.action,
+			risk_rules.threshold,
+			risk_rules.count,
+			risk_rules.window_minutes,
+			risk_rules.multiplier,
+			risk_rules.ratio
+		FROM
+			risk_rules
+		WHERE
+			risk_rules.active
+		ORDER BY
+			risk_rules.id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []risk.Rule{}
+	for rows.Next() {
+		var rule risk.Rule
+		err := rows.Scan(
+			&rule.ID,
+			&rule.Name,
+			&rule.Kind,
+			&rule.Action,
+			&rule.Threshold,
+			&rule.Count,
+			&rule.WindowMinutes,
+			&rule.Multiplier,
+			&rule.Ratio,
+		)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// txHistory answers the questions of the risk rules from the database, within the
+// transaction deciding the debit.
+type txHistory struct {
+	ctx             context.Context
+	tx              *sql.Tx
+	userID          int64
+	wallet          *wallets.Wallet
+	transactionType string
+	device          string
+	beneficiaryID   *int64
+}
+
+// DebitsSince counts every debit the user has attempted, blocked ones included.
+func (history *txHistory) DebitsSince(since time.Time) (int, error) {
+	var count int
+	err := history.tx.QueryRowContext(history.ctx, `
+		SELECT COUNT(*)
+		FROM risk_decisions
+		WHERE user_id = $1 AND created_at > $2`,
+		history.userID, since,
+	).Scan(&count)
+	return count, err
+}
+
+// AverageDebit averages the debits of the same type out of the user's wallets in
+// the currency.
+func (history *txHistory) AverageDebit(since time.Time) (int, money.Amount, error) {
+	var count int
+	var average money.Amount
+	err := history.tx.QueryRowContext(history.ctx, `
+		SELECT COUNT(*), COALESCE(AVG(-ledger_entries.amount), 0)
+		FROM ledger_entries
+		JOIN transactions ON transactions.id = ledger_entries.transaction_id
+		JOIN wallets ON wallets.id = ledger_entries.wallet_id
+		WHERE wallets.user_id = $1
+		AND wallets.currency_id = $2
+		AND wallets.kind = 'user'
+		AND transactions.type = $3
+		AND ledger_entries.amount < 0
+		AND ledger_entries.created_at > $4`,
+		history.userID, history.wallet.Currency.ID, history.transactionType, since,
+	).Scan(&count, &average)
+	return count, average, err
+}
+
+// DeviceSeen only counts debits that went through.
+func (history *txHistory) DeviceSeen() (bool, error) {
+	var seen bool
+	err := history.tx.QueryRowContext(history.ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM risk_decisions
+			WHERE user_id = $1 AND device = $2 AND status IN ('completed', 'approved')
+		)`,
+		history.userID, history.device,
+	).Scan(&seen)
+	return seen, err
+}
+
+// BeneficiarySeen only counts debits that went through.
+func (history *txHistory) BeneficiarySeen() (bool, error) {
+	if history.beneficiaryID == nil {
+		return true, nil
+	}
+
+	var seen bool
+	err := history.tx.QueryRowContext(history.ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM risk_decisions
+			WHERE user_id = $1 AND beneficiary_wallet_id = $2 AND status IN ('completed', 'approved')
+		)`,
+		history.userID, *history.beneficiaryID,
+	).Scan(&seen)
+	return seen, err
+}
+
+func (history *txHistory) CreditsSince(since time.Time) (money.Amount, error) {
+	var credits money.Amount
+	err := history.tx.QueryRowContext(history.ctx, `
+		SELECT COALESCE(SUM(amount), 0)
+		FROM ledger_entries
+		WHERE wallet_id = $1 AND amount > 0 AND created_at > $2`,
+		history.wallet.ID, since,
+	).Scan(&credits)
+	return credits, err
+}
@@ -0,0 +1,477 @@
+package screenings
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/data/users"
+	"github.com/thesambayo/digillets-api/internal/publicid"
+	"github.com/thesambayo/digillets-api/internal/sanctions"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// Subject types, what was being screened when a match was found.
+const (
+	SubjectUser     = "user"
+	SubjectTransfer = "transfer"
+	SubjectPayment  = "payment"
+)
+
+// Match statuses.
+const (
+	StatusPending   = "pending"
+	StatusCleared   = "cleared"
+	StatusConfirmed = "confirmed"
+)
+
+// Screening statuses of users. An account is under review while it has pending
+// matches, and blocked once one of them is confirmed.
+const (
+	UserClear   = "clear"
+	UserReview  = "review"
+	UserBlocked = "blocked"
+)
+
+// Match represents the sanctions_matches table in the database: a potential match of
+// a user's name with the sanctions list, waiting for or after review.
+type Match struct {
+	ID           int64      `json:"-"`
+	PublicID     string     `json:"public_id"`
+	SubjectType  string     `json:"subject_type"`
+	UserID       int64      `json:"-"`
+	User         string     `json:"user"`
+	RiskDecision string     `json:"risk_decision,omitempty"`
+	ScreenedName string     `json:"screened_name"`
+	EntryUID     string     `json:"entry_uid"`
+	EntryName    string     `json:"entry_name"`
+	MatchedName  string     `json:"matched_name"`
+	Programs     string     `json:"programs"`
+	Score        float64    `json:"score"`
+	Status       string     `json:"status"`
+	ReviewNote   string     `json:"review_note,omitempty"`
+	ReviewedBy   string     `json:"reviewed_by,omitempty"`
+	ReviewedAt   *time.Time `json:"reviewed_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// Review is a reviewer's decision on a match: a false positive is cleared, a true
+// one confirmed.
+type Review struct {
+	Confirm    bool
+	Note       string
+	ReviewerID int64
+}
+
+func ValidateReview(validator *validators.Validator, review *Review) {
+	validator.Check(review.Note != "", "note", "must be provided")
+	validator.Check(len(review.Note) <= 1000, "note", "must not be more than 1000 characters long")
+}
+
+type ScreeningModel struct {
+	DB       *sql.DB
+	Screener *sanctions.Screener
+}
+
+// Screen returns the potential matches of a name with the sanctions list.
+func (screeningModel ScreeningModel) Screen(name string) []sanctions.Match {
+	return screeningModel.Screener.Screen(name)
+}
+
+func (screeningModel ScreeningModel) ListStatus() sanctions.Status {
+	return screeningModel.Screener.Status()
+}
+
+// ReloadList reloads the sanctions list from its file without a restart.
+func (screeningModel ScreeningModel) ReloadList(actor audit.Actor) (sanctions.Status, error) {
+	before := screeningModel.Screener.Status()
+	if _, err := screeningModel.Screener.Reload(); err != nil {
+		return sanctions.Status{}, err
+	}
+	after := screeningModel.Screener.Status()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := screeningModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return sanctions.Status{}, err
+	}
+	defer tx.Rollback()
+
+	err = audit.RecordTx(ctx, tx, actor, "sanctions.reload", "sanctions_list", after.Path, before, after)
+	if err != nil {
+		return sanctions.Status{}, err
+	}
+
+	return after, tx.Commit()
+}
+
+// FlagUser queues the potential matches of a user's name for review, and puts the
+// account under review meanwhile.
+func (screeningModel ScreeningModel) FlagUser(user *users.User, matches []sanctions.Match, actor audit.Actor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := screeningModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = InsertMatchesTx(ctx, tx, SubjectUser, user.ID, nil, user.Name, matches, actor); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// FilterClearedTx leaves out the matches that were already cleared for a user, so
+// that a false positive is not queued again every time the user is screened.
+func FilterClearedTx(ctx context.Context, tx *sql.Tx, userID int64, matches []sanctions.Match) ([]sanctions.Match, error) {
+	if len(matches) == 0 {
+		return matches, nil
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT DISTINCT entry_uid
+		FROM sanctions_matches
+		WHERE user_id = $1 AND status = 'cleared'`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cleared := map[string]bool{}
+	for rows.Next() {
+		var uid string
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		cleared[uid] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	filtered := []sanctions.Match{}
+	for _, match := range matches {
+		if !cleared[match.Entry.UID] {
+			filtered = append(filtered, match)
+		}
+	}
+	return filtered, nil
+}
+
+// InsertMatchesTx queues potential matches of the name of a user for review within
+// an existing database transaction, and puts the account under review unless it is
+// already blocked. A transfer match refers to the risk decision holding the
+// transfer. It returns the public ids of the matches.
+func InsertMatchesTx(ctx context.Context, tx *sql.Tx, subjectType string, userID int64, riskDecisionID *int64, screenedName string, matches []sanctions.Match, actor audit.Actor) ([]string, error) {
+	publicIDs := []string{}
+	if len(matches) == 0 {
+		return publicIDs, nil
+	}
+
+	for _, match := range matches {
+		publicID, err := publicid.New(constants.PrefixSanctionsMatchID)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO sanctions_matches
+				(public_id, subject_type, user_id, risk_decision_id, screened_name, entry_uid, entry_name, matched_name, programs, score)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+			publicID,
+			subjectType,
+			userID,
+			riskDecisionID,
+			screenedName,
+			match.Entry.UID,
+			match.Entry.Name,
+			match.MatchedName,
+			strings.Join(match.Entry.Programs, ", "),
+			fmt.Sprintf("%.4f", match.Score),
+		)
+		if err != nil {
+			return nil, err
+		}
+		publicIDs = append(publicIDs, publicID)
+	}
+
+	if err := setUserStatusTx(ctx, tx, userID, actor); err != nil {
+		return nil, err
+	}
+
+	return publicIDs, nil
+}
+
+// setUserStatusTx sets the screening status of a user from their matches, and
+// records the change if there is one.
+func setUserStatusTx(ctx context.Context, tx *sql.Tx, userID int64, actor audit.Actor) error {
+	var publicID, before string
+	err := tx.QueryRowContext(ctx, `
+		SELECT public_id, screening_status
+		FROM users
+		WHERE id = $1
+		FOR UPDATE`,
+		userID,
+	).Scan(&publicID, &before)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return constants.ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	var after string
+	err = tx.QueryRowContext(ctx, `
+		SELECT
+			CASE
+				WHEN bool_or(status = 'confirmed') THEN 'blocked'
+				WHEN bool_or(status = 'pending') THEN 'review'
+				ELSE 'clear'
+			END
+		FROM sanctions_matches
+		WHERE user_id = $1`,
+		userID,
+	).Scan(&after)
+	if err != nil {
+		return err
+	}
+	if before == after {
+		return nil
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE users
+		SET screening_status = $1, updated_at = NOW(), version = version + 1
+		WHERE id = $2`,
+		after, userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return audit.RecordTx(ctx, tx, actor, "user.screening", "user", publicID,
+		map[string]interface{}{"screening_status": before},
+		map[string]interface{}{"screening_status": after},
+	)
+}
+
+// Review clears or confirms a match, together with every other pending match of the
+// same user with the same list entry, and updates the screening status of the user.
+// A transfer held for a match is reviewed on its own, through its risk decision.
+func (screeningModel ScreeningModel) Review(match *Match, review Review, actor audit.Actor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := screeningModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRowContext(ctx, `
+		SELECT status
+		FROM sanctions_matches
+		WHERE id = $1
+		FOR UPDATE`,
+		match.ID,
+	).Scan(&status)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return constants.ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	if status != StatusPending {
+		return constants.ErrMatchAlreadyReviewed
+	}
+
+	action := "sanctions.clear"
+	match.Status = StatusCleared
+	if review.Confirm {
+		action = "sanctions.confirm"
+		match.Status = StatusConfirmed
+	}
+	match.ReviewNote = review.Note
+	match.ReviewedBy = actor.PublicID
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE sanctions_matches
+		SET status = $1, review_note = $2, reviewed_by = $3, reviewed_at = NOW(), updated_at = NOW()
+		WHERE id = $4
+		RETURNING reviewed_at, updated_at`,
+		match.Status, match.ReviewNote, review.ReviewerID, match.ID,
+	).Scan(&match.ReviewedAt, &match.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE sanctions_matches
+		SET status = $1, review_note = $2, reviewed_by = $3, reviewed_at = NOW(), updated_at = NOW()
+		WHERE user_id = $4 AND entry_uid = $5 AND status = 'pending'`,
+		match.Status, match.ReviewNote, review.ReviewerID, match.UserID, match.EntryUID,
+	)
+	if err != nil {
+		return err
+	}
+
+	before := map[string]interface{}{"status": status}
+	after := map[string]interface{}{"status": match.Status, "review_note": match.ReviewNote}
+	err = audit.RecordTx(ctx, tx, actor, action, "sanctions_match", match.PublicID, before, after)
+	if err != nil {
+		return err
+	}
+
+	if err = setUserStatusTx(ctx, tx, match.UserID, actor); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const matchColumns = `
+	sanctions_matches.id,
+	sanctions_matches.public_id,
+	sanctions_matches.subject_type,
+	sanctions_matches.user_id,
+	users.public_id,
+	COALESCE(risk_decisions.public_id, ''),
+	sanctions_matches.screened_name,
+	sanctions_matches.entry_uid,
+	sanctions_matches.entry_name,
+	sanctions_matches.matched_name,
+	sanctions_matches.programs,
+	sanctions_matches.score,
+	sanctions_matches.status,
+	sanctions_matches.review_note,
+	COALESCE(reviewers.public_id, ''),
+	sanctions_matches.reviewed_at,
+	sanctions_matches.created_at,
+	sanctions_matches.updated_at`
+
+const matchJoins = `
+	JOIN
+		users ON users.id = sanctions_matches.user_id
+	LEFT JOIN
+		risk_decisions ON risk_decisions.id = sanctions_matches.risk_decision_id
+	LEFT JOIN
+		users reviewers ON reviewers.id = sanctions_matches.reviewed_by`
+
+func (match *Match) scanDestinations() []interface{} {
+	return []interface{}{
+		&match.ID,
+		&match.PublicID,
+		&match.SubjectType,
+		&match.UserID,
+		&match.User,
+		&match.RiskDecision,
+		&match.ScreenedName,
+		&match.EntryUID,
+		&match.EntryName,
+		&match.MatchedName,
+		&match.Programs,
+		&match.Score,
+		&match.Status,
+		&match.ReviewNote,
+		&match.ReviewedBy,
+		&match.ReviewedAt,
+		&match.CreatedAt,
+		&match.UpdatedAt,
+	}
+}
+
+func (screeningModel ScreeningModel) GetAll(filters listing.Filters) ([]*Match, listing.Metadata, error) {
+	where, args := filters.Where(nil)
+	pagination, args := filters.Paginate(args)
+
+	query := fmt.Sprintf(`
+		SELECT
+			count(*) OVER(),
+			%s,
+			%s
+		FROM
+			sanctions_matches
+		%s
+		WHERE
+			true
+		%s
+		%s
+		%s;
+	`, filters.CursorColumns(), matchColumns, matchJoins, where, filters.OrderBy(), pagination)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := screeningModel.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, listing.Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	lastSortValue := ""
+	var lastID int64
+	matches := []*Match{}
+	for rows.Next() {
+		var match Match
+		destinations := append([]interface{}{&totalRecords, &lastSortValue, &lastID}, match.scanDestinations()...)
+		if err := rows.Scan(destinations...); err != nil {
+			return nil, listing.Metadata{}, err
+		}
+		matches = append(matches, &match)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, listing.Metadata{}, err
+	}
+
+	metadata := filters.Metadata(totalRecords, len(matches), lastSortValue, lastID)
+	return matches, metadata, nil
+}
+
+func (screeningModel ScreeningModel) GetByPublicId(publicID string) (*Match, error) {
+	query := fmt.Sprintf(`
+		SELECT
+			%s
+		FROM
+			sanctions_matches
+		%s
+		WHERE
+			sanctions_matches.public_id = $1;
+	`, matchColumns, matchJoins)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var match Match
+	err := screeningModel.DB.QueryRowContext(ctx, query, publicID).Scan(match.scanDestinations()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, constants.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &match, nil
+}
@@ -0,0 +1,116 @@
+package streams
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// Channel is the Postgres notification channel events are announced on, with the
+// id of the user they are for as the payload.
+const Channel = "stream_events"
+
+// Retention is how long events are kept for clients to resume from.
+const Retention = 24 * time.Hour
+
+// Event types.
+const (
+	EventBalanceUpdated     = "balance.updated"
+	EventTransactionUpdated = "transaction.updated"
+)
+
+// Event represents the stream_events table in the database. Data is sent as is.
+type Event struct {
+	ID        int64
+	Type      string
+	Data      json.RawMessage
+	CreatedAt time.Time
+}
+
+// WriteTx writes an event for a user within an existing database transaction and
+// announces it on Channel, which Postgres only does once the transaction commits.
+func WriteTx(ctx context.Context, tx *sql.Tx, userID int64, eventType string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		WITH event AS (
+			INSERT INTO stream_events (user_id, event_type, payload)
+			VALUES ($1, $2, $3)
+			RETURNING user_id
+		)
+		SELECT pg_notify($4, event.user_id::text) FROM event`,
+		userID, eventType, string(payload), Channel,
+	)
+	return err
+}
+
+type StreamModel struct {
+	DB *sql.DB
+}
+
+// GetSince returns up to limit events of a user after the event with id afterID,
+// oldest first.
+func (streamModel StreamModel) GetSince(ctx context.Context, userID, afterID int64, limit int) ([]*Event, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := streamModel.DB.QueryContext(ctx, `
+		SELECT id, event_type, payload::text, created_at
+		FROM stream_events
+		WHERE user_id = $1 AND id > $2
+		ORDER BY id
+		LIMIT $3`,
+		userID, afterID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*Event{}
+	for rows.Next() {
+		var event Event
+		if err := rows.Scan(&event.ID, &event.Type, &event.Data, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+
+	return events, rows.Err()
+}
+
+// GetLatestID returns the id of the latest event of a user, or 0 when there is
+// none.
+func (streamModel StreamModel) GetLatestID(ctx context.Context, userID int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var id int64
+	err := streamModel.DB.QueryRowContext(ctx, `
+		SELECT COALESCE(MAX(id), 0)
+		FROM stream_events
+		WHERE user_id = $1`,
+		userID,
+	).Scan(&id)
+	return id, err
+}
+
+// Prune deletes the events older than Retention and returns how many it deleted.
+func (streamModel StreamModel) Prune() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := streamModel.DB.ExecContext(ctx, `
+		DELETE FROM stream_events
+		WHERE created_at < NOW() - make_interval(secs => $1)`,
+		Retention.Seconds(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,352 @@
+package transactions
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/limits"
+	"github.com/thesambayo/digillets-api/internal/data/streams"
+	"github.com/thesambayo/digillets-api/internal/money"
+)
+
+const (
+	StatusCompleted = "completed"
+)
+
+const (
+	TypeSweep      = "sweep"
+	TypeTransfer   = "transfer"
+	TypeFee        = "fee"
+	TypeAdjustment = "adjustment"
+	// TypeDeposit and TypeWithdrawal move money in and out through a payment
+	// provider, with the provider's reference, and are reconciled with its
+	// settlement files.
+	TypeDeposit    = "deposit"
+	TypeWithdrawal = "withdrawal"
+	// TypePayment and TypeRefund move money from customers to merchants and back,
+	// with the payment as their reference.
+	TypePayment = "payment"
+	TypeRefund  = "refund"
+)
+
+// Transaction represents the transactions table in the database. A transaction
+// groups the ledger entries of a single movement of money.
+type Transaction struct {
+	ID          int64     `json:"-"`
+	PublicID    string    `json:"public_id"`
+	Type        string    `json:"type"`
+	Status      string    `json:"status"`
+	Reference   string    `json:"reference"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Entry is a single leg of a transaction against a wallet. Credits are positive
+// amounts and debits negative ones.
+type Entry struct {
+	WalletID int64
+	Amount   money.Amount
+}
+
+// StatementLine is a ledger entry of a wallet together with its transaction, as
+// shown on a statement.
+type StatementLine struct {
+	TransactionID string       `json:"transaction_id"`
+	Type          string       `json:"type"`
+	Description   string       `json:"description"`
+	Reference     string       `json:"reference"`
+	Amount        money.Amount `json:"amount"`
+	Balance       money.Amount `json:"balance"`
+	CreatedAt     time.Time    `json:"created_at"`
+}
+
+type TransactionModel struct {
+	DB *sql.DB
+}
+
+// Post records a transaction and its entries, and applies every entry to the balance
+// of its wallet, all in one database transaction. See PostTx.
+func (transactionModel TransactionModel) Post(transaction *Transaction, entries []Entry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := transactionModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback()
+
+	if err = PostTx(ctx, tx, transaction, entries); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// PostTx records a transaction and its entries within an existing database
+// transaction, so that callers can post to the ledger together with other changes.
+// The entries must sum to zero per currency and fit the minor units of their
+// wallet's currency, no customer wallet may be debited past its balance less its
+// pending holds or taken past the limits of its user's KYC tier, and the wallets
+// must be open and accept the entry given their freeze, otherwise an error is
+// returned and the database transaction should be rolled back.
+func PostTx(ctx context.Context, tx *sql.Tx, transaction *Transaction, entries []Entry) error {
+	if transaction.Status == "" {
+		transaction.Status = StatusCompleted
+	}
+
+	query := `
+		INSERT INTO transactions
+			(public_id, type, status, reference, description)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	args := []interface{}{
+		transaction.PublicID,
+		transaction.Type,
+		transaction.Status,
+		transaction.Reference,
+		transaction.Description,
+	}
+	err := tx.QueryRowContext(ctx, query, args...).Scan(&transaction.ID, &transaction.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	// Apply the entries in wallet id order so that two concurrent postings touching
+	// the same wallets always lock them in the same order and cannot deadlock.
+	sorted := make([]Entry, len(entries))
+	copy(sorted, entries)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].WalletID < sorted[j].WalletID })
+
+	var customerEntries []Entry
+	for _, entry := range sorted {
+		// Lock the wallet row for the rest of the transaction, then check that the
+		// entry is allowed: a frozen wallet rejects every debit, and every credit too
+		// when its freeze blocks credits. House wallets may run negative.
+		// What a debit can take is the balance less the pending holds on the wallet.
+		var available money.Amount
+		var isFrozen, blockCredits bool
+		var kind, status, walletPublicID, currency string
+		var minorUnits int32
+		var userID int64
+		err = tx.QueryRowContext(ctx, `
+			SELECT
+				wallets.balance - COALESCE((
+					SELECT SUM(holds.amount) FROM holds
+					WHERE holds.wallet_id = wallets.id AND holds.status = 'pending' AND holds.expires_at > NOW()
+				), 0),
+				wallets.is_frozen, wallets.block_credits, wallets.kind, wallets.status, currencies.minor_units,
+				wallets.user_id, wallets.public_id, currencies.code
+			FROM wallets
+			JOIN currencies ON currencies.id = wallets.currency_id
+			WHERE wallets.id = $1
+			FOR UPDATE OF wallets`,
+			entry.WalletID,
+		).Scan(&available, &isFrozen, &blockCredits, &kind, &status, &minorUnits, &userID, &walletPublicID, &currency)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return constants.ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+
+		switch {
+		case !entry.Amount.HasPrecision(minorUnits):
+			return constants.ErrAmountPrecision
+		case status == constants.WalletStatusClosed:
+			return constants.ErrWalletClosed
+		case isFrozen && (entry.Amount.IsNegative() || blockCredits):
+			return constants.ErrWalletFrozen
+		case kind == constants.WalletKindUser && entry.Amount.IsNegative() && available.Add(entry.Amount).IsNegative():
+			return constants.ErrInsufficientFunds
+		}
+
+		var balance money.Amount
+		err = tx.QueryRowContext(ctx, `
+			UPDATE wallets
+			SET balance = balance + $1, updated_at = NOW()
+			WHERE id = $2
+			RETURNING balance`,
+			entry.Amount, entry.WalletID,
+		).Scan(&balance)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO ledger_entries
+				(transaction_id, wallet_id, amount, balance_after)
+			VALUES ($1, $2, $3, $4)`,
+			transaction.ID, entry.WalletID, entry.Amount, balance,
+		)
+		if err != nil {
+			return err
+		}
+
+		if kind == constants.WalletKindUser {
+			customerEntries = append(customerEntries, entry)
+
+			err = writeStreamEventsTx(ctx, tx, userID, transaction, walletPublicID, currency, entry.Amount, balance, available.Add(entry.Amount))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Check the limits of customers once every entry is in, so that the rolling
+	// windows count the whole transaction.
+	for _, entry := range customerEntries {
+		if err = limits.CheckTx(ctx, tx, entry.WalletID, entry.Amount); err != nil {
+			return err
+		}
+	}
+
+	// Every currency must balance out within the transaction.
+	var unbalanced bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1
+			FROM ledger_entries
+			JOIN wallets ON wallets.id = ledger_entries.wallet_id
+			WHERE ledger_entries.transaction_id = $1
+			GROUP BY wallets.currency_id
+			HAVING SUM(ledger_entries.amount) <> 0
+		)`,
+		transaction.ID,
+	).Scan(&unbalanced)
+	if err != nil {
+		return err
+	}
+	if unbalanced {
+		return constants.ErrUnbalancedTransaction
+	}
+
+	return nil
+}
+
+// writeStreamEventsTx tells the user owning a wallet about an entry posted to it,
+// with the transaction and the balance it left the wallet with.
+func writeStreamEventsTx(ctx context.Context, tx *sql.Tx, userID int64, transaction *Transaction, wallet, currency string, amount, balance, available money.Amount) error {
+	err := streams.WriteTx(ctx, tx, userID, streams.EventTransactionUpdated, map[string]interface{}{
+		"public_id":   transaction.PublicID,
+		"type":        transaction.Type,
+		"status":      transaction.Status,
+		"reference":   transaction.Reference,
+		"description": transaction.Description,
+		"wallet":      wallet,
+		"amount":      amount,
+		"currency":    currency,
+		"created_at":  transaction.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	return streams.WriteTx(ctx, tx, userID, streams.EventBalanceUpdated, map[string]interface{}{
+		"wallet":      wallet,
+		"currency":    currency,
+		"balance":     balance,
+		"available":   available,
+		"transaction": transaction.PublicID,
+	})
+}
+
+// GetOpeningBalance returns the balance of a wallet just before the given time,
+// which is the running balance of its last entry before then.
+func (transactionModel TransactionModel) GetOpeningBalance(walletID int64, before time.Time) (money.Amount, error) {
+	query := `
+		SELECT
+			ledger_entries.balance_after
+		FROM
+			ledger_entries
+		WHERE
+			ledger_entries.wallet_id = $1
+		AND
+			ledger_entries.created_at < $2
+		ORDER BY
+			ledger_entries.created_at DESC, ledger_entries.id DESC
+		LIMIT 1;
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var balance money.Amount
+	err := transactionModel.DB.QueryRowContext(ctx, query, walletID, before).Scan(&balance)
+	if err != nil {
+		switch {
+		// a wallet with no earlier entries opens at zero
+		case errors.Is(err, sql.ErrNoRows):
+			return money.Zero, nil
+		default:
+			return money.Zero, err
+		}
+	}
+
+	return balance, nil
+}
+
+// StreamStatement calls fn with every ledger entry of a wallet between from
+// (inclusive) and to (exclusive) in order, as it is read from the database, so that
+// statements over large ranges never have to be held in memory. The context bounds
+// the whole stream, so it should be the request context.
+func (transactionModel TransactionModel) StreamStatement(ctx context.Context, walletID int64, from, to time.Time, fn func(*StatementLine) error) error {
+	query := `
+		SELECT
+			transactions.public_id,
+			transactions.type,
+			transactions.description,
+			transactions.reference,
+			ledger_entries.amount,
+			ledger_entries.balance_after,
+			ledger_entries.created_at
+		FROM
+			ledger_entries
+		JOIN
+			transactions ON transactions.id = ledger_entries.transaction_id
+		WHERE
+			ledger_entries.wallet_id = $1
+		AND
+			ledger_entries.created_at >= $2
+		AND
+			ledger_entries.created_at < $3
+		ORDER BY
+			ledger_entries.created_at, ledger_entries.id;
+	`
+
+	rows, err := transactionModel.DB.QueryContext(ctx, query, walletID, from, to)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var line StatementLine
+		err := rows.Scan(
+			&line.TransactionID,
+			&line.Type,
+			&line.Description,
+			&line.Reference,
+			&line.Amount,
+			&line.Balance,
+			&line.CreatedAt,
+		)
+		if err != nil {
+			return err
+		}
+
+		if err = fn(&line); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
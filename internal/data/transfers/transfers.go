@@ -0,0 +1,165 @@
+package transfers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/outbox"
+	"github.com/thesambayo/digillets-api/internal/data/transactions"
+	"github.com/thesambayo/digillets-api/internal/data/wallets"
+	"github.com/thesambayo/digillets-api/internal/money"
+	"github.com/thesambayo/digillets-api/internal/pricing"
+	"github.com/thesambayo/digillets-api/internal/publicid"
+)
+
+// Transfer is a movement of money from a wallet into another wallet, of the same
+// user or of someone else, with its fee. Until it is created it is only a preview
+// and has no public id.
+type Transfer struct {
+	PublicID         string          `json:"public_id,omitempty"`
+	FeeTransactionID string          `json:"fee_transaction_id,omitempty"`
+	From             *wallets.Wallet `json:"-"`
+	To               *wallets.Wallet `json:"-"`
+	FromWallet       string          `json:"from_wallet"`
+	ToWallet         string          `json:"to_wallet"`
+	Amount           money.Amount    `json:"amount"`
+	Currency         string          `json:"currency"`
+	ConvertedAmount  money.Amount    `json:"converted_amount"`
+	ToCurrency       string          `json:"to_currency"`
+	Fee              pricing.Quote   `json:"fee"`
+	Description      string          `json:"description"`
+	CreatedAt        *time.Time      `json:"created_at,omitempty"`
+}
+
+// New prices a transfer of amount from one wallet into another with the fee rule
+// that applies to it, which may be nil for a free transfer.
+func New(from, to *wallets.Wallet, amount money.Amount, description string, rule *pricing.Rule) *Transfer {
+	return &Transfer{
+		From:            from,
+		To:              to,
+		FromWallet:      from.PublicID,
+		ToWallet:        to.PublicID,
+		Amount:          from.Currency.Round(amount),
+		Currency:        from.Currency.Code,
+		ConvertedAmount: from.Currency.Convert(amount, to.Currency),
+		ToCurrency:      to.Currency.Code,
+		Fee:             pricing.Price(rule, amount, from.Currency.Code, from.Currency.MinorUnits),
+		Description:     description,
+	}
+}
+
+type TransferModel struct {
+	DB *sql.DB
+}
+
+// Create posts a priced transfer to the ledger. See CreateTx.
+func (transferModel TransferModel) Create(transfer *Transfer, actor audit.Actor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := transferModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = CreateTx(ctx, tx, transfer, actor); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CreateTx posts a priced transfer to the ledger within an existing database
+// transaction. The transfer and its fee are posted as two transactions, the fee
+// with type fee and the transfer as its reference, crediting the house fee wallet of
+// the currency.
+func CreateTx(ctx context.Context, tx *sql.Tx, transfer *Transfer, actor audit.Actor) error {
+	transferID, err := publicid.New(constants.PrefixTransactionID)
+	if err != nil {
+		return err
+	}
+
+	description := transfer.Description
+	if description == "" {
+		description = fmt.Sprintf("Transfer to %s", transfer.ToWallet)
+	}
+	transaction := &transactions.Transaction{
+		PublicID:    transferID,
+		Type:        transactions.TypeTransfer,
+		Reference:   transfer.ToWallet,
+		Description: description,
+	}
+
+	entries, converted, err := wallets.MovementEntriesTx(ctx, tx, transfer.From, transfer.To, transfer.Amount)
+	if err != nil {
+		return err
+	}
+	if err = transactions.PostTx(ctx, tx, transaction, entries); err != nil {
+		return err
+	}
+	transfer.PublicID = transaction.PublicID
+	transfer.ConvertedAmount = converted
+	transfer.CreatedAt = &transaction.CreatedAt
+
+	if transfer.Fee.Fee.IsPositive() {
+		feeWallet, err := wallets.GetHouseWalletTx(ctx, tx, constants.WalletKindFee, transfer.From.Currency.ID)
+		if err != nil {
+			return err
+		}
+
+		feeID, err := publicid.New(constants.PrefixTransactionID)
+		if err != nil {
+			return err
+		}
+		fee := &transactions.Transaction{
+			PublicID:    feeID,
+			Type:        transactions.TypeFee,
+			Reference:   transaction.PublicID,
+			Description: fmt.Sprintf("Fee for transfer %s", transaction.PublicID),
+		}
+		feeEntries := []transactions.Entry{
+			{WalletID: transfer.From.ID, Amount: transfer.Fee.Fee.Neg()},
+			{WalletID: feeWallet, Amount: transfer.Fee.Fee},
+		}
+		if err = transactions.PostTx(ctx, tx, fee, feeEntries); err != nil {
+			return err
+		}
+		transfer.FeeTransactionID = fee.PublicID
+	}
+
+	err = audit.RecordTx(ctx, tx, actor, "transfer.create", "transaction", transfer.PublicID, nil, transfer)
+	if err != nil {
+		return err
+	}
+
+	return writeEventsTx(ctx, tx, transfer)
+}
+
+// writeEventsTx tells the sender and the recipient of a transfer that it completed.
+// The recipient only sees what reached their wallet, not the sender's fee.
+func writeEventsTx(ctx context.Context, tx *sql.Tx, transfer *Transfer) error {
+	sent := struct {
+		*Transfer
+		Direction string `json:"direction"`
+	}{transfer, "outgoing"}
+	if err := outbox.WriteTx(ctx, tx, transfer.From.User.ID, outbox.EventTransferCompleted, sent); err != nil {
+		return err
+	}
+
+	received := map[string]interface{}{
+		"public_id":   transfer.PublicID,
+		"from_wallet": transfer.FromWallet,
+		"to_wallet":   transfer.ToWallet,
+		"amount":      transfer.ConvertedAmount,
+		"currency":    transfer.ToCurrency,
+		"description": transfer.Description,
+		"created_at":  transfer.CreatedAt,
+		"direction":   "incoming",
+	}
+	return outbox.WriteTx(ctx, tx, transfer.To.User.ID, outbox.EventTransferCompleted, received)
+}
@@ -8,19 +8,24 @@ import (
 	"time"
 
 	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
 )
 
 // User represents the users table in the database.
 type User struct {
-	ID        int64     `json:"-"`
-	PublicID  string    `json:"public_id"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-	Version   int       `json:"version"`
+	ID        int64    `json:"-"`
+	PublicID  string   `json:"public_id"`
+	Name      string   `json:"name"`
+	Email     string   `json:"email"`
+	Password  password `json:"-"`
+	Activated bool     `json:"activated"`
+	KYCTier   int      `json:"kyc_tier"`
+	// ScreeningStatus is clear, review or blocked, from sanctions screening. It is
+	// kept from the user.
+	ScreeningStatus string    `json:"-"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+	Version         int       `json:"version"`
 }
 
 var AnonymousUser = &User{}
@@ -34,7 +39,7 @@ type UserModel struct {
 	DB *sql.DB
 }
 
-func (userModel UserModel) Insert(user *User) (*User, error) {
+func (userModel UserModel) Insert(user *User, actor audit.Actor) (*User, error) {
 	query := `
     INSERT INTO users
       (public_id, name, email, password_hash, activated)
@@ -44,12 +49,18 @@ func (userModel UserModel) Insert(user *User) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	tx, err := userModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
 	args := []interface{}{user.PublicID, user.Name, user.Email, user.Password.hash, user.Activated}
 	// If the table already contains a record with this email address, then when we try
 	// to perform the insert there will be a violation of the UNIQUE "user_email_key"
 	// constraint that we set up in the previous chapter. We check for this error
 	// specifically, and return custom ErrDuplicateEmail error instead.
-	err := userModel.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -59,6 +70,15 @@ func (userModel UserModel) Insert(user *User) (*User, error) {
 		}
 	}
 
+	err = audit.RecordTx(ctx, tx, actor, "user.create", "user", user.PublicID, nil, user)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
 	return user, nil
 }
 
@@ -71,6 +91,8 @@ func (userModel UserModel) GetByPublicId(publicID string) (*User, error) {
 			users.email,
 			users.password_hash,
 			users.activated,
+			users.kyc_tier,
+			users.screening_status,
 			users.created_at,
 			users.updated_at,
 			users.version
@@ -90,6 +112,8 @@ func (userModel UserModel) GetByPublicId(publicID string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.KYCTier,
+		&user.ScreeningStatus,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 		&user.Version,
@@ -116,6 +140,8 @@ func (userModel UserModel) GetByEmail(email string) (*User, error) {
 			users.email,
 			users.password_hash,
 			users.activated,
+			users.kyc_tier,
+			users.screening_status,
 			users.created_at,
 			users.updated_at,
 			users.version
@@ -135,6 +161,8 @@ func (userModel UserModel) GetByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.KYCTier,
+		&user.ScreeningStatus,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 		&user.Version,
@@ -0,0 +1,232 @@
+package wallets
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/transactions"
+	"github.com/thesambayo/digillets-api/internal/money"
+	"github.com/thesambayo/digillets-api/internal/publicid"
+)
+
+// Close closes a wallet. A wallet with pending holds cannot be closed, and any
+// remaining balance must be swept into sweepTo, another open wallet of the same
+// user, converting it if the currencies differ. Without sweepTo the balance must be
+// zero. The wallet is kept with its history and marked closed, which frees its
+// currency for a new wallet. It returns the sweep transaction, if there was one.
+func (walletModel WalletModel) Close(wallet *Wallet, sweepTo *Wallet, actor audit.Actor) (*transactions.Transaction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := walletModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the wallet first, so that no posting or hold can slip in between the
+	// checks below and the closure.
+	var balance money.Amount
+	var status string
+	var isFrozen bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT balance, status, is_frozen
+		FROM wallets
+		WHERE id = $1
+		FOR UPDATE`,
+		wallet.ID,
+	).Scan(&balance, &status, &isFrozen)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, constants.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	switch {
+	case status == constants.WalletStatusClosed:
+		return nil, constants.ErrWalletClosed
+	case isFrozen:
+		return nil, constants.ErrWalletFrozen
+	}
+
+	var pendingHolds bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM holds
+			WHERE wallet_id = $1 AND status = 'pending' AND expires_at > NOW()
+		)`,
+		wallet.ID,
+	).Scan(&pendingHolds)
+	if err != nil {
+		return nil, err
+	}
+	if pendingHolds {
+		return nil, constants.ErrPendingHolds
+	}
+
+	var sweep *transactions.Transaction
+	if !balance.IsZero() {
+		if sweepTo == nil {
+			return nil, constants.ErrNonZeroBalance
+		}
+
+		sweep, err = walletModel.sweepTx(ctx, tx, wallet, sweepTo, balance)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE wallets
+		SET status = $1, closed_at = NOW(), updated_at = NOW()
+		WHERE id = $2
+		RETURNING status, closed_at, balance`,
+		constants.WalletStatusClosed, wallet.ID,
+	).Scan(&wallet.Status, &wallet.ClosedAt, &wallet.Balance)
+	if err != nil {
+		return nil, err
+	}
+	wallet.Balance = wallet.Currency.Round(wallet.Balance)
+
+	before := map[string]interface{}{
+		"status":  status,
+		"balance": wallet.Currency.Round(balance),
+	}
+	after := map[string]interface{}{
+		"status":    wallet.Status,
+		"balance":   wallet.Balance,
+		"closed_at": wallet.ClosedAt,
+	}
+	if sweep != nil {
+		after["sweep_transaction_id"] = sweep.PublicID
+		after["sweep_to"] = sweepTo.PublicID
+	}
+	err = audit.RecordTx(ctx, tx, actor, "wallet.close", "wallet", wallet.PublicID, before, after)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return sweep, nil
+}
+
+// sweepTx posts the whole balance of a wallet into another wallet.
+func (walletModel WalletModel) sweepTx(ctx context.Context, tx *sql.Tx, from, to *Wallet, amount money.Amount) (*transactions.Transaction, error) {
+	publicID, err := publicid.New(constants.PrefixTransactionID)
+	if err != nil {
+		return nil, err
+	}
+
+	transaction := &transactions.Transaction{
+		PublicID:    publicID,
+		Type:        transactions.TypeSweep,
+		Reference:   from.PublicID,
+		Description: fmt.Sprintf("Balance sweep from closed %s wallet", from.Currency.Code),
+	}
+
+	entries, _, err := MovementEntriesTx(ctx, tx, from, to, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = transactions.PostTx(ctx, tx, transaction, entries); err != nil {
+		return nil, err
+	}
+
+	return transaction, nil
+}
+
+// MovementEntriesTx returns the ledger entries that move amount out of one wallet
+// into another, together with the amount credited. Across currencies the amount is
+// converted and the house fx wallets take the other side of each leg, so that every
+// currency still balances.
+func MovementEntriesTx(ctx context.Context, tx *sql.Tx, from, to *Wallet, amount money.Amount) ([]transactions.Entry, money.Amount, error) {
+	converted := amount
+	if from.Currency.Code != to.Currency.Code {
+		converted = from.Currency.Convert(amount, to.Currency)
+	}
+
+	entries, err := ExchangeEntriesTx(ctx, tx, from, to, amount, converted)
+	if err != nil {
+		return nil, money.Zero, err
+	}
+	return entries, converted, nil
+}
+
+// ExchangeEntriesTx returns the ledger entries that debit one wallet and credit
+// another, each amount in the currency of its wallet, for callers that converted
+// the amounts themselves. Across currencies the house fx wallets take the other side
+// of each leg.
+func ExchangeEntriesTx(ctx context.Context, tx *sql.Tx, from, to *Wallet, debit, credit money.Amount) ([]transactions.Entry, error) {
+	entries := []transactions.Entry{
+		{WalletID: from.ID, Amount: debit.Neg()},
+	}
+
+	if from.Currency.Code == to.Currency.Code {
+		entries = append(entries, transactions.Entry{WalletID: to.ID, Amount: credit})
+		return entries, nil
+	}
+
+	fxFrom, err := GetHouseWalletTx(ctx, tx, constants.WalletKindFX, from.Currency.ID)
+	if err != nil {
+		return nil, err
+	}
+	fxTo, err := GetHouseWalletTx(ctx, tx, constants.WalletKindFX, to.Currency.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	entries = append(entries,
+		transactions.Entry{WalletID: fxFrom, Amount: debit},
+		transactions.Entry{WalletID: fxTo, Amount: credit.Neg()},
+		transactions.Entry{WalletID: to.ID, Amount: credit},
+	)
+	return entries, nil
+}
+
+// GetHouseWalletTx returns the id of the house wallet of the given kind in a
+// currency, creating it the first time it is needed.
+func GetHouseWalletTx(ctx context.Context, tx *sql.Tx, kind string, currencyID int64) (int64, error) {
+	publicID, err := publicid.New(constants.PrefixWalletID)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO wallets
+			(public_id, user_id, currency_id, kind)
+		SELECT $1, users.id, $2, $3
+		FROM users
+		WHERE users.public_id = $4
+		ON CONFLICT (user_id, currency_id, kind) WHERE closed_at IS NULL DO NOTHING`,
+		publicID, currencyID, kind, constants.SystemUserPublicID,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err = tx.QueryRowContext(ctx, `
+		SELECT wallets.id
+		FROM wallets
+		JOIN users ON users.id = wallets.user_id
+		WHERE users.public_id = $1
+		AND wallets.currency_id = $2
+		AND wallets.kind = $3
+		AND wallets.closed_at IS NULL`,
+		constants.SystemUserPublicID, currencyID, kind,
+	).Scan(&id)
+
+	return id, err
+}
@@ -0,0 +1,258 @@
+package wallets
+
+import (
+	"context"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+const (
+	FreezeActionFreeze   = "freeze"
+	FreezeActionUnfreeze = "unfreeze"
+)
+
+// Reason codes for freezing a wallet. The reason code is the category shown to the
+// wallet owner, the free-text note is for staff only.
+var FreezeReasons = []string{
+	"suspected_fraud",
+	"compliance_review",
+	"legal_order",
+	"chargeback_dispute",
+	"customer_request",
+	"other",
+}
+
+// Reason codes for unfreezing a wallet.
+var UnfreezeReasons = []string{
+	"review_cleared",
+	"legal_order_lifted",
+	"customer_request",
+	"freeze_in_error",
+	"other",
+}
+
+// FreezeEvent represents the wallet_freeze_events table in the database, one
+// freeze or unfreeze of a wallet by a member of staff.
+type FreezeEvent struct {
+	ID           int64     `json:"-"`
+	WalletID     string    `json:"wallet_id"`
+	Action       string    `json:"action"`
+	Reason       string    `json:"reason"`
+	Note         string    `json:"note"`
+	BlockCredits bool      `json:"block_credits"`
+	ActorID      int64     `json:"-"`
+	Actor        string    `json:"actor"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func (walletModel WalletModel) ValidateFreezeEvent(validator *validators.Validator, event *FreezeEvent) {
+	reasons := FreezeReasons
+	if event.Action == FreezeActionUnfreeze {
+		reasons = UnfreezeReasons
+	}
+
+	validator.Check(event.Reason != "", "reason", "must be provided")
+	validator.Check(validators.In(event.Reason, reasons...), "reason", "must be one of the listed reason codes")
+	validator.Check(event.Note != "", "note", "must be provided")
+	validator.Check(len(event.Note) <= 1000, "note", "must not be more than 1000 characters long")
+	validator.Check(event.Action == FreezeActionFreeze || !event.BlockCredits, "block_credits", "only applies when freezing")
+}
+
+// FreezeByPublicId applies a freeze or unfreeze event to a single wallet.
+func (walletModel WalletModel) FreezeByPublicId(publicID string, event FreezeEvent, actor audit.Actor) ([]*FreezeEvent, error) {
+	return walletModel.applyFreezeEvent("wallets.public_id = $1", publicID, event, actor)
+}
+
+// FreezeByUserId applies a freeze or unfreeze event to every wallet of a user.
+func (walletModel WalletModel) FreezeByUserId(userID int64, event FreezeEvent, actor audit.Actor) ([]*FreezeEvent, error) {
+	return walletModel.applyFreezeEvent("wallets.user_id = $1", userID, event, actor)
+}
+
+// applyFreezeEvent updates the freeze state of the wallets matching the condition
+// and records an event and an audit event for each of them in one database
+// transaction. It returns constants.ErrRecordNotFound when no wallet matches.
+func (walletModel WalletModel) applyFreezeEvent(condition string, value interface{}, event FreezeEvent, actor audit.Actor) ([]*FreezeEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := walletModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	frozen := event.Action == FreezeActionFreeze
+
+	// an unfreeze clears the reason shown to the owner, the history keeps it. The
+	// previous state is read in the same statement for the audit log.
+	query := `
+		UPDATE wallets
+		SET
+			is_frozen = $2,
+			freeze_reason = CASE WHEN $2 THEN $3 ELSE '' END,
+			freeze_note = CASE WHEN $2 THEN $4 ELSE '' END,
+			block_credits = $5,
+			frozen_by = CASE WHEN $2 THEN $6::bigint END,
+			frozen_at = CASE WHEN $2 THEN NOW() END,
+			updated_at = NOW()
+		FROM (
+			SELECT wallets.id, wallets.is_frozen, wallets.freeze_reason, wallets.freeze_note, wallets.block_credits
+			FROM wallets
+			WHERE ` + condition + ` AND wallets.kind = 'user'
+			FOR UPDATE
+		) previous
+		WHERE wallets.id = previous.id
+		RETURNING
+			wallets.id, wallets.public_id,
+			previous.is_frozen, previous.freeze_reason, previous.freeze_note, previous.block_credits`
+
+	args := []interface{}{
+		value,
+		frozen,
+		event.Reason,
+		event.Note,
+		frozen && event.BlockCredits,
+		event.ActorID,
+	}
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	type updated struct {
+		id       int64
+		publicID string
+		previous freezeState
+	}
+	var wallets []updated
+	for rows.Next() {
+		var wallet updated
+		err := rows.Scan(
+			&wallet.id,
+			&wallet.publicID,
+			&wallet.previous.IsFrozen,
+			&wallet.previous.Reason,
+			&wallet.previous.Note,
+			&wallet.previous.BlockCredits,
+		)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		wallets = append(wallets, wallet)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(wallets) == 0 {
+		return nil, constants.ErrRecordNotFound
+	}
+
+	events := make([]*FreezeEvent, 0, len(wallets))
+	for _, wallet := range wallets {
+		recorded := event
+		recorded.WalletID = wallet.publicID
+		recorded.BlockCredits = frozen && event.BlockCredits
+
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO wallet_freeze_events
+				(wallet_id, action, reason, note, block_credits, actor_id)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING id, created_at`,
+			wallet.id, recorded.Action, recorded.Reason, recorded.Note, recorded.BlockCredits, recorded.ActorID,
+		).Scan(&recorded.ID, &recorded.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		current := freezeState{IsFrozen: frozen}
+		if frozen {
+			current.Reason, current.Note, current.BlockCredits = recorded.Reason, recorded.Note, recorded.BlockCredits
+		}
+		err = audit.RecordTx(ctx, tx, actor, "wallet."+recorded.Action, "wallet", wallet.publicID, wallet.previous, current)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, &recorded)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// freezeState is the freeze state of a wallet as recorded in the audit log.
+type freezeState struct {
+	IsFrozen     bool   `json:"is_frozen"`
+	Reason       string `json:"freeze_reason"`
+	Note         string `json:"freeze_note"`
+	BlockCredits bool   `json:"block_credits"`
+}
+
+// GetFreezeEvents returns the freeze history of a wallet, latest first.
+func (walletModel WalletModel) GetFreezeEvents(publicID string) ([]*FreezeEvent, error) {
+	query := `
+		SELECT
+			wallet_freeze_events.id,
+			wallets.public_id,
+			wallet_freeze_events.action,
+			wallet_freeze_events.reason,
+			wallet_freeze_events.note,
+			wallet_freeze_events.block_credits,
+			users.public_id,
+			wallet_freeze_events.created_at
+		FROM
+			wallet_freeze_events
+		JOIN
+			wallets ON wallets.id = wallet_freeze_events.wallet_id
+		JOIN
+			users ON users.id = wallet_freeze_events.actor_id
+		WHERE
+			wallets.public_id = $1
+		ORDER BY
+			wallet_freeze_events.created_at DESC, wallet_freeze_events.id DESC;
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := walletModel.DB.QueryContext(ctx, query, publicID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*FreezeEvent{}
+	for rows.Next() {
+		var event FreezeEvent
+		err := rows.Scan(
+			&event.ID,
+			&event.WalletID,
+			&event.Action,
+			&event.Reason,
+			&event.Note,
+			&event.BlockCredits,
+			&event.Actor,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
@@ -0,0 +1,102 @@
+package wallets
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/money"
+	"github.com/thesambayo/digillets-api/internal/publicid"
+)
+
+// Hold statuses. A pending hold reserves funds until it expires, is captured when
+// the money is posted to the ledger, or released when it no longer has to be.
+const (
+	HoldStatusPending  = "pending"
+	HoldStatusCaptured = "captured"
+	HoldStatusReleased = "released"
+)
+
+// PlaceHoldTx reserves amount on a customer wallet until expiresAt, within an
+// existing database transaction, and returns the public id of the hold. The wallet
+// must be open, not frozen, and have that much available once its other pending
+// holds are taken off its balance.
+func PlaceHoldTx(ctx context.Context, tx *sql.Tx, walletID int64, amount money.Amount, reason, reference string, expiresAt time.Time) (string, error) {
+	var available money.Amount
+	var isFrozen bool
+	var status string
+	err := tx.QueryRowContext(ctx, `
+		SELECT
+			wallets.balance - COALESCE((
+				SELECT SUM(holds.amount) FROM holds
+				WHERE holds.wallet_id = wallets.id AND holds.status = 'pending' AND holds.expires_at > NOW()
+			), 0),
+			wallets.is_frozen,
+			wallets.status
+		FROM wallets
+		WHERE wallets.id = $1
+		FOR UPDATE OF wallets`,
+		walletID,
+	).Scan(&available, &isFrozen, &status)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", constants.ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+
+	switch {
+	case status == constants.WalletStatusClosed:
+		return "", constants.ErrWalletClosed
+	case isFrozen:
+		return "", constants.ErrWalletFrozen
+	case available.Cmp(amount) < 0:
+		return "", constants.ErrInsufficientFunds
+	}
+
+	publicID, err := publicid.New(constants.PrefixHoldID)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO holds
+			(public_id, wallet_id, amount, status, reason, reference, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		publicID, walletID, amount, HoldStatusPending, reason, reference, expiresAt,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return publicID, nil
+}
+
+// SettleHoldTx captures or releases a pending hold within an existing database
+// transaction. A hold is captured just before the money it reserves is posted, so
+// that it no longer counts against the balance being debited.
+func SettleHoldTx(ctx context.Context, tx *sql.Tx, publicID, status string) error {
+	result, err := tx.ExecContext(ctx, `
+		UPDATE holds
+		SET status = $1, updated_at = NOW()
+		WHERE public_id = $2 AND status = 'pending'`,
+		status, publicID,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return constants.ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -3,36 +3,46 @@ package wallets
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
 	"github.com/thesambayo/digillets-api/internal/data/currencies"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/data/outbox"
 	"github.com/thesambayo/digillets-api/internal/data/users"
+	"github.com/thesambayo/digillets-api/internal/money"
 )
 
 // Wallet represents the wallets table in the database.
 type Wallet struct {
-	ID        string              `json:"-"`
-	PublicID  string              `json:"public_id"`
-	User      users.User          `json:"user"`
-	Currency  currencies.Currency `json:"currency"`
-	Balance   float64             `json:"balance"`
-	IsFrozen  bool                `json:"is_frozen"`
-	CreatedAt time.Time           `json:"created_at"`
-	UpdatedAt time.Time           `json:"updated_at"`
+	ID           int64               `json:"-"`
+	PublicID     string              `json:"public_id"`
+	User         users.User          `json:"user"`
+	Currency     currencies.Currency `json:"currency"`
+	Balance      money.Amount        `json:"balance"`
+	IsFrozen     bool                `json:"is_frozen"`
+	FreezeReason string              `json:"freeze_reason,omitempty"` // reason code of the current freeze
+	Status       string              `json:"status"`
+	ClosedAt     *time.Time          `json:"closed_at,omitempty"`
+	CreatedAt    time.Time           `json:"created_at"`
+	UpdatedAt    time.Time           `json:"updated_at"`
 }
 
 type WalletModel struct {
 	DB *sql.DB
 }
 
-func (walletModel WalletModel) Insert(wallet *Wallet) (*Wallet, error) {
+func (walletModel WalletModel) Insert(wallet *Wallet, actor audit.Actor) (*Wallet, error) {
+	wallet.Balance = wallet.Currency.Round(wallet.Balance)
 
 	query := `
     INSERT INTO wallets
       (public_id, user_id, currency_id, balance, is_frozen)
     VALUES ($1, $2, $3, $4, $5)
-    RETURNING id, created_at`
+    RETURNING id, status, created_at`
 
 	args := []interface{}{
 		wallet.PublicID,
@@ -45,11 +55,17 @@ func (walletModel WalletModel) Insert(wallet *Wallet) (*Wallet, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	// If the table already contains a record with this email address, then when we try
-	// to perform the insert there will be a violation of the UNIQUE "user_email_key"
-	// constraint that we set up in the previous chapter. We check for this error
-	// specifically, and return custom ErrDuplicateEmail error instead.
-	err := walletModel.DB.QueryRowContext(ctx, query, args...).Scan(&wallet.ID, &wallet.CreatedAt)
+	tx, err := walletModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// If the user already has an open wallet in this currency, then when we try to
+	// perform the insert there will be a violation of the "unique_user_currency"
+	// index. We check for this error specifically, and return custom
+	// ErrDuplicateUserWallet error instead.
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&wallet.ID, &wallet.Status, &wallet.CreatedAt)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "unique_user_currency"`:
@@ -59,80 +75,128 @@ func (walletModel WalletModel) Insert(wallet *Wallet) (*Wallet, error) {
 		}
 	}
 
+	after := map[string]interface{}{
+		"currency": wallet.Currency.Code,
+		"status":   wallet.Status,
+		"balance":  wallet.Balance,
+	}
+	err = audit.RecordTx(ctx, tx, actor, "wallet.create", "wallet", wallet.PublicID, nil, after)
+	if err != nil {
+		return nil, err
+	}
+
+	event := map[string]interface{}{
+		"public_id":  wallet.PublicID,
+		"currency":   wallet.Currency.Code,
+		"balance":    wallet.Balance,
+		"status":     wallet.Status,
+		"created_at": wallet.CreatedAt,
+	}
+	if err = outbox.WriteTx(ctx, tx, wallet.User.ID, outbox.EventWalletCreated, event); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
 	return wallet, nil
 }
 
-func (walletModel WalletModel) GetByUserId(userId int64) ([]*Wallet, error) {
-	query := `
+func (walletModel WalletModel) GetByUserId(userId int64, filters listing.Filters) ([]*Wallet, listing.Metadata, error) {
+	args := []interface{}{
+		userId,
+	}
+	where, args := filters.Where(args)
+	pagination, args := filters.Paginate(args)
+
+	// count(*) OVER() returns the total number of matching records alongside every row,
+	// and the cursor columns give the sort value and id of each row for the next cursor.
+	query := fmt.Sprintf(`
 		SELECT
+			count(*) OVER(),
+			%s,
 			wallets.public_id,
 		  wallets.balance,
 		  wallets.is_frozen,
+		  wallets.freeze_reason,
+		  wallets.status,
+		  wallets.closed_at,
 		  wallets.created_at,
 		  wallets.updated_at,
 		  currencies.code AS currency_code,
 		  currencies.name AS currency_name,
-		  currencies.symbol AS currency_symbol
+		  currencies.symbol AS currency_symbol,
+		  currencies.minor_units AS currency_minor_units
 		FROM
 	 		wallets
 		JOIN
 			currencies ON currencies.id = wallets.currency_id
 		WHERE
-	  	wallets.user_id = $1;
-  `
-
-	args := []interface{}{
-		userId,
-	}
+	  	wallets.user_id = $1
+		AND
+			wallets.kind = 'user'
+		%s
+		%s
+		%s;
+  `, filters.CursorColumns(), where, filters.OrderBy(), pagination)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	// If the table already contains a record with this email address, then when we try
-	// to perform the insert there will be a violation of the UNIQUE "user_email_key"
-	// constraint that we set up in the previous chapter. We check for this error
-	// specifically, and return custom ErrDuplicateEmail error instead.
 	rows, err := walletModel.DB.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return nil, listing.Metadata{}, err
 	}
 	defer rows.Close()
 
-	var wallets []*Wallet
+	totalRecords := 0
+	lastSortValue := ""
+	var lastID int64
+	wallets := []*Wallet{}
 	for rows.Next() {
 		var wallet Wallet
 		err := rows.Scan(
+			&totalRecords,
+			&lastSortValue,
+			&lastID,
 			&wallet.PublicID,
 			&wallet.Balance,
 			&wallet.IsFrozen,
+			&wallet.FreezeReason,
+			&wallet.Status,
+			&wallet.ClosedAt,
 			&wallet.CreatedAt,
 			&wallet.UpdatedAt,
 			&wallet.Currency.Code,
 			&wallet.Currency.Name,
 			&wallet.Currency.Symbol,
+			&wallet.Currency.MinorUnits,
 		)
 
 		if err != nil {
-			return nil, err
+			return nil, listing.Metadata{}, err
 		}
+		wallet.Balance = wallet.Currency.Round(wallet.Balance)
 
 		wallets = append(wallets, &wallet)
 	}
 
-	return wallets, nil
+	if err = rows.Err(); err != nil {
+		return nil, listing.Metadata{}, err
+	}
+
+	metadata := filters.Metadata(totalRecords, len(wallets), lastSortValue, lastID)
+	return wallets, metadata, nil
 }
 
-func (walletModel WalletModel) GetByCurrencyAndUserId(userId int64, currencyCode string) (*Wallet, error) {
-	query := `
+// GetForUser returns a wallet of the user, identified either by its public id or
+// by its currency code, e.g wllt_XXXXXXXXXXXXX or NGN. A currency code only matches
+// the open wallet in that currency, closed wallets are found by public id.
+func (walletModel WalletModel) GetForUser(userId int64, id string) (*Wallet, error) {
+	query := fmt.Sprintf(`
 		SELECT
-			wallets.public_id,
-		  wallets.balance,
-		  wallets.is_frozen,
-		  wallets.created_at,
-		  wallets.updated_at,
-		  currencies.code AS currency_code,
-		  currencies.name AS currency_name,
-		  currencies.symbol AS currency_symbol
+			%s
 		FROM
 	 		wallets
 		JOIN
@@ -140,31 +204,92 @@ func (walletModel WalletModel) GetByCurrencyAndUserId(userId int64, currencyCode
 		WHERE
 	  	wallets.user_id = $1
 		AND
-			currencies.code = $2;
-  `
-
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+			wallets.kind = 'user'
+		AND
+			(wallets.public_id = $2 OR (currencies.code = $2 AND wallets.closed_at IS NULL));
+  `, walletColumns)
 
 	args := []interface{}{
 		userId,
-		currencyCode,
+		id,
 	}
 
+	return walletModel.get(query, args...)
+}
+
+// GetByPublicId returns a customer wallet of any user by its public id, e.g the
+// wallet money is being sent to.
+func (walletModel WalletModel) GetByPublicId(publicID string) (*Wallet, error) {
+	query := fmt.Sprintf(`
+		SELECT
+			%s
+		FROM
+	 		wallets
+		JOIN
+			currencies ON currencies.id = wallets.currency_id
+		WHERE
+	  	wallets.public_id = $1
+		AND
+			wallets.kind = 'user';
+  `, walletColumns)
+
+	return walletModel.get(query, publicID)
+}
+
+func (walletModel WalletModel) get(query string, args ...interface{}) (*Wallet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
 	var wallet Wallet
-	err := walletModel.DB.QueryRowContext(ctx, query, args...).Scan(
+	err := walletModel.DB.QueryRowContext(ctx, query, args...).Scan(wallet.scanDestinations()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, constants.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	wallet.Balance = wallet.Currency.Round(wallet.Balance)
+
+	return &wallet, nil
+}
+
+const walletColumns = `
+	wallets.id,
+	wallets.public_id,
+	wallets.user_id,
+	wallets.balance,
+	wallets.is_frozen,
+	wallets.freeze_reason,
+	wallets.status,
+	wallets.closed_at,
+	wallets.created_at,
+	wallets.updated_at,
+	currencies.id,
+	currencies.exchange_rate,
+	currencies.code,
+	currencies.name,
+	currencies.symbol,
+	currencies.minor_units`
+
+func (wallet *Wallet) scanDestinations() []interface{} {
+	return []interface{}{
+		&wallet.ID,
 		&wallet.PublicID,
+		&wallet.User.ID,
 		&wallet.Balance,
 		&wallet.IsFrozen,
+		&wallet.FreezeReason,
+		&wallet.Status,
+		&wallet.ClosedAt,
 		&wallet.CreatedAt,
 		&wallet.UpdatedAt,
+		&wallet.Currency.ID,
+		&wallet.Currency.ExchangeRate,
 		&wallet.Currency.Code,
 		&wallet.Currency.Name,
 		&wallet.Currency.Symbol,
-	)
-	if err != nil {
-		return nil, err
+		&wallet.Currency.MinorUnits,
 	}
-
-	return &wallet, nil
 }
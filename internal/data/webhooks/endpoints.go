@@ -0,0 +1,393 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/outbox"
+	"github.com/thesambayo/digillets-api/internal/dispatch"
+	"github.com/thesambayo/digillets-api/internal/publicid"
+	"github.com/thesambayo/digillets-api/internal/validators"
+)
+
+// secretPrefix starts every signing secret, so that a leaked one is easy to spot.
+const secretPrefix = "whsec_"
+
+// MaxOverlap is the longest a rotated secret keeps signing deliveries.
+const MaxOverlap = 7 * 24 * time.Hour
+
+// Endpoint represents the webhook_endpoints table in the database, a URL of a user
+// events are delivered to. Secret is only set when it has just been generated, it
+// cannot be read back afterwards.
+type Endpoint struct {
+	ID                      int64      `json:"-"`
+	PublicID                string     `json:"public_id"`
+	UserID                  int64      `json:"-"`
+	URL                     string     `json:"url"`
+	Description             string     `json:"description"`
+	EventTypes              []string   `json:"event_types"`
+	Active                  bool       `json:"active"`
+	Secret                  string     `json:"secret,omitempty"`
+	PreviousSecretExpiresAt *time.Time `json:"previous_secret_expires_at,omitempty"`
+	Version                 int        `json:"version"`
+	CreatedAt               time.Time  `json:"created_at"`
+	UpdatedAt               time.Time  `json:"updated_at"`
+}
+
+// ValidateEndpoint checks an endpoint. Its URL must use https and must not name a
+// host of our own network, unless development is set for local development. Host
+// names are checked again by the dispatcher once resolved, as they are dialled.
+func ValidateEndpoint(validator *validators.Validator, endpoint *Endpoint, development bool) {
+	parsed, err := url.Parse(endpoint.URL)
+	validator.Check(endpoint.URL != "", "url", "must be provided")
+	validator.Check(len(endpoint.URL) <= 2000, "url", "must not be more than 2000 characters long")
+	validator.Check(err == nil && parsed.Host != "" && parsed.User == nil, "url", "must be a valid absolute url")
+	if err == nil {
+		validator.Check(parsed.Scheme == "https" || (development && parsed.Scheme == "http"), "url", "must use https")
+		validator.Check(development || publicHost(parsed.Hostname()), "url", "must be a public address")
+	}
+	validator.Check(len(endpoint.Description) <= 500, "description", "must not be more than 500 characters long")
+	validator.Check(len(endpoint.EventTypes) != 0, "event_types", "must contain at least one event type")
+	validator.Check(validators.Unique(endpoint.EventTypes), "event_types", "must not contain duplicate values")
+	for _, eventType := range endpoint.EventTypes {
+		validator.Check(validators.In(eventType, outbox.EventTypes...), "event_types", "must only contain supported event types")
+	}
+}
+
+// publicHost reports whether a host can be registered: a name other than
+// localhost, or a public IP address.
+func publicHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return dispatch.PublicAddress(addr)
+	}
+	return host != ""
+}
+
+// newSecret returns a random signing secret.
+func newSecret() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return secretPrefix + base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+// auditEndpoint is what the audit trail records of an endpoint, leaving its secrets
+// out.
+func auditEndpoint(endpoint *Endpoint) map[string]interface{} {
+	return map[string]interface{}{
+		"url":         endpoint.URL,
+		"description": endpoint.Description,
+		"event_types": endpoint.EventTypes,
+		"active":      endpoint.Active,
+	}
+}
+
+// InsertEndpoint registers an endpoint with a new signing secret, which is set on
+// it to be shown to the user once.
+func (webhookModel WebhookModel) InsertEndpoint(endpoint *Endpoint, actor audit.Actor) error {
+	publicID, err := publicid.New(constants.PrefixWebhookEndpointID)
+	if err != nil {
+		return err
+	}
+	secret, err := newSecret()
+	if err != nil {
+		return err
+	}
+	encrypted, err := webhookModel.Cipher.EncryptString(secret)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := webhookModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	endpoint.PublicID = publicID
+	endpoint.Active = true
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO webhook_endpoints (public_id, user_id, url, description, event_types, secret_encrypted)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, version, created_at, updated_at`,
+		endpoint.PublicID, endpoint.UserID, endpoint.URL, endpoint.Description, pq.Array(endpoint.EventTypes), encrypted,
+	).Scan(&endpoint.ID, &endpoint.Version, &endpoint.CreatedAt, &endpoint.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	err = audit.RecordTx(ctx, tx, actor, "webhook.create", "webhook_endpoint", endpoint.PublicID, nil, auditEndpoint(endpoint))
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	endpoint.Secret = secret
+	return nil
+}
+
+const endpointColumns = `
+	id,
+	public_id,
+	user_id,
+	url,
+	description,
+	event_types,
+	active,
+	CASE WHEN previous_secret_expires_at > NOW() THEN previous_secret_expires_at END,
+	version,
+	created_at,
+	updated_at`
+
+func (endpoint *Endpoint) scanDestinations() []interface{} {
+	return []interface{}{
+		&endpoint.ID,
+		&endpoint.PublicID,
+		&endpoint.UserID,
+		&endpoint.URL,
+		&endpoint.Description,
+		pq.Array(&endpoint.EventTypes),
+		&endpoint.Active,
+		&endpoint.PreviousSecretExpiresAt,
+		&endpoint.Version,
+		&endpoint.CreatedAt,
+		&endpoint.UpdatedAt,
+	}
+}
+
+// GetEndpoints returns the endpoints of a user, the latest first.
+func (webhookModel WebhookModel) GetEndpoints(userID int64) ([]*Endpoint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := webhookModel.DB.QueryContext(ctx, `
+		SELECT`+endpointColumns+`
+		FROM webhook_endpoints
+		WHERE user_id = $1
+		ORDER BY id DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	endpoints := []*Endpoint{}
+	for rows.Next() {
+		var endpoint Endpoint
+		if err := rows.Scan(endpoint.scanDestinations()...); err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, &endpoint)
+	}
+
+	return endpoints, rows.Err()
+}
+
+// GetEndpointForUser returns an endpoint of a user by its public id.
+func (webhookModel WebhookModel) GetEndpointForUser(userID int64, publicID string) (*Endpoint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var endpoint Endpoint
+	err := webhookModel.DB.QueryRowContext(ctx, `
+		SELECT`+endpointColumns+`
+		FROM webhook_endpoints
+		WHERE user_id = $1 AND public_id = $2`,
+		userID, publicID,
+	).Scan(endpoint.scanDestinations()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, constants.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &endpoint, nil
+}
+
+// UpdateEndpoint saves changes to the url, description, event types and active
+// flag of an endpoint. before is the endpoint as it was read, for the audit trail.
+// Deliveries to an endpoint that is made inactive stay pending until it is active
+// again.
+func (webhookModel WebhookModel) UpdateEndpoint(before, endpoint *Endpoint, actor audit.Actor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := webhookModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE webhook_endpoints
+		SET url = $1, description = $2, event_types = $3, active = $4, version = version + 1, updated_at = NOW()
+		WHERE id = $5 AND version = $6
+		RETURNING version, updated_at`,
+		endpoint.URL, endpoint.Description, pq.Array(endpoint.EventTypes), endpoint.Active, endpoint.ID, endpoint.Version,
+	).Scan(&endpoint.Version, &endpoint.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return constants.ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	err = audit.RecordTx(ctx, tx, actor, "webhook.update", "webhook_endpoint", endpoint.PublicID, auditEndpoint(before), auditEndpoint(endpoint))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RotateSecret gives an endpoint a new signing secret, which is set on it to be
+// shown to the user once. Deliveries are signed with the old secret as well for
+// overlap, so that the endpoint can switch over without rejecting any; with no
+// overlap the old secret stops signing straight away.
+func (webhookModel WebhookModel) RotateSecret(endpoint *Endpoint, overlap time.Duration, actor audit.Actor) error {
+	secret, err := newSecret()
+	if err != nil {
+		return err
+	}
+	encrypted, err := webhookModel.Cipher.EncryptString(secret)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := webhookModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE webhook_endpoints
+		SET
+			previous_secret_encrypted = CASE WHEN $1::float8 > 0 THEN secret_encrypted END,
+			previous_secret_expires_at = CASE WHEN $1::float8 > 0 THEN NOW() + make_interval(secs => $1::float8) END,
+			secret_encrypted = $2,
+			version = version + 1,
+			updated_at = NOW()
+		WHERE id = $3 AND version = $4
+		RETURNING previous_secret_expires_at, version, updated_at`,
+		overlap.Seconds(), encrypted, endpoint.ID, endpoint.Version,
+	).Scan(&endpoint.PreviousSecretExpiresAt, &endpoint.Version, &endpoint.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return constants.ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	after := map[string]interface{}{"previous_secret_expires_at": endpoint.PreviousSecretExpiresAt}
+	err = audit.RecordTx(ctx, tx, actor, "webhook.rotate_secret", "webhook_endpoint", endpoint.PublicID, nil, after)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	endpoint.Secret = secret
+	return nil
+}
+
+// DeleteEndpoint removes an endpoint along with its deliveries and their attempts.
+func (webhookModel WebhookModel) DeleteEndpoint(endpoint *Endpoint, actor audit.Actor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := webhookModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM webhook_endpoints WHERE id = $1`, endpoint.ID)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return constants.ErrRecordNotFound
+	}
+
+	err = audit.RecordTx(ctx, tx, actor, "webhook.delete", "webhook_endpoint", endpoint.PublicID, auditEndpoint(endpoint), nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SendTest queues a test event to an endpoint, whatever event types it subscribes
+// to, and returns the public id of its delivery.
+func (webhookModel WebhookModel) SendTest(endpoint *Endpoint) (string, error) {
+	if !endpoint.Active {
+		return "", constants.ErrEndpointInactive
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := webhookModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	data := map[string]interface{}{
+		"endpoint": endpoint.PublicID,
+		"message":  "this is a test event",
+	}
+	eventID, err := outbox.WriteDispatchedTx(ctx, tx, endpoint.UserID, outbox.EventWebhookTest, data)
+	if err != nil {
+		return "", err
+	}
+
+	deliveryID, err := queueDeliveryTx(ctx, tx, eventID, endpoint.ID)
+	if err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+
+	return deliveryID, nil
+}
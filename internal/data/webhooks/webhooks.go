@@ -0,0 +1,617 @@
+package webhooks
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/thesambayo/digillets-api/internal/constants"
+	"github.com/thesambayo/digillets-api/internal/data/audit"
+	"github.com/thesambayo/digillets-api/internal/data/listing"
+	"github.com/thesambayo/digillets-api/internal/dispatch"
+	"github.com/thesambayo/digillets-api/internal/encryption"
+	"github.com/thesambayo/digillets-api/internal/publicid"
+)
+
+// Delivery statuses. A delivery is pending, retries included, until it is
+// delivered or runs out of attempts and is dead.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// Delivery represents the webhook_deliveries table in the database, an event to
+// deliver to an endpoint. Attempts are only loaded for a single delivery.
+type Delivery struct {
+	ID             int64      `json:"-"`
+	PublicID       string     `json:"public_id"`
+	Event          string     `json:"event"`
+	EventType      string     `json:"event_type"`
+	Endpoint       string     `json:"endpoint"`
+	URL            string     `json:"url"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at"`
+	LastStatusCode *int       `json:"last_status_code"`
+	LastError      string     `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+	AttemptLog     []Attempt  `json:"attempt_log,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// Attempt represents the webhook_attempts table in the database, one attempt at a
+// delivery. StatusCode is nil when the endpoint did not respond. The delivery and
+// its event type are only set when attempts are listed across deliveries.
+type Attempt struct {
+	Delivery   string    `json:"delivery,omitempty"`
+	EventType  string    `json:"event_type,omitempty"`
+	StatusCode *int      `json:"status_code"`
+	LatencyMS  int       `json:"latency_ms"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Due is a delivery claimed by the dispatcher, with what it needs to send it.
+type Due struct {
+	Delivery
+	Body    []byte
+	Secrets []string
+}
+
+type WebhookModel struct {
+	DB     *sql.DB
+	Cipher *encryption.Cipher
+}
+
+// FanOut queues a delivery of every event not yet dispatched to each active
+// endpoint of its user subscribed to its type, and returns how many events it
+// dispatched. Events are dispatched in the order they were written.
+func (webhookModel WebhookModel) FanOut() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := webhookModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id
+		FROM outbox_events
+		WHERE dispatched_at IS NULL
+		ORDER BY id
+		LIMIT 500
+		FOR UPDATE SKIP LOCKED`,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		if err = queueDeliveriesTx(ctx, tx, id); err != nil {
+			return 0, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE outbox_events
+		SET dispatched_at = NOW()
+		WHERE id = ANY($1)`,
+		pq.Array(ids),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(ids), nil
+}
+
+// queueDeliveriesTx queues the deliveries of an event to the endpoints subscribed
+// to it.
+func queueDeliveriesTx(ctx context.Context, tx *sql.Tx, eventID int64) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT webhook_endpoints.id
+		FROM webhook_endpoints
+		JOIN outbox_events ON outbox_events.user_id = webhook_endpoints.user_id
+		WHERE outbox_events.id = $1
+		AND webhook_endpoints.active
+		AND outbox_events.event_type = ANY(webhook_endpoints.event_types)`,
+		eventID,
+	)
+	if err != nil {
+		return err
+	}
+	var endpointIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		endpointIDs = append(endpointIDs, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, endpointID := range endpointIDs {
+		if _, err = queueDeliveryTx(ctx, tx, eventID, endpointID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queueDeliveryTx queues a delivery of an event to an endpoint, due now, and
+// returns its public id.
+func queueDeliveryTx(ctx context.Context, tx *sql.Tx, eventID, endpointID int64) (string, error) {
+	publicID, err := publicid.New(constants.PrefixWebhookDeliveryID)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO webhook_deliveries (public_id, event_id, endpoint_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (event_id, endpoint_id) DO NOTHING`,
+		publicID, eventID, endpointID,
+	)
+	return publicID, err
+}
+
+// ClaimDue claims up to limit deliveries that are due, for lease, so that other
+// dispatchers leave them alone while they are being sent. A delivery whose
+// dispatcher dies is due again once the lease is over.
+func (webhookModel WebhookModel) ClaimDue(limit int, lease time.Duration) ([]*Due, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := webhookModel.DB.QueryContext(ctx, `
+		WITH claimed AS (
+			UPDATE webhook_deliveries
+			SET next_attempt_at = NOW() + make_interval(secs => $1), updated_at = NOW()
+			WHERE id IN (
+				SELECT webhook_deliveries.id
+				FROM webhook_deliveries
+				JOIN webhook_endpoints ON webhook_endpoints.id = webhook_deliveries.endpoint_id
+				WHERE webhook_deliveries.status = 'pending'
+				AND webhook_deliveries.next_attempt_at <= NOW()
+				AND webhook_endpoints.active
+				ORDER BY webhook_deliveries.next_attempt_at
+				LIMIT $2
+				FOR UPDATE OF webhook_deliveries SKIP LOCKED
+			)
+			RETURNING *
+		)
+		SELECT
+			claimed.id,
+			claimed.public_id,
+			outbox_events.public_id,
+			outbox_events.event_type,
+			webhook_endpoints.public_id,
+			webhook_endpoints.url,
+			claimed.attempts,
+			outbox_events.payload::text,
+			webhook_endpoints.secret_encrypted,
+			CASE WHEN webhook_endpoints.previous_secret_expires_at > NOW() THEN webhook_endpoints.previous_secret_encrypted END
+		FROM
+			claimed
+		JOIN
+			outbox_events ON outbox_events.id = claimed.event_id
+		JOIN
+			webhook_endpoints ON webhook_endpoints.id = claimed.endpoint_id
+		ORDER BY
+			claimed.id`,
+		lease.Seconds(), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	claimed := []*Due{}
+	for rows.Next() {
+		var due Due
+		var secret, previousSecret []byte
+		err := rows.Scan(
+			&due.ID,
+			&due.PublicID,
+			&due.Event,
+			&due.EventType,
+			&due.Endpoint,
+			&due.URL,
+			&due.Attempts,
+			&due.Body,
+			&secret,
+			&previousSecret,
+		)
+		if err != nil {
+			return nil, err
+		}
+		due.Status = DeliveryPending
+
+		plaintext, err := webhookModel.Cipher.DecryptString(secret)
+		if err != nil {
+			return nil, err
+		}
+		due.Secrets = []string{plaintext}
+
+		// the secret that was rotated out keeps signing until its overlap is over
+		if previousSecret != nil {
+			plaintext, err := webhookModel.Cipher.DecryptString(previousSecret)
+			if err != nil {
+				return nil, err
+			}
+			due.Secrets = append(due.Secrets, plaintext)
+		}
+
+		claimed = append(claimed, &due)
+	}
+
+	return claimed, rows.Err()
+}
+
+// RecordAttempt records how sending a claimed delivery went. A failed delivery is
+// due again after a backoff, or dead once it has had its attempts.
+func (webhookModel WebhookModel) RecordAttempt(due *Due, result dispatch.Result) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := webhookModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var statusCode *int
+	if result.StatusCode != 0 {
+		statusCode = &result.StatusCode
+	}
+	lastError := ""
+	if result.Err != nil {
+		lastError = result.Err.Error()
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO webhook_attempts (delivery_id, status_code, latency_ms, error)
+		VALUES ($1, $2, $3, $4)`,
+		due.ID, statusCode, result.Latency.Milliseconds(), lastError,
+	)
+	if err != nil {
+		return err
+	}
+
+	due.Attempts++
+	due.LastStatusCode, due.LastError = statusCode, lastError
+	switch {
+	case result.Delivered():
+		due.Status = DeliveryDelivered
+	case due.Attempts >= dispatch.MaxAttempts:
+		due.Status = DeliveryDead
+	default:
+		due.Status = DeliveryPending
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE webhook_deliveries
+		SET
+			status = $1,
+			attempts = $2,
+			last_status_code = $3,
+			last_error = $4,
+			next_attempt_at = NOW() + make_interval(secs => $5),
+			delivered_at = CASE WHEN $1 = 'delivered' THEN NOW() END,
+			updated_at = NOW()
+		WHERE id = $6`,
+		due.Status, due.Attempts, statusCode, lastError, dispatch.Backoff(due.Attempts).Seconds(), due.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Redeliver queues a delivered or dead delivery again, due now and with a fresh set
+// of attempts.
+func (webhookModel WebhookModel) Redeliver(delivery *Delivery, actor audit.Actor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := webhookModel.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRowContext(ctx, `
+		SELECT status
+		FROM webhook_deliveries
+		WHERE id = $1
+		FOR UPDATE`,
+		delivery.ID,
+	).Scan(&status)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return constants.ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	if status == DeliveryPending {
+		return constants.ErrDeliveryPending
+	}
+
+	delivery.Status = DeliveryPending
+	delivery.Attempts = 0
+	err = tx.QueryRowContext(ctx, `
+		UPDATE webhook_deliveries
+		SET status = $1, attempts = 0, next_attempt_at = NOW(), delivered_at = NULL, updated_at = NOW()
+		WHERE id = $2
+		RETURNING next_attempt_at, updated_at`,
+		delivery.Status, delivery.ID,
+	).Scan(&delivery.NextAttemptAt, &delivery.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	delivery.DeliveredAt = nil
+
+	before := map[string]interface{}{"status": status}
+	after := map[string]interface{}{"status": delivery.Status}
+	err = audit.RecordTx(ctx, tx, actor, "webhook.redeliver", "webhook_delivery", delivery.PublicID, before, after)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const deliveryColumns = `
+	webhook_deliveries.id,
+	webhook_deliveries.public_id,
+	outbox_events.public_id,
+	outbox_events.event_type,
+	webhook_endpoints.public_id,
+	webhook_endpoints.url,
+	webhook_deliveries.status,
+	webhook_deliveries.attempts,
+	webhook_deliveries.next_attempt_at,
+	webhook_deliveries.last_status_code,
+	webhook_deliveries.last_error,
+	webhook_deliveries.delivered_at,
+	webhook_deliveries.created_at,
+	webhook_deliveries.updated_at`
+
+const deliveryJoins = `
+	JOIN
+		outbox_events ON outbox_events.id = webhook_deliveries.event_id
+	JOIN
+		webhook_endpoints ON webhook_endpoints.id = webhook_deliveries.endpoint_id`
+
+func (delivery *Delivery) scanDestinations() []interface{} {
+	return []interface{}{
+		&delivery.ID,
+		&delivery.PublicID,
+		&delivery.Event,
+		&delivery.EventType,
+		&delivery.Endpoint,
+		&delivery.URL,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.NextAttemptAt,
+		&delivery.LastStatusCode,
+		&delivery.LastError,
+		&delivery.DeliveredAt,
+		&delivery.CreatedAt,
+		&delivery.UpdatedAt,
+	}
+}
+
+// GetDeliveries returns deliveries matching the filters. Passing an endpoint id
+// only returns deliveries to that endpoint.
+func (webhookModel WebhookModel) GetDeliveries(endpointID *int64, filters listing.Filters) ([]*Delivery, listing.Metadata, error) {
+	var args []interface{}
+	scope := ""
+	if endpointID != nil {
+		args = append(args, *endpointID)
+		scope = "AND webhook_deliveries.endpoint_id = $1"
+	}
+	where, args := filters.Where(args)
+	pagination, args := filters.Paginate(args)
+
+	query := fmt.Sprintf(`
+		SELECT
+			count(*) OVER(),
+			%s,
+			%s
+		FROM
+			webhook_deliveries
+		%s
+		WHERE
+			true
+		%s
+		%s
+		%s
+		%s;
+	`, filters.CursorColumns(), deliveryColumns, deliveryJoins, scope, where, filters.OrderBy(), pagination)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := webhookModel.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, listing.Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	lastSortValue := ""
+	var lastID int64
+	deliveries := []*Delivery{}
+	for rows.Next() {
+		var delivery Delivery
+		destinations := append([]interface{}{&totalRecords, &lastSortValue, &lastID}, delivery.scanDestinations()...)
+		if err := rows.Scan(destinations...); err != nil {
+			return nil, listing.Metadata{}, err
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, listing.Metadata{}, err
+	}
+
+	metadata := filters.Metadata(totalRecords, len(deliveries), lastSortValue, lastID)
+	return deliveries, metadata, nil
+}
+
+// GetDeliveryByPublicId returns a delivery with its attempts, the latest first.
+func (webhookModel WebhookModel) GetDeliveryByPublicId(publicID string) (*Delivery, error) {
+	query := fmt.Sprintf(`
+		SELECT
+			%s
+		FROM
+			webhook_deliveries
+		%s
+		WHERE
+			webhook_deliveries.public_id = $1;
+	`, deliveryColumns, deliveryJoins)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var delivery Delivery
+	err := webhookModel.DB.QueryRowContext(ctx, query, publicID).Scan(delivery.scanDestinations()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, constants.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	rows, err := webhookModel.DB.QueryContext(ctx, `
+		SELECT status_code, latency_ms, error, created_at
+		FROM webhook_attempts
+		WHERE delivery_id = $1
+		ORDER BY id DESC
+		LIMIT 50`,
+		delivery.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	delivery.AttemptLog = []Attempt{}
+	for rows.Next() {
+		var attempt Attempt
+		if err := rows.Scan(&attempt.StatusCode, &attempt.LatencyMS, &attempt.Error, &attempt.CreatedAt); err != nil {
+			return nil, err
+		}
+		delivery.AttemptLog = append(delivery.AttemptLog, attempt)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+// GetAttempts returns the attempts at deliveries to an endpoint matching the
+// filters.
+func (webhookModel WebhookModel) GetAttempts(endpointID int64, filters listing.Filters) ([]*Attempt, listing.Metadata, error) {
+	where, args := filters.Where([]interface{}{endpointID})
+	pagination, args := filters.Paginate(args)
+
+	query := fmt.Sprintf(`
+		SELECT
+			count(*) OVER(),
+			%s,
+			webhook_deliveries.public_id,
+			outbox_events.event_type,
+			webhook_attempts.status_code,
+			webhook_attempts.latency_ms,
+			webhook_attempts.error,
+			webhook_attempts.created_at
+		FROM
+			webhook_attempts
+		JOIN
+			webhook_deliveries ON webhook_deliveries.id = webhook_attempts.delivery_id
+		JOIN
+			outbox_events ON outbox_events.id = webhook_deliveries.event_id
+		WHERE
+			webhook_deliveries.endpoint_id = $1
+		%s
+		%s
+		%s;
+	`, filters.CursorColumns(), where, filters.OrderBy(), pagination)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := webhookModel.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, listing.Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	lastSortValue := ""
+	var lastID int64
+	attempts := []*Attempt{}
+	for rows.Next() {
+		var attempt Attempt
+		err := rows.Scan(
+			&totalRecords,
+			&lastSortValue,
+			&lastID,
+			&attempt.Delivery,
+			&attempt.EventType,
+			&attempt.StatusCode,
+			&attempt.LatencyMS,
+			&attempt.Error,
+			&attempt.CreatedAt,
+		)
+		if err != nil {
+			return nil, listing.Metadata{}, err
+		}
+		attempts = append(attempts, &attempt)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, listing.Metadata{}, err
+	}
+
+	metadata := filters.Metadata(totalRecords, len(attempts), lastSortValue, lastID)
+	return attempts, metadata, nil
+}
@@ -0,0 +1,187 @@
+// dispatch sends webhook events to the endpoints of integrators. Every request is
+// signed with HMAC-SHA256 so that endpoints can check it came from us and was not
+// replayed: the Digillets-Signature header holds the unix time the request was
+// signed at and the signature of "<time>.<body>", e.g t=1700000000,v1=5257a869...,
+// with one v1 per signing secret while a secret is being rotated.
+package dispatch
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Headers sent with every event.
+const (
+	HeaderSignature = "Digillets-Signature"
+	HeaderEvent     = "Digillets-Event"
+	HeaderDelivery  = "Digillets-Delivery"
+)
+
+// MaxAttempts is how many times a delivery is attempted before it is dead.
+const MaxAttempts = 10
+
+const (
+	baseBackoff = 30 * time.Second
+	maxBackoff  = 6 * time.Hour
+)
+
+// Request is an event to send to an endpoint.
+type Request struct {
+	URL        string
+	EventType  string
+	DeliveryID string
+	Body       []byte
+	Secrets    []string
+}
+
+// Result is the outcome of sending a request. StatusCode is 0 when no response was
+// received, and Err is set for any outcome but a 2xx response.
+type Result struct {
+	StatusCode int
+	Latency    time.Duration
+	Err        error
+}
+
+// Delivered reports whether the endpoint accepted the event.
+func (result Result) Delivered() bool {
+	return result.Err == nil
+}
+
+// ErrForbiddenAddress is returned for endpoints on an address of our own network,
+// which integrators must not be able to reach through us.
+var ErrForbiddenAddress = errors.New("endpoint address is not public")
+
+// nonPublicRanges are the ranges PublicAddress refuses on top of the ones netip
+// knows: "this network", which reaches the local host on Linux, and the
+// carrier-grade NAT range, private in all but name.
+var nonPublicRanges = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+// PublicAddress reports whether an address can be sent events: not loopback,
+// private, link-local, multicast or unspecified.
+func PublicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicRanges {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// Client sends events. Redirects are not followed, an endpoint must answer itself.
+type Client struct {
+	http *http.Client
+}
+
+// NewClient returns a client giving up on a request after timeout. Unless
+// allowPrivate is set for local development, it refuses to connect to addresses
+// that are not public. The address is checked as it is dialled, after DNS
+// resolution, so a host name can't be pointed at our network once it is
+// registered.
+func NewClient(timeout time.Duration, allowPrivate bool) *Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, conn syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil || !PublicAddress(addrPort.Addr()) {
+				return ErrForbiddenAddress
+			}
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would be dialled in place of the endpoint, out of reach of the check
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &Client{
+		http: &http.Client{
+			Timeout:   timeout,
+			Transport: transport,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Send posts an event to its endpoint and reports how it went.
+func (client *Client) Send(ctx context.Context, request Request) Result {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, request.URL, bytes.NewReader(request.Body))
+	if err != nil {
+		return Result{Err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Digillets-Webhooks/1.0")
+	req.Header.Set(HeaderEvent, request.EventType)
+	req.Header.Set(HeaderDelivery, request.DeliveryID)
+	req.Header.Set(HeaderSignature, SignatureHeader(time.Now(), request.Body, request.Secrets...))
+
+	start := time.Now()
+	res, err := client.http.Do(req)
+	latency := time.Since(start)
+	if err != nil {
+		return Result{Latency: latency, Err: err}
+	}
+	defer res.Body.Close()
+	// drain a little of the body so that the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+
+	result := Result{StatusCode: res.StatusCode, Latency: latency}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		result.Err = fmt.Errorf("endpoint responded with %s", res.Status)
+	}
+	return result
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of "<timestamp>.<body>" with secret.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignatureHeader returns the signature header of a body signed at a time with
+// every one of secrets.
+func SignatureHeader(at time.Time, body []byte, secrets ...string) string {
+	timestamp := at.Unix()
+	parts := []string{"t=" + strconv.FormatInt(timestamp, 10)}
+	for _, secret := range secrets {
+		parts = append(parts, "v1="+Sign(secret, timestamp, body))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Backoff returns how long to wait before the next attempt at a delivery after
+// attempts failed ones: 30s doubling up to 6h, with up to a fifth of jitter so that
+// the retries of many deliveries do not all land together.
+func Backoff(attempts int) time.Duration {
+	wait := maxBackoff
+	if attempts < 20 {
+		wait = min(baseBackoff<<max(attempts-1, 0), maxBackoff)
+	}
+	return wait + rand.N(wait/5+1)
+}
@@ -0,0 +1,67 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestPublicAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"93.184.216.34", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"127.1.2.3", false},
+		{"::1", false},
+		{"10.0.0.1", false},
+		{"172.16.5.4", false},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"ff02::1", false},
+		{"255.255.255.255", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:8.8.8.8", true},
+	}
+
+	for _, test := range tests {
+		if got := PublicAddress(netip.MustParseAddr(test.addr)); got != test.want {
+			t.Errorf("PublicAddress(%s) = %t, want %t", test.addr, got, test.want)
+		}
+	}
+}
+
+func TestSendRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	request := Request{URL: server.URL, EventType: "webhook.test", DeliveryID: "whd_test", Body: []byte("{}")}
+
+	result := NewClient(time.Second, false).Send(context.Background(), request)
+	if !errors.Is(result.Err, ErrForbiddenAddress) {
+		t.Errorf("Send to %s = %v, want ErrForbiddenAddress", server.URL, result.Err)
+	}
+	if result.StatusCode != 0 {
+		t.Errorf("Send to %s got status %d, want no response", server.URL, result.StatusCode)
+	}
+
+	result = NewClient(time.Second, true).Send(context.Background(), request)
+	if !result.Delivered() {
+		t.Errorf("Send to %s with private addresses allowed = %v, want delivered", server.URL, result.Err)
+	}
+}
@@ -0,0 +1,88 @@
+// encryption encrypts personal data before it is stored, with AES-256-GCM.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// version is the first byte of every ciphertext, so that the scheme or key can be
+// changed later while old values are still readable.
+const version byte = 1
+
+var ErrDecrypt = errors.New("encryption: cannot decrypt value")
+
+// Cipher encrypts and decrypts values with a single key.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// New returns a Cipher for a 32 byte key.
+func New(key []byte) (*Cipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption: key must be 32 bytes, got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cipher{aead: aead}, nil
+}
+
+// NewFromHex returns a Cipher for a key given as 64 hex characters.
+func NewFromHex(key string) (*Cipher, error) {
+	decoded, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: key must be hex encoded: %w", err)
+	}
+	return New(decoded)
+}
+
+// Encrypt returns the version byte, a random nonce and the sealed plaintext.
+func (c *Cipher) Encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, 1+len(nonce)+len(plaintext)+c.aead.Overhead())
+	out = append(out, version)
+	out = append(out, nonce...)
+	return c.aead.Seal(out, nonce, plaintext, nil), nil
+}
+
+// Decrypt opens a value returned by Encrypt.
+func (c *Cipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	if len(ciphertext) < 1+nonceSize || ciphertext[0] != version {
+		return nil, ErrDecrypt
+	}
+
+	nonce, sealed := ciphertext[1:1+nonceSize], ciphertext[1+nonceSize:]
+	plaintext, err := c.aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+// EncryptString is Encrypt for strings.
+func (c *Cipher) EncryptString(plaintext string) ([]byte, error) {
+	return c.Encrypt([]byte(plaintext))
+}
+
+// DecryptString is Decrypt for strings.
+func (c *Cipher) DecryptString(ciphertext []byte) (string, error) {
+	plaintext, err := c.Decrypt(ciphertext)
+	return string(plaintext), err
+}
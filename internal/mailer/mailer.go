@@ -0,0 +1,207 @@
+// mailer sends emails through an SMTP server, rendered from the templates embedded
+// in the templates directory. Each template defines a "subject", a "plainBody" and
+// an "htmlBody".
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+//go:embed "templates"
+var templateFS embed.FS
+
+// timeout is how long a single attempt at sending an email can take.
+const timeout = 10 * time.Second
+
+type Mailer struct {
+	host     string
+	port     int
+	username string
+	password string
+	sender   string
+}
+
+// New returns a mailer sending through the SMTP server at host and port as sender,
+// e.g "Digillets <no-reply@digillets.com>". Without a host it is off, see Enabled.
+func New(host string, port int, username, password, sender string) Mailer {
+	return Mailer{
+		host:     host,
+		port:     port,
+		username: username,
+		password: password,
+		sender:   sender,
+	}
+}
+
+// Enabled reports whether the mailer has an SMTP server to send through.
+func (mailer Mailer) Enabled() bool {
+	return mailer.host != ""
+}
+
+// Send renders templateFile with data and sends it to recipient, trying up to three
+// times before giving up.
+func (mailer Mailer) Send(recipient, templateFile string, data interface{}) error {
+	if !mailer.Enabled() {
+		return fmt.Errorf("mailer: no smtp server configured")
+	}
+
+	message, err := mailer.render(recipient, templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	from, err := mail.ParseAddress(mailer.sender)
+	if err != nil {
+		return fmt.Errorf("mailer: invalid sender: %w", err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		err = mailer.send(from.Address, recipient, message)
+		if err == nil {
+			return nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	return err
+}
+
+// render builds the MIME message of an email, with both its plain text and HTML
+// bodies.
+func (mailer Mailer) render(recipient, templateFile string, data interface{}) ([]byte, error) {
+	textTmpl, err := texttemplate.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	subject := new(bytes.Buffer)
+	if err = textTmpl.ExecuteTemplate(subject, "subject", data); err != nil {
+		return nil, err
+	}
+
+	plainBody := new(bytes.Buffer)
+	if err = textTmpl.ExecuteTemplate(plainBody, "plainBody", data); err != nil {
+		return nil, err
+	}
+
+	htmlTmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	htmlBody := new(bytes.Buffer)
+	if err = htmlTmpl.ExecuteTemplate(htmlBody, "htmlBody", data); err != nil {
+		return nil, err
+	}
+
+	message := new(bytes.Buffer)
+	parts := multipart.NewWriter(message)
+
+	fmt.Fprintf(message, "From: %s\r\n", mailer.sender)
+	fmt.Fprintf(message, "To: %s\r\n", recipient)
+	fmt.Fprintf(message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject.String())))
+	fmt.Fprintf(message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(message, "Message-ID: <%s@%s>\r\n", messageID(), mailer.host)
+	fmt.Fprintf(message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(message, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", parts.Boundary())
+
+	for _, body := range []struct {
+		contentType string
+		content     []byte
+	}{
+		{"text/plain; charset=utf-8", plainBody.Bytes()},
+		{"text/html; charset=utf-8", htmlBody.Bytes()},
+	} {
+		part, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {body.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		writer := quotedprintable.NewWriter(part)
+		if _, err = writer.Write(body.content); err != nil {
+			return nil, err
+		}
+		if err = writer.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = parts.Close(); err != nil {
+		return nil, err
+	}
+
+	return message.Bytes(), nil
+}
+
+// send makes a single attempt at delivering message to the SMTP server.
+func (mailer Mailer) send(from, recipient string, message []byte) error {
+	addr := net.JoinHostPort(mailer.host, strconv.Itoa(mailer.port))
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	client, err := smtp.NewClient(conn, mailer.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err = client.StartTLS(&tls.Config{ServerName: mailer.host}); err != nil {
+			return err
+		}
+	}
+	if mailer.username != "" {
+		if err = client.Auth(smtp.PlainAuth("", mailer.username, mailer.password, mailer.host)); err != nil {
+			return err
+		}
+	}
+
+	if err = client.Mail(from); err != nil {
+		return err
+	}
+	if err = client.Rcpt(recipient); err != nil {
+		return err
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(message); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+func messageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
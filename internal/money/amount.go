@@ -0,0 +1,270 @@
+// money provides exact decimal amounts for balances, rates and everything derived
+// from them, so that no value ever goes through a binary float and drifts.
+package money
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Amount is an exact decimal number, coefficient × 10^-scale. The zero value is 0.
+// Amounts are immutable, every operation returns a new Amount.
+type Amount struct {
+	coef  *big.Int
+	scale int32
+}
+
+var ErrInvalidAmount = errors.New("invalid amount")
+
+// Parse refuses amounts with more than maxDigits digits or an exponent beyond
+// ±maxExponent, so that a value from a request can't make it build huge numbers.
+// Both are far above anything money is kept with.
+const (
+	maxDigits   = 40
+	maxExponent = 30
+)
+
+var bigTen = big.NewInt(10)
+
+// Zero is the amount 0.
+var Zero = Amount{}
+
+// New returns coefficient × 10^-scale, e.g New(1050, 2) is 10.50
+func New(coefficient int64, scale int32) Amount {
+	if scale < 0 {
+		return Amount{coef: new(big.Int).Mul(big.NewInt(coefficient), pow10(-scale))}
+	}
+	return Amount{coef: big.NewInt(coefficient), scale: scale}
+}
+
+// Parse parses a decimal string such as "-1234.50" or "1.5e3", of up to 40 digits
+// with an exponent from -30 to 30.
+func Parse(value string) (Amount, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return Zero, ErrInvalidAmount
+	}
+
+	mantissa, exponent := value, int64(0)
+	if i := strings.IndexAny(value, "eE"); i >= 0 {
+		var err error
+		mantissa = value[:i]
+		exponent, err = strconv.ParseInt(value[i+1:], 10, 32)
+		if err != nil || exponent < -maxExponent || exponent > maxExponent {
+			return Zero, ErrInvalidAmount
+		}
+	}
+
+	whole, fraction, _ := strings.Cut(mantissa, ".")
+	digits := whole + fraction
+	unsigned := strings.TrimLeft(digits, "+-")
+	if unsigned == "" || len(unsigned) > maxDigits || strings.ContainsAny(unsigned, "+-") {
+		return Zero, ErrInvalidAmount
+	}
+
+	coef, ok := new(big.Int).SetString(digits, 10)
+	if !ok {
+		return Zero, ErrInvalidAmount
+	}
+
+	scale := int64(len(fraction)) - exponent
+	if scale < 0 {
+		return Amount{coef: coef.Mul(coef, pow10(int32(-scale)))}, nil
+	}
+	return Amount{coef: coef, scale: int32(scale)}, nil
+}
+
+// MustParse is like Parse but panics on an invalid value, for constants.
+func MustParse(value string) Amount {
+	amount, err := Parse(value)
+	if err != nil {
+		panic(fmt.Sprintf("money: invalid amount %q", value))
+	}
+	return amount
+}
+
+func pow10(n int32) *big.Int {
+	return new(big.Int).Exp(bigTen, big.NewInt(int64(n)), nil)
+}
+
+func (a Amount) coefficient() *big.Int {
+	if a.coef == nil {
+		return new(big.Int)
+	}
+	return a.coef
+}
+
+// rescaled returns the coefficient of a at a larger scale.
+func (a Amount) rescaled(scale int32) *big.Int {
+	if scale == a.scale {
+		return new(big.Int).Set(a.coefficient())
+	}
+	return new(big.Int).Mul(a.coefficient(), pow10(scale-a.scale))
+}
+
+func align(a, b Amount) (*big.Int, *big.Int, int32) {
+	scale := max(a.scale, b.scale)
+	return a.rescaled(scale), b.rescaled(scale), scale
+}
+
+// Scale returns the number of decimal places the amount is held with.
+func (a Amount) Scale() int32 {
+	return a.scale
+}
+
+func (a Amount) Add(b Amount) Amount {
+	x, y, scale := align(a, b)
+	return Amount{coef: x.Add(x, y), scale: scale}
+}
+
+func (a Amount) Sub(b Amount) Amount {
+	x, y, scale := align(a, b)
+	return Amount{coef: x.Sub(x, y), scale: scale}
+}
+
+// Mul returns the exact product, its scale is the sum of both scales.
+func (a Amount) Mul(b Amount) Amount {
+	return Amount{coef: new(big.Int).Mul(a.coefficient(), b.coefficient()), scale: a.scale + b.scale}
+}
+
+// Div returns a / b rounded to the given number of decimal places. It panics if b
+// is zero.
+func (a Amount) Div(b Amount, places int32, mode RoundingMode) Amount {
+	if b.IsZero() {
+		panic("money: division by zero")
+	}
+
+	// a/b = (ca / cb) × 10^(sb - sa), so scaling to places decimals means
+	// dividing ca × 10^(places + sb - sa) by cb.
+	numerator := new(big.Int).Set(a.coefficient())
+	denominator := new(big.Int).Set(b.coefficient())
+	if shift := places + b.scale - a.scale; shift >= 0 {
+		numerator.Mul(numerator, pow10(shift))
+	} else {
+		denominator.Mul(denominator, pow10(-shift))
+	}
+
+	return Amount{coef: divRound(numerator, denominator, mode), scale: places}
+}
+
+// Round returns the amount rounded to the given number of decimal places, held at
+// exactly that scale, so 1.5 rounded to 2 places is 1.50
+func (a Amount) Round(places int32, mode RoundingMode) Amount {
+	if places >= a.scale {
+		return Amount{coef: a.rescaled(places), scale: places}
+	}
+	return Amount{coef: divRound(a.coefficient(), pow10(a.scale-places), mode), scale: places}
+}
+
+// HasPrecision reports whether a has no non-zero digits beyond the given number of
+// decimal places, e.g 10.50 has a precision of 1 but 10.05 doesn't.
+func (a Amount) HasPrecision(places int32) bool {
+	return places >= a.scale || a.Round(places, Down).Equal(a)
+}
+
+func (a Amount) Neg() Amount {
+	return Amount{coef: new(big.Int).Neg(a.coefficient()), scale: a.scale}
+}
+
+func (a Amount) Abs() Amount {
+	return Amount{coef: new(big.Int).Abs(a.coefficient()), scale: a.scale}
+}
+
+// Cmp compares a and b and returns -1, 0 or +1.
+func (a Amount) Cmp(b Amount) int {
+	x, y, _ := align(a, b)
+	return x.Cmp(y)
+}
+
+// Equal reports whether a and b are the same number, whatever their scale.
+func (a Amount) Equal(b Amount) bool {
+	return a.Cmp(b) == 0
+}
+
+// Sign returns -1, 0 or +1.
+func (a Amount) Sign() int {
+	return a.coefficient().Sign()
+}
+
+func (a Amount) IsZero() bool {
+	return a.Sign() == 0
+}
+
+func (a Amount) IsNegative() bool {
+	return a.Sign() < 0
+}
+
+func (a Amount) IsPositive() bool {
+	return a.Sign() > 0
+}
+
+// String formats the amount as a plain decimal with all of its decimal places,
+// e.g "-1234.50"
+func (a Amount) String() string {
+	digits := new(big.Int).Abs(a.coefficient()).String()
+	if a.scale > 0 {
+		if pad := int(a.scale) + 1 - len(digits); pad > 0 {
+			digits = strings.Repeat("0", pad) + digits
+		}
+		digits = digits[:len(digits)-int(a.scale)] + "." + digits[len(digits)-int(a.scale):]
+	}
+	if a.IsNegative() {
+		return "-" + digits
+	}
+	return digits
+}
+
+// Value implements the driver.Valuer interface, amounts are sent to Postgres as
+// their exact decimal text.
+func (a Amount) Value() (driver.Value, error) {
+	return a.String(), nil
+}
+
+// Scan implements the sql.Scanner interface for DECIMAL and NUMERIC columns.
+func (a *Amount) Scan(value interface{}) error {
+	var err error
+	switch v := value.(type) {
+	case nil:
+		*a = Zero
+	case []byte:
+		*a, err = Parse(string(v))
+	case string:
+		*a, err = Parse(v)
+	case int64:
+		*a = New(v, 0)
+	case float64:
+		// only reached for float columns, which money should never be kept in
+		*a, err = Parse(strconv.FormatFloat(v, 'f', -1, 64))
+	default:
+		return fmt.Errorf("money: cannot scan %T into Amount", value)
+	}
+	return err
+}
+
+// MarshalJSON encodes the amount as a JSON string, so clients never parse it into a
+// binary float by accident.
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(a.String())), nil
+}
+
+// UnmarshalJSON accepts a JSON string or number.
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	value := string(data)
+	if value == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		value = unquoted
+	}
+
+	amount, err := Parse(value)
+	if err != nil {
+		return fmt.Errorf("money: %q is not a valid amount", value)
+	}
+	*a = amount
+	return nil
+}
@@ -0,0 +1,192 @@
+package money
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"0", "0"},
+		{"10.50", "10.50"},
+		{"-1234.50", "-1234.50"},
+		{"+7", "7"},
+		{" 3.1 ", "3.1"},
+		{".5", "0.5"},
+		{"5.", "5"},
+		{"-0.001", "-0.001"},
+		{"1.5e3", "1500"},
+		{"1.5E3", "1500"},
+		{"-2e-2", "-0.02"},
+		{"1e30", "1" + strings.Repeat("0", 30)},
+		{"1e-30", "0." + strings.Repeat("0", 29) + "1"},
+		{strings.Repeat("9", 40), strings.Repeat("9", 40)},
+		{"-" + strings.Repeat("9", 40), "-" + strings.Repeat("9", 40)},
+	}
+
+	for _, test := range tests {
+		got, err := Parse(test.value)
+		if err != nil {
+			t.Errorf("Parse(%q) returned error %v", test.value, err)
+			continue
+		}
+		if got.String() != test.want {
+			t.Errorf("Parse(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		" ",
+		"-",
+		"+",
+		".",
+		"abc",
+		"1.2.3",
+		"--1",
+		"+-1",
+		"1-",
+		"1e",
+		"e5",
+		"1e1.5",
+		"1e31",
+		"1e-31",
+		"1e5000000",
+		"1e200000000",
+		"1e99999999999",
+		strings.Repeat("9", 41),
+		"0." + strings.Repeat("0", 40) + "1",
+	}
+
+	for _, value := range tests {
+		if got, err := Parse(value); !errors.Is(err, ErrInvalidAmount) {
+			t.Errorf("Parse(%q) = %s, %v, want ErrInvalidAmount", value, got, err)
+		}
+	}
+}
+
+func TestUnmarshalJSONLargeExponent(t *testing.T) {
+	start := time.Now()
+	for _, value := range []string{`"1e200000000"`, `1e200000000`, `"1e5000000"`} {
+		var amount Amount
+		if err := amount.UnmarshalJSON([]byte(value)); err == nil {
+			t.Errorf("UnmarshalJSON(%s) = %s, want an error", value, amount)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("rejecting large exponents took %s", elapsed)
+	}
+}
+
+func TestRound(t *testing.T) {
+	tests := []struct {
+		value  string
+		places int32
+		mode   RoundingMode
+		want   string
+	}{
+		{"1.5", 2, HalfEven, "1.50"},
+		{"1.005", 2, HalfEven, "1.00"},
+		{"1.015", 2, HalfEven, "1.02"},
+		{"1.025", 2, HalfEven, "1.02"},
+		{"1.0251", 2, HalfEven, "1.03"},
+		{"2.5", 0, HalfEven, "2"},
+		{"3.5", 0, HalfEven, "4"},
+		{"-2.5", 0, HalfEven, "-2"},
+		{"-3.5", 0, HalfEven, "-4"},
+		{"-1.025", 2, HalfEven, "-1.02"},
+		{"2.5", 0, HalfUp, "3"},
+		{"-2.5", 0, HalfUp, "-3"},
+		{"2.5", 0, HalfDown, "2"},
+		{"-2.5", 0, HalfDown, "-2"},
+		{"2.9", 0, Down, "2"},
+		{"-2.9", 0, Down, "-2"},
+		{"2.1", 0, Up, "3"},
+		{"-2.1", 0, Up, "-3"},
+		{"-2.1", 0, Floor, "-3"},
+		{"2.9", 0, Floor, "2"},
+		{"-2.9", 0, Ceiling, "-2"},
+		{"2.1", 0, Ceiling, "3"},
+		{"0.004", 2, HalfEven, "0.00"},
+		{"-0.004", 2, HalfEven, "0.00"},
+	}
+
+	for _, test := range tests {
+		got := MustParse(test.value).Round(test.places, test.mode)
+		if got.String() != test.want {
+			t.Errorf("Round(%s, %d, %s) = %s, want %s", test.value, test.places, test.mode, got, test.want)
+		}
+	}
+}
+
+func TestDiv(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		places int32
+		mode   RoundingMode
+		want   string
+	}{
+		{"10", "4", 2, HalfEven, "2.50"},
+		{"10", "3", 2, HalfEven, "3.33"},
+		{"20", "3", 2, HalfEven, "6.67"},
+		{"-10", "3", 2, HalfEven, "-3.33"},
+		{"10", "-4", 0, HalfEven, "-2"},
+		{"-10", "-4", 0, HalfEven, "2"},
+		{"1", "8", 2, HalfEven, "0.12"},
+		{"3", "8", 2, HalfEven, "0.38"},
+		{"1", "8", 2, HalfUp, "0.13"},
+		{"1", "3", 2, Up, "0.34"},
+		{"-1", "3", 2, Floor, "-0.34"},
+		{"1500", "1.5", 4, HalfEven, "1000.0000"},
+		{"0.01", "1000", 4, HalfEven, "0.0000"},
+		{"123.456", "0.001", 0, HalfEven, "123456"},
+	}
+
+	for _, test := range tests {
+		got := MustParse(test.a).Div(MustParse(test.b), test.places, test.mode)
+		if got.String() != test.want {
+			t.Errorf("%s.Div(%s, %d, %s) = %s, want %s", test.a, test.b, test.places, test.mode, got, test.want)
+		}
+	}
+}
+
+func TestDivByZero(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Div by zero did not panic")
+		}
+	}()
+	MustParse("1").Div(Zero, 2, HalfEven)
+}
+
+func TestHasPrecision(t *testing.T) {
+	tests := []struct {
+		value  string
+		places int32
+		want   bool
+	}{
+		{"10", 0, true},
+		{"10.50", 1, true},
+		{"10.05", 1, false},
+		{"10.05", 2, true},
+		{"10.005", 2, false},
+		{"-10.005", 2, false},
+		{"-10.50", 1, true},
+		{"0.000", 0, true},
+		{"1e-3", 2, false},
+		{"1e3", 0, true},
+	}
+
+	for _, test := range tests {
+		if got := MustParse(test.value).HasPrecision(test.places); got != test.want {
+			t.Errorf("HasPrecision(%s, %d) = %t, want %t", test.value, test.places, got, test.want)
+		}
+	}
+}
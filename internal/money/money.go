@@ -0,0 +1,60 @@
+package money
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrCurrencyMismatch = errors.New("currency mismatch")
+
+// Money is an amount in a currency. Arithmetic between two Money values only works
+// when they are in the same currency, anything else has to be converted first.
+type Money struct {
+	Amount   Amount `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+func (m Money) String() string {
+	return fmt.Sprintf("%s %s", m.Amount, m.Currency)
+}
+
+func (m Money) sameCurrency(other Money) error {
+	if m.Currency != other.Currency {
+		return fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, other.Currency)
+	}
+	return nil
+}
+
+func (m Money) Add(other Money) (Money, error) {
+	if err := m.sameCurrency(other); err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: m.Amount.Add(other.Amount), Currency: m.Currency}, nil
+}
+
+func (m Money) Sub(other Money) (Money, error) {
+	if err := m.sameCurrency(other); err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: m.Amount.Sub(other.Amount), Currency: m.Currency}, nil
+}
+
+// Cmp compares two amounts in the same currency and returns -1, 0 or +1.
+func (m Money) Cmp(other Money) (int, error) {
+	if err := m.sameCurrency(other); err != nil {
+		return 0, err
+	}
+	return m.Amount.Cmp(other.Amount), nil
+}
+
+// Round rounds the amount to the given number of decimal places with the default
+// rounding mode.
+func (m Money) Round(places int32) Money {
+	return Money{Amount: m.Amount.Round(places, DefaultRounding), Currency: m.Currency}
+}
+
+// Convert converts m into another currency at rate units of currency per unit of
+// m, rounding the result to the given number of decimal places.
+func (m Money) Convert(rate Amount, currency string, places int32) Money {
+	return Money{Amount: m.Amount.Mul(rate).Round(places, DefaultRounding), Currency: currency}
+}
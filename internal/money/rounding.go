@@ -0,0 +1,98 @@
+package money
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// RoundingMode decides what happens to the digits dropped when an amount is
+// rounded or divided.
+type RoundingMode int
+
+const (
+	// HalfEven rounds to the nearest neighbour, and ties to the even one. Also known as
+	// banker's rounding, it doesn't drift up or down over many roundings.
+	HalfEven RoundingMode = iota
+	// HalfUp rounds to the nearest neighbour, and ties away from zero.
+	HalfUp
+	// HalfDown rounds to the nearest neighbour, and ties towards zero.
+	HalfDown
+	// Down truncates towards zero.
+	Down
+	// Up rounds away from zero.
+	Up
+	// Floor rounds towards negative infinity.
+	Floor
+	// Ceiling rounds towards positive infinity.
+	Ceiling
+)
+
+// DefaultRounding is the rounding mode used wherever the caller doesn't pick one.
+// It is set once at startup from the -money-rounding flag.
+var DefaultRounding = HalfEven
+
+var roundingModes = map[string]RoundingMode{
+	"half_even": HalfEven,
+	"half_up":   HalfUp,
+	"half_down": HalfDown,
+	"down":      Down,
+	"up":        Up,
+	"floor":     Floor,
+	"ceiling":   Ceiling,
+}
+
+// ParseRoundingMode returns the rounding mode for a name such as "half_even".
+func ParseRoundingMode(name string) (RoundingMode, error) {
+	mode, ok := roundingModes[name]
+	if !ok {
+		return HalfEven, fmt.Errorf("money: unknown rounding mode %q", name)
+	}
+	return mode, nil
+}
+
+func (mode RoundingMode) String() string {
+	for name, m := range roundingModes {
+		if m == mode {
+			return name
+		}
+	}
+	return fmt.Sprintf("RoundingMode(%d)", int(mode))
+}
+
+// divRound divides numerator by denominator, rounding the quotient with mode.
+func divRound(numerator, denominator *big.Int, mode RoundingMode) *big.Int {
+	quotient, remainder := new(big.Int).QuoRem(numerator, denominator, new(big.Int))
+	if remainder.Sign() == 0 {
+		return quotient
+	}
+
+	// QuoRem truncates towards zero, so rounding is a matter of whether to step one
+	// further away from zero, in the direction of the true result.
+	sign := numerator.Sign() * denominator.Sign()
+	half := new(big.Int).Abs(remainder)
+	half.Lsh(half, 1)
+	half = big.NewInt(int64(half.CmpAbs(denominator)))
+
+	var away bool
+	switch mode {
+	case HalfEven:
+		away = half.Sign() > 0 || (half.Sign() == 0 && quotient.Bit(0) == 1)
+	case HalfUp:
+		away = half.Sign() >= 0
+	case HalfDown:
+		away = half.Sign() > 0
+	case Down:
+		away = false
+	case Up:
+		away = true
+	case Floor:
+		away = sign < 0
+	case Ceiling:
+		away = sign > 0
+	}
+
+	if away {
+		quotient.Add(quotient, big.NewInt(int64(sign)))
+	}
+	return quotient
+}
@@ -0,0 +1,184 @@
+// notify fans out Postgres notifications to the subscribers in this instance, so
+// that a change committed through any instance reaches the clients connected to
+// every one of them. A notification only wakes subscribers up, they read what
+// changed from the database, which is also where they catch up on what they may
+// have missed while the connection to Postgres was down.
+package notify
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Subscription receives a value on C whenever there may be something new for it.
+// Wake-ups are coalesced, a subscriber that is busy gets a single one once it is
+// ready. C is closed when the hub closes.
+type Subscription struct {
+	C <-chan struct{}
+
+	c       chan struct{}
+	hub     *Hub
+	channel string
+	key     string
+}
+
+// Close stops the subscription.
+func (subscription *Subscription) Close() {
+	subscription.hub.unsubscribe(subscription)
+}
+
+func (subscription *Subscription) wake() {
+	select {
+	case subscription.c <- struct{}{}:
+	default:
+	}
+}
+
+// Hub listens on Postgres channels for the subscriptions made to it.
+type Hub struct {
+	listener *pq.Listener
+
+	mu     sync.Mutex
+	closed bool
+	// subscriptions by channel then key
+	subscriptions map[string]map[string]map[*Subscription]struct{}
+}
+
+// New returns a hub listening on channels through its own connection to the
+// database at dsn. onError is told about problems with the connection, which the
+// hub keeps reconnecting.
+func New(dsn string, onError func(error), channels ...string) (*Hub, error) {
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	})
+
+	for _, channel := range channels {
+		if err := listener.Listen(channel); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	return &Hub{
+		listener:      listener,
+		subscriptions: map[string]map[string]map[*Subscription]struct{}{},
+	}, nil
+}
+
+// Subscribe subscribes to the notifications on channel whose payload is key, or to
+// all of them with an empty key.
+func (hub *Hub) Subscribe(channel, key string) *Subscription {
+	c := make(chan struct{}, 1)
+	subscription := &Subscription{C: c, c: c, hub: hub, channel: channel, key: key}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if hub.closed {
+		close(c)
+		return subscription
+	}
+	if hub.subscriptions[channel] == nil {
+		hub.subscriptions[channel] = map[string]map[*Subscription]struct{}{}
+	}
+	if hub.subscriptions[channel][key] == nil {
+		hub.subscriptions[channel][key] = map[*Subscription]struct{}{}
+	}
+	hub.subscriptions[channel][key][subscription] = struct{}{}
+	return subscription
+}
+
+func (hub *Hub) unsubscribe(subscription *Subscription) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	subscriptions := hub.subscriptions[subscription.channel][subscription.key]
+	if _, ok := subscriptions[subscription]; ok {
+		delete(subscriptions, subscription)
+		if len(subscriptions) == 0 {
+			delete(hub.subscriptions[subscription.channel], subscription.key)
+		}
+		close(subscription.c)
+	}
+}
+
+// Run wakes up subscribers as notifications come in until ctx is cancelled, then
+// closes the hub.
+func (hub *Hub) Run(ctx context.Context) {
+	defer hub.Close()
+
+	// ping the connection now and then, so that a connection that died quietly is
+	// noticed and re-established
+	ticker := time.NewTicker(90 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			go hub.listener.Ping()
+		case notification, ok := <-hub.listener.Notify:
+			if !ok {
+				return
+			}
+			hub.dispatch(notification)
+		}
+	}
+}
+
+// dispatch wakes up the subscribers to a notification. A nil notification means
+// the connection was re-established and notifications may have been missed, so
+// every subscriber is woken up to check.
+func (hub *Hub) dispatch(notification *pq.Notification) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if notification == nil {
+		for _, keys := range hub.subscriptions {
+			for _, subscriptions := range keys {
+				for subscription := range subscriptions {
+					subscription.wake()
+				}
+			}
+		}
+		return
+	}
+
+	keys := hub.subscriptions[notification.Channel]
+	for subscription := range keys[notification.Extra] {
+		subscription.wake()
+	}
+	if notification.Extra != "" {
+		for subscription := range keys[""] {
+			subscription.wake()
+		}
+	}
+}
+
+// Close closes every subscription and the connection to the database. It is safe
+// to call more than once.
+func (hub *Hub) Close() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if hub.closed {
+		return
+	}
+	hub.closed = true
+
+	for _, keys := range hub.subscriptions {
+		for _, subscriptions := range keys {
+			for subscription := range subscriptions {
+				close(subscription.c)
+			}
+		}
+	}
+	hub.subscriptions = map[string]map[string]map[*Subscription]struct{}{}
+	hub.listener.Close()
+}
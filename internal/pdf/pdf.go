@@ -0,0 +1,218 @@
+// pdf is a small pure Go PDF writer, enough for simple text documents such as
+// statements. Pages are written to the output as soon as the next one is started,
+// so documents of any length are produced with only one page held in memory.
+//
+// Text is set in the built-in Courier fonts, which every PDF reader has and which
+// need no embedding. Courier is monospaced, every character is 600/1000 of the font
+// size wide, which keeps measuring and right aligning text trivial.
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// A4 portrait page size in points.
+const (
+	PageWidth  = 595.0
+	PageHeight = 842.0
+)
+
+const charWidth = 0.6
+
+// Document writes a PDF document to an io.Writer page by page.
+type Document struct {
+	out     *countingWriter
+	offsets map[int]int64
+	nextID  int
+	pageIDs []int
+	page    *bytes.Buffer
+	err     error
+}
+
+// object ids reserved at the start of every document.
+const (
+	catalogID = 1
+	pagesID   = 2
+	fontID    = 3
+	boldID    = 4
+)
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// New starts a document on the writer with its first page open.
+func New(w io.Writer) *Document {
+	doc := &Document{
+		out:     &countingWriter{w: w},
+		offsets: make(map[int]int64),
+		nextID:  boldID + 1,
+	}
+
+	doc.write("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	doc.object(catalogID, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pagesID))
+	doc.object(fontID, "<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>")
+	doc.object(boldID, "<< /Type /Font /Subtype /Type1 /BaseFont /Courier-Bold /Encoding /WinAnsiEncoding >>")
+	doc.page = &bytes.Buffer{}
+
+	return doc
+}
+
+// TextWidth returns the width in points of text set at the given font size.
+func TextWidth(text string, size float64) float64 {
+	return float64(utf8.RuneCountInString(text)) * size * charWidth
+}
+
+// Encodable reports whether every character of text can be shown with the
+// document fonts, which use the Windows-1252 character set.
+func Encodable(text string) bool {
+	for _, r := range text {
+		if _, ok := winAnsi(r); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Text sets text with its baseline starting at x, y measured in points from the
+// bottom left corner of the page. Characters outside of Windows-1252 print as "?".
+func (doc *Document) Text(x, y, size float64, bold bool, text string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(doc.page, "BT /%s %.2f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, y, escape(text))
+}
+
+// TextRight sets text so that it ends at x.
+func (doc *Document) TextRight(x, y, size float64, bold bool, text string) {
+	doc.Text(x-TextWidth(text, size), y, size, bold, text)
+}
+
+// Line draws a thin line from x1, y1 to x2, y2.
+func (doc *Document) Line(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(doc.page, "0.5 w %.2f %.2f m %.2f %.2f l S\n", x1, y1, x2, y2)
+}
+
+// NewPage writes out the current page and starts a new one.
+func (doc *Document) NewPage() error {
+	doc.flushPage()
+	doc.page = &bytes.Buffer{}
+	return doc.err
+}
+
+// Close writes out the last page and the document trailer. It does not close the
+// underlying writer.
+func (doc *Document) Close() error {
+	doc.flushPage()
+	doc.page = nil
+
+	kids := make([]string, len(doc.pageIDs))
+	for i, id := range doc.pageIDs {
+		kids[i] = fmt.Sprintf("%d 0 R", id)
+	}
+	doc.object(pagesID, fmt.Sprintf(
+		"<< /Type /Pages /Kids [%s] /Count %d /MediaBox [0 0 %.0f %.0f] >>",
+		strings.Join(kids, " "), len(doc.pageIDs), PageWidth, PageHeight,
+	))
+
+	// the cross-reference table lists the byte offset of every object by id.
+	xrefOffset := doc.out.n
+	doc.write(fmt.Sprintf("xref\n0 %d\n0000000000 65535 f \n", doc.nextID))
+	for id := 1; id < doc.nextID; id++ {
+		doc.write(fmt.Sprintf("%010d 00000 n \n", doc.offsets[id]))
+	}
+	doc.write(fmt.Sprintf(
+		"trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		doc.nextID, catalogID, xrefOffset,
+	))
+
+	return doc.err
+}
+
+func (doc *Document) flushPage() {
+	if doc.page == nil {
+		return
+	}
+
+	contentID := doc.reserve()
+	doc.object(contentID, fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", doc.page.Len(), doc.page.Bytes()))
+
+	pageID := doc.reserve()
+	doc.object(pageID, fmt.Sprintf(
+		"<< /Type /Page /Parent %d 0 R /Resources << /Font << /F1 %d 0 R /F2 %d 0 R >> >> /Contents %d 0 R >>",
+		pagesID, fontID, boldID, contentID,
+	))
+	doc.pageIDs = append(doc.pageIDs, pageID)
+}
+
+func (doc *Document) reserve() int {
+	id := doc.nextID
+	doc.nextID++
+	return id
+}
+
+func (doc *Document) object(id int, body string) {
+	doc.offsets[id] = doc.out.n
+	doc.write(fmt.Sprintf("%d 0 obj\n%s\nendobj\n", id, body))
+}
+
+// write keeps the first error, later writes become no-ops.
+func (doc *Document) write(s string) {
+	if doc.err != nil {
+		return
+	}
+	_, doc.err = io.WriteString(doc.out, s)
+}
+
+// escape encodes text as the contents of a PDF literal string in Windows-1252.
+func escape(text string) string {
+	var builder strings.Builder
+	for _, r := range text {
+		b, ok := winAnsi(r)
+		if !ok {
+			b = '?'
+		}
+		switch b {
+		case '(', ')', '\\':
+			builder.WriteByte('\\')
+			builder.WriteByte(b)
+		default:
+			if b < 32 || b > 126 {
+				fmt.Fprintf(&builder, "\\%03o", b)
+			} else {
+				builder.WriteByte(b)
+			}
+		}
+	}
+	return builder.String()
+}
+
+// winAnsiExtras maps the characters Windows-1252 places in 0x80 to 0x9F.
+var winAnsiExtras = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87,
+	'ˆ': 0x88, '‰': 0x89, 'Š': 0x8A, '‹': 0x8B, 'Œ': 0x8C, 'Ž': 0x8E, '‘': 0x91,
+	'’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '˜': 0x98,
+	'™': 0x99, 'š': 0x9A, '›': 0x9B, 'œ': 0x9C, 'ž': 0x9E, 'Ÿ': 0x9F,
+}
+
+func winAnsi(r rune) (byte, bool) {
+	switch {
+	case r >= 32 && r <= 126, r >= 0xA0 && r <= 0xFF:
+		return byte(r), true
+	default:
+		b, ok := winAnsiExtras[r]
+		return b, ok
+	}
+}
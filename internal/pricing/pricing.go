@@ -0,0 +1,155 @@
+// pricing works out the fees charged on a movement of money from the fee rules that
+// apply to it, before anything is posted, so that the same breakdown can be shown
+// to the user and then charged.
+package pricing
+
+import (
+	"github.com/thesambayo/digillets-api/internal/money"
+)
+
+// Fee kinds.
+const (
+	// KindFlat charges a fixed amount.
+	KindFlat = "flat"
+	// KindPercentage charges a percentage of the amount.
+	KindPercentage = "percentage"
+	// KindTiered charges the flat amount and percentage of the band the amount falls in.
+	KindTiered = "tiered"
+)
+
+// Breakdown component names.
+const (
+	ComponentFlat       = "flat"
+	ComponentPercentage = "percentage"
+	ComponentMinimumFee = "minimum_fee"
+	ComponentMaximumFee = "maximum_fee"
+)
+
+var hundred = money.New(100, 0)
+
+// Tier is a band of a tiered rule, covering amounts up to and including UpTo. The
+// last band has no UpTo and covers everything above the others.
+type Tier struct {
+	UpTo       *money.Amount `json:"up_to"`
+	Flat       money.Amount  `json:"flat"`
+	Percentage money.Amount  `json:"percentage"`
+}
+
+// Rule is a fee rule for a transaction type in a currency. A rule without a user
+// tier applies to every tier that has no rule of its own.
+type Rule struct {
+	ID              int64         `json:"id"`
+	TransactionType string        `json:"transaction_type"`
+	Currency        string        `json:"currency"`
+	UserTier        *int          `json:"user_tier"`
+	Kind            string        `json:"kind"`
+	Flat            money.Amount  `json:"flat"`
+	Percentage      money.Amount  `json:"percentage"` // e.g 1.5 for 1.5%
+	Tiers           []Tier        `json:"tiers,omitempty"`
+	MinFee          *money.Amount `json:"min_fee"`
+	MaxFee          *money.Amount `json:"max_fee"`
+}
+
+// Component is a line of a fee breakdown. Cap adjustments are components too, so
+// the components always add up to the total fee.
+type Component struct {
+	Name   string        `json:"name"`
+	Rate   *money.Amount `json:"rate,omitempty"`
+	Amount money.Amount  `json:"amount"`
+}
+
+// Quote is the fee for an amount and how it was arrived at.
+type Quote struct {
+	Amount     money.Amount `json:"amount"`
+	Currency   string       `json:"currency"`
+	RuleID     int64        `json:"rule_id,omitempty"`
+	Breakdown  []Component  `json:"breakdown"`
+	Fee        money.Amount `json:"fee"`
+	TotalDebit money.Amount `json:"total_debit"`
+}
+
+// Match returns the rule for a transaction type, currency and user tier: the rule for
+// exactly that tier if there is one, otherwise the one for every tier. It returns nil
+// when no rule applies, which means the movement is free.
+func Match(rules []Rule, transactionType, currency string, userTier int) *Rule {
+	var fallback *Rule
+	for i := range rules {
+		rule := &rules[i]
+		if rule.TransactionType != transactionType || rule.Currency != currency {
+			continue
+		}
+		switch {
+		case rule.UserTier == nil:
+			fallback = rule
+		case *rule.UserTier == userTier:
+			return rule
+		}
+	}
+	return fallback
+}
+
+// Price quotes the fee of a rule for an amount in a currency with the given minor
+// units. Each component and the total are rounded to the minor units with the
+// default rounding mode, and the caps are applied to the total. A nil rule quotes a
+// zero fee.
+func Price(rule *Rule, amount money.Amount, currency string, minorUnits int32) Quote {
+	quote := Quote{
+		Amount:    amount.Round(minorUnits, money.DefaultRounding),
+		Currency:  currency,
+		Breakdown: []Component{},
+		Fee:       money.Zero.Round(minorUnits, money.DefaultRounding),
+	}
+
+	if rule != nil {
+		quote.RuleID = rule.ID
+
+		flat, percentage := rule.Flat, rule.Percentage
+		switch rule.Kind {
+		case KindFlat:
+			percentage = money.Zero
+		case KindPercentage:
+			flat = money.Zero
+		case KindTiered:
+			tier := rule.tierFor(amount)
+			flat, percentage = tier.Flat, tier.Percentage
+		}
+
+		if !flat.IsZero() {
+			quote.add(Component{Name: ComponentFlat, Amount: flat.Round(minorUnits, money.DefaultRounding)})
+		}
+		if !percentage.IsZero() {
+			rate := percentage
+			fee := amount.Mul(percentage).Div(hundred, minorUnits, money.DefaultRounding)
+			quote.add(Component{Name: ComponentPercentage, Rate: &rate, Amount: fee})
+		}
+
+		if rule.MinFee != nil && quote.Fee.Cmp(*rule.MinFee) < 0 {
+			quote.add(Component{Name: ComponentMinimumFee, Amount: rule.MinFee.Sub(quote.Fee).Round(minorUnits, money.DefaultRounding)})
+		}
+		if rule.MaxFee != nil && quote.Fee.Cmp(*rule.MaxFee) > 0 {
+			quote.add(Component{Name: ComponentMaximumFee, Amount: rule.MaxFee.Sub(quote.Fee).Round(minorUnits, money.DefaultRounding)})
+		}
+	}
+
+	quote.TotalDebit = quote.Amount.Add(quote.Fee)
+	return quote
+}
+
+func (quote *Quote) add(component Component) {
+	quote.Breakdown = append(quote.Breakdown, component)
+	quote.Fee = quote.Fee.Add(component.Amount)
+}
+
+// tierFor returns the band an amount falls in. Bands are expected in ascending order
+// of UpTo, an amount above every band falls in the last one.
+func (rule *Rule) tierFor(amount money.Amount) Tier {
+	if len(rule.Tiers) == 0 {
+		return Tier{}
+	}
+	for _, tier := range rule.Tiers {
+		if tier.UpTo == nil || amount.Cmp(*tier.UpTo) <= 0 {
+			return tier
+		}
+	}
+	return rule.Tiers[len(rule.Tiers)-1]
+}
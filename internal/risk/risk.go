@@ -0,0 +1,203 @@
+// risk decides whether a debit may go ahead by running the risk rules against it
+// and the history of the user making it. Every rule that fires asks for the debit to
+// be reviewed or blocked, and the strictest of them wins.
+package risk
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/money"
+)
+
+// Rule kinds.
+const (
+	// KindVelocity fires when the user has made Count or more debits in the last
+	// WindowMinutes.
+	KindVelocity = "velocity"
+	// KindAmountAnomaly fires when the amount is over Multiplier times the average
+	// of the user's debits in the currency, once they have made at least Count.
+	KindAmountAnomaly = "amount_anomaly"
+	// KindNewDevice fires when the debit comes from a device the user has not used
+	// before and is at least Threshold.
+	KindNewDevice = "new_device"
+	// KindNewBeneficiary fires when the user has never paid the beneficiary before
+	// and the debit is at least Threshold.
+	KindNewBeneficiary = "new_beneficiary"
+	// KindRapidInOut fires when the debit takes Ratio or more of the money credited
+	// to the wallet in the last WindowMinutes straight back out.
+	KindRapidInOut = "rapid_in_out"
+	// KindWatchlist fires when the user or the beneficiary is on a watchlist, e.g a
+	// potential sanctions match.
+	KindWatchlist = "watchlist"
+)
+
+// Outcomes, from the least to the most strict.
+const (
+	OutcomeAllow  = "allow"
+	OutcomeReview = "review"
+	OutcomeBlock  = "block"
+)
+
+// HistoryDays is how far back the average debit of a user is taken over.
+const HistoryDays = 90
+
+var severity = map[string]int{OutcomeAllow: 0, OutcomeReview: 1, OutcomeBlock: 2}
+
+// Rule is a risk rule and the outcome it asks for when it fires. Thresholds are in
+// the base currency, so that one rule covers every currency; the parameters a kind
+// does not use are ignored.
+type Rule struct {
+	ID            int64         `json:"id"`
+	Name          string        `json:"name"`
+	Kind          string        `json:"kind"`
+	Action        string        `json:"action"`
+	Threshold     *money.Amount `json:"threshold"`
+	Count         int           `json:"count"`
+	WindowMinutes int           `json:"window_minutes"`
+	Multiplier    *money.Amount `json:"multiplier"`
+	Ratio         *money.Amount `json:"ratio"`
+}
+
+// Debit is a movement of money out of a customer wallet, as the rules see it.
+// BaseAmount is the amount converted to the base currency. Beneficiary is empty
+// when the money goes to another wallet of the same user. Watchlist describes the
+// watchlist hits on the parties, if any.
+type Debit struct {
+	Amount      money.Amount
+	Currency    string
+	BaseAmount  money.Amount
+	Device      string
+	Beneficiary string
+	Watchlist   []string
+}
+
+// History answers the questions the rules ask about the user making a debit.
+type History interface {
+	// DebitsSince counts the debits the user has made since a time.
+	DebitsSince(since time.Time) (int, error)
+	// AverageDebit returns how many debits the user has made in the currency since a
+	// time and their average amount.
+	AverageDebit(since time.Time) (int, money.Amount, error)
+	// DeviceSeen reports whether the user has made a debit from the device before.
+	DeviceSeen() (bool, error)
+	// BeneficiarySeen reports whether the user has paid the beneficiary before.
+	BeneficiarySeen() (bool, error)
+	// CreditsSince sums the credits to the wallet since a time.
+	CreditsSince(since time.Time) (money.Amount, error)
+}
+
+// Fired is a rule that fired, with what made it fire.
+type Fired struct {
+	RuleID int64  `json:"rule_id"`
+	Name   string `json:"name"`
+	Kind   string `json:"kind"`
+	Action string `json:"action"`
+	Detail string `json:"detail"`
+}
+
+// Decision is the outcome of running the rules on a debit.
+type Decision struct {
+	Outcome string  `json:"outcome"`
+	Fired   []Fired `json:"fired"`
+}
+
+// Evaluate runs every rule against a debit made at now and decides its outcome.
+func Evaluate(rules []Rule, debit Debit, history History, now time.Time) (Decision, error) {
+	decision := Decision{Outcome: OutcomeAllow, Fired: []Fired{}}
+
+	for _, rule := range rules {
+		detail, fired, err := rule.check(debit, history, now)
+		if err != nil {
+			return Decision{}, err
+		}
+		if !fired {
+			continue
+		}
+
+		decision.Fired = append(decision.Fired, Fired{
+			RuleID: rule.ID,
+			Name:   rule.Name,
+			Kind:   rule.Kind,
+			Action: rule.Action,
+			Detail: detail,
+		})
+		if severity[rule.Action] > severity[decision.Outcome] {
+			decision.Outcome = rule.Action
+		}
+	}
+
+	return decision, nil
+}
+
+// check reports whether a rule fires on a debit, and why.
+func (rule Rule) check(debit Debit, history History, now time.Time) (string, bool, error) {
+	// a rule with a threshold only looks at debits of at least that much
+	if rule.Threshold != nil && debit.BaseAmount.Cmp(*rule.Threshold) < 0 {
+		return "", false, nil
+	}
+	window := now.Add(-time.Duration(rule.WindowMinutes) * time.Minute)
+
+	switch rule.Kind {
+	case KindVelocity:
+		count, err := history.DebitsSince(window)
+		if err != nil {
+			return "", false, err
+		}
+		// the debit being checked is the next one
+		count++
+		detail := fmt.Sprintf("%d debits in the last %d minutes", count, rule.WindowMinutes)
+		return detail, count >= rule.Count, nil
+
+	case KindAmountAnomaly:
+		if rule.Multiplier == nil {
+			return "", false, nil
+		}
+		count, average, err := history.AverageDebit(now.AddDate(0, 0, -HistoryDays))
+		if err != nil {
+			return "", false, err
+		}
+		if count < rule.Count || !average.IsPositive() {
+			return "", false, nil
+		}
+		detail := fmt.Sprintf("%s %s is over %s times the average debit of %s %s", debit.Amount, debit.Currency, rule.Multiplier, average.Round(2, money.DefaultRounding), debit.Currency)
+		return detail, debit.Amount.Cmp(average.Mul(*rule.Multiplier)) > 0, nil
+
+	case KindNewDevice:
+		seen, err := history.DeviceSeen()
+		if err != nil {
+			return "", false, err
+		}
+		return fmt.Sprintf("%s %s from a new device", debit.Amount, debit.Currency), !seen, nil
+
+	case KindNewBeneficiary:
+		if debit.Beneficiary == "" {
+			return "", false, nil
+		}
+		seen, err := history.BeneficiarySeen()
+		if err != nil {
+			return "", false, err
+		}
+		return fmt.Sprintf("%s %s to new beneficiary %s", debit.Amount, debit.Currency, debit.Beneficiary), !seen, nil
+
+	case KindRapidInOut:
+		if rule.Ratio == nil {
+			return "", false, nil
+		}
+		credits, err := history.CreditsSince(window)
+		if err != nil {
+			return "", false, err
+		}
+		if !credits.IsPositive() {
+			return "", false, nil
+		}
+		detail := fmt.Sprintf("%s %s out of %s %s credited in the last %d minutes", debit.Amount, debit.Currency, credits, debit.Currency, rule.WindowMinutes)
+		return detail, debit.Amount.Cmp(credits.Mul(*rule.Ratio)) >= 0, nil
+
+	case KindWatchlist:
+		return strings.Join(debit.Watchlist, "; "), len(debit.Watchlist) > 0, nil
+	}
+
+	return "", false, nil
+}
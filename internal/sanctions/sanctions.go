@@ -0,0 +1,386 @@
+// sanctions screens names against a sanctions list kept in a local file in the OFAC
+// SDN format, either the sdn.csv or the sdn.xml export. Names are matched fuzzily:
+// both sides are normalized into lower case ascii tokens, and scored with
+// Jaro-Winkler on the whole name and token by token, so that word order, accents
+// and small spelling differences do not hide a match.
+package sanctions
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// ErrUnknownFormat is returned for a list file that is neither .csv nor .xml.
+var ErrUnknownFormat = errors.New("sanctions list must be a .csv or .xml file")
+
+// Entry is a sanctioned party with the names it is known by.
+type Entry struct {
+	UID      string   `json:"uid"`
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Programs []string `json:"programs"`
+	Aliases  []string `json:"aliases,omitempty"`
+}
+
+// Match is a potential match of a screened name with an entry.
+type Match struct {
+	Entry       Entry   `json:"entry"`
+	MatchedName string  `json:"matched_name"`
+	Score       float64 `json:"score"`
+}
+
+// Status describes the list a screener has loaded.
+type Status struct {
+	Path     string     `json:"path"`
+	Entries  int        `json:"entries"`
+	LoadedAt *time.Time `json:"loaded_at"`
+}
+
+// name is a name of an entry, normalized for matching.
+type name struct {
+	entry  int
+	raw    string
+	tokens []string
+	joined string
+}
+
+// Screener screens names against the list loaded from a file. The list can be
+// reloaded from the file while it is in use.
+type Screener struct {
+	path      string
+	threshold float64
+
+	mu       sync.RWMutex
+	entries  []Entry
+	names    []name
+	loadedAt *time.Time
+}
+
+// NewScreener returns a screener reporting matches scoring at least threshold,
+// between 0 and 1, and loads the list at path. Without a path it has an empty list
+// and matches nothing.
+func NewScreener(path string, threshold float64) (*Screener, error) {
+	screener := &Screener{path: path, threshold: threshold}
+	if path == "" {
+		return screener, nil
+	}
+	if _, err := screener.Reload(); err != nil {
+		return nil, err
+	}
+	return screener, nil
+}
+
+// Reload reads the list from the file again and swaps it in, returning the number of
+// entries. The old list stays in use if the file cannot be read.
+func (screener *Screener) Reload() (int, error) {
+	if screener.path == "" {
+		return 0, nil
+	}
+
+	entries, err := LoadFile(screener.path)
+	if err != nil {
+		return 0, err
+	}
+
+	var names []name
+	for i, entry := range entries {
+		for _, raw := range append([]string{entry.Name}, entry.Aliases...) {
+			tokens := Tokens(raw)
+			if len(tokens) == 0 {
+				continue
+			}
+			names = append(names, name{entry: i, raw: raw, tokens: tokens, joined: strings.Join(tokens, " ")})
+		}
+	}
+	now := time.Now()
+
+	screener.mu.Lock()
+	defer screener.mu.Unlock()
+	screener.entries, screener.names, screener.loadedAt = entries, names, &now
+
+	return len(entries), nil
+}
+
+func (screener *Screener) Status() Status {
+	screener.mu.RLock()
+	defer screener.mu.RUnlock()
+	return Status{Path: screener.path, Entries: len(screener.entries), LoadedAt: screener.loadedAt}
+}
+
+// Screen returns the entries a name potentially matches, the best first, with the
+// best scoring of their names.
+func (screener *Screener) Screen(raw string) []Match {
+	tokens := Tokens(raw)
+	matches := []Match{}
+	if len(tokens) == 0 {
+		return matches
+	}
+	joined := strings.Join(tokens, " ")
+
+	screener.mu.RLock()
+	defer screener.mu.RUnlock()
+
+	best := map[int]Match{}
+	for _, candidate := range screener.names {
+		score := Score(tokens, joined, candidate.tokens, candidate.joined)
+		if score < screener.threshold || score <= best[candidate.entry].Score {
+			continue
+		}
+		best[candidate.entry] = Match{Entry: screener.entries[candidate.entry], MatchedName: candidate.raw, Score: score}
+	}
+
+	for _, match := range best {
+		matches = append(matches, match)
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	return matches
+}
+
+// Score scores how alike two normalized names are, from 0 to 1. It is the better of
+// Jaro-Winkler on the sorted tokens joined together, and the average of how well
+// the tokens of each name are matched by the tokens of the other.
+func Score(a []string, aJoined string, b []string, bJoined string) float64 {
+	whole := JaroWinkler(aJoined, bJoined)
+	byToken := (tokenCoverage(a, b) + tokenCoverage(b, a)) / 2
+	return max(whole, byToken)
+}
+
+// tokenCoverage averages, over the tokens of a, the best score of each against the
+// tokens of b.
+func tokenCoverage(a, b []string) float64 {
+	var total float64
+	for _, token := range a {
+		var best float64
+		for _, other := range b {
+			best = max(best, JaroWinkler(token, other))
+		}
+		total += best
+	}
+	return total / float64(len(a))
+}
+
+var folds = strings.NewReplacer(
+	"à", "a", "á", "a", "â", "a", "ã", "a", "ä", "a", "å", "a", "æ", "ae",
+	"ç", "c", "è", "e", "é", "e", "ê", "e", "ë", "e",
+	"ì", "i", "í", "i", "î", "i", "ï", "i", "ñ", "n",
+	"ò", "o", "ó", "o", "ô", "o", "õ", "o", "ö", "o", "ø", "o", "œ", "oe",
+	"ù", "u", "ú", "u", "û", "u", "ü", "u", "ý", "y", "ÿ", "y", "ß", "ss",
+	"'", "", "’", "", "`", "",
+)
+
+// Tokens normalizes a name into its words, lower cased with accents and
+// punctuation removed, and sorted so that word order does not matter.
+func Tokens(raw string) []string {
+	folded := folds.Replace(strings.ToLower(raw))
+	tokens := strings.FieldsFunc(folded, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	sort.Strings(tokens)
+	return tokens
+}
+
+// JaroWinkler returns the Jaro-Winkler similarity of two strings, from 0 to 1.
+func JaroWinkler(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	ar, br := []rune(a), []rune(b)
+	if len(ar) == 0 || len(br) == 0 {
+		return 0
+	}
+
+	window := max(len(ar), len(br))/2 - 1
+	window = max(window, 0)
+
+	aMatched := make([]bool, len(ar))
+	bMatched := make([]bool, len(br))
+	matches := 0
+	for i := range ar {
+		low, high := max(0, i-window), min(len(br), i+window+1)
+		for j := low; j < high; j++ {
+			if bMatched[j] || ar[i] != br[j] {
+				continue
+			}
+			aMatched[i], bMatched[j] = true, true
+			matches++
+			break
+		}
+	}
+	if matches == 0 {
+		return 0
+	}
+
+	transpositions := 0
+	j := 0
+	for i := range ar {
+		if !aMatched[i] {
+			continue
+		}
+		for !bMatched[j] {
+			j++
+		}
+		if ar[i] != br[j] {
+			transpositions++
+		}
+		j++
+	}
+
+	m := float64(matches)
+	jaro := (m/float64(len(ar)) + m/float64(len(br)) + (m-float64(transpositions)/2)/m) / 3
+
+	prefix := 0
+	for prefix < min(4, len(ar), len(br)) && ar[prefix] == br[prefix] {
+		prefix++
+	}
+
+	return jaro + float64(prefix)*0.1*(1-jaro)
+}
+
+// LoadFile reads a list in the OFAC SDN format, from a .csv or .xml file. Vessels
+// and aircraft are left out, only people and organisations are screened.
+func LoadFile(path string) ([]Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []Entry
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		entries, err = readCSV(file)
+	case ".xml":
+		entries, err = readXML(file)
+	default:
+		return nil, ErrUnknownFormat
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading sanctions list %s: %w", path, err)
+	}
+
+	screened := entries[:0]
+	for _, entry := range entries {
+		if entry.Type == "vessel" || entry.Type == "aircraft" {
+			continue
+		}
+		screened = append(screened, entry)
+	}
+	return screened, nil
+}
+
+var akaRX = regexp.MustCompile(`a\.k\.a\. '([^']+)'`)
+
+// readCSV reads the sdn.csv export: ent_num, SDN_Name, SDN_Type, Program, Title,
+// Call_Sign, Vess_type, Tonnage, GRT, Vess_flag, Vess_owner, Remarks, without a
+// header and with -0- for empty fields. Aliases are taken from the remarks.
+func readCSV(reader io.Reader) ([]Entry, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+	csvReader.LazyQuotes = true
+
+	field := func(record []string, i int) string {
+		if i >= len(record) {
+			return ""
+		}
+		value := strings.TrimSpace(record[i])
+		if value == "-0-" {
+			return ""
+		}
+		return value
+	}
+
+	var entries []Entry
+	for {
+		record, err := csvReader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if field(record, 0) == "" || strings.EqualFold(field(record, 0), "ent_num") || field(record, 1) == "" {
+			continue
+		}
+
+		entry := Entry{
+			UID:      field(record, 0),
+			Name:     field(record, 1),
+			Type:     strings.ToLower(field(record, 2)),
+			Programs: splitPrograms(field(record, 3)),
+		}
+		// the csv leaves the type of organisations empty
+		if entry.Type == "" {
+			entry.Type = "entity"
+		}
+		for _, aka := range akaRX.FindAllStringSubmatch(field(record, 11), -1) {
+			entry.Aliases = append(entry.Aliases, aka[1])
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// splitPrograms splits the programs of a csv entry, e.g "SDGT] [IRGC".
+func splitPrograms(programs string) []string {
+	var split []string
+	for _, program := range strings.Split(programs, "] [") {
+		if program = strings.Trim(program, "[] "); program != "" {
+			split = append(split, program)
+		}
+	}
+	return split
+}
+
+type xmlName struct {
+	FirstName string `xml:"firstName"`
+	LastName  string `xml:"lastName"`
+}
+
+func (name xmlName) String() string {
+	if name.FirstName == "" {
+		return strings.TrimSpace(name.LastName)
+	}
+	return strings.TrimSpace(name.LastName + ", " + name.FirstName)
+}
+
+// readXML reads the sdn.xml export.
+func readXML(reader io.Reader) ([]Entry, error) {
+	var list struct {
+		Entries []struct {
+			UID string `xml:"uid"`
+			xmlName
+			SDNType  string    `xml:"sdnType"`
+			Programs []string  `xml:"programList>program"`
+			Akas     []xmlName `xml:"akaList>aka"`
+		} `xml:"sdnEntry"`
+	}
+	if err := xml.NewDecoder(reader).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(list.Entries))
+	for _, sdn := range list.Entries {
+		entry := Entry{
+			UID:      sdn.UID,
+			Name:     sdn.xmlName.String(),
+			Type:     strings.ToLower(sdn.SDNType),
+			Programs: sdn.Programs,
+		}
+		for _, aka := range sdn.Akas {
+			entry.Aliases = append(entry.Aliases, aka.String())
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,267 @@
+// settlement reads the settlement files payment providers send, listing the
+// deposits and withdrawals they settled, so that they can be reconciled with our
+// own records of them. A file is a csv with a header row naming at least the
+// reference, type, amount and currency columns, in any order, and optionally
+// settled_at; other columns are ignored.
+package settlement
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/money"
+)
+
+// Line types.
+const (
+	TypeDeposit    = "deposit"
+	TypeWithdrawal = "withdrawal"
+)
+
+var requiredColumns = []string{"reference", "type", "amount", "currency"}
+
+// Line is a deposit or withdrawal the provider settled. Reference is the reference
+// it was made with, which our ledger transaction carries too.
+type Line struct {
+	Row       int          `json:"row"`
+	Reference string       `json:"reference"`
+	Type      string       `json:"type"`
+	Amount    money.Amount `json:"amount"`
+	Currency  string       `json:"currency"`
+	SettledAt *time.Time   `json:"settled_at,omitempty"`
+}
+
+// LoadFile reads the settlement file at path.
+func LoadFile(path string) ([]Line, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines, err := ReadCSV(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading settlement file %s: %w", path, err)
+	}
+	return lines, nil
+}
+
+// ReadCSV reads a settlement file. Amounts are positive whatever the type, and
+// settled_at is either a RFC 3339 time or a date.
+func ReadCSV(reader io.Reader) ([]Line, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+	csvReader.TrimLeadingSpace = true
+
+	header, err := csvReader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("missing header row")
+		}
+		return nil, err
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range requiredColumns {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing %s column", name)
+		}
+	}
+
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var lines []Line
+	for row := 2; ; row++ {
+		record, err := csvReader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+
+		line := Line{
+			Row:       row,
+			Reference: field(record, "reference"),
+			Type:      strings.ToLower(field(record, "type")),
+			Currency:  strings.ToUpper(field(record, "currency")),
+		}
+		if line.Reference == "" {
+			return nil, fmt.Errorf("row %d: missing reference", row)
+		}
+		if line.Type != TypeDeposit && line.Type != TypeWithdrawal {
+			return nil, fmt.Errorf("row %d: type must be %s or %s", row, TypeDeposit, TypeWithdrawal)
+		}
+		if len(line.Currency) != 3 {
+			return nil, fmt.Errorf("row %d: invalid currency %q", row, line.Currency)
+		}
+		line.Amount, err = money.Parse(field(record, "amount"))
+		if err != nil || !line.Amount.IsPositive() {
+			return nil, fmt.Errorf("row %d: invalid amount %q", row, field(record, "amount"))
+		}
+		if settledAt := field(record, "settled_at"); settledAt != "" {
+			line.SettledAt, err = parseTime(settledAt)
+			if err != nil {
+				return nil, fmt.Errorf("row %d: invalid settled_at %q", row, settledAt)
+			}
+		}
+
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+func parseTime(value string) (*time.Time, error) {
+	for _, layout := range []string{time.RFC3339, time.DateTime, time.DateOnly} {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return &parsed, nil
+		}
+	}
+	return nil, errors.New("invalid time")
+}
+
+// Kinds of differences between a settlement file and our records.
+const (
+	// KindUnmatched is a line of the file we have no record of.
+	KindUnmatched = "settlement_unmatched"
+	// KindMissing is a record of ours the file does not settle.
+	KindMissing = "settlement_missing"
+	// KindMismatch is a line whose type, currency or amount differs from our record.
+	KindMismatch = "settlement_mismatch"
+)
+
+// Record is a deposit or withdrawal of ours, as posted to the ledger.
+type Record struct {
+	TransactionID string
+	Reference     string
+	Type          string
+	Amount        money.Amount
+	Currency      string
+}
+
+// Difference is a line of a settlement file and a record of ours that do not agree.
+// Expected is the amount the provider settled and Actual the amount we posted,
+// either is nil when there is no line or no record.
+type Difference struct {
+	Kind      string
+	Reference string
+	Currency  string
+	Expected  *money.Amount
+	Actual    *money.Amount
+	Detail    string
+}
+
+// Reconcile matches the lines of a settlement file with our records by reference
+// and returns where they differ, in the order of the lines and then of the records.
+// Records are expected to cover the period of the file, so a record no line matches
+// is reported missing from the file.
+func Reconcile(lines []Line, records []Record) []Difference {
+	byReference := make(map[string]Record, len(records))
+	for _, record := range records {
+		byReference[record.Reference] = record
+	}
+
+	differences := []Difference{}
+	matched := map[string]bool{}
+	for _, line := range lines {
+		record, ok := byReference[line.Reference]
+		switch {
+		case matched[line.Reference]:
+			differences = append(differences, Difference{
+				Kind:      KindUnmatched,
+				Reference: line.Reference,
+				Currency:  line.Currency,
+				Expected:  &line.Amount,
+				Detail:    fmt.Sprintf("row %d settles reference %s again", line.Row, line.Reference),
+			})
+			continue
+		case !ok:
+			differences = append(differences, Difference{
+				Kind:      KindUnmatched,
+				Reference: line.Reference,
+				Currency:  line.Currency,
+				Expected:  &line.Amount,
+				Detail:    fmt.Sprintf("row %d settles a %s we have no record of", line.Row, line.Type),
+			})
+			continue
+		}
+		matched[line.Reference] = true
+
+		var problems []string
+		if line.Type != record.Type {
+			problems = append(problems, fmt.Sprintf("type %s, ours is %s", line.Type, record.Type))
+		}
+		if line.Currency != record.Currency {
+			problems = append(problems, fmt.Sprintf("currency %s, ours is %s", line.Currency, record.Currency))
+		}
+		if line.Amount.Cmp(record.Amount) != 0 {
+			problems = append(problems, fmt.Sprintf("amount %s, ours is %s", line.Amount, record.Amount))
+		}
+		if len(problems) == 0 {
+			continue
+		}
+
+		actual := record.Amount
+		differences = append(differences, Difference{
+			Kind:      KindMismatch,
+			Reference: line.Reference,
+			Currency:  line.Currency,
+			Expected:  &line.Amount,
+			Actual:    &actual,
+			Detail:    fmt.Sprintf("row %d settles %s with %s", line.Row, record.TransactionID, strings.Join(problems, ", ")),
+		})
+	}
+
+	for _, record := range records {
+		if matched[record.Reference] {
+			continue
+		}
+		actual := record.Amount
+		differences = append(differences, Difference{
+			Kind:      KindMissing,
+			Reference: record.Reference,
+			Currency:  record.Currency,
+			Actual:    &actual,
+			Detail:    fmt.Sprintf("%s %s is not in the settlement file", record.Type, record.TransactionID),
+		})
+	}
+
+	return differences
+}
+
+// Period returns the days the lines of a file were settled on, from the start of
+// the first to the end of the last, or false when no line has a settlement time.
+func Period(lines []Line) (time.Time, time.Time, bool) {
+	var from, to time.Time
+	found := false
+	for _, line := range lines {
+		if line.SettledAt == nil {
+			continue
+		}
+		day := time.Date(line.SettledAt.Year(), line.SettledAt.Month(), line.SettledAt.Day(), 0, 0, 0, 0, line.SettledAt.Location())
+		if !found || day.Before(from) {
+			from = day
+		}
+		if !found || day.After(to) {
+			to = day
+		}
+		found = true
+	}
+	return from, to.AddDate(0, 0, 1), found
+}
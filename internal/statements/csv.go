@@ -0,0 +1,83 @@
+package statements
+
+import (
+	"encoding/csv"
+	"io"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/data/transactions"
+	"github.com/thesambayo/digillets-api/internal/money"
+)
+
+// csvWriter writes one row per movement between an opening and a closing balance
+// row. Amounts are plain numbers so spreadsheets can sum them, with the currency
+// code and symbol in their own columns. Rows are flushed periodically so that large
+// statements are streamed to the client.
+type csvWriter struct {
+	writer *csv.Writer
+	header Header
+	rows   int
+}
+
+func newCSVWriter(w io.Writer) *csvWriter {
+	return &csvWriter{writer: csv.NewWriter(w)}
+}
+
+func (cw *csvWriter) WriteHeader(header Header) error {
+	cw.header = header
+
+	cw.writer.Write([]string{
+		"date", "transaction_id", "type", "description", "reference",
+		"debit", "credit", "balance", "currency", "currency_symbol",
+	})
+	cw.writer.Write(cw.balanceRow(header.From, "Opening balance", header.OpeningBalance))
+	cw.writer.Flush()
+
+	return cw.writer.Error()
+}
+
+func (cw *csvWriter) WriteLine(line *transactions.StatementLine) error {
+	debit, credit := "", ""
+	if line.Amount.IsNegative() {
+		debit = plainAmount(line.Amount.Neg(), cw.header.MinorUnits)
+	} else {
+		credit = plainAmount(line.Amount, cw.header.MinorUnits)
+	}
+
+	cw.writer.Write([]string{
+		line.CreatedAt.UTC().Format(time.RFC3339),
+		line.TransactionID,
+		line.Type,
+		line.Description,
+		line.Reference,
+		debit,
+		credit,
+		plainAmount(line.Balance, cw.header.MinorUnits),
+		cw.header.CurrencyCode,
+		cw.header.CurrencySymbol,
+	})
+
+	cw.rows++
+	if cw.rows%100 == 0 {
+		cw.writer.Flush()
+	}
+
+	return cw.writer.Error()
+}
+
+func (cw *csvWriter) Close(closingBalance money.Amount) error {
+	cw.writer.Write(cw.balanceRow(cw.header.To, "Closing balance", closingBalance))
+	cw.writer.Flush()
+
+	return cw.writer.Error()
+}
+
+func (cw *csvWriter) balanceRow(at time.Time, description string, balance money.Amount) []string {
+	return []string{
+		at.UTC().Format(time.RFC3339),
+		"", "", description, "", "", "",
+		plainAmount(balance, cw.header.MinorUnits),
+		cw.header.CurrencyCode,
+		cw.header.CurrencySymbol,
+	}
+}
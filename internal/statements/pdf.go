@@ -0,0 +1,162 @@
+package statements
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/thesambayo/digillets-api/internal/data/transactions"
+	"github.com/thesambayo/digillets-api/internal/money"
+	"github.com/thesambayo/digillets-api/internal/pdf"
+)
+
+// page layout in points, the page is A4 portrait.
+const (
+	marginLeft   = 40.0
+	marginRight  = pdf.PageWidth - 40.0
+	marginTop    = pdf.PageHeight - 50.0
+	marginBottom = 50.0
+	fontSize     = 8.0
+	lineHeight   = 12.0
+
+	columnDate        = marginLeft
+	columnTransaction = 95.0
+	columnDescription = 182.0
+	columnDebitEnd    = 400.0
+	columnCreditEnd   = 475.0
+	columnBalanceEnd  = marginRight
+
+	descriptionWidth = 24 // characters
+)
+
+// pdfWriter lays the statement out as a table, starting a new page with repeated
+// column headings whenever the current one is full.
+type pdfWriter struct {
+	doc    *pdf.Document
+	header Header
+	symbol string
+	y      float64
+	page   int
+}
+
+func newPDFWriter(w io.Writer) *pdfWriter {
+	return &pdfWriter{doc: pdf.New(w)}
+}
+
+func (pw *pdfWriter) WriteHeader(header Header) error {
+	pw.header = header
+	// symbols outside of the PDF font character set (e.g ₦) fall back to the
+	// currency code.
+	pw.symbol = header.CurrencySymbol
+	if pw.symbol == "" || !pdf.Encodable(pw.symbol) {
+		pw.symbol = header.CurrencyCode + " "
+	}
+	pw.page = 1
+
+	y := marginTop
+	pw.doc.Text(marginLeft, y, 16, true, "Account Statement")
+	y -= 24
+	pw.doc.Text(marginLeft, y, 9, false, fmt.Sprintf("Account holder: %s", header.AccountName))
+	y -= lineHeight
+	pw.doc.Text(marginLeft, y, 9, false, fmt.Sprintf("Wallet: %s", header.WalletID))
+	y -= lineHeight
+	currency := header.CurrencyCode
+	if pw.symbol != header.CurrencyCode+" " {
+		currency = fmt.Sprintf("%s (%s)", header.CurrencyCode, header.CurrencySymbol)
+	}
+	pw.doc.Text(marginLeft, y, 9, false, "Currency: "+currency)
+	y -= lineHeight
+	pw.doc.Text(marginLeft, y, 9, false, fmt.Sprintf(
+		"Period: %s to %s",
+		header.From.UTC().Format("02 Jan 2006 15:04"), header.To.UTC().Format("02 Jan 2006 15:04 MST"),
+	))
+	y -= lineHeight
+	pw.doc.Text(marginLeft, y, 9, false, fmt.Sprintf("Generated: %s", header.GeneratedAt.UTC().Format("02 Jan 2006 15:04 MST")))
+	y -= 2 * lineHeight
+
+	pw.doc.Text(marginLeft, y, 10, true, "Opening balance")
+	pw.doc.TextRight(columnBalanceEnd, y, 10, true, pw.money(header.OpeningBalance))
+	y -= 2 * lineHeight
+
+	pw.y = y
+	pw.columnHeadings()
+
+	return nil
+}
+
+func (pw *pdfWriter) WriteLine(line *transactions.StatementLine) error {
+	if pw.y < marginBottom {
+		if err := pw.newPage(); err != nil {
+			return err
+		}
+	}
+
+	description := line.Description
+	if description == "" {
+		description = line.Type
+	}
+	if len([]rune(description)) > descriptionWidth {
+		description = string([]rune(description)[:descriptionWidth-1]) + "…"
+	}
+
+	pw.doc.Text(columnDate, pw.y, fontSize, false, line.CreatedAt.UTC().Format("2006-01-02"))
+	pw.doc.Text(columnTransaction, pw.y, fontSize, false, line.TransactionID)
+	pw.doc.Text(columnDescription, pw.y, fontSize, false, description)
+	if line.Amount.IsNegative() {
+		pw.doc.TextRight(columnDebitEnd, pw.y, fontSize, false, formatAmount(line.Amount.Neg(), pw.header.MinorUnits))
+	} else {
+		pw.doc.TextRight(columnCreditEnd, pw.y, fontSize, false, formatAmount(line.Amount, pw.header.MinorUnits))
+	}
+	pw.doc.TextRight(columnBalanceEnd, pw.y, fontSize, false, formatAmount(line.Balance, pw.header.MinorUnits))
+	pw.y -= lineHeight
+
+	return nil
+}
+
+func (pw *pdfWriter) Close(closingBalance money.Amount) error {
+	if pw.y < marginBottom+2*lineHeight {
+		if err := pw.newPage(); err != nil {
+			return err
+		}
+	}
+
+	pw.doc.Line(marginLeft, pw.y+lineHeight-3, marginRight, pw.y+lineHeight-3)
+	pw.y -= lineHeight
+	pw.doc.Text(marginLeft, pw.y, 10, true, "Closing balance")
+	pw.doc.TextRight(columnBalanceEnd, pw.y, 10, true, pw.money(closingBalance))
+	pw.footer()
+
+	return pw.doc.Close()
+}
+
+func (pw *pdfWriter) footer() {
+	pw.doc.Text(marginLeft, marginBottom-24, 7, false, fmt.Sprintf("%s - page %d", pw.header.WalletID, pw.page))
+}
+
+func (pw *pdfWriter) newPage() error {
+	pw.footer()
+	if err := pw.doc.NewPage(); err != nil {
+		return err
+	}
+	pw.page++
+	pw.y = marginTop
+	pw.columnHeadings()
+	return nil
+}
+
+func (pw *pdfWriter) columnHeadings() {
+	pw.doc.Text(columnDate, pw.y, fontSize, true, "Date")
+	pw.doc.Text(columnTransaction, pw.y, fontSize, true, "Transaction")
+	pw.doc.Text(columnDescription, pw.y, fontSize, true, "Description")
+	pw.doc.TextRight(columnDebitEnd, pw.y, fontSize, true, "Debit")
+	pw.doc.TextRight(columnCreditEnd, pw.y, fontSize, true, "Credit")
+	pw.doc.TextRight(columnBalanceEnd, pw.y, fontSize, true, "Balance")
+	pw.doc.Line(marginLeft, pw.y-4, marginRight, pw.y-4)
+	pw.y -= lineHeight + 4
+}
+
+func (pw *pdfWriter) money(amount money.Amount) string {
+	if amount.IsNegative() {
+		return "-" + pw.symbol + formatAmount(amount.Neg(), pw.header.MinorUnits)
+	}
+	return pw.symbol + formatAmount(amount, pw.header.MinorUnits)
+}
@@ -0,0 +1,91 @@
+// statements renders wallet statements line by line as they are read from the
+// ledger, in CSV or PDF.
+package statements
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/thesambayo/digillets-api/internal/data/transactions"
+	"github.com/thesambayo/digillets-api/internal/money"
+)
+
+const (
+	FormatCSV = "csv"
+	FormatPDF = "pdf"
+)
+
+// Header holds the details printed at the top of a statement.
+type Header struct {
+	AccountName    string
+	WalletID       string
+	CurrencyCode   string
+	CurrencySymbol string
+	MinorUnits     int32
+	From           time.Time
+	To             time.Time
+	OpeningBalance money.Amount
+	GeneratedAt    time.Time
+}
+
+// Writer writes a statement: the header first, then every line in order, then the
+// closing balance on Close.
+type Writer interface {
+	WriteHeader(header Header) error
+	WriteLine(line *transactions.StatementLine) error
+	Close(closingBalance money.Amount) error
+}
+
+// New returns a Writer for the given format writing to w.
+func New(format string, w io.Writer) Writer {
+	switch format {
+	case FormatPDF:
+		return newPDFWriter(w)
+	default:
+		return newCSVWriter(w)
+	}
+}
+
+// ContentType returns the MIME type of a statement format.
+func ContentType(format string) string {
+	switch format {
+	case FormatPDF:
+		return "application/pdf"
+	default:
+		return "text/csv; charset=utf-8"
+	}
+}
+
+// plainAmount formats an amount with the given number of decimals, e.g 1234567.5
+// with two as 1234567.50
+func plainAmount(amount money.Amount, places int32) string {
+	return amount.Round(places, money.DefaultRounding).String()
+}
+
+// formatAmount formats an amount with the given number of decimals and thousands
+// separators, e.g 1234567.5 with two as 1,234,567.50
+func formatAmount(amount money.Amount, places int32) string {
+	sign := ""
+	if amount.IsNegative() {
+		sign = "-"
+		amount = amount.Neg()
+	}
+
+	digits := plainAmount(amount, places)
+	whole, fraction, hasFraction := strings.Cut(digits, ".")
+
+	var grouped strings.Builder
+	for i, digit := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			grouped.WriteByte(',')
+		}
+		grouped.WriteRune(digit)
+	}
+
+	if !hasFraction {
+		return sign + grouped.String()
+	}
+	return fmt.Sprintf("%s%s.%s", sign, grouped.String(), fraction)
+}
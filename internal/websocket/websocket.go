@@ -0,0 +1,325 @@
+// websocket is a minimal server side implementation of the WebSocket protocol (RFC
+// 6455), enough for pushing small JSON messages to clients: it upgrades a request,
+// reads messages (answering pings and the closing handshake itself), and writes
+// messages. Extensions and subprotocols are not supported.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Message types.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+	CloseMessage  = 8
+	PingMessage   = 9
+	PongMessage   = 10
+
+	continuationFrame = 0
+)
+
+// Close codes.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupported     = 1003
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+	CloseTryAgainLater   = 1013
+)
+
+// writeWait is how long a single write may take before the connection is given up
+// on.
+const writeWait = 10 * time.Second
+
+// acceptGUID is mixed into the key of the client to accept the upgrade.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	// ErrBadHandshake is returned by Upgrade for a request that is not a valid
+	// WebSocket upgrade. No response has been written, the caller should respond.
+	ErrBadHandshake = errors.New("websocket: not a valid upgrade request")
+
+	// ErrMessageTooBig is returned when a client sends a message over the read
+	// limit.
+	ErrMessageTooBig = errors.New("websocket: message too big")
+)
+
+// CloseError is returned by ReadMessage once the client closed the connection.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (closeError *CloseError) Error() string {
+	return fmt.Sprintf("websocket: closed with %d %s", closeError.Code, closeError.Reason)
+}
+
+// Conn is an upgraded connection. ReadMessage must only be called from one
+// goroutine at a time, the write methods are safe to call concurrently.
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// ReadLimit is the largest message a client may send, 4KB by default.
+	ReadLimit int64
+	// OnPong is called whenever the client answers a ping.
+	OnPong func()
+
+	writeMu sync.Mutex
+	closed  bool
+}
+
+// Upgrade upgrades a request to a WebSocket connection.
+func Upgrade(resWriter http.ResponseWriter, req *http.Request) (*Conn, error) {
+	key := req.Header.Get("Sec-WebSocket-Key")
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	switch {
+	case req.Method != http.MethodGet,
+		!headerContains(req.Header, "Connection", "upgrade"),
+		!headerContains(req.Header, "Upgrade", "websocket"),
+		req.Header.Get("Sec-WebSocket-Version") != "13",
+		err != nil || len(decoded) != 16:
+		return nil, ErrBadHandshake
+	}
+
+	conn, buffered, err := http.NewResponseController(resWriter).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// the deadlines the server set for the request do not apply to the connection
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(key + acceptGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n\r\n"
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if _, err = conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Conn{conn: conn, reader: buffered.Reader, ReadLimit: 4096}, nil
+}
+
+// headerContains reports whether a comma separated header has a token, ignoring
+// case.
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetReadDeadline sets when a pending or future ReadMessage gives up.
+func (conn *Conn) SetReadDeadline(deadline time.Time) error {
+	return conn.conn.SetReadDeadline(deadline)
+}
+
+// ReadMessage returns the next text or binary message. Pings are answered, pongs
+// are passed to OnPong, and a close from the client is answered and returned as a
+// *CloseError. Any error ends the connection, which should then be closed.
+func (conn *Conn) ReadMessage() (int, []byte, error) {
+	var messageType int
+	var message []byte
+
+	for {
+		fin, opcode, payload, err := conn.readFrame()
+		if err != nil {
+			if errors.Is(err, ErrMessageTooBig) {
+				conn.WriteClose(CloseMessageTooBig, "")
+			}
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case PingMessage:
+			if err := conn.write(PongMessage, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			if conn.OnPong != nil {
+				conn.OnPong()
+			}
+			continue
+		case CloseMessage:
+			closeError := &CloseError{Code: CloseNormal}
+			if len(payload) >= 2 {
+				closeError.Code = int(binary.BigEndian.Uint16(payload))
+				closeError.Reason = string(payload[2:])
+			}
+			conn.WriteClose(CloseNormal, "")
+			return 0, nil, closeError
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				conn.WriteClose(CloseProtocolError, "")
+				return 0, nil, errors.New("websocket: new message before the previous one finished")
+			}
+			messageType = opcode
+		case continuationFrame:
+			if messageType == 0 {
+				conn.WriteClose(CloseProtocolError, "")
+				return 0, nil, errors.New("websocket: continuation without a message")
+			}
+		default:
+			conn.WriteClose(CloseProtocolError, "")
+			return 0, nil, fmt.Errorf("websocket: unknown opcode %d", opcode)
+		}
+
+		if int64(len(message)+len(payload)) > conn.ReadLimit {
+			conn.WriteClose(CloseMessageTooBig, "")
+			return 0, nil, ErrMessageTooBig
+		}
+		message = append(message, payload...)
+		if fin {
+			if messageType == TextMessage && !utf8.Valid(message) {
+				conn.WriteClose(CloseInvalidPayload, "")
+				return 0, nil, errors.New("websocket: text message is not valid utf-8")
+			}
+			return messageType, message, nil
+		}
+	}
+}
+
+// readFrame reads a single frame, unmasking its payload.
+func (conn *Conn) readFrame() (bool, int, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := int(header[0] & 0x0f)
+	masked := header[1]&0x80 != 0
+	length := int64(header[1] & 0x7f)
+
+	if header[0]&0x70 != 0 {
+		conn.WriteClose(CloseProtocolError, "")
+		return false, 0, nil, errors.New("websocket: reserved bits set without an extension")
+	}
+	// clients must mask what they send
+	if !masked {
+		conn.WriteClose(CloseProtocolError, "")
+		return false, 0, nil, errors.New("websocket: unmasked frame from client")
+	}
+	isControl := opcode >= CloseMessage
+	if isControl && (!fin || length > 125) {
+		conn.WriteClose(CloseProtocolError, "")
+		return false, 0, nil, errors.New("websocket: invalid control frame")
+	}
+
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(conn.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(conn.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint64(extended[:]))
+	}
+	if length < 0 || length > conn.ReadLimit {
+		return false, 0, nil, ErrMessageTooBig
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(conn.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// WriteMessage writes a text or binary message.
+func (conn *Conn) WriteMessage(messageType int, data []byte) error {
+	return conn.write(messageType, data)
+}
+
+// Ping sends a ping, which the client answers with a pong.
+func (conn *Conn) Ping() error {
+	return conn.write(PingMessage, nil)
+}
+
+// WriteClose starts or answers the closing handshake. Nothing is written after it.
+func (conn *Conn) WriteClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	return conn.write(CloseMessage, payload)
+}
+
+// write writes a whole message as a single unmasked frame.
+func (conn *Conn) write(opcode int, payload []byte) error {
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
+
+	if conn.closed {
+		return net.ErrClosed
+	}
+	if opcode == CloseMessage {
+		conn.closed = true
+	}
+
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|byte(opcode))
+	switch length := len(payload); {
+	case length <= 125:
+		frame = append(frame, byte(length))
+	case length <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+	frame = append(frame, payload...)
+
+	if err := conn.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+		return err
+	}
+	_, err := conn.conn.Write(frame)
+	return err
+}
+
+// Close closes the underlying connection, without a closing handshake if none
+// was written.
+func (conn *Conn) Close() error {
+	return conn.conn.Close()
+}
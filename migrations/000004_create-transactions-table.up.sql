@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS transactions (
+  id bigserial PRIMARY KEY,
+  public_id VARCHAR(50) UNIQUE NOT NULL,
+  type VARCHAR(30) NOT NULL, -- e.g transfer, sweep, fee, adjustment
+  status VARCHAR(20) NOT NULL DEFAULT 'completed',
+  reference text NOT NULL DEFAULT '',
+  description text NOT NULL DEFAULT '',
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+-- every movement of money is a ledger entry against a wallet. The entries of a
+-- transaction sum to zero per currency, credits are positive and debits negative.
+CREATE TABLE IF NOT EXISTS ledger_entries (
+  id bigserial PRIMARY KEY,
+  transaction_id bigint REFERENCES transactions (id) NOT NULL,
+  wallet_id INT REFERENCES wallets (id) NOT NULL,
+  amount DECIMAL(20, 2) NOT NULL,
+  balance_after DECIMAL(20, 2) NOT NULL, -- running balance of the wallet after this entry
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE INDEX IF NOT EXISTS ledger_entries_wallet_id_created_at_idx ON ledger_entries (wallet_id, created_at, id);
+CREATE INDEX IF NOT EXISTS ledger_entries_transaction_id_idx ON ledger_entries (transaction_id);
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS wallet_freeze_events;
+
+ALTER TABLE wallets
+  DROP COLUMN IF EXISTS freeze_reason,
+  DROP COLUMN IF EXISTS freeze_note,
+  DROP COLUMN IF EXISTS block_credits,
+  DROP COLUMN IF EXISTS frozen_by,
+  DROP COLUMN IF EXISTS frozen_at;
@@ -0,0 +1,22 @@
+ALTER TABLE wallets
+  ADD COLUMN IF NOT EXISTS freeze_reason VARCHAR(30) NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS freeze_note text NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS block_credits BOOLEAN NOT NULL DEFAULT false, -- frozen wallets always reject debits, credits only when set
+  ADD COLUMN IF NOT EXISTS frozen_by bigint REFERENCES users (id),
+  ADD COLUMN IF NOT EXISTS frozen_at timestamp(0) with time zone;
+
+-- history of every freeze and unfreeze, with who did it and why.
+CREATE TABLE IF NOT EXISTS wallet_freeze_events (
+  id bigserial PRIMARY KEY,
+  wallet_id INT REFERENCES wallets (id) NOT NULL,
+  action VARCHAR(10) NOT NULL, -- freeze or unfreeze
+  reason VARCHAR(30) NOT NULL,
+  note text NOT NULL,
+  block_credits BOOLEAN NOT NULL DEFAULT false,
+  actor_id bigint REFERENCES users (id) NOT NULL,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE INDEX IF NOT EXISTS wallet_freeze_events_wallet_id_idx ON wallet_freeze_events (wallet_id);
@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS holds;
+
+DROP INDEX IF EXISTS unique_user_currency;
+ALTER TABLE wallets ADD CONSTRAINT unique_user_currency UNIQUE (user_id, currency_id);
+
+ALTER TABLE wallets
+  DROP COLUMN IF EXISTS kind,
+  DROP COLUMN IF EXISTS status,
+  DROP COLUMN IF EXISTS closed_at;
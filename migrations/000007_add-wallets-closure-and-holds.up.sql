@@ -0,0 +1,44 @@
+-- closed wallets are kept for their history, so the one wallet per user and
+-- currency rule only applies to wallets that are still open. The kind separates the
+-- house wallets the system user holds per currency (e.g fx) from customer wallets.
+ALTER TABLE wallets
+  ADD COLUMN IF NOT EXISTS kind VARCHAR(20) NOT NULL DEFAULT 'user',
+  ADD COLUMN IF NOT EXISTS status VARCHAR(10) NOT NULL DEFAULT 'active',
+  ADD COLUMN IF NOT EXISTS closed_at timestamp(0) with time zone;
+
+ALTER TABLE wallets DROP CONSTRAINT IF EXISTS unique_user_currency;
+CREATE UNIQUE INDEX IF NOT EXISTS unique_user_currency ON wallets (user_id, currency_id, kind) WHERE closed_at IS NULL;
+
+-- funds reserved on a wallet that are not yet posted to the ledger.
+CREATE TABLE IF NOT EXISTS holds (
+  id bigserial PRIMARY KEY,
+  public_id VARCHAR(50) UNIQUE NOT NULL,
+  wallet_id INT REFERENCES wallets (id) NOT NULL,
+  amount DECIMAL(20, 2) NOT NULL CHECK (amount > 0),
+  status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending, captured, released
+  reason VARCHAR(30) NOT NULL DEFAULT '',
+  reference text NOT NULL DEFAULT '',
+  expires_at timestamp(0) with time zone NOT NULL,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW (),
+    updated_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE INDEX IF NOT EXISTS holds_wallet_id_status_idx ON holds (wallet_id, status);
+
+-- the system user owns the house wallets. Its password hash is of a discarded random
+-- value, so it can never log in.
+INSERT INTO
+  users (public_id, name, email, password_hash, activated)
+VALUES
+  (
+    'usr_system',
+    'Digillets System',
+    'system@digillets.internal',
+    '$2a$12$h3lEZt.HV6vvWOU245KZrefVOipfPbsacNsZl0EX3JLiwzAXuXLUa',
+    false
+  )
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,37 @@
+-- append-only record of every state-changing action. Each row carries the hash of
+-- the row before it, so any edit or removal of a row breaks the chain from there on.
+-- before and after are json rather than jsonb so their text is kept byte for byte,
+-- as it was hashed.
+CREATE TABLE IF NOT EXISTS audit_events (
+  id bigserial PRIMARY KEY,
+  actor_type VARCHAR(10) NOT NULL, -- user, admin or system
+  actor_id VARCHAR(50) NOT NULL DEFAULT '', -- public id of the acting user
+  action VARCHAR(50) NOT NULL, -- e.g wallet.freeze
+  target_type VARCHAR(30) NOT NULL,
+  target_id VARCHAR(50) NOT NULL, -- public id of the changed entity
+  request_id VARCHAR(64) NOT NULL DEFAULT '',
+  ip VARCHAR(45) NOT NULL DEFAULT '',
+  before json,
+  after json,
+  prev_hash CHAR(64) NOT NULL,
+  hash CHAR(64) UNIQUE NOT NULL,
+  created_at timestamp(6) with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_target_id_idx ON audit_events (target_id);
+CREATE INDEX IF NOT EXISTS audit_events_actor_id_idx ON audit_events (actor_id);
+
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_append_only
+  BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_events
+  FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
+
+INSERT INTO
+  permissions (code)
+VALUES
+  ('audit:read');
@@ -0,0 +1,10 @@
+ALTER TABLE holds ALTER COLUMN amount TYPE DECIMAL(20, 2);
+ALTER TABLE ledger_entries
+  ALTER COLUMN amount TYPE DECIMAL(20, 2),
+  ALTER COLUMN balance_after TYPE DECIMAL(20, 2);
+ALTER TABLE wallets ALTER COLUMN balance TYPE DECIMAL(20, 2);
+
+DELETE FROM currencies WHERE code IN ('JPY', 'KWD');
+
+ALTER TABLE currencies ALTER COLUMN exchange_rate TYPE DECIMAL(10, 4);
+ALTER TABLE currencies DROP COLUMN IF EXISTS minor_units;
@@ -0,0 +1,23 @@
+-- ISO 4217 minor units, the number of decimal places amounts in a currency are kept
+-- and shown with, e.g 2 for NGN, 0 for JPY and 3 for KWD.
+ALTER TABLE currencies
+  ADD COLUMN IF NOT EXISTS minor_units SMALLINT NOT NULL DEFAULT 2 CHECK (minor_units BETWEEN 0 AND 4);
+
+-- rates against the base currency need more than four decimals once a currency is
+-- worth more than the base, e.g KWD.
+ALTER TABLE currencies ALTER COLUMN exchange_rate TYPE DECIMAL(18, 8);
+
+INSERT INTO
+  currencies (code, name, symbol, exchange_rate, base_currency, minor_units)
+VALUES
+  ('JPY', 'Japanese Yen', '¥', 151.95000000, 'USD', 0),
+  ('KWD', 'Kuwaiti Dinar', 'KD', 0.30750000, 'USD', 3)
+ON CONFLICT (code) DO NOTHING;
+
+-- amounts are stored with four decimals, enough for every currency, and the
+-- application keeps each one to the minor units of its currency.
+ALTER TABLE wallets ALTER COLUMN balance TYPE DECIMAL(24, 4);
+ALTER TABLE ledger_entries
+  ALTER COLUMN amount TYPE DECIMAL(24, 4),
+  ALTER COLUMN balance_after TYPE DECIMAL(24, 4);
+ALTER TABLE holds ALTER COLUMN amount TYPE DECIMAL(24, 4);
@@ -0,0 +1,35 @@
+-- fee rules per transaction type and currency. A rule without a user tier applies
+-- to every tier that has no rule of its own. Percentages are in percent, e.g 1.5,
+-- and tiers are bands of {"up_to", "flat", "percentage"} in ascending order, the
+-- last one without up_to.
+CREATE TABLE IF NOT EXISTS fee_rules (
+  id bigserial PRIMARY KEY,
+  transaction_type VARCHAR(30) NOT NULL,
+  currency CHAR(3) REFERENCES currencies (code) NOT NULL,
+  user_tier SMALLINT,
+  kind VARCHAR(20) NOT NULL CHECK (kind IN ('flat', 'percentage', 'tiered')),
+  flat DECIMAL(24, 4) NOT NULL DEFAULT 0,
+  percentage DECIMAL(9, 6) NOT NULL DEFAULT 0,
+  tiers json NOT NULL DEFAULT '[]',
+  min_fee DECIMAL(24, 4),
+  max_fee DECIMAL(24, 4),
+  active BOOLEAN NOT NULL DEFAULT true,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW (),
+    updated_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS fee_rules_active_idx ON fee_rules (transaction_type, currency, COALESCE(user_tier, -1)) WHERE active;
+
+INSERT INTO
+  fee_rules (transaction_type, currency, kind, flat, percentage, tiers, min_fee, max_fee)
+VALUES
+  (
+    'transfer', 'NGN', 'tiered', 0, 0,
+    '[{"up_to": "5000", "flat": "10", "percentage": "0"}, {"up_to": "50000", "flat": "25", "percentage": "0"}, {"up_to": null, "flat": "50", "percentage": "0"}]',
+    NULL, NULL
+  ),
+  ('transfer', 'USD', 'percentage', 0, 1, '[]', 0.50, 10.00);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS kyc_tier_limits;
+ALTER TABLE users DROP COLUMN IF EXISTS kyc_tier;
@@ -0,0 +1,37 @@
+-- KYC tiers: 0 unverified, 1 BVN or ID verified, 2 address verified.
+ALTER TABLE users
+  ADD COLUMN IF NOT EXISTS kyc_tier SMALLINT NOT NULL DEFAULT 0 CHECK (kyc_tier BETWEEN 0 AND 2);
+
+-- limits of each tier per currency. The daily and monthly limits apply separately to
+-- the money going out of and coming into a user's wallets over a rolling 24 hours
+-- and 30 days, the single transaction limit to each movement, and the maximum
+-- balance to every wallet. A NULL limit is no limit.
+CREATE TABLE IF NOT EXISTS kyc_tier_limits (
+  tier SMALLINT NOT NULL,
+  currency_id INT REFERENCES currencies (id) NOT NULL,
+  single_transaction_limit DECIMAL(24, 4),
+  daily_limit DECIMAL(24, 4),
+  monthly_limit DECIMAL(24, 4),
+  max_balance DECIMAL(24, 4),
+  PRIMARY KEY (tier, currency_id)
+);
+
+-- the default limits are set in US dollars and converted to every currency.
+INSERT INTO
+  kyc_tier_limits (tier, currency_id, single_transaction_limit, daily_limit, monthly_limit, max_balance)
+SELECT
+  tiers.tier,
+  currencies.id,
+  ROUND(tiers.single_transaction_limit * currencies.exchange_rate, currencies.minor_units),
+  ROUND(tiers.daily_limit * currencies.exchange_rate, currencies.minor_units),
+  ROUND(tiers.monthly_limit * currencies.exchange_rate, currencies.minor_units),
+  ROUND(tiers.max_balance * currencies.exchange_rate, currencies.minor_units)
+FROM
+  currencies,
+  (
+    VALUES
+      (0, 50, 100, 500, 300),
+      (1, 1000, 2000, 10000, 5000),
+      (2, 10000, 20000, 100000, NULL)
+  ) AS tiers (tier, single_transaction_limit, daily_limit, monthly_limit, max_balance)
+ON CONFLICT DO NOTHING;
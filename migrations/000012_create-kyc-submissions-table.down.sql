@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'kyc:review';
+DROP TABLE IF EXISTS kyc_documents;
+DROP TABLE IF EXISTS kyc_submissions;
@@ -0,0 +1,46 @@
+-- identity data users submit to move up a KYC tier. The id number and date of birth
+-- are encrypted by the application, and the documents are kept, encrypted too, in
+-- the blob store under their blob_key.
+CREATE TABLE IF NOT EXISTS kyc_submissions (
+  id bigserial PRIMARY KEY,
+  public_id VARCHAR(50) UNIQUE NOT NULL,
+  user_id bigint REFERENCES users (id) NOT NULL,
+  requested_tier SMALLINT NOT NULL CHECK (requested_tier BETWEEN 1 AND 2),
+  id_type VARCHAR(30) NOT NULL,
+  id_number_encrypted bytea NOT NULL,
+  date_of_birth_encrypted bytea NOT NULL,
+  status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending, approved, rejected
+  rejection_reason VARCHAR(30) NOT NULL DEFAULT '',
+  review_note text NOT NULL DEFAULT '',
+  reviewed_by bigint REFERENCES users (id),
+  reviewed_at timestamp(0) with time zone,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW (),
+    updated_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+-- a user can only have one submission waiting for review.
+CREATE UNIQUE INDEX IF NOT EXISTS kyc_submissions_pending_idx ON kyc_submissions (user_id) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS kyc_submissions_status_idx ON kyc_submissions (status, created_at);
+
+CREATE TABLE IF NOT EXISTS kyc_documents (
+  id bigserial PRIMARY KEY,
+  submission_id bigint REFERENCES kyc_submissions (id) ON DELETE CASCADE NOT NULL,
+  kind VARCHAR(30) NOT NULL, -- id_front, id_back, selfie, proof_of_address
+  blob_key text NOT NULL,
+  content_type VARCHAR(100) NOT NULL,
+  size bigint NOT NULL,
+  sha256 CHAR(64) NOT NULL, -- of the original file
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW (),
+  UNIQUE (submission_id, kind)
+);
+
+INSERT INTO
+  permissions (code)
+VALUES
+  ('kyc:review');
@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'risk:review';
+DROP TABLE IF EXISTS risk_decisions;
+DROP TABLE IF EXISTS risk_rules;
@@ -0,0 +1,77 @@
+-- risk rules run before every debit. Each asks for the debit to be reviewed or
+-- blocked when it fires, thresholds are in the base currency and the parameters a
+-- kind does not use are ignored:
+--   velocity: count debits or more in the last window_minutes
+--   amount_anomaly: over multiplier times the average debit, after count debits
+--   new_device: at least threshold from a device not used before
+--   new_beneficiary: at least threshold to a wallet never paid before
+--   rapid_in_out: ratio or more of the credits of the last window_minutes
+CREATE TABLE IF NOT EXISTS risk_rules (
+  id bigserial PRIMARY KEY,
+  name VARCHAR(50) UNIQUE NOT NULL,
+  kind VARCHAR(30) NOT NULL CHECK (kind IN ('velocity', 'amount_anomaly', 'new_device', 'new_beneficiary', 'rapid_in_out')),
+  action VARCHAR(10) NOT NULL CHECK (action IN ('review', 'block')),
+  threshold DECIMAL(24, 4),
+  count INT NOT NULL DEFAULT 0,
+  window_minutes INT NOT NULL DEFAULT 0,
+  multiplier DECIMAL(9, 4),
+  ratio DECIMAL(9, 4),
+  active BOOLEAN NOT NULL DEFAULT true,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW (),
+    updated_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+INSERT INTO
+  risk_rules (name, kind, action, threshold, count, window_minutes, multiplier, ratio)
+VALUES
+  ('velocity', 'velocity', 'review', NULL, 5, 10, NULL, NULL),
+  ('velocity_burst', 'velocity', 'block', NULL, 15, 60, NULL, NULL),
+  ('amount_anomaly', 'amount_anomaly', 'review', 100, 3, 0, 10, NULL),
+  ('new_device_large', 'new_device', 'review', 500, 0, 0, NULL, NULL),
+  ('new_beneficiary_large', 'new_beneficiary', 'review', 1000, 0, 0, NULL, NULL),
+  ('rapid_in_out', 'rapid_in_out', 'review', 100, 0, 60, NULL, 0.9)
+ON CONFLICT DO NOTHING;
+
+-- every decision taken on a debit and the rules that fired. Status is completed or
+-- blocked straight away, or pending review with the funds held and the transfer
+-- kept to be made once it is approved.
+CREATE TABLE IF NOT EXISTS risk_decisions (
+  id bigserial PRIMARY KEY,
+  public_id VARCHAR(50) UNIQUE NOT NULL,
+  user_id INT REFERENCES users (id) NOT NULL,
+  wallet_id INT REFERENCES wallets (id) NOT NULL,
+  beneficiary_wallet_id INT REFERENCES wallets (id),
+  transaction_type VARCHAR(30) NOT NULL,
+  amount DECIMAL(24, 4) NOT NULL,
+  currency CHAR(3) NOT NULL,
+  base_amount DECIMAL(24, 4) NOT NULL,
+  device VARCHAR(64) NOT NULL DEFAULT '',
+  outcome VARCHAR(10) NOT NULL CHECK (outcome IN ('allow', 'review', 'block')),
+  fired json NOT NULL DEFAULT '[]',
+  status VARCHAR(20) NOT NULL CHECK (status IN ('completed', 'blocked', 'pending', 'approved', 'rejected')),
+  hold_id VARCHAR(50) NOT NULL DEFAULT '',
+  transaction_id VARCHAR(50) NOT NULL DEFAULT '',
+  transfer json,
+  review_note text NOT NULL DEFAULT '',
+  reviewed_by INT REFERENCES users (id),
+  reviewed_at timestamp(0) with time zone,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW (),
+    updated_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE INDEX IF NOT EXISTS risk_decisions_user_id_idx ON risk_decisions (user_id, created_at);
+CREATE INDEX IF NOT EXISTS risk_decisions_user_id_device_idx ON risk_decisions (user_id, device);
+CREATE INDEX IF NOT EXISTS risk_decisions_status_idx ON risk_decisions (status, created_at);
+
+INSERT INTO
+  permissions (code)
+VALUES
+  ('risk:review');
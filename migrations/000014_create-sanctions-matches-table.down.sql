@@ -0,0 +1,7 @@
+DELETE FROM permissions WHERE code = 'sanctions:review';
+DELETE FROM risk_rules WHERE kind = 'watchlist';
+ALTER TABLE risk_rules DROP CONSTRAINT IF EXISTS risk_rules_kind_check;
+ALTER TABLE risk_rules
+  ADD CONSTRAINT risk_rules_kind_check CHECK (kind IN ('velocity', 'amount_anomaly', 'new_device', 'new_beneficiary', 'rapid_in_out'));
+DROP TABLE IF EXISTS sanctions_matches;
+ALTER TABLE users DROP COLUMN IF EXISTS screening_status;
@@ -0,0 +1,50 @@
+-- an account with a potential sanctions match is under review until every match is
+-- cleared, and blocked once one is confirmed.
+ALTER TABLE users
+  ADD COLUMN IF NOT EXISTS screening_status VARCHAR(10) NOT NULL DEFAULT 'clear' CHECK (screening_status IN ('clear', 'review', 'blocked'));
+
+-- potential matches of screened names with the sanctions list, queued for review.
+-- A user match is of the name of the account, a transfer match of the name of its
+-- beneficiary, with the transfer held by its risk decision meanwhile.
+CREATE TABLE IF NOT EXISTS sanctions_matches (
+  id bigserial PRIMARY KEY,
+  public_id VARCHAR(50) UNIQUE NOT NULL,
+  subject_type VARCHAR(10) NOT NULL CHECK (subject_type IN ('user', 'transfer')),
+  user_id INT REFERENCES users (id) NOT NULL,
+  risk_decision_id bigint REFERENCES risk_decisions (id),
+  screened_name text NOT NULL,
+  entry_uid VARCHAR(20) NOT NULL,
+  entry_name text NOT NULL,
+  matched_name text NOT NULL,
+  programs text NOT NULL DEFAULT '',
+  score DECIMAL(5, 4) NOT NULL,
+  status VARCHAR(10) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'cleared', 'confirmed')),
+  review_note text NOT NULL DEFAULT '',
+  reviewed_by INT REFERENCES users (id),
+  reviewed_at timestamp(0) with time zone,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW (),
+    updated_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE INDEX IF NOT EXISTS sanctions_matches_status_idx ON sanctions_matches (status, created_at);
+CREATE INDEX IF NOT EXISTS sanctions_matches_user_id_idx ON sanctions_matches (user_id);
+
+-- transfers to or from accounts with potential matches are held for review.
+ALTER TABLE risk_rules DROP CONSTRAINT IF EXISTS risk_rules_kind_check;
+ALTER TABLE risk_rules
+  ADD CONSTRAINT risk_rules_kind_check CHECK (kind IN ('velocity', 'amount_anomaly', 'new_device', 'new_beneficiary', 'rapid_in_out', 'watchlist'));
+
+INSERT INTO
+  risk_rules (name, kind, action)
+VALUES
+  ('sanctions_match', 'watchlist', 'review')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO
+  permissions (code)
+VALUES
+  ('sanctions:review');
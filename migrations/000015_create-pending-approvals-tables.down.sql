@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'approvals:decide';
+DROP TABLE IF EXISTS pending_approval_events;
+DROP TABLE IF EXISTS pending_approvals;
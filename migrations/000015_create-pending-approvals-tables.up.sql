@@ -0,0 +1,50 @@
+-- actions staff must approve before they are executed, e.g transfers over the
+-- approval threshold. The payload is what is executed once approved, and the funds
+-- a debit needs are held on its wallet meanwhile. An approval nobody decides on
+-- expires at expires_at.
+CREATE TABLE IF NOT EXISTS pending_approvals (
+  id bigserial PRIMARY KEY,
+  public_id VARCHAR(50) UNIQUE NOT NULL,
+  action VARCHAR(20) NOT NULL CHECK (action IN ('transfer')),
+  initiated_by INT REFERENCES users (id) NOT NULL,
+  wallet_id INT REFERENCES wallets (id) NOT NULL,
+  amount DECIMAL(24, 4) NOT NULL,
+  currency CHAR(3) NOT NULL,
+  base_amount DECIMAL(24, 4) NOT NULL,
+  payload json NOT NULL,
+  hold_id VARCHAR(50) NOT NULL DEFAULT '',
+  status VARCHAR(10) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected', 'expired')),
+  expires_at timestamp(0) with time zone NOT NULL,
+  decided_by INT REFERENCES users (id),
+  decided_at timestamp(0) with time zone,
+  decision_note text NOT NULL DEFAULT '',
+  result_id VARCHAR(50) NOT NULL DEFAULT '',
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW (),
+    updated_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE INDEX IF NOT EXISTS pending_approvals_status_idx ON pending_approvals (status, expires_at);
+CREATE INDEX IF NOT EXISTS pending_approvals_initiated_by_idx ON pending_approvals (initiated_by);
+
+-- the trail of an approval, from its creation to its decision or expiry.
+CREATE TABLE IF NOT EXISTS pending_approval_events (
+  id bigserial PRIMARY KEY,
+  approval_id bigint REFERENCES pending_approvals (id) NOT NULL,
+  event VARCHAR(10) NOT NULL CHECK (event IN ('created', 'approved', 'rejected', 'expired')),
+  actor_id INT REFERENCES users (id),
+  note text NOT NULL DEFAULT '',
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE INDEX IF NOT EXISTS pending_approval_events_approval_id_idx ON pending_approval_events (approval_id);
+
+INSERT INTO
+  permissions (code)
+VALUES
+  ('approvals:decide');
@@ -0,0 +1,6 @@
+DELETE FROM permissions WHERE code = 'ledger:adjust';
+DELETE FROM pending_approval_events WHERE approval_id IN (SELECT id FROM pending_approvals WHERE action = 'adjustment');
+DELETE FROM pending_approvals WHERE action = 'adjustment';
+ALTER TABLE pending_approvals DROP CONSTRAINT IF EXISTS pending_approvals_action_check;
+ALTER TABLE pending_approvals
+  ADD CONSTRAINT pending_approvals_action_check CHECK (action IN ('transfer'));
@@ -0,0 +1,10 @@
+-- manual adjustments of wallet balances by staff wait for approval like large
+-- transfers do.
+ALTER TABLE pending_approvals DROP CONSTRAINT IF EXISTS pending_approvals_action_check;
+ALTER TABLE pending_approvals
+  ADD CONSTRAINT pending_approvals_action_check CHECK (action IN ('transfer', 'adjustment'));
+
+INSERT INTO
+  permissions (code)
+VALUES
+  ('ledger:adjust');
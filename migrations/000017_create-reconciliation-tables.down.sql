@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'reconciliation:manage';
+DROP TABLE IF EXISTS reconciliation_breaks;
+DROP TABLE IF EXISTS reconciliation_runs;
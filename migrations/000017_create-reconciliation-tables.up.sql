@@ -0,0 +1,49 @@
+-- runs of the reconciliation of wallet balances with the ledger, and of provider
+-- settlement files with our deposits and withdrawals.
+CREATE TABLE IF NOT EXISTS reconciliation_runs (
+  id bigserial PRIMARY KEY,
+  public_id VARCHAR(50) UNIQUE NOT NULL,
+  source VARCHAR(10) NOT NULL CHECK (source IN ('job', 'command')),
+  settlement_file text NOT NULL DEFAULT '',
+  wallets_checked INT NOT NULL DEFAULT 0,
+  currencies_checked INT NOT NULL DEFAULT 0,
+  settlement_lines INT NOT NULL DEFAULT 0,
+  breaks_found INT NOT NULL DEFAULT 0,
+  started_at timestamp(0) with time zone NOT NULL,
+  finished_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+-- discrepancies found by reconciliation. The subject is what does not reconcile: a
+-- wallet, a currency or a settlement reference. A discrepancy found again by a
+-- later run updates its open break rather than adding another.
+CREATE TABLE IF NOT EXISTS reconciliation_breaks (
+  id bigserial PRIMARY KEY,
+  public_id VARCHAR(50) UNIQUE NOT NULL,
+  run_id bigint REFERENCES reconciliation_runs (id) NOT NULL,
+  kind VARCHAR(30) NOT NULL CHECK (kind IN ('balance_mismatch', 'currency_imbalance', 'settlement_missing', 'settlement_unmatched', 'settlement_mismatch')),
+  subject VARCHAR(100) NOT NULL,
+  currency CHAR(3) NOT NULL,
+  expected DECIMAL(24, 4),
+  actual DECIMAL(24, 4),
+  detail text NOT NULL DEFAULT '',
+  status VARCHAR(10) NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'resolved')),
+  resolution_note text NOT NULL DEFAULT '',
+  resolved_by INT REFERENCES users (id),
+  resolved_at timestamp(0) with time zone,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW (),
+    updated_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS reconciliation_breaks_open_idx ON reconciliation_breaks (kind, subject) WHERE status = 'open';
+CREATE INDEX IF NOT EXISTS reconciliation_breaks_status_idx ON reconciliation_breaks (status, created_at);
+
+INSERT INTO
+  permissions (code)
+VALUES
+  ('reconciliation:manage');
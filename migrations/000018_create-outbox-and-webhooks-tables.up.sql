@@ -0,0 +1,82 @@
+-- domain events, written in the same transaction as the change they describe and
+-- relayed to the webhook endpoints of their user afterwards. The payload is the
+-- body delivered, dispatched_at is set once deliveries have been queued for it.
+CREATE TABLE IF NOT EXISTS outbox_events (
+  id bigserial PRIMARY KEY,
+  public_id VARCHAR(50) UNIQUE NOT NULL,
+  event_type VARCHAR(50) NOT NULL,
+  user_id INT REFERENCES users (id) NOT NULL,
+  payload json NOT NULL,
+  dispatched_at timestamp(0) with time zone,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE INDEX IF NOT EXISTS outbox_events_undispatched_idx ON outbox_events (id) WHERE dispatched_at IS NULL;
+
+-- urls users have events pushed to, for the event types they subscribe to. The
+-- signing secret is encrypted.
+CREATE TABLE IF NOT EXISTS webhook_endpoints (
+  id bigserial PRIMARY KEY,
+  public_id VARCHAR(50) UNIQUE NOT NULL,
+  user_id INT REFERENCES users (id) NOT NULL,
+  url text NOT NULL,
+  description text NOT NULL DEFAULT '',
+  event_types text[] NOT NULL,
+  secret_encrypted bytea NOT NULL,
+  active BOOLEAN NOT NULL DEFAULT true,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW (),
+    updated_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE INDEX IF NOT EXISTS webhook_endpoints_user_id_idx ON webhook_endpoints (user_id);
+
+-- an event to deliver to an endpoint. A delivery is retried with exponential
+-- backoff until it succeeds, or it is dead once it runs out of attempts.
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  id bigserial PRIMARY KEY,
+  public_id VARCHAR(50) UNIQUE NOT NULL,
+  event_id bigint REFERENCES outbox_events (id) NOT NULL,
+  endpoint_id bigint REFERENCES webhook_endpoints (id) ON DELETE CASCADE NOT NULL,
+  status VARCHAR(10) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'dead')),
+  attempts INT NOT NULL DEFAULT 0,
+  next_attempt_at timestamp(0) with time zone NOT NULL DEFAULT NOW (),
+  last_status_code INT,
+  last_error text NOT NULL DEFAULT '',
+  delivered_at timestamp(0) with time zone,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW (),
+    updated_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW (),
+  UNIQUE (event_id, endpoint_id)
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_deliveries_endpoint_id_idx ON webhook_deliveries (endpoint_id, created_at);
+
+-- every attempt at a delivery, with the response code or error and how long the
+-- endpoint took.
+CREATE TABLE IF NOT EXISTS webhook_attempts (
+  id bigserial PRIMARY KEY,
+  delivery_id bigint REFERENCES webhook_deliveries (id) ON DELETE CASCADE NOT NULL,
+  status_code INT,
+  latency_ms INT NOT NULL,
+  error text NOT NULL DEFAULT '',
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE INDEX IF NOT EXISTS webhook_attempts_delivery_id_idx ON webhook_attempts (delivery_id);
+
+INSERT INTO
+  permissions (code)
+VALUES
+  ('webhooks:manage');
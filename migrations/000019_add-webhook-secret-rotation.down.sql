@@ -0,0 +1,4 @@
+ALTER TABLE webhook_endpoints
+  DROP COLUMN IF EXISTS previous_secret_encrypted,
+  DROP COLUMN IF EXISTS previous_secret_expires_at,
+  DROP COLUMN IF EXISTS version;
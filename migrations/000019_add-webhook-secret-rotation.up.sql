@@ -0,0 +1,7 @@
+-- the secret an endpoint was signed with before it was last rotated. Deliveries are
+-- signed with both secrets until previous_secret_expires_at, so that the endpoint
+-- can switch over without rejecting any.
+ALTER TABLE webhook_endpoints
+  ADD COLUMN IF NOT EXISTS previous_secret_encrypted bytea,
+  ADD COLUMN IF NOT EXISTS previous_secret_expires_at timestamp(0) with time zone,
+  ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
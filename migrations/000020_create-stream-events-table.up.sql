@@ -0,0 +1,14 @@
+-- changes pushed to the apps of a user over the real-time stream. The id orders
+-- the events of a user and is the SSE event id a client resumes from. Events are
+-- only kept long enough for clients to catch up after a reconnect.
+CREATE TABLE IF NOT EXISTS stream_events (
+  id bigserial PRIMARY KEY,
+  user_id INT REFERENCES users (id) NOT NULL,
+  event_type VARCHAR(50) NOT NULL,
+  payload json NOT NULL,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+CREATE INDEX IF NOT EXISTS stream_events_user_id_id_idx ON stream_events (user_id, id);
+CREATE INDEX IF NOT EXISTS stream_events_created_at_idx ON stream_events (created_at);
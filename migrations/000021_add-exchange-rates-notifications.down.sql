@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS currencies_exchange_rate_notify ON currencies;
+DROP FUNCTION IF EXISTS notify_exchange_rate_change ();
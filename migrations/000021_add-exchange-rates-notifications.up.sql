@@ -0,0 +1,18 @@
+-- announce every change of an exchange rate on the exchange_rates channel, with the
+-- currency code as the payload, however the rate is changed.
+CREATE OR REPLACE FUNCTION notify_exchange_rate_change () RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'UPDATE' AND OLD.exchange_rate = NEW.exchange_rate THEN
+    RETURN NEW;
+  END IF;
+  PERFORM pg_notify('exchange_rates', NEW.code);
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS currencies_exchange_rate_notify ON currencies;
+CREATE TRIGGER currencies_exchange_rate_notify
+AFTER INSERT
+OR
+UPDATE OF exchange_rate ON currencies FOR EACH ROW
+EXECUTE FUNCTION notify_exchange_rate_change ();
@@ -0,0 +1,19 @@
+-- keys for calling the API server to server. Only a hash of a key is kept, the key
+-- itself is shown once when it is created; prefix is enough of it to tell keys
+-- apart, e.g sk_live_Xa81bC2d.
+CREATE TABLE IF NOT EXISTS api_keys (
+  id bigserial PRIMARY KEY,
+  public_id VARCHAR(50) UNIQUE NOT NULL,
+  user_id INT REFERENCES users (id) NOT NULL,
+  name VARCHAR(100) NOT NULL,
+  mode VARCHAR(4) NOT NULL CHECK (mode IN ('live', 'test')),
+  scopes text[] NOT NULL,
+  prefix VARCHAR(20) NOT NULL,
+  key_hash bytea UNIQUE NOT NULL,
+  last_used_at timestamp(0) with time zone,
+  revoked_at timestamp(0) with time zone,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+CREATE INDEX IF NOT EXISTS api_keys_user_id_idx ON api_keys (user_id);
@@ -0,0 +1,58 @@
+-- third party apps users can grant access to their wallets. Confidential clients
+-- authenticate with a secret, of which only a hash is kept; public clients, e.g
+-- mobile and single page apps, rely on PKCE alone.
+CREATE TABLE IF NOT EXISTS oauth_clients (
+  id bigserial PRIMARY KEY,
+  public_id VARCHAR(50) UNIQUE NOT NULL,
+  user_id INT REFERENCES users (id) NOT NULL,
+  name VARCHAR(100) NOT NULL,
+  redirect_uris text[] NOT NULL,
+  confidential BOOLEAN NOT NULL,
+  secret_hash bytea,
+  revoked_at timestamp(0) with time zone,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE INDEX IF NOT EXISTS oauth_clients_user_id_idx ON oauth_clients (user_id);
+
+-- codes given to a client once a user consents, exchanged for tokens along with the
+-- PKCE verifier of the challenge. A code can only be used once.
+CREATE TABLE IF NOT EXISTS oauth_authorization_codes (
+  id bigserial PRIMARY KEY,
+  code_hash bytea UNIQUE NOT NULL,
+  client_id bigint REFERENCES oauth_clients (id) NOT NULL,
+  user_id INT REFERENCES users (id) NOT NULL,
+  redirect_uri text NOT NULL,
+  scopes text[] NOT NULL,
+  code_challenge VARCHAR(128) NOT NULL,
+  expires_at timestamp(0) with time zone NOT NULL,
+  used_at timestamp(0) with time zone,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+-- the access a user granted a client, which its access tokens carry the id of and
+-- its refresh token renews. Revoking a grant ends the access straight away.
+CREATE TABLE IF NOT EXISTS oauth_grants (
+  id bigserial PRIMARY KEY,
+  public_id VARCHAR(50) UNIQUE NOT NULL,
+  client_id bigint REFERENCES oauth_clients (id) NOT NULL,
+  user_id INT REFERENCES users (id) NOT NULL,
+  code_id bigint REFERENCES oauth_authorization_codes (id) NOT NULL,
+  scopes text[] NOT NULL,
+  refresh_hash bytea UNIQUE NOT NULL,
+  refresh_expires_at timestamp(0) with time zone NOT NULL,
+  revoked_at timestamp(0) with time zone,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW (),
+    updated_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE INDEX IF NOT EXISTS oauth_grants_user_id_idx ON oauth_grants (user_id);
+CREATE INDEX IF NOT EXISTS oauth_grants_code_id_idx ON oauth_grants (code_id);
@@ -0,0 +1,64 @@
+-- users who collect payments. Captured payments are paid into the settlement
+-- wallet, one of the merchant's own wallets, and refunds are paid out of it.
+CREATE TABLE IF NOT EXISTS merchants (
+  id bigserial PRIMARY KEY,
+  public_id VARCHAR(50) UNIQUE NOT NULL,
+  user_id INT UNIQUE REFERENCES users (id) NOT NULL,
+  business_name VARCHAR(100) NOT NULL,
+  business_email citext NOT NULL,
+  website text NOT NULL DEFAULT '',
+  settlement_wallet_id INT REFERENCES wallets (id) NOT NULL,
+  version INT NOT NULL DEFAULT 1,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW (),
+    updated_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+-- a payment from a customer wallet to the settlement wallet the merchant had when it
+-- was made, in the currency of both. An authorized payment holds the amount on the
+-- customer wallet until it is captured, voided or expires; captured payments can
+-- then be refunded, in part or in full.
+CREATE TABLE IF NOT EXISTS payments (
+  id bigserial PRIMARY KEY,
+  public_id VARCHAR(50) UNIQUE NOT NULL,
+  merchant_id bigint REFERENCES merchants (id) NOT NULL,
+  customer_wallet_id INT REFERENCES wallets (id) NOT NULL,
+  settlement_wallet_id INT REFERENCES wallets (id) NOT NULL,
+  amount DECIMAL(24, 4) NOT NULL CHECK (amount > 0),
+  captured_amount DECIMAL(24, 4) NOT NULL DEFAULT 0,
+  refunded_amount DECIMAL(24, 4) NOT NULL DEFAULT 0,
+  status VARCHAR(20) NOT NULL, -- authorized, captured, partially_refunded, refunded, voided, expired
+  description text NOT NULL DEFAULT '',
+  metadata jsonb NOT NULL DEFAULT '{}',
+  hold_id VARCHAR(50) NOT NULL DEFAULT '',
+  capture_transaction_id VARCHAR(50) NOT NULL DEFAULT '',
+  expires_at timestamp(0) with time zone NOT NULL,
+  captured_at timestamp(0) with time zone,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW (),
+    updated_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE INDEX IF NOT EXISTS payments_merchant_id_created_at_idx ON payments (merchant_id, created_at);
+CREATE INDEX IF NOT EXISTS payments_authorized_expires_at_idx ON payments (expires_at) WHERE status = 'authorized';
+
+-- money given back on a captured payment.
+CREATE TABLE IF NOT EXISTS payment_refunds (
+  id bigserial PRIMARY KEY,
+  public_id VARCHAR(50) UNIQUE NOT NULL,
+  payment_id bigint REFERENCES payments (id) NOT NULL,
+  amount DECIMAL(24, 4) NOT NULL CHECK (amount > 0),
+  reason text NOT NULL DEFAULT '',
+  transaction_id VARCHAR(50) NOT NULL,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE INDEX IF NOT EXISTS payment_refunds_payment_id_idx ON payment_refunds (payment_id);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS checkout_sessions;
@@ -0,0 +1,32 @@
+-- a payment link a merchant shares: any user can pay it once from any of their
+-- wallets before it expires. The payer is debited in the currency of their wallet
+-- and the settlement wallet credited in its own, converting from the session
+-- currency where they differ.
+CREATE TABLE IF NOT EXISTS checkout_sessions (
+  id bigserial PRIMARY KEY,
+  public_id VARCHAR(50) UNIQUE NOT NULL,
+  merchant_id bigint REFERENCES merchants (id) NOT NULL,
+  amount DECIMAL(24, 4) NOT NULL CHECK (amount > 0),
+  currency_id INT REFERENCES currencies (id) NOT NULL,
+  description text NOT NULL DEFAULT '',
+  success_url text NOT NULL,
+  cancel_url text NOT NULL,
+  metadata jsonb NOT NULL DEFAULT '{}',
+  status VARCHAR(20) NOT NULL DEFAULT 'open', -- open, complete, expired
+  payer_wallet_id INT REFERENCES wallets (id),
+  settlement_wallet_id INT REFERENCES wallets (id),
+  paid_amount DECIMAL(24, 4), -- debited from the payer wallet, in its currency
+  settled_amount DECIMAL(24, 4), -- credited to the settlement wallet, in its currency
+  transaction_id VARCHAR(50) NOT NULL DEFAULT '',
+  expires_at timestamp(0) with time zone NOT NULL,
+  completed_at timestamp(0) with time zone,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW (),
+    updated_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE INDEX IF NOT EXISTS checkout_sessions_merchant_id_created_at_idx ON checkout_sessions (merchant_id, created_at);
+CREATE INDEX IF NOT EXISTS checkout_sessions_open_expires_at_idx ON checkout_sessions (expires_at) WHERE status = 'open';
@@ -0,0 +1,65 @@
+-- an invoice a merchant sends to a customer by email. Drafts can be edited, open
+-- invoices can be paid in one or more payments until the total is covered, and
+-- turn overdue when their due date passes unpaid.
+CREATE TABLE IF NOT EXISTS invoices (
+  id bigserial PRIMARY KEY,
+  public_id VARCHAR(50) UNIQUE NOT NULL,
+  merchant_id bigint REFERENCES merchants (id) NOT NULL,
+  customer_email citext NOT NULL,
+  currency_id INT REFERENCES currencies (id) NOT NULL,
+  subtotal DECIMAL(24, 4) NOT NULL,
+  tax_rate DECIMAL(5, 2) NOT NULL DEFAULT 0 CHECK (tax_rate >= 0 AND tax_rate <= 100),
+  tax_amount DECIMAL(24, 4) NOT NULL DEFAULT 0,
+  total DECIMAL(24, 4) NOT NULL CHECK (total > 0),
+  amount_paid DECIMAL(24, 4) NOT NULL DEFAULT 0,
+  memo text NOT NULL DEFAULT '',
+  due_date date NOT NULL,
+  status VARCHAR(10) NOT NULL DEFAULT 'draft', -- draft, open, paid, overdue, void
+  reminders_sent INT NOT NULL DEFAULT 0,
+  last_reminded_at timestamp(0) with time zone,
+  finalized_at timestamp(0) with time zone,
+  paid_at timestamp(0) with time zone,
+  voided_at timestamp(0) with time zone,
+  version INT NOT NULL DEFAULT 1,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW (),
+    updated_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE INDEX IF NOT EXISTS invoices_merchant_id_created_at_idx ON invoices (merchant_id, created_at);
+CREATE INDEX IF NOT EXISTS invoices_customer_email_idx ON invoices (customer_email);
+CREATE INDEX IF NOT EXISTS invoices_unpaid_due_date_idx ON invoices (due_date) WHERE status IN ('open', 'overdue');
+
+CREATE TABLE IF NOT EXISTS invoice_line_items (
+  id bigserial PRIMARY KEY,
+  invoice_id bigint REFERENCES invoices (id) ON DELETE CASCADE NOT NULL,
+  description text NOT NULL,
+  quantity INT NOT NULL CHECK (quantity > 0),
+  unit_amount DECIMAL(24, 4) NOT NULL CHECK (unit_amount > 0),
+  amount DECIMAL(24, 4) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS invoice_line_items_invoice_id_idx ON invoice_line_items (invoice_id);
+
+-- a payment towards an invoice, amount in the invoice currency. The payer is debited
+-- paid_amount in the currency of their wallet and the settlement wallet credited
+-- settled_amount in its own.
+CREATE TABLE IF NOT EXISTS invoice_payments (
+  id bigserial PRIMARY KEY,
+  public_id VARCHAR(50) UNIQUE NOT NULL,
+  invoice_id bigint REFERENCES invoices (id) NOT NULL,
+  payer_wallet_id INT REFERENCES wallets (id) NOT NULL,
+  settlement_wallet_id INT REFERENCES wallets (id) NOT NULL,
+  amount DECIMAL(24, 4) NOT NULL CHECK (amount > 0),
+  paid_amount DECIMAL(24, 4) NOT NULL,
+  settled_amount DECIMAL(24, 4) NOT NULL,
+  transaction_id VARCHAR(50) NOT NULL,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE INDEX IF NOT EXISTS invoice_payments_invoice_id_idx ON invoice_payments (invoice_id);
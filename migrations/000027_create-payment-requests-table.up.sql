@@ -0,0 +1,29 @@
+-- money a user asks another user for. The payer accepts it by transferring the
+-- amount from one of their wallets into the requester's wallet, or declines it.
+-- Requests left unanswered expire at expires_at. An accepted request whose transfer
+-- waits on an approval or risk review is processing until that is decided.
+-- result_id is the public id of the transfer, or of what a processing request waits on.
+CREATE TABLE IF NOT EXISTS payment_requests (
+  id bigserial PRIMARY KEY,
+  public_id VARCHAR(50) UNIQUE NOT NULL,
+  requester_id bigint REFERENCES users (id) NOT NULL,
+  payer_id bigint REFERENCES users (id) NOT NULL CHECK (payer_id <> requester_id),
+  wallet_id INT REFERENCES wallets (id) NOT NULL,
+  amount DECIMAL(24, 4) NOT NULL CHECK (amount > 0),
+  note text NOT NULL DEFAULT '',
+  status VARCHAR(10) NOT NULL DEFAULT 'pending', -- pending, processing, accepted, declined, cancelled, expired
+  result_id VARCHAR(50) NOT NULL DEFAULT '',
+  expires_at timestamp(0) with time zone NOT NULL,
+  answered_at timestamp(0) with time zone,
+  created_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW (),
+    updated_at timestamp(0)
+  with
+    time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE INDEX IF NOT EXISTS payment_requests_requester_id_created_at_idx ON payment_requests (requester_id, created_at);
+CREATE INDEX IF NOT EXISTS payment_requests_payer_id_created_at_idx ON payment_requests (payer_id, created_at);
+CREATE INDEX IF NOT EXISTS payment_requests_pending_expires_at_idx ON payment_requests (expires_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS payment_requests_processing_idx ON payment_requests (id) WHERE status = 'processing';
@@ -0,0 +1,17 @@
+-- requests to an email no user has cannot be kept without a payer
+ALTER TABLE payment_requests ADD COLUMN IF NOT EXISTS payer_id bigint REFERENCES users (id);
+
+UPDATE payment_requests
+SET payer_id = users.id
+FROM users
+WHERE users.email = payment_requests.payer_email;
+
+DELETE FROM payment_requests WHERE payer_id IS NULL OR payer_id = requester_id;
+
+ALTER TABLE payment_requests ALTER COLUMN payer_id SET NOT NULL;
+ALTER TABLE payment_requests ADD CONSTRAINT payment_requests_payer_id_check CHECK (payer_id <> requester_id);
+
+DROP INDEX IF EXISTS payment_requests_payer_email_created_at_idx;
+ALTER TABLE payment_requests DROP COLUMN IF EXISTS payer_email;
+
+CREATE INDEX IF NOT EXISTS payment_requests_payer_id_created_at_idx ON payment_requests (payer_id, created_at);
@@ -0,0 +1,16 @@
+-- payment requests are addressed to an email rather than a user, like invoices, so
+-- that asking for money tells nothing of whether the email has an account. The
+-- user with the email sees the request, whenever they sign up.
+ALTER TABLE payment_requests ADD COLUMN IF NOT EXISTS payer_email citext;
+
+UPDATE payment_requests
+SET payer_email = users.email
+FROM users
+WHERE users.id = payment_requests.payer_id;
+
+ALTER TABLE payment_requests ALTER COLUMN payer_email SET NOT NULL;
+
+DROP INDEX IF EXISTS payment_requests_payer_id_created_at_idx;
+ALTER TABLE payment_requests DROP COLUMN IF EXISTS payer_id;
+
+CREATE INDEX IF NOT EXISTS payment_requests_payer_email_created_at_idx ON payment_requests (payer_email, created_at);
@@ -0,0 +1,13 @@
+DELETE FROM sanctions_matches WHERE subject_type = 'payment';
+ALTER TABLE sanctions_matches DROP CONSTRAINT IF EXISTS sanctions_matches_subject_type_check;
+ALTER TABLE sanctions_matches
+  ADD CONSTRAINT sanctions_matches_subject_type_check CHECK (subject_type IN ('user', 'transfer'));
+
+DELETE FROM pending_approval_events WHERE approval_id IN (SELECT id FROM pending_approvals WHERE action = 'payment');
+DELETE FROM pending_approvals WHERE action = 'payment';
+ALTER TABLE pending_approvals DROP CONSTRAINT IF EXISTS pending_approvals_action_check;
+ALTER TABLE pending_approvals
+  ADD CONSTRAINT pending_approvals_action_check CHECK (action IN ('transfer', 'adjustment'));
+
+DELETE FROM risk_decisions WHERE payload IS NOT NULL;
+ALTER TABLE risk_decisions DROP COLUMN IF EXISTS payload;
@@ -0,0 +1,12 @@
+-- payments to merchants go through the approval threshold, the risk rules and the
+-- screening of the merchant like transfers do. What a payment is made with is kept
+-- as the payload of its approval or risk decision until it is decided.
+ALTER TABLE risk_decisions ADD COLUMN IF NOT EXISTS payload json;
+
+ALTER TABLE pending_approvals DROP CONSTRAINT IF EXISTS pending_approvals_action_check;
+ALTER TABLE pending_approvals
+  ADD CONSTRAINT pending_approvals_action_check CHECK (action IN ('transfer', 'adjustment', 'payment'));
+
+ALTER TABLE sanctions_matches DROP CONSTRAINT IF EXISTS sanctions_matches_subject_type_check;
+ALTER TABLE sanctions_matches
+  ADD CONSTRAINT sanctions_matches_subject_type_check CHECK (subject_type IN ('user', 'transfer', 'payment'));